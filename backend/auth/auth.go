@@ -16,6 +16,8 @@ import (
 
 	"connectrpc.com/connect"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/yuv418/cs553project/backend/commondata"
 	authpb "github.com/yuv418/cs553project/backend/protos/auth"
@@ -120,7 +122,22 @@ func NewAuthServer(jwtSecret string, tokenExpiry time.Duration, userFilePath str
 	return server, nil
 }
 
+var logins = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "flappy_logins_total",
+	Help: "Login attempts, by whether they got a token.",
+}, []string{"result"})
+
 func (s *AuthServer) Authenticate(ctx *commondata.ReqCtx, c *authpb.AuthRequest) (*authpb.AuthResponse, error) {
+	resp, err := s.authenticate(c)
+	if err != nil {
+		logins.WithLabelValues("failure").Inc()
+	} else {
+		logins.WithLabelValues("success").Inc()
+	}
+	return resp, err
+}
+
+func (s *AuthServer) authenticate(c *authpb.AuthRequest) (*authpb.AuthResponse, error) {
 	if c.Username == "" || c.Password == "" {
 		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("username and password cannot be empty"))
 	}
@@ -7,11 +7,30 @@ import (
 )
 
 func main() {
+	if err := abstraction.AbsCtx.CommonServer.LoadCfg(); err != nil {
+		log.Fatal(err)
+	}
+	abstraction.StartStats(abstraction.AbsCtx)
 	log.Printf("Microservices is set to %v\n", abstraction.AbsCtx.Microservice)
 
 	SetupServiceData(abstraction.AbsCtx)
 	SetupDispatchTable(abstraction.AbsCtx)
 	SetupHandlers(abstraction.AbsCtx)
 
+	if err := abstraction.ValidateDispatchTable(abstraction.AbsCtx); err != nil {
+		// Microservices only get the URLs for what they call, so this is
+		// fine as long as they don't call it
+		if abstraction.AbsCtx.Microservice {
+			log.Printf("Some verbs can't be dispatched from here:\n%s\n", err)
+		} else {
+			log.Fatalf("Dispatch table is incomplete:\n%s\n", err)
+		}
+	}
+
+	// After the handlers, so in a monolith anything left over goes straight to them
+	if err := abstraction.StartOutbox(abstraction.AbsCtx); err != nil {
+		log.Fatalf("Couldn't start outbox: %s\n", err)
+	}
+
 	abstraction.AbsCtx.Run()
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	auth "github.com/yuv418/cs553project/backend/auth"
 	"github.com/yuv418/cs553project/backend/commondata"
@@ -26,21 +27,79 @@ func SetupServiceData(ctx *abstraction.AbstractionServer) {
 	abstraction.InsertServiceData(abstraction.AbsCtx, "score", os.Getenv("SCORE_URL"), "/score.ScoreService")
 	abstraction.InsertServiceData(abstraction.AbsCtx, "auth", os.Getenv("AUTH_URL"), "/auth.AuthService")
 	abstraction.InsertServiceData(abstraction.AbsCtx, "initiator", os.Getenv("INITIATOR_URL"), "/initiator.InitiatorService")
-	abstraction.InsertServiceData(abstraction.AbsCtx, "music", os.Getenv("MUSIC_URL"), "/music.MusicService/PlayMusic")
+	abstraction.InsertServiceData(abstraction.AbsCtx, "music", os.Getenv("MUSIC_URL"), "/music.MusicService")
 	abstraction.InsertServiceData(abstraction.AbsCtx, "worldGen", os.Getenv("WORLD_GEN_URL"), "/world_gen.WorldGenService")
 	abstraction.InsertServiceData(abstraction.AbsCtx, "gameEngine", os.Getenv("GAME_ENGINE_URL"), "/game_engine.GameEngineService")
 }
 
 func SetupDispatchTable(ctx *abstraction.AbstractionServer) {
-	abstraction.InsertDispatchTable(abstraction.AbsCtx, "auth", "Authenticate")
-	abstraction.InsertDispatchTable(abstraction.AbsCtx, "initiator", "StartGame")
-	abstraction.InsertDispatchTable(abstraction.AbsCtx, "gameEngine", "EngineStartGame")
-	abstraction.InsertDispatchTable(abstraction.AbsCtx, "initiator", "StartGame")
-	abstraction.InsertDispatchTable(abstraction.AbsCtx, "worldGen", "GenerateWorld")
-	abstraction.InsertDispatchTable(abstraction.AbsCtx, "gameEngine", "EngineStartGame")
-	abstraction.InsertDispatchTable(abstraction.AbsCtx, "music", "PlayMusic")
-	abstraction.InsertDispatchTable(abstraction.AbsCtx, "score", "UpdateScore")
-	abstraction.InsertDispatchTable(abstraction.AbsCtx, "score", "GetScores")
+	for _, err := range []error{
+		authpb.InsertAuthServiceDispatchTable(abstraction.AbsCtx),
+		initiatorpb.InsertInitiatorServiceDispatchTable(abstraction.AbsCtx),
+		worldgenpb.InsertWorldGenServiceDispatchTable(abstraction.AbsCtx),
+		enginepb.InsertGameEngineServiceDispatchTable(abstraction.AbsCtx),
+		musicpb.InsertMusicServiceDispatchTable(abstraction.AbsCtx),
+		scorepb.InsertScoreServiceDispatchTable(abstraction.AbsCtx),
+	} {
+		if err != nil {
+			log.Fatalf("Couldn't build the dispatch table:\n%s\n", err)
+		}
+	}
+
+	// Everything else gets DISPATCH_TIMEOUT
+	dispatchTimeouts := map[string]time.Duration{
+		// Repairing a world can take a while
+		"GenerateWorld": 10 * time.Second,
+		// These wait on world generation
+		"StartGame":  15 * time.Second,
+		"CreateRoom": 15 * time.Second,
+		// Moves every game on an engine one at a time
+		"EngineDrain": 2 * time.Minute,
+		// The game loop waits on these, and a late sound is useless anyway
+		"PlayMusic": 500 * time.Millisecond,
+	}
+	for verb, timeout := range dispatchTimeouts {
+		if err := abstraction.SetDispatchTimeout(abstraction.AbsCtx, verb, timeout); err != nil {
+			log.Fatalf("Couldn't set timeout: %s\n", err)
+		}
+	}
+
+	// Everything else gets one try and the error goes back to the caller
+	dispatchPolicies := map[string]abstraction.Policy{
+		"Authenticate":  abstraction.DefaultRetry,
+		"GenerateWorld": abstraction.DefaultRetry,
+		"GetScores":     abstraction.DefaultRetry,
+		"GetGhost":      abstraction.DefaultRetry,
+		// The score service ignores a game it already has, so this is safe to repeat
+		"UpdateScore": abstraction.DefaultRetry,
+		"PlayMusic":   {Fallback: abstraction.FallbackDrop},
+		// Closing a session twice is fine
+		"EndMusicSession": abstraction.DefaultRetry,
+	}
+	for verb, policy := range dispatchPolicies {
+		if err := abstraction.SetDispatchPolicy(abstraction.AbsCtx, verb, policy); err != nil {
+			log.Fatalf("Couldn't set policy: %s\n", err)
+		}
+	}
+
+	// The engine fires these from its game loop. Scores are kept on disk
+	// until they're in, sounds are gone after one try. Ending the music
+	// session keeps trying so the music service doesn't hold on to it.
+	if err := scorepb.InsertUpdateScoreOutbox(abstraction.AbsCtx, abstraction.OutboxOptions{Durable: true}); err != nil {
+		log.Fatalf("Couldn't set up outbox: %s\n", err)
+	}
+	if err := musicpb.InsertPlayMusicOutbox(abstraction.AbsCtx, abstraction.OutboxOptions{MaxAttempts: 1}); err != nil {
+		log.Fatalf("Couldn't set up outbox: %s\n", err)
+	}
+	if err := musicpb.InsertEndMusicSessionOutbox(abstraction.AbsCtx, abstraction.OutboxOptions{MaxAttempts: 5}); err != nil {
+		log.Fatalf("Couldn't set up outbox: %s\n", err)
+	}
+}
+
+func mustRegister(err error) {
+	if err != nil {
+		log.Fatalf("Couldn't register handler: %s\n", err)
+	}
 }
 
 func SetupScoreHandler(ctx *abstraction.AbstractionServer) {
@@ -49,8 +108,12 @@ func SetupScoreHandler(ctx *abstraction.AbstractionServer) {
 		log.Fatalf("Failed to load auth score context with %s\n", err)
 	}
 
-	abstraction.InsertDispatchTableHandler[scorepb.ScoreEntry, emptypb.Empty](abstraction.AbsCtx, "score", "UpdateScore", scoreCtx.UpdateScore, true)
-	abstraction.InsertDispatchTableHandler[emptypb.Empty, scorepb.GetScoresResp](abstraction.AbsCtx, "score", "GetScores", scoreCtx.GetScores, true)
+	mustRegister(scorepb.RegisterUpdateScore(abstraction.AbsCtx, scoreCtx.UpdateScore, true))
+	mustRegister(scorepb.RegisterGetScores(abstraction.AbsCtx, scoreCtx.GetScores, true))
+	mustRegister(scorepb.RegisterGetGhost(abstraction.AbsCtx, scoreCtx.GetGhost, true))
+	mustRegister(scorepb.RegisterWatchScores(abstraction.AbsCtx, scoreCtx.WatchScores, true))
+	abstraction.OnShutdown("scores", scoreCtx.Close)
+	abstraction.AddHealthCheck("scores", scoreCtx.Healthy)
 
 }
 
@@ -66,22 +129,30 @@ func SetupAuthHandler(ctx *abstraction.AbstractionServer) {
 		log.Fatalf("Failed to create auth server: %v", err)
 	}
 
-	abstraction.InsertDispatchTableHandler[authpb.AuthRequest, authpb.AuthResponse](abstraction.AbsCtx, "auth", "Authenticate", authServer.Authenticate, false)
+	mustRegister(authpb.RegisterAuthenticate(abstraction.AbsCtx, authServer.Authenticate, false))
 
 }
 
 func SetupInitiatorHandler(ctx *abstraction.AbstractionServer) {
-	abstraction.InsertDispatchTableHandler[initiatorpb.StartGameReq, initiatorpb.StartGameResp](abstraction.AbsCtx, "initiator", "StartGame", initiator.StartGame, true)
+	mustRegister(initiatorpb.RegisterStartGame(abstraction.AbsCtx, initiator.StartGame, true))
+	mustRegister(initiatorpb.RegisterCreateRoom(abstraction.AbsCtx, initiator.CreateRoom, true))
 }
 
 func SetupWorldgenHandler(ctx *abstraction.AbstractionServer) {
-	abstraction.InsertDispatchTableHandler[worldgenpb.WorldGenReq, worldgenpb.WorldGenerated](abstraction.AbsCtx, "worldGen", "GenerateWorld", worldgen.GenerateWorld, false)
+	mustRegister(worldgenpb.RegisterGenerateWorld(abstraction.AbsCtx, worldgen.GenerateWorld, false))
 }
 
 func SetupGameEngineHandler(ctx *abstraction.AbstractionServer) {
 
 	// Any internal microservice functions don't have to be validated.
-	abstraction.InsertDispatchTableHandler[enginepb.GameEngineStartReq, emptypb.Empty](abstraction.AbsCtx, "gameEngine", "EngineStartGame", engine.StartGame, false)
+	mustRegister(enginepb.RegisterEngineStartGame(abstraction.AbsCtx, engine.StartGame, false))
+	mustRegister(enginepb.RegisterEngineCreateRoom(abstraction.AbsCtx, engine.CreateRoom, false))
+	// These move games around, so they need a service token (see common.ServiceJwt)
+	mustRegister(enginepb.RegisterEngineRestoreGame(abstraction.AbsCtx, engine.RestoreGame, true))
+	mustRegister(enginepb.RegisterEngineDrain(abstraction.AbsCtx, engine.Drain, true))
+	engine.StartFrameStats()
+	abstraction.OnShutdown("games", engine.Shutdown)
+	abstraction.OnShutdown("frame stats", engine.CloseFrameStats)
 	abstraction.AddWebTransportRoute[enginepb.GameEngineInputReq, *enginepb.GameEngineInputReq, emptypb.Empty, *emptypb.Empty](
 		abstraction.AbsCtx.CommonServer,
 		"GameEngine",
@@ -89,12 +160,21 @@ func SetupGameEngineHandler(ctx *abstraction.AbstractionServer) {
 		engine.HandleInput,
 		engine.EstablishGameWebTransport,
 	)
+	abstraction.AddWebTransportRoute[emptypb.Empty, *emptypb.Empty, emptypb.Empty, *emptypb.Empty](
+		abstraction.AbsCtx.CommonServer,
+		"GameEngine",
+		"/gameEngine/Spectate",
+		engine.HandleSpectatorInput,
+		engine.EstablishSpectatorWebTransport,
+	)
 }
 
 func SetupMusicHandler(ctx *abstraction.AbstractionServer) {
 
 	// Any internal microservice functions don't have to be validated.
-	abstraction.InsertDispatchTableHandler[musicpb.PlayMusicReq, emptypb.Empty](abstraction.AbsCtx, "music", "PlayMusic", music.PlayMusic, false)
+	mustRegister(musicpb.RegisterPlayMusic(abstraction.AbsCtx, music.PlayMusic, false))
+	mustRegister(musicpb.RegisterEndMusicSession(abstraction.AbsCtx, music.EndMusicSession, false))
+	mustRegister(musicpb.RegisterUpdateAudioSettings(abstraction.AbsCtx, music.UpdateAudioSettings, true))
 	// Stub out the handler function because it'll never be used.
 	abstraction.AddWebTransportRoute[emptypb.Empty, *emptypb.Empty, emptypb.Empty, *emptypb.Empty](
 		abstraction.AbsCtx.CommonServer,
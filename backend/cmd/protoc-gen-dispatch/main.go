@@ -0,0 +1,179 @@
+// protoc-gen-dispatch writes typed dispatch table registration and client stubs
+// for every service in a .proto, next to the regular .pb.go. Using them instead
+// of calling common.Dispatch with hand written type parameters means a handler
+// or caller with the wrong types is a compile error instead of a panic.
+//
+// Every method becomes a verb with the same name, and the service is named
+// after the proto package in lowerCamelCase (game_engine -> gameEngine), which
+// is the key InsertServiceData uses. Verbs share one table, so method names
+// have to be unique across all services. The generator rejects duplicates in
+// the files it's run on, and common.InsertDispatchTable rejects the rest.
+//
+// Verbs named in the outbox option (outbox=UpdateScore+PlayMusic) also get
+// Insert<Verb>Outbox and Enqueue<Verb>. They have to return
+// google.protobuf.Empty, since nobody is around to read the response.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+const (
+	commonPackage     = protogen.GoImportPath("github.com/yuv418/cs553project/backend/common")
+	commondataPackage = protogen.GoImportPath("github.com/yuv418/cs553project/backend/commondata")
+	errorsPackage     = protogen.GoImportPath("errors")
+)
+
+func main() {
+	var flags flag.FlagSet
+	outboxFlag := flags.String("outbox", "", "verbs that can be queued, separated by +")
+
+	protogen.Options{ParamFunc: flags.Set}.Run(func(gen *protogen.Plugin) error {
+		return generate(gen, *outboxFlag)
+	})
+}
+
+func generate(gen *protogen.Plugin, outboxFlag string) error {
+	// Stubs only look at methods, so optional fields need nothing special,
+	// but protoc refuses to run plugins that don't say so
+	gen.SupportedFeatures = uint64(pluginpb.CodeGeneratorResponse_FEATURE_PROTO3_OPTIONAL)
+
+	outboxVerbs := make(map[string]bool)
+	for _, verb := range strings.Split(outboxFlag, "+") {
+		if verb != "" {
+			outboxVerbs[verb] = true
+		}
+	}
+
+	// Which service each verb came from
+	verbs := make(map[string]protoreflect.FullName)
+	for _, file := range gen.Files {
+		if !file.Generate {
+			continue
+		}
+		for _, service := range file.Services {
+			for _, method := range service.Methods {
+				if other, ok := verbs[method.GoName]; ok {
+					return fmt.Errorf("%s is in both %s and %s, verbs have to be unique", method.GoName, other, service.Desc.FullName())
+				}
+				verbs[method.GoName] = service.Desc.FullName()
+			}
+		}
+	}
+
+	for _, file := range gen.Files {
+		if !file.Generate || len(file.Services) == 0 {
+			continue
+		}
+		if err := generateFile(gen, file, outboxVerbs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// world_gen -> worldGen
+func svcName(file *protogen.File) string {
+	parts := strings.Split(string(file.Desc.Package()), "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func generateFile(gen *protogen.Plugin, file *protogen.File, outboxVerbs map[string]bool) error {
+	g := gen.NewGeneratedFile(file.GeneratedFilenamePrefix+"_dispatch.pb.go", file.GoImportPath)
+	g.P("// Code generated by protoc-gen-dispatch. DO NOT EDIT.")
+	g.P("// source: ", file.Desc.Path())
+	g.P()
+	g.P("package ", file.GoPackageName)
+	g.P()
+
+	for _, service := range file.Services {
+		if err := generateService(g, file, service, outboxVerbs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generateService(g *protogen.GeneratedFile, file *protogen.File, service *protogen.Service, outboxVerbs map[string]bool) error {
+	reqCtx := g.QualifiedGoIdent(commondataPackage.Ident("ReqCtx"))
+	absServer := g.QualifiedGoIdent(commonPackage.Ident("AbstractionServer"))
+	svcConst := service.GoName + "Name"
+
+	g.P("// The dispatch table key for ", service.GoName)
+	g.P("const ", svcConst, " = ", `"`, svcName(file), `"`)
+	g.P()
+
+	g.P("// Insert", service.GoName, "DispatchTable adds every ", service.GoName, " verb to the dispatch table.")
+	g.P("func Insert", service.GoName, "DispatchTable(absCtx *", absServer, ") error {")
+	g.P("return ", errorsPackage.Ident("Join"), "(")
+	for _, method := range service.Methods {
+		g.P(commonPackage.Ident("InsertDispatchTable"), "(absCtx, ", svcConst, `, "`, method.GoName, `"),`)
+	}
+	g.P(")")
+	g.P("}")
+	g.P()
+
+	for _, method := range service.Methods {
+		in := g.QualifiedGoIdent(method.Input.GoIdent)
+		out := g.QualifiedGoIdent(method.Output.GoIdent)
+		verb := `"` + method.GoName + `"`
+
+		switch {
+		case method.Desc.IsStreamingClient() && method.Desc.IsStreamingServer():
+			g.P("func Register", method.GoName, "(absCtx *", absServer, ", handlerFn ", commonPackage.Ident("BidiStreamFn"), "[", in, ", ", out, "], shouldVerifyJwt bool) error {")
+			g.P("return ", commonPackage.Ident("InsertDispatchTableBidiStreamHandler"), "[", in, ", ", out, "](absCtx, ", svcConst, ", ", verb, ", handlerFn, shouldVerifyJwt)")
+			g.P("}")
+			g.P()
+			g.P("func Dispatch", method.GoName, "(ctx *", reqCtx, ") (*", commonPackage.Ident("ClientStream"), "[", in, ", ", out, "], error) {")
+			g.P("return ", commonPackage.Ident("DispatchBidiStream"), "[", in, ", ", out, "](ctx, ", verb, ")")
+			g.P("}")
+		case method.Desc.IsStreamingServer():
+			g.P("func Register", method.GoName, "(absCtx *", absServer, ", handlerFn ", commonPackage.Ident("ServerStreamFn"), "[", in, ", ", out, "], shouldVerifyJwt bool) error {")
+			g.P("return ", commonPackage.Ident("InsertDispatchTableServerStreamHandler"), "[", in, ", ", out, "](absCtx, ", svcConst, ", ", verb, ", handlerFn, shouldVerifyJwt)")
+			g.P("}")
+			g.P()
+			g.P("func Dispatch", method.GoName, "(ctx *", reqCtx, ", req *", in, ") (*", commonPackage.Ident("ClientStream"), "[", in, ", ", out, "], error) {")
+			g.P("return ", commonPackage.Ident("DispatchServerStream"), "[", in, ", ", out, "](ctx, ", verb, ", req)")
+			g.P("}")
+		case method.Desc.IsStreamingClient():
+			// Nothing uses these, and there's no common support for them
+			g.P("// ", method.GoName, " is client streaming, which dispatch doesn't support")
+		default:
+			g.P("func Register", method.GoName, "(absCtx *", absServer, ", handlerFn func(*", reqCtx, ", *", in, ") (*", out, ", error), shouldVerifyJwt bool) error {")
+			g.P("return ", commonPackage.Ident("InsertDispatchTableHandler"), "[", in, ", ", out, "](absCtx, ", svcConst, ", ", verb, ", handlerFn, shouldVerifyJwt)")
+			g.P("}")
+			g.P()
+			g.P("func Dispatch", method.GoName, "(ctx *", reqCtx, ", req *", in, ") (*", out, ", error) {")
+			g.P("return ", commonPackage.Ident("Dispatch"), "[", in, ", ", out, "](ctx, ", verb, ", req)")
+			g.P("}")
+
+			if outboxVerbs[method.GoName] {
+				if method.Output.Desc.FullName() != "google.protobuf.Empty" {
+					return fmt.Errorf("%s can't go through the outbox, it doesn't return google.protobuf.Empty", method.GoName)
+				}
+				g.P()
+				g.P("// Insert", method.GoName, "Outbox lets ", method.GoName, " be queued with Enqueue", method.GoName, ".")
+				g.P("func Insert", method.GoName, "Outbox(absCtx *", absServer, ", opts ", commonPackage.Ident("OutboxOptions"), ") error {")
+				g.P("return ", commonPackage.Ident("InsertOutboxVerb"), "[", in, ", *", in, ", ", out, "](absCtx, ", verb, ", opts)")
+				g.P("}")
+				g.P()
+				g.P("func Enqueue", method.GoName, "(ctx *", reqCtx, ", req *", in, ") error {")
+				g.P("return ", commonPackage.Ident("Enqueue"), "(ctx, ", verb, ", req)")
+				g.P("}")
+			}
+		}
+		g.P()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func method(name string, in string, out string, clientStreams bool, serverStreams bool) *descriptorpb.MethodDescriptorProto {
+	return &descriptorpb.MethodDescriptorProto{
+		Name:            proto.String(name),
+		InputType:       proto.String(in),
+		OutputType:      proto.String(out),
+		ClientStreaming: proto.Bool(clientStreams),
+		ServerStreaming: proto.Bool(serverStreams),
+	}
+}
+
+// A .proto in package pkg with Ping and Pong messages and the given services
+func protoFile(pkg string, services ...*descriptorpb.ServiceDescriptorProto) *descriptorpb.FileDescriptorProto {
+	return &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("protos/" + pkg + "/" + pkg + ".proto"),
+		Package:    proto.String(pkg),
+		Dependency: []string{"google/protobuf/empty.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Ping")},
+			{Name: proto.String("Pong")},
+		},
+		Service: services,
+		Options: &descriptorpb.FileOptions{
+			GoPackage: proto.String("github.com/yuv418/cs553project/backend/protos/" + pkg + ";" + strings.ReplaceAll(pkg, "_", "") + "pb"),
+		},
+		Syntax: proto.String("proto3"),
+	}
+}
+
+// Every kind of method, with Record going through the outbox
+var testService = &descriptorpb.ServiceDescriptorProto{
+	Name: proto.String("TestService"),
+	Method: []*descriptorpb.MethodDescriptorProto{
+		method("Call", ".test_svc.Ping", ".test_svc.Pong", false, false),
+		method("Record", ".test_svc.Ping", ".google.protobuf.Empty", false, false),
+		method("Watch", ".test_svc.Ping", ".test_svc.Pong", false, true),
+		method("Chat", ".test_svc.Ping", ".test_svc.Pong", true, true),
+		method("Upload", ".test_svc.Ping", ".test_svc.Pong", true, false),
+	},
+}
+
+// Runs the generator on files like protoc would
+func runGenerator(t *testing.T, outbox string, files ...*descriptorpb.FileDescriptorProto) (*pluginpb.CodeGeneratorResponse, error) {
+	t.Helper()
+
+	req := &pluginpb.CodeGeneratorRequest{
+		Parameter: proto.String("paths=source_relative"),
+		ProtoFile: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(emptypb.File_google_protobuf_empty_proto)},
+	}
+	for _, file := range files {
+		req.FileToGenerate = append(req.FileToGenerate, file.GetName())
+		req.ProtoFile = append(req.ProtoFile, file)
+	}
+	gen, err := protogen.Options{}.New(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := generate(gen, outbox); err != nil {
+		return nil, err
+	}
+	return gen.Response(), nil
+}
+
+func TestGolden(t *testing.T) {
+	resp, err := runGenerator(t, "Record", protoFile("test_svc", testService))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil {
+		t.Fatal(resp.GetError())
+	}
+	if len(resp.File) != 1 || resp.File[0].GetName() != "protos/test_svc/test_svc_dispatch.pb.go" {
+		t.Fatalf("got %d files, want just test_svc_dispatch.pb.go", len(resp.File))
+	}
+
+	golden := filepath.Join("testdata", "test_svc_dispatch.pb.go.golden")
+	got := resp.File[0].GetContent()
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s (go test -update rewrites it):\n%s", golden, got)
+	}
+}
+
+func TestRejectsDuplicateVerbs(t *testing.T) {
+	other := &descriptorpb.ServiceDescriptorProto{
+		Name:   proto.String("OtherService"),
+		Method: []*descriptorpb.MethodDescriptorProto{method("Call", ".other.Ping", ".other.Pong", false, false)},
+	}
+	if _, err := runGenerator(t, "", protoFile("test_svc", testService), protoFile("other", other)); err == nil {
+		t.Error("generated two Call verbs in different files")
+	}
+
+	other.Method[0] = method("Call", ".test_svc.Ping", ".test_svc.Pong", false, false)
+	if _, err := runGenerator(t, "", protoFile("test_svc", testService, other)); err == nil {
+		t.Error("generated two Call verbs in one file")
+	}
+}
+
+func TestOutboxVerbsReturnEmpty(t *testing.T) {
+	if _, err := runGenerator(t, "Call", protoFile("test_svc", testService)); err == nil {
+		t.Error("put Call, which returns Pong, in the outbox")
+	}
+}
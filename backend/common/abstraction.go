@@ -4,7 +4,8 @@ package common
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -14,9 +15,8 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/yuv418/cs553project/backend/commondata"
 	"github.com/yuv418/cs553project/backend/stats"
+	"github.com/yuv418/cs553project/backend/tracing"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -24,6 +24,10 @@ type Action struct {
 	verb    string
 	svcName string
 	fn      any
+	// 0 uses the server default, negative means no timeout
+	timeout time.Duration
+	// nil means one try and no fallback
+	policy *Policy
 }
 
 func GetMicroserviceStatus() bool {
@@ -35,59 +39,146 @@ func GetMicroserviceStatus() bool {
 }
 
 type AbstractionService struct {
-	url    string
-	prefix string
-	client *grpc.ClientConn
+	url      string
+	prefix   string
+	balancer *balancer
+	breaker  *circuitBreaker
 }
 
 type AbstractionServer struct {
 	Microservice  bool
 	dispatchTable map[string]*Action
-	serviceData   map[string]AbstractionService
-	CommonServer  *CommonServer
-	statChannel   chan *stats.Stat
+	// Verbs that were inserted twice, for ValidateDispatchTable
+	conflicts    []error
+	serviceData  map[string]AbstractionService
+	CommonServer *CommonServer
+	stats        *stats.StatWriter // nil until StartStats
+	// For verbs that don't set their own
+	defaultTimeout time.Duration
+	// Fire and forget calls waiting to go out
+	outbox *Outbox
+}
+
+// DISPATCH_TIMEOUT is how long a call waits for a verb that doesn't have
+// its own timeout. 0 waits forever.
+func dispatchTimeoutSetup() time.Duration {
+	timeout, err := time.ParseDuration(commondata.GetEnv("DISPATCH_TIMEOUT", "5s"))
+	if err != nil {
+		log.Fatalf("DISPATCH_TIMEOUT is invalid: %s\n", err)
+	}
+	if timeout == 0 {
+		return -1
+	}
+	return timeout
 }
 
 var AbsCtx = &AbstractionServer{
-	Microservice:  GetMicroserviceStatus(),
-	serviceData:   make(map[string]AbstractionService),
-	dispatchTable: make(map[string]*Action),
-	CommonServer:  NewCommonServer(),
-	statChannel:   stats.StartStatThread(),
+	Microservice:   GetMicroserviceStatus(),
+	serviceData:    make(map[string]AbstractionService),
+	dispatchTable:  make(map[string]*Action),
+	CommonServer:   NewCommonServer(),
+	defaultTimeout: dispatchTimeoutSetup(),
+	outbox:         newOutbox(),
 }
 
+// InsertServiceData adds a service that can be found at url. See discovery.go
+// for what url can be.
 func InsertServiceData(absCtx *AbstractionServer, key string, url string, prefix string) error {
-	// https://stackoverflow.com/questions/57278822/sending-grpc-communications-over-a-specific-port
-	// https://gist.github.com/marzocchi/c4d3e2254853c5ff02b420044e796aea
-	creds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
-	client, err := grpc.NewClient(
-		url,
-		grpc.WithTransportCredentials(creds),
-	)
+	resolver, err := newResolver(key, url)
 	if err != nil {
 		log.Fatalf("(CAL) Couldn't add client for microservice with url %s, got error %s\n", url, err)
 		return err
-	} else {
-		log.Printf("(CAL) Established client for %s at url %s\n", key, url)
 	}
+	InsertServiceResolver(absCtx, key, url, resolver, prefix)
+	return nil
+}
+
+// InsertServiceResolver adds a service whose instances come from resolver.
+// url is only used for logging.
+func InsertServiceResolver(absCtx *AbstractionServer, key string, url string, resolver Resolver, prefix string) {
 	absCtx.serviceData[key] = AbstractionService{
-		url:    url,
-		client: client,
-		prefix: prefix,
+		url:      url,
+		prefix:   prefix,
+		balancer: newBalancer(key, resolver),
+		breaker:  newCircuitBreaker(key),
 	}
-
-	return nil
 }
 
+// InsertDispatchTable adds verb, which svcName handles. Every service's verbs
+// share one table, so two services can't have a verb with the same name.
 func InsertDispatchTable(
 	absCtx *AbstractionServer,
 	svcName string,
 	verb string,
-) {
+) error {
+	if action := absCtx.dispatchTable[verb]; action != nil {
+		err := fmt.Errorf("(CAL) %s is in both %s and %s", verb, action.svcName, svcName)
+		absCtx.conflicts = append(absCtx.conflicts, err)
+		return err
+	}
 	absCtx.dispatchTable[verb] = &Action{
 		verb:    verb,
 		svcName: svcName,
 	}
+	return nil
+}
+
+// SetDispatchTimeout changes how long callers wait on verb. Negative means forever.
+func SetDispatchTimeout(absCtx *AbstractionServer, verb string, timeout time.Duration) error {
+	action := absCtx.dispatchTable[verb]
+	if action == nil {
+		return fmt.Errorf("(CAL) %s isn't in the dispatch table", verb)
+	}
+	action.timeout = timeout
+	return nil
+}
+
+// The caller's context, cut short by the verb's timeout
+func callContext(ctx *commondata.ReqCtx, action *Action) (context.Context, context.CancelFunc) {
+	timeout := action.timeout
+	if timeout == 0 {
+		timeout = AbsCtx.defaultTimeout
+	}
+	if timeout < 0 {
+		return context.WithCancel(ctx.Context())
+	}
+	// Keeps the caller's deadline if it's sooner
+	return context.WithTimeout(ctx.Context(), timeout)
+}
+
+// Builds the ReqCtx for a request that came in over connect
+func connectReqCtx(ctx context.Context, svcName string, verb string) *commondata.ReqCtx {
+	var username string
+	var jwtString string
+	// Get username from ctx
+	claims := ctx.Value("claims")
+	if claims != nil {
+		username = claims.(jwt.MapClaims)["username"].(string)
+	}
+	// Get JWT from ctx
+	jwt := ctx.Value("jwt")
+	if jwt != nil {
+		jwtString = jwt.(string)
+	}
+	return &commondata.ReqCtx{
+		Ctx:           ctx,
+		Username:      username,
+		Jwt:           jwtString,
+		TargetSvcName: svcName,
+		TargetSvcVerb: verb,
+	}
+}
+
+func setHandler(absCtx *AbstractionServer, verb string, handlerFn any) error {
+	action := absCtx.dispatchTable[verb]
+	if action == nil {
+		return fmt.Errorf("(CAL) %s isn't in the dispatch table", verb)
+	}
+	if action.fn != nil {
+		return fmt.Errorf("(CAL) %s already has a handler", verb)
+	}
+	action.fn = handlerFn
+	return nil
 }
 
 // TODO: set up web server as well.
@@ -95,36 +186,26 @@ func InsertDispatchTableHandler[ReqT any, RespT any](
 	absCtx *AbstractionServer,
 	svcName string,
 	verb string,
-	handlerFn any,
+	handlerFn func(*commondata.ReqCtx, *ReqT) (*RespT, error),
 	shouldVerifyJwt bool,
 ) error {
 	svcData := absCtx.serviceData[svcName]
-	absCtx.dispatchTable[verb].fn = handlerFn.(any)
+	if err := setHandler(absCtx, verb, handlerFn); err != nil {
+		return err
+	}
 	// TODO dry
 	route := svcData.prefix + "/" + verb
 	log.Println("(CAL) Adding route ", route)
 
 	AddRoute(absCtx.CommonServer, route,
 		func(ctx context.Context, req *connect.Request[ReqT]) (*connect.Response[RespT], error) {
-			var username string
-			var jwtString string
-			// Get username from ctx
-			claims := ctx.Value("claims")
-			if claims != nil {
-				username = claims.(jwt.MapClaims)["username"].(string)
-			}
-			// Get JWT from ctx
-			jwt := ctx.Value("jwt")
-			if jwt != nil {
-				jwtString = jwt.(string)
-			}
-			resp, err := (handlerFn.(func(*commondata.ReqCtx, *ReqT) (*RespT, error)))(&commondata.ReqCtx{
-				HttpCtx:       &ctx,
-				Username:      username,
-				Jwt:           jwtString,
-				TargetSvcName: svcName,
-				TargetSvcVerb: verb,
-			}, req.Msg)
+			traceParent := req.Header().Get("traceparent")
+			span := tracing.Start(traceParent, svcName+"/"+verb, tracing.Server)
+			reqCtx := connectReqCtx(ctx, svcName, verb)
+			reqCtx.TraceParent = span.TraceParent(traceParent)
+
+			resp, err := handlerFn(reqCtx, req.Msg)
+			span.End(err)
 
 			if err != nil {
 				return nil, err
@@ -142,38 +223,68 @@ func InsertDispatchTableHandler[ReqT any, RespT any](
 func Dispatch[Req any, Resp any](ctx *commondata.ReqCtx, verb string, req *Req) (*Resp, error) {
 
 	dispatchTableData := AbsCtx.dispatchTable[verb]
+	if dispatchTableData == nil {
+		return nil, fmt.Errorf("unknown verb %s", verb)
+	}
+
+	return dispatchWithPolicy[Req, Resp](ctx, dispatchTableData, req)
+}
+
+// One try at the verb, no retries
+func dispatchOnce[Req any, Resp any](ctx *commondata.ReqCtx, dispatchTableData *Action, req *Req) (*Resp, error) {
+	kind := tracing.Internal
+	if AbsCtx.Microservice {
+		kind = tracing.Client
+	}
+	span := tracing.Start(ctx.TraceParent, dispatchTableData.svcName+"/"+dispatchTableData.verb, kind)
+	span.SetAttr("src.verb", ctx.TargetSvcVerb)
+	span.SetAttr("game.id", ctx.GameId)
+
+	resp, err := dispatchTo[Req, Resp](ctx.WithTraceParent(span.TraceParent(ctx.TraceParent)), dispatchTableData, req)
+	span.End(err)
+	return resp, err
+}
+
+// Sends the verb to whoever handles it, here or over gRPC
+func dispatchTo[Req any, Resp any](ctx *commondata.ReqCtx, dispatchTableData *Action, req *Req) (*Resp, error) {
+	verb := dispatchTableData.verb
 
 	// https://sahansera.dev/building-grpc-client-go/
 	if AbsCtx.Microservice {
 		// https://pkg.go.dev/google.golang.org/grpc#ClientConn.Invoke
 		// Adapted from protobuf generated svcs
 		svcData := AbsCtx.serviceData[dispatchTableData.svcName]
-		client := svcData.client
+		ep, err := svcData.balancer.pick(ctx.Instance)
+		if err != nil {
+			return nil, err
+		}
 
 		// https://www.freecodecamp.org/news/new-vs-make-functions-in-go/
 		// https://chatgpt.com/share/680de978-f87c-8012-bd76-a8a6ae618438
 		resp := new(Resp)
 		loc := svcData.prefix + "/" + dispatchTableData.verb
-		log.Printf("(CAL Dispatch) Invoking microservice request on %s at %s\n", svcData.url, loc)
+		log.Printf("(CAL Dispatch) Invoking microservice request on %s at %s\n", ep.addr, loc)
 
 		// Create a context with the JWT as an authorization header
-		md := map[string]string{
+		md := traceMetadata(ctx, map[string]string{
 			"authorization": "Bearer " + ctx.Jwt,
-		}
-		callCtx := metadata.NewOutgoingContext(context.Background(), metadata.New(md))
+		})
+		// gRPC sends the deadline along, so the other side gives up when we do
+		timeoutCtx, cancel := callContext(ctx, dispatchTableData)
+		defer cancel()
+		callCtx := metadata.NewOutgoingContext(timeoutCtx, metadata.New(md))
 
+		// Impairment counts towards the latency, like a slow network would
 		start := time.Now()
-		err := client.Invoke(callCtx, loc, req, resp)
-		end := time.Since(start)
-		// TODO inefficient
-		AbsCtx.statChannel <- &stats.Stat{
-			SrcSvcName:  ctx.TargetSvcName,
-			SrcSvcVerb:  ctx.TargetSvcVerb,
-			DestSvcName: dispatchTableData.svcName,
-			DestSvcVerb: verb,
-			GameId:      ctx.GameId,
-			ReqTime:     end,
+		err = impairer.dispatchRequest(callCtx, dispatchTableData.svcName, req)
+		if err == nil {
+			err = ep.client.Invoke(callCtx, loc, req, resp)
+		}
+		if err == nil {
+			err = impairer.dispatchResponse(callCtx, dispatchTableData.svcName, resp)
 		}
+		recordStat(ctx, dispatchTableData, time.Since(start))
+		svcData.balancer.done(ep, err)
 
 		if err != nil {
 			log.Printf("Request failed with %s\n", err)
@@ -184,19 +295,52 @@ func Dispatch[Req any, Resp any](ctx *commondata.ReqCtx, verb string, req *Req)
 
 	} else {
 
+		handlerFn, ok := dispatchTableData.fn.(func(*commondata.ReqCtx, *Req) (*Resp, error))
+		if !ok {
+			return nil, fmt.Errorf("%s doesn't take %T and return %T", verb, req, new(Resp))
+		}
+
+		callCtx, cancel := callContext(ctx, dispatchTableData)
+		defer cancel()
+
+		type result struct {
+			resp *Resp
+			err  error
+		}
+		// Buffered so a handler that finishes after we gave up doesn't leak
+		done := make(chan result, 1)
+
 		// Dispatch some stuff
 		start := time.Now()
-		returnedResp, err := (AbsCtx.dispatchTable[verb].fn.(func(*commondata.ReqCtx, *Req) (*Resp, error))(ctx, req))
-		end := time.Since(start)
-		// TODO inefficient
-		AbsCtx.statChannel <- &stats.Stat{
-			SrcSvcName:  ctx.TargetSvcName,
-			SrcSvcVerb:  ctx.TargetSvcVerb,
-			GameId:      ctx.GameId,
-			DestSvcName: dispatchTableData.svcName,
-			DestSvcVerb: verb,
-			ReqTime:     end,
+		go func() {
+			// net/http would have caught this if we were still on the request's goroutine
+			defer func() {
+				if r := recover(); r != nil {
+					done <- result{err: fmt.Errorf("%s panicked: %v", verb, r)}
+				}
+			}()
+			// Pretend there's a network in between, if IMPAIRMENT_FILE says so
+			if err := impairer.dispatchRequest(callCtx, dispatchTableData.svcName, req); err != nil {
+				done <- result{err: err}
+				return
+			}
+			resp, err := handlerFn(ctx.WithContext(callCtx), req)
+			if err == nil {
+				err = impairer.dispatchResponse(callCtx, dispatchTableData.svcName, resp)
+			}
+			done <- result{resp: resp, err: err}
+		}()
+
+		var returnedResp *Resp
+		var err error
+		select {
+		case res := <-done:
+			returnedResp, err = res.resp, res.err
+		case <-callCtx.Done():
+			// The handler keeps going until it notices, but the caller doesn't wait for it
+			err = fmt.Errorf("%s: %w (%w)", verb, callCtx.Err(), errAbandoned)
 		}
+		recordStat(ctx, dispatchTableData, time.Since(start))
 
 		if err != nil {
 			return nil, err
@@ -206,6 +350,49 @@ func Dispatch[Req any, Resp any](ctx *commondata.ReqCtx, verb string, req *Req)
 	}
 }
 
-func (absCtx *AbstractionServer) Run() {
-	absCtx.CommonServer.StartServer()
+// Adds the caller's traceparent to the gRPC metadata, if it has one
+func traceMetadata(ctx *commondata.ReqCtx, md map[string]string) map[string]string {
+	if ctx.TraceParent != "" {
+		md["traceparent"] = ctx.TraceParent
+	}
+	return md
+}
+
+func recordStat(ctx *commondata.ReqCtx, action *Action, reqTime time.Duration) {
+	dispatchLatency.WithLabelValues(ctx.TargetSvcVerb, action.verb).Observe(reqTime.Seconds())
+
+	if AbsCtx.stats == nil {
+		return
+	}
+	// Queued, so this doesn't wait on disk. See stats/aggregate.go
+	AbsCtx.stats.Record(&stats.Stat{
+		SrcSvcName:  ctx.TargetSvcName,
+		SrcSvcVerb:  ctx.TargetSvcVerb,
+		DestSvcName: action.svcName,
+		DestSvcVerb: action.verb,
+		GameId:      ctx.GameId,
+		ReqTime:     reqTime,
+	})
+}
+
+// ValidateDispatchTable checks every verb can actually be dispatched: in a
+// monolith it needs a handler, otherwise it needs a handler here or a URL for
+// the service that has one. We don't wait for the other services to come up
+// since they can start in any order.
+func ValidateDispatchTable(absCtx *AbstractionServer) error {
+	errs := append([]error(nil), absCtx.conflicts...)
+	for verb, action := range absCtx.dispatchTable {
+		if action.fn != nil {
+			continue
+		}
+		if !absCtx.Microservice {
+			errs = append(errs, fmt.Errorf("%s has no handler", verb))
+			continue
+		}
+		svcData, ok := absCtx.serviceData[action.svcName]
+		if !ok || svcData.balancer.empty() {
+			errs = append(errs, fmt.Errorf("%s goes to %s, which has no instances", verb, action.svcName))
+		}
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,26 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestDuplicateVerbIsRejected(t *testing.T) {
+	if err := InsertDispatchTable(AbsCtx, "first", "DupVerb"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		delete(AbsCtx.dispatchTable, "DupVerb")
+		AbsCtx.conflicts = nil
+	})
+
+	if err := InsertDispatchTable(AbsCtx, "second", "DupVerb"); err == nil {
+		t.Error("inserted DupVerb for a second service")
+	}
+	if svcName := AbsCtx.dispatchTable["DupVerb"].svcName; svcName != "first" {
+		t.Errorf("DupVerb goes to %s, want first", svcName)
+	}
+	// Even if nobody checked the error from InsertDispatchTable
+	if err := ValidateDispatchTable(AbsCtx); err == nil {
+		t.Error("dispatch table with a duplicate verb is valid")
+	}
+}
@@ -1,12 +1,20 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
+	"connectrpc.com/connect"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/yuv418/cs553project/backend/commondata"
 )
 
+// How long a token from ServiceJwt is good for. They're made right before
+// the call that uses them, so this only has to cover one call.
+const serviceJwtExpiry = time.Minute
+
 // https://pkg.go.dev/github.com/golang-jwt/jwt/v5#example-Parse-Hmac
 // https://github.com/dgrijalva/jwt-go/blob/master/hmac_example_test.go
 
@@ -35,3 +43,38 @@ func (cfg *SrvCfg) ValidateJwt(jwtToken string) jwt.MapClaims {
 		return nil
 	}
 }
+
+// ServiceJwt makes a token for svcName to call another service on behalf of
+// username. Calls made long after the user's request (the outbox, moving
+// games) use these instead of holding on to the user's own token, which
+// could have expired by then.
+func (cfg *SrvCfg) ServiceJwt(svcName string, username string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": username,
+		"service":  svcName,
+		"exp":      time.Now().Add(serviceJwtExpiry).Unix(),
+	})
+	return token.SignedString([]byte(cfg.JWTSecret))
+}
+
+// AsService copies ctx with its JWT swapped for a service token from
+// ServiceJwt, for the same user.
+func AsService(ctx *commondata.ReqCtx, svcName string) (*commondata.ReqCtx, error) {
+	token, err := AbsCtx.CommonServer.Cfg.ServiceJwt(svcName, ctx.Username)
+	if err != nil {
+		return nil, err
+	}
+	reqCtx := *ctx
+	reqCtx.Jwt = token
+	return &reqCtx, nil
+}
+
+// RequireService turns away calls that weren't made with a ServiceJwt, for
+// verbs that only other services should be calling.
+func RequireService(ctx *commondata.ReqCtx) error {
+	claims := AbsCtx.CommonServer.Cfg.ValidateJwt(ctx.Jwt)
+	if svcName, _ := claims["service"].(string); svcName == "" {
+		return connect.NewError(connect.CodePermissionDenied, errors.New("only services can call this"))
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+// Spreading calls over every instance of a service. Instances that keep
+// failing are skipped for a while, and the list is kept up to date from the
+// service's Resolver.
+
+package common
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/yuv418/cs553project/backend/commondata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+)
+
+type balancePolicy int8
+
+const (
+	// Take turns
+	roundRobin balancePolicy = iota
+	// Whoever has the fewest calls out right now
+	leastLoaded
+)
+
+// LB_POLICY is round_robin or least_loaded. ENDPOINT_FAILURES consecutive
+// failures take an instance out for ENDPOINT_COOLDOWN.
+var balancerPolicy, endpointFailures, endpointCooldown = balancerSetup()
+
+func balancerSetup() (balancePolicy, int, time.Duration) {
+	var policy balancePolicy
+	switch commondata.GetEnv("LB_POLICY", "round_robin") {
+	case "round_robin":
+		policy = roundRobin
+	case "least_loaded":
+		policy = leastLoaded
+	default:
+		log.Fatalf("LB_POLICY has to be round_robin or least_loaded\n")
+	}
+	failures, err := strconv.Atoi(commondata.GetEnv("ENDPOINT_FAILURES", "3"))
+	if err != nil {
+		log.Fatalf("ENDPOINT_FAILURES is invalid: %s\n", err)
+	}
+	cooldown, err := time.ParseDuration(commondata.GetEnv("ENDPOINT_COOLDOWN", "5s"))
+	if err != nil {
+		log.Fatalf("ENDPOINT_COOLDOWN is invalid: %s\n", err)
+	}
+	return policy, failures, cooldown
+}
+
+// How long a removed instance's connection stays open for calls already on it
+const endpointDrainTime = 30 * time.Second
+
+type endpoint struct {
+	addr   string
+	client *grpc.ClientConn
+	// Everything below is under the balancer lock
+	inflight  int
+	failures  int
+	downUntil time.Time
+}
+
+// Must hold the balancer lock
+func (ep *endpoint) healthy(now time.Time) bool {
+	if now.Before(ep.downUntil) {
+		return false
+	}
+	// gRPC already knows when it can't connect
+	return ep.client.GetState() != connectivity.TransientFailure
+}
+
+type balancer struct {
+	svcName   string
+	resolver  Resolver
+	lock      sync.Mutex
+	endpoints []*endpoint
+	next      int
+}
+
+func newBalancer(svcName string, resolver Resolver) *balancer {
+	bal := &balancer{svcName: svcName, resolver: resolver}
+	bal.refresh()
+	go bal.watch()
+	return bal
+}
+
+func (bal *balancer) watch() {
+	var changed <-chan struct{}
+	if notifying, ok := bal.resolver.(notifyingResolver); ok {
+		changed = notifying.Changed()
+	}
+	ticker := time.NewTicker(discoveryInterval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-changed:
+		}
+		bal.refresh()
+	}
+}
+
+// Looks the addresses up again, connecting to new instances and letting go of
+// the ones that are gone
+func (bal *balancer) refresh() {
+	addrs, err := bal.resolver.Resolve()
+	if err != nil {
+		// Better to keep calling the old instances than nobody
+		log.Printf("(CAL) Couldn't look up %s, keeping what we had: %s\n", bal.svcName, err)
+		return
+	}
+
+	bal.lock.Lock()
+	defer bal.lock.Unlock()
+
+	var endpoints []*endpoint
+	for _, addr := range addrs {
+		i := slices.IndexFunc(bal.endpoints, func(ep *endpoint) bool { return ep.addr == addr })
+		if i >= 0 {
+			endpoints = append(endpoints, bal.endpoints[i])
+			continue
+		}
+
+		// https://stackoverflow.com/questions/57278822/sending-grpc-communications-over-a-specific-port
+		// https://gist.github.com/marzocchi/c4d3e2254853c5ff02b420044e796aea
+		creds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+		client, err := grpc.NewClient(
+			addr,
+			grpc.WithTransportCredentials(creds),
+		)
+		if err != nil {
+			log.Printf("(CAL) Couldn't add client for %s at %s: %s\n", bal.svcName, addr, err)
+			continue
+		}
+		log.Printf("(CAL) Established client for %s at url %s\n", bal.svcName, addr)
+		endpoints = append(endpoints, &endpoint{addr: addr, client: client})
+	}
+
+	for _, ep := range bal.endpoints {
+		if !slices.Contains(endpoints, ep) {
+			log.Printf("(CAL) %s at %s is gone\n", bal.svcName, ep.addr)
+			time.AfterFunc(endpointDrainTime, func() { ep.client.Close() })
+		}
+	}
+	bal.endpoints = endpoints
+}
+
+// Hangs up on every instance
+func (bal *balancer) close() {
+	bal.lock.Lock()
+	defer bal.lock.Unlock()
+
+	for _, ep := range bal.endpoints {
+		ep.client.Close()
+	}
+}
+
+func (bal *balancer) empty() bool {
+	bal.lock.Lock()
+	defer bal.lock.Unlock()
+	return len(bal.endpoints) == 0
+}
+
+// pick gives the instance the next call should go to, which is addr if it's
+// set. Call done on it once the call is over.
+func (bal *balancer) pick(addr string) (*endpoint, error) {
+	bal.lock.Lock()
+	defer bal.lock.Unlock()
+
+	if addr != "" {
+		i := slices.IndexFunc(bal.endpoints, func(ep *endpoint) bool { return ep.addr == addr })
+		if i < 0 {
+			return nil, connect.NewError(connect.CodeUnavailable, fmt.Errorf("%s at %s is gone", bal.svcName, addr))
+		}
+		// Down or not, nobody else has what the caller wants
+		bal.endpoints[i].inflight++
+		return bal.endpoints[i], nil
+	}
+
+	if len(bal.endpoints) == 0 {
+		return nil, connect.NewError(connect.CodeUnavailable, fmt.Errorf("no instances of %s", bal.svcName))
+	}
+
+	candidates := bal.healthy()
+
+	bal.next++
+	ep := candidates[bal.next%len(candidates)]
+	if balancerPolicy == leastLoaded {
+		// Starting from the round robin pick so ties get spread out
+		for i := range candidates {
+			candidate := candidates[(bal.next+i)%len(candidates)]
+			if candidate.inflight < ep.inflight {
+				ep = candidate
+			}
+		}
+	}
+
+	ep.inflight++
+	return ep, nil
+}
+
+// The instances that aren't being skipped. If they're all down, one of them
+// might have come back, so that's all of them.
+// Must hold the balancer lock
+func (bal *balancer) healthy() []*endpoint {
+	now := time.Now()
+	candidates := make([]*endpoint, 0, len(bal.endpoints))
+	for _, ep := range bal.endpoints {
+		if ep.healthy(now) {
+			candidates = append(candidates, ep)
+		}
+	}
+	if len(candidates) == 0 {
+		return bal.endpoints
+	}
+	return candidates
+}
+
+func (bal *balancer) done(ep *endpoint, err error) {
+	bal.lock.Lock()
+	defer bal.lock.Unlock()
+
+	ep.inflight--
+	if !isTransient(err) {
+		ep.failures = 0
+		return
+	}
+
+	ep.failures++
+	if endpointFailures > 0 && ep.failures >= endpointFailures {
+		if time.Now().After(ep.downUntil) {
+			log.Printf("(CAL) %s at %s failed %d times, skipping it for %s\n", bal.svcName, ep.addr, ep.failures, endpointCooldown)
+		}
+		ep.downUntil = time.Now().Add(endpointCooldown)
+	}
+}
+
+// ServiceInstances gives the addresses of svcName's instances, for callers that
+// place work with ReqCtx.Instance. healthyOnly leaves out the ones being
+// skipped, which is no good for placement that has to come out the same every
+// time. It's empty in a monolith, where there's only us.
+func ServiceInstances(absCtx *AbstractionServer, svcName string, healthyOnly bool) []string {
+	svcData, ok := absCtx.serviceData[svcName]
+	if !absCtx.Microservice || !ok {
+		return nil
+	}
+
+	svcData.balancer.lock.Lock()
+	defer svcData.balancer.lock.Unlock()
+
+	endpoints := svcData.balancer.endpoints
+	if healthyOnly {
+		endpoints = svcData.balancer.healthy()
+	}
+	var addrs []string
+	for _, ep := range endpoints {
+		addrs = append(addrs, ep.addr)
+	}
+	return addrs
+}
@@ -0,0 +1,209 @@
+package common
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+)
+
+// A balancer over a registry the test controls
+func newTestBalancer(t *testing.T, addrs ...string) (*balancer, *LocalRegistry) {
+	t.Helper()
+
+	registry := NewLocalRegistry()
+	for _, addr := range addrs {
+		registry.Register("test", addr)
+	}
+	bal := newBalancer("test", registry.Resolver("test"))
+	t.Cleanup(bal.close)
+	return bal, registry
+}
+
+func withBalancerPolicy(t *testing.T, policy balancePolicy) {
+	prev := balancerPolicy
+	balancerPolicy = policy
+	t.Cleanup(func() { balancerPolicy = prev })
+}
+
+// Picks n times, finishing each call right away
+func pickCounts(t *testing.T, bal *balancer, n int) map[string]int {
+	t.Helper()
+
+	counts := make(map[string]int)
+	for range n {
+		ep, err := bal.pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[ep.addr]++
+		bal.done(ep, nil)
+	}
+	return counts
+}
+
+func TestRoundRobin(t *testing.T) {
+	withBalancerPolicy(t, roundRobin)
+	bal, _ := newTestBalancer(t, "a:1", "b:1", "c:1")
+
+	counts := pickCounts(t, bal, 30)
+	for _, addr := range []string{"a:1", "b:1", "c:1"} {
+		if counts[addr] != 10 {
+			t.Errorf("got %v, want 10 each", counts)
+			break
+		}
+	}
+}
+
+func TestLeastLoaded(t *testing.T) {
+	withBalancerPolicy(t, leastLoaded)
+	bal, _ := newTestBalancer(t, "a:1", "b:1", "c:1")
+
+	// Two calls stuck on whatever the first two picks are
+	busy := []*endpoint{}
+	for range 2 {
+		ep, err := bal.pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		busy = append(busy, ep)
+	}
+
+	counts := pickCounts(t, bal, 5)
+	for _, ep := range busy {
+		if counts[ep.addr] != 0 {
+			t.Errorf("busy %s got %d calls while another instance had none", ep.addr, counts[ep.addr])
+		}
+	}
+}
+
+func TestPickAddr(t *testing.T) {
+	bal, _ := newTestBalancer(t, "a:1", "b:1")
+
+	for range 3 {
+		ep, err := bal.pick("b:1")
+		if err != nil || ep.addr != "b:1" {
+			t.Fatalf("got %v, %v, want b:1", ep, err)
+		}
+		bal.done(ep, nil)
+	}
+
+	if _, err := bal.pick("gone:1"); connect.CodeOf(err) != connect.CodeUnavailable {
+		t.Errorf("got %v, want unavailable", err)
+	}
+}
+
+func TestFailingEndpointIsSkipped(t *testing.T) {
+	withBalancerPolicy(t, roundRobin)
+	prevFailures, prevCooldown := endpointFailures, endpointCooldown
+	endpointFailures, endpointCooldown = 2, 50*time.Millisecond
+	t.Cleanup(func() { endpointFailures, endpointCooldown = prevFailures, prevCooldown })
+
+	bal, _ := newTestBalancer(t, "a:1", "b:1")
+	fail := func(addr string, err error) {
+		ep, _ := bal.pick(addr)
+		bal.done(ep, err)
+	}
+
+	// A rejection doesn't count, the instance answered
+	fail("a:1", unavailable())
+	fail("a:1", connect.NewError(connect.CodeInvalidArgument, errors.New("no")))
+	fail("a:1", unavailable())
+	if counts := pickCounts(t, bal, 4); counts["a:1"] != 2 {
+		t.Fatalf("got %v, a:1 shouldn't be skipped yet", counts)
+	}
+
+	fail("a:1", unavailable())
+	fail("a:1", unavailable())
+	if counts := pickCounts(t, bal, 4); counts["b:1"] != 4 {
+		t.Errorf("got %v, want everything on b:1", counts)
+	}
+	if addrs := bal.healthyAddrs(); !slices.Equal(addrs, []string{"b:1"}) {
+		t.Errorf("healthy instances are %v, want b:1", addrs)
+	}
+
+	// Both down, so both get tried
+	fail("b:1", unavailable())
+	fail("b:1", unavailable())
+	if counts := pickCounts(t, bal, 4); counts["a:1"] == 0 || counts["b:1"] == 0 {
+		t.Errorf("got %v, want both tried", counts)
+	}
+
+	// Cooldown's up
+	time.Sleep(60 * time.Millisecond)
+	if addrs := bal.healthyAddrs(); len(addrs) != 2 {
+		t.Errorf("healthy instances are %v, want both back", addrs)
+	}
+}
+
+func (bal *balancer) healthyAddrs() []string {
+	bal.lock.Lock()
+	defer bal.lock.Unlock()
+
+	var addrs []string
+	for _, ep := range bal.healthy() {
+		addrs = append(addrs, ep.addr)
+	}
+	return addrs
+}
+
+func (bal *balancer) addrs() []string {
+	bal.lock.Lock()
+	defer bal.lock.Unlock()
+
+	var addrs []string
+	for _, ep := range bal.endpoints {
+		addrs = append(addrs, ep.addr)
+	}
+	return addrs
+}
+
+func TestBalancerFollowsRegistry(t *testing.T) {
+	bal, registry := newTestBalancer(t, "a:1", "b:1")
+
+	bal.lock.Lock()
+	kept := bal.endpoints[0]
+	bal.lock.Unlock()
+
+	registry.Register("test", "c:1")
+	registry.Deregister("test", "b:1")
+	// Told about it, doesn't wait for DISCOVERY_INTERVAL
+	eventually(t, "the balancer to see the change", func() bool {
+		return slices.Equal(bal.addrs(), []string{"a:1", "c:1"})
+	})
+
+	bal.lock.Lock()
+	defer bal.lock.Unlock()
+	if bal.endpoints[0] != kept {
+		t.Error("reconnected to an instance that didn't go anywhere")
+	}
+}
+
+type failingResolver struct{}
+
+func (failingResolver) Resolve() ([]string, error) {
+	return nil, errors.New("DNS is down")
+}
+
+func TestFailedLookupKeepsInstances(t *testing.T) {
+	// Not watching, so the resolver can be swapped
+	bal := &balancer{svcName: "test", resolver: staticResolver{"a:1"}}
+	bal.refresh()
+	t.Cleanup(bal.close)
+
+	bal.resolver = failingResolver{}
+	bal.refresh()
+
+	if addrs := bal.addrs(); !slices.Equal(addrs, []string{"a:1"}) {
+		t.Errorf("instances are %v after a failed lookup, want a:1", addrs)
+	}
+}
+
+func TestNoInstances(t *testing.T) {
+	bal, _ := newTestBalancer(t)
+	if _, err := bal.pick(""); connect.CodeOf(err) != connect.CodeUnavailable {
+		t.Errorf("got %v, want unavailable", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Finding the instances of a service. The *_URL env vars can be any of:
+//
+//	host:port[,host:port...]   a fixed list
+//	srv://_score._tcp.example  a DNS SRV record, looked up again every DISCOVERY_INTERVAL
+//	file:///path/registry.json a JSON object of service name to addresses, reread when it changes
+//
+// Tests (or anything else in the same process) can use a LocalRegistry
+// through InsertServiceResolver instead.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+)
+
+type Resolver interface {
+	// Every address the service can be reached at right now
+	Resolve() ([]string, error)
+}
+
+// Resolvers that can say when their addresses change, so we don't wait for
+// the next DISCOVERY_INTERVAL to find out
+type notifyingResolver interface {
+	Resolver
+	Changed() <-chan struct{}
+}
+
+// How often addresses are looked up again
+var discoveryInterval = discoveryIntervalSetup()
+
+func discoveryIntervalSetup() time.Duration {
+	interval, err := time.ParseDuration(commondata.GetEnv("DISCOVERY_INTERVAL", "10s"))
+	if err != nil {
+		log.Fatalf("DISCOVERY_INTERVAL is invalid: %s\n", err)
+	}
+	return interval
+}
+
+// Picks a resolver based on what the URL looks like
+func newResolver(svcName string, url string) (Resolver, error) {
+	switch {
+	case strings.HasPrefix(url, "srv://"):
+		return &srvResolver{name: strings.TrimPrefix(url, "srv://")}, nil
+	case strings.HasPrefix(url, "file://"):
+		return newFileResolver(svcName, strings.TrimPrefix(url, "file://")), nil
+	case strings.Contains(url, "://"):
+		return nil, fmt.Errorf("(CAL) don't know how to find %s at %s", svcName, url)
+	default:
+		var addrs []string
+		for _, addr := range strings.Split(url, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+		return staticResolver(addrs), nil
+	}
+}
+
+type staticResolver []string
+
+func (resolver staticResolver) Resolve() ([]string, error) {
+	return resolver, nil
+}
+
+type srvResolver struct {
+	name string
+}
+
+func (resolver *srvResolver) Resolve() ([]string, error) {
+	// Already sorted by priority, then shuffled by weight
+	_, records, err := net.LookupSRV("", "", resolver.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, record := range records {
+		// Only the best priority, the rest are backups
+		if record.Priority != records[0].Priority {
+			break
+		}
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), fmt.Sprint(record.Port)))
+	}
+	return addrs, nil
+}
+
+// Reads {"score": ["10.0.0.1:50056", "10.0.0.2:50056"], ...} from a file that
+// something else (a deploy script, a sidecar) keeps up to date.
+type fileResolver struct {
+	svcName string
+	path    string
+	changed chan struct{}
+}
+
+// How often the registry file is checked for changes
+const fileResolverPoll = time.Second
+
+func newFileResolver(svcName string, path string) *fileResolver {
+	resolver := &fileResolver{
+		svcName: svcName,
+		path:    path,
+		changed: make(chan struct{}, 1),
+	}
+	go resolver.watch()
+	return resolver
+}
+
+func (resolver *fileResolver) Resolve() ([]string, error) {
+	data, err := os.ReadFile(resolver.path)
+	if err != nil {
+		return nil, err
+	}
+	registry := make(map[string][]string)
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("%s: %w", resolver.path, err)
+	}
+	return registry[resolver.svcName], nil
+}
+
+func (resolver *fileResolver) Changed() <-chan struct{} {
+	return resolver.changed
+}
+
+func (resolver *fileResolver) watch() {
+	var lastMod time.Time
+	for range time.Tick(fileResolverPoll) {
+		info, err := os.Stat(resolver.path)
+		if err != nil || info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+		select {
+		case resolver.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// LocalRegistry keeps addresses in memory. Instances register themselves
+// and callers see the change right away.
+type LocalRegistry struct {
+	lock     sync.Mutex
+	services map[string]map[string]struct{}
+	watchers map[string][]chan struct{}
+}
+
+func NewLocalRegistry() *LocalRegistry {
+	return &LocalRegistry{
+		services: make(map[string]map[string]struct{}),
+		watchers: make(map[string][]chan struct{}),
+	}
+}
+
+func (registry *LocalRegistry) Register(svcName string, addr string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if registry.services[svcName] == nil {
+		registry.services[svcName] = make(map[string]struct{})
+	}
+	registry.services[svcName][addr] = struct{}{}
+	registry.notify(svcName)
+}
+
+func (registry *LocalRegistry) Deregister(svcName string, addr string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	delete(registry.services[svcName], addr)
+	registry.notify(svcName)
+}
+
+// Must hold the registry lock
+func (registry *LocalRegistry) notify(svcName string) {
+	for _, watcher := range registry.watchers[svcName] {
+		select {
+		case watcher <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Resolver gives the addresses registered under svcName.
+func (registry *LocalRegistry) Resolver(svcName string) Resolver {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	changed := make(chan struct{}, 1)
+	registry.watchers[svcName] = append(registry.watchers[svcName], changed)
+	return &localResolver{registry: registry, svcName: svcName, changed: changed}
+}
+
+type localResolver struct {
+	registry *LocalRegistry
+	svcName  string
+	changed  chan struct{}
+}
+
+func (resolver *localResolver) Resolve() ([]string, error) {
+	resolver.registry.lock.Lock()
+	defer resolver.registry.lock.Unlock()
+
+	var addrs []string
+	for addr := range resolver.registry.services[resolver.svcName] {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+func (resolver *localResolver) Changed() <-chan struct{} {
+	return resolver.changed
+}
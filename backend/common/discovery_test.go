@@ -0,0 +1,109 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewResolver(t *testing.T) {
+	tests := []struct {
+		url     string
+		want    []string
+		wantErr bool
+	}{
+		{url: "a:1", want: []string{"a:1"}},
+		{url: " a:1, b:2 ,,", want: []string{"a:1", "b:2"}},
+		{url: "", want: nil},
+		{url: "http://a:1", wantErr: true},
+	}
+	for _, tc := range tests {
+		resolver, err := newResolver("test", tc.url)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("newResolver(%q) gave error %v", tc.url, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		addrs, err := resolver.Resolve()
+		if err != nil || !slices.Equal(addrs, tc.want) {
+			t.Errorf("%q resolved to %v, %v, want %v", tc.url, addrs, err, tc.want)
+		}
+	}
+
+	if resolver, _ := newResolver("test", "srv://_test._tcp.example"); resolver.(*srvResolver).name != "_test._tcp.example" {
+		t.Errorf("got %#v, want an SRV lookup", resolver)
+	}
+	if resolver, _ := newResolver("test", "file:///tmp/registry.json"); resolver.(*fileResolver).path != "/tmp/registry.json" {
+		t.Errorf("got %#v, want a registry file", resolver)
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolver := newFileResolver("score", path)
+	if _, err := resolver.Resolve(); err == nil {
+		t.Error("resolved without a file")
+	}
+
+	write(`{"score": ["a:1", "b:1"], "music": ["c:1"]}`)
+	if addrs, err := resolver.Resolve(); err != nil || !slices.Equal(addrs, []string{"a:1", "b:1"}) {
+		t.Errorf("got %v, %v, want a:1 and b:1", addrs, err)
+	}
+	// The watcher saw the file show up
+	select {
+	case <-resolver.Changed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("never heard the file changed")
+	}
+
+	write(`{"music": ["c:1"]}`)
+	if addrs, err := resolver.Resolve(); err != nil || len(addrs) != 0 {
+		t.Errorf("got %v, %v, want no instances", addrs, err)
+	}
+
+	write(`{"score": `)
+	if _, err := resolver.Resolve(); err == nil {
+		t.Error("resolved a broken file")
+	}
+}
+
+func TestLocalRegistry(t *testing.T) {
+	registry := NewLocalRegistry()
+	resolver := registry.Resolver("score").(notifyingResolver)
+	other := registry.Resolver("music").(notifyingResolver)
+
+	registry.Register("score", "b:1")
+	registry.Register("score", "a:1")
+	registry.Register("score", "a:1")
+
+	select {
+	case <-resolver.Changed():
+	default:
+		t.Error("registering didn't notify")
+	}
+	select {
+	case <-other.Changed():
+		t.Error("another service's resolver was notified")
+	default:
+	}
+
+	if addrs, _ := resolver.Resolve(); !slices.Equal(addrs, []string{"a:1", "b:1"}) {
+		t.Errorf("got %v, want a:1 and b:1", addrs)
+	}
+
+	registry.Deregister("score", "a:1")
+	registry.Deregister("score", "gone:1")
+	if addrs, _ := resolver.Resolve(); !slices.Equal(addrs, []string{"b:1"}) {
+		t.Errorf("got %v, want b:1", addrs)
+	}
+}
@@ -0,0 +1,268 @@
+// Health checking. /healthz says the process is up, /readyz says whether it
+// should get traffic and why not, and grpc.health.v1 says the same as /readyz
+// for anything that speaks gRPC health checking.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// A check returns an error when whatever it checks can't do its job
+type HealthCheck func(ctx context.Context) error
+
+var (
+	healthChecks     = make(map[string]HealthCheck)
+	healthChecksLock = sync.Mutex{}
+)
+
+// How long /readyz waits on all the checks together
+const healthCheckTimeout = 2 * time.Second
+
+// How often grpc.health.v1 Watch looks for a change
+var healthWatchInterval = time.Second
+
+// AddHealthCheck makes readiness depend on check too.
+func AddHealthCheck(name string, check HealthCheck) {
+	healthChecksLock.Lock()
+	defer healthChecksLock.Unlock()
+	healthChecks[name] = check
+}
+
+type checkResult struct {
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]checkResult `json:"checks"`
+	// Reported, but they don't make us unready. Otherwise one service going
+	// down would take everything that calls it out of the load balancer too.
+	Dependencies map[string]checkResult `json:"dependencies,omitempty"`
+}
+
+// Runs every check, plus the ones every service gets for free
+func (absCtx *AbstractionServer) readiness(ctx context.Context) readiness {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	checks := map[string]HealthCheck{
+		"server": func(context.Context) error {
+			if !absCtx.CommonServer.accepting.Load() {
+				return fmt.Errorf("shutting down")
+			}
+			return nil
+		},
+	}
+	// Nothing listens for WebTransport without TLS
+	if absCtx.CommonServer.wtpServer != nil && !absCtx.CommonServer.Cfg.Plaintext {
+		checks["webtransport"] = func(context.Context) error {
+			if !absCtx.CommonServer.wtpListening.Load() {
+				return fmt.Errorf("not listening on %s", absCtx.CommonServer.Cfg.WtpListenAddr)
+			}
+			return nil
+		}
+	}
+	healthChecksLock.Lock()
+	for name, check := range healthChecks {
+		checks[name] = check
+	}
+	healthChecksLock.Unlock()
+
+	// In a monolith these would all just be us
+	dependencies := make(map[string]HealthCheck)
+	if absCtx.Microservice {
+		for svcName, svcData := range absCtx.serviceData {
+			if absCtx.calls(svcName) {
+				dependencies[svcName] = svcData.healthy
+			}
+		}
+	}
+
+	ready := readiness{}
+	ready.Checks, ready.Ready = runChecks(ctx, checks)
+	if len(dependencies) > 0 {
+		ready.Dependencies, _ = runChecks(ctx, dependencies)
+	}
+	return ready
+}
+
+// Runs checks all at once, and says whether they all passed
+func runChecks(ctx context.Context, checks map[string]HealthCheck) (map[string]checkResult, bool) {
+	type namedResult struct {
+		name string
+		err  error
+	}
+	results := make(chan namedResult, len(checks))
+	for name, check := range checks {
+		go func() {
+			results <- namedResult{name: name, err: check(ctx)}
+		}()
+	}
+
+	report := make(map[string]checkResult)
+	ok := true
+	for range checks {
+		var result namedResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			// Whatever hasn't answered by now failed
+			for name := range checks {
+				if _, ok := report[name]; !ok {
+					report[name] = checkResult{Detail: "timed out"}
+				}
+			}
+			return report, false
+		}
+
+		if result.err != nil {
+			ok = false
+			report[result.name] = checkResult{Detail: result.err.Error()}
+		} else {
+			report[result.name] = checkResult{Ok: true}
+		}
+	}
+	return report, ok
+}
+
+// Whether some verb we can't handle ourselves goes to svcName, in which case we
+// need it to be up
+func (absCtx *AbstractionServer) calls(svcName string) bool {
+	for _, action := range absCtx.dispatchTable {
+		if action.svcName == svcName && action.fn == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// A service is reachable if any of its instances is connected, and its breaker isn't open
+func (svcData AbstractionService) healthy(context.Context) error {
+	if svcData.breaker != nil {
+		svcData.breaker.lock.Lock()
+		open := svcData.breaker.state == breakerOpen
+		svcData.breaker.lock.Unlock()
+		if open {
+			return fmt.Errorf("circuit breaker is open")
+		}
+	}
+
+	svcData.balancer.lock.Lock()
+	defer svcData.balancer.lock.Unlock()
+
+	if len(svcData.balancer.endpoints) == 0 {
+		return fmt.Errorf("no instances")
+	}
+
+	var states []string
+	for _, ep := range svcData.balancer.endpoints {
+		state := ep.client.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Idle:
+			// gRPC only connects once there's a call, so give it a nudge for next time
+			ep.client.Connect()
+		}
+		states = append(states, fmt.Sprintf("%s is %s", ep.addr, strings.ToLower(state.String())))
+	}
+	sort.Strings(states)
+	return fmt.Errorf("%s", strings.Join(states, ", "))
+}
+
+func (absCtx *AbstractionServer) mountHealth() {
+	mux := absCtx.CommonServer.mux
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready := absCtx.readiness(r.Context())
+		out, err := json.Marshal(ready)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !ready.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(out)
+	})
+
+	// https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+	AddRoute(absCtx.CommonServer, "/grpc.health.v1.Health/Check",
+		func(ctx context.Context, req *connect.Request[healthpb.HealthCheckRequest]) (*connect.Response[healthpb.HealthCheckResponse], error) {
+			status, err := absCtx.healthStatus(ctx, req.Msg.Service)
+			if err != nil {
+				return nil, err
+			}
+			return connect.NewResponse(&healthpb.HealthCheckResponse{Status: status}), nil
+		}, false)
+
+	AddServerStreamRoute(absCtx.CommonServer, "/grpc.health.v1.Health/Watch",
+		func(ctx context.Context, req *connect.Request[healthpb.HealthCheckRequest], stream *connect.ServerStream[healthpb.HealthCheckResponse]) error {
+			ticker := time.NewTicker(healthWatchInterval)
+			defer ticker.Stop()
+
+			last := healthpb.HealthCheckResponse_UNKNOWN
+			for first := true; ; first = false {
+				status, err := absCtx.healthStatus(ctx, req.Msg.Service)
+				if err != nil {
+					// Watch says to keep going for services we don't know yet
+					status = healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+				}
+				if first || status != last {
+					if err := stream.Send(&healthpb.HealthCheckResponse{Status: status}); err != nil {
+						return err
+					}
+					last = status
+				}
+
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}, false)
+
+	log.Printf("(CALServer) Serving health checks at /healthz, /readyz and grpc.health.v1\n")
+}
+
+// "" is the whole server, otherwise a gRPC service we handle, like score.ScoreService
+func (absCtx *AbstractionServer) healthStatus(ctx context.Context, service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+	if service != "" && !absCtx.serves(service) {
+		return healthpb.HealthCheckResponse_UNKNOWN, connect.NewError(connect.CodeNotFound, fmt.Errorf("unknown service %s", service))
+	}
+	if absCtx.readiness(ctx).Ready {
+		return healthpb.HealthCheckResponse_SERVING, nil
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING, nil
+}
+
+// Whether we have a handler for anything in service
+func (absCtx *AbstractionServer) serves(service string) bool {
+	for _, action := range absCtx.dispatchTable {
+		if action.fn != nil && absCtx.serviceData[action.svcName].prefix == "/"+service {
+			return true
+		}
+	}
+	return false
+}
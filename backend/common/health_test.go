@@ -0,0 +1,202 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// A server with nothing but the health routes, and a handler for
+// test.HealthService
+func newTestHealthServer(t *testing.T) (*AbstractionServer, *httptest.Server) {
+	t.Helper()
+
+	absCtx := &AbstractionServer{
+		dispatchTable: map[string]*Action{
+			"HealthVerb": {verb: "HealthVerb", svcName: "healthTest", fn: func() {}},
+		},
+		serviceData: map[string]AbstractionService{
+			"healthTest": {prefix: "/test.HealthService"},
+		},
+		CommonServer: newTestCommonServer(t, &SrvCfg{Plaintext: true}),
+	}
+	absCtx.mountHealth()
+	server := httptest.NewServer(absCtx.CommonServer.mux)
+	t.Cleanup(server.Close)
+	return absCtx, server
+}
+
+func withHealthCheck(t *testing.T, name string, check HealthCheck) {
+	AddHealthCheck(name, check)
+	t.Cleanup(func() {
+		healthChecksLock.Lock()
+		defer healthChecksLock.Unlock()
+		delete(healthChecks, name)
+	})
+}
+
+func getReadiness(t *testing.T, url string) (int, readiness) {
+	t.Helper()
+
+	resp, err := http.Get(url + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var ready readiness
+	if err := json.NewDecoder(resp.Body).Decode(&ready); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, ready
+}
+
+func TestHealthDuringDrain(t *testing.T) {
+	absCtx, server := newTestHealthServer(t)
+
+	status, ready := getReadiness(t, server.URL)
+	if status != http.StatusOK || !ready.Ready || !ready.Checks["server"].Ok {
+		t.Fatalf("got %d %+v, want ready", status, ready)
+	}
+
+	// What StopAccepting does first
+	absCtx.CommonServer.accepting.Store(false)
+
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz got %d while draining, the process is still up", resp.StatusCode)
+	}
+	status, ready = getReadiness(t, server.URL)
+	if status != http.StatusServiceUnavailable || ready.Ready || ready.Checks["server"].Detail != "shutting down" {
+		t.Errorf("got %d %+v, want unready because we're shutting down", status, ready)
+	}
+}
+
+func TestFailingCheckMakesUnready(t *testing.T) {
+	_, server := newTestHealthServer(t)
+	withHealthCheck(t, "disk", func(context.Context) error { return errors.New("full") })
+
+	status, ready := getReadiness(t, server.URL)
+	if status != http.StatusServiceUnavailable || ready.Checks["disk"] != (checkResult{Detail: "full"}) || !ready.Checks["server"].Ok {
+		t.Errorf("got %d %+v, want unready because of disk", status, ready)
+	}
+}
+
+func TestRunChecksTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	report, ok := runChecks(ctx, map[string]HealthCheck{
+		"fast": func(context.Context) error { return nil },
+		// Doesn't look at ctx
+		"stuck": func(context.Context) error {
+			<-release
+			return nil
+		},
+	})
+
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("took %s, should give up after 50ms", took)
+	}
+	if ok {
+		t.Error("passed with a check that never answered")
+	}
+	if !report["fast"].Ok || report["stuck"] != (checkResult{Detail: "timed out"}) {
+		t.Errorf("got %+v", report)
+	}
+}
+
+func TestGrpcHealthCheck(t *testing.T) {
+	absCtx, server := newTestHealthServer(t)
+	client := connect.NewClient[healthpb.HealthCheckRequest, healthpb.HealthCheckResponse](
+		http.DefaultClient, server.URL+"/grpc.health.v1.Health/Check")
+
+	for _, tc := range []struct {
+		service string
+		status  healthpb.HealthCheckResponse_ServingStatus
+		code    connect.Code
+	}{
+		{"", healthpb.HealthCheckResponse_SERVING, 0},
+		{"test.HealthService", healthpb.HealthCheckResponse_SERVING, 0},
+		{"score.ScoreService", 0, connect.CodeNotFound},
+	} {
+		resp, err := client.CallUnary(context.Background(), connect.NewRequest(&healthpb.HealthCheckRequest{Service: tc.service}))
+		if tc.code != 0 {
+			if connect.CodeOf(err) != tc.code {
+				t.Errorf("%q: got %v, want %s", tc.service, err, tc.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Msg.Status != tc.status {
+			t.Errorf("%q: got %s, want %s", tc.service, resp.Msg.Status, tc.status)
+		}
+	}
+
+	absCtx.CommonServer.accepting.Store(false)
+	resp, err := client.CallUnary(context.Background(), connect.NewRequest(&healthpb.HealthCheckRequest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Msg.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("got %s while draining, want NOT_SERVING", resp.Msg.Status)
+	}
+}
+
+func TestGrpcHealthWatch(t *testing.T) {
+	prev := healthWatchInterval
+	healthWatchInterval = 10 * time.Millisecond
+	t.Cleanup(func() { healthWatchInterval = prev })
+
+	absCtx, server := newTestHealthServer(t)
+	client := connect.NewClient[healthpb.HealthCheckRequest, healthpb.HealthCheckResponse](
+		http.DefaultClient, server.URL+"/grpc.health.v1.Health/Watch")
+
+	watch := func(service string) *connect.ServerStreamForClient[healthpb.HealthCheckResponse] {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		t.Cleanup(cancel)
+		stream, err := client.CallServerStream(ctx, connect.NewRequest(&healthpb.HealthCheckRequest{Service: service}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { stream.Close() })
+		return stream
+	}
+	next := func(stream *connect.ServerStreamForClient[healthpb.HealthCheckResponse]) healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		if !stream.Receive() {
+			t.Fatalf("stream ended: %v", stream.Err())
+		}
+		return stream.Msg().Status
+	}
+
+	// Unknown services stay open in case they show up
+	if status := next(watch("score.ScoreService")); status != healthpb.HealthCheckResponse_SERVICE_UNKNOWN {
+		t.Errorf("got %s for an unknown service, want SERVICE_UNKNOWN", status)
+	}
+
+	stream := watch("")
+	if status := next(stream); status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("got %s, want SERVING", status)
+	}
+	// Only changes are sent, so the next one is from draining
+	absCtx.CommonServer.accepting.Store(false)
+	if status := next(stream); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("got %s while draining, want NOT_SERVING", status)
+	}
+}
@@ -0,0 +1,401 @@
+// Network impairment, for latency experiments on one machine. IMPAIRMENT_FILE
+// points at a JSON file like
+//
+//	{
+//	  "dispatch": {
+//	    "score": {"delay": "40ms", "jitter": "5ms", "loss": 0.01, "bandwidth_kbps": 1000},
+//	    "*": {"delay": "1ms"}
+//	  },
+//	  "webtransport": {
+//	    "GameEngine": {"delay": "30ms", "jitter": "10ms"}
+//	  }
+//	}
+//
+// dispatch is keyed by the service being called, webtransport by the service
+// serving the session, and "*" is for everything not listed. The file is
+// reread when it changes.
+//
+// delay and jitter are one way, so a Dispatch call pays them going out and
+// coming back. Jitter is uniform in [-jitter, jitter]. bandwidth_kbps caps
+// each direction of each service's link, and messages queue behind each other
+// for it. gRPC and WebTransport streams are reliable, so a lost message isn't
+// gone, it shows up late: loss is the chance a message waits an extra
+// retransmit (default two delays). fail is the chance a Dispatch call fails
+// outright with Unavailable, for trying out retries and the circuit breaker.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type impairmentJson struct {
+	Delay         string  `json:"delay"`
+	Jitter        string  `json:"jitter"`
+	Loss          float64 `json:"loss"`
+	Retransmit    string  `json:"retransmit"`
+	BandwidthKbps float64 `json:"bandwidth_kbps"`
+	Fail          float64 `json:"fail"`
+}
+
+type impairment struct {
+	delay      time.Duration
+	jitter     time.Duration
+	loss       float64
+	retransmit time.Duration
+	// Bytes per second, 0 is unlimited
+	bandwidth float64
+	fail      float64
+}
+
+type impairmentCfg struct {
+	dispatch     map[string]*impairment
+	webTransport map[string]*impairment
+}
+
+// One direction of one service's link
+type impairedLink struct {
+	// When everything already sent will have gone through the bandwidth cap
+	busyUntil time.Time
+	// When the last message gets to the other side. Streams arrive in order,
+	// so nothing after it can arrive sooner.
+	lastArrival time.Time
+}
+
+type impairments struct {
+	path  string
+	cfg   atomic.Pointer[impairmentCfg]
+	lock  sync.Mutex
+	links map[string]*impairedLink
+}
+
+// How often IMPAIRMENT_FILE is checked for changes
+const impairmentPoll = time.Second
+
+// nil when IMPAIRMENT_FILE isn't set, which impairs nothing
+var impairer = impairmentSetup()
+
+func impairmentSetup() *impairments {
+	path := commondata.GetEnv("IMPAIRMENT_FILE", "")
+	if path == "" {
+		return nil
+	}
+
+	imp := &impairments{path: path, links: make(map[string]*impairedLink)}
+	cfg, err := loadImpairments(path)
+	if err != nil {
+		log.Fatalf("IMPAIRMENT_FILE is invalid: %s\n", err)
+	}
+	imp.cfg.Store(cfg)
+	log.Printf("(CAL) Impairing the network as %s says\n", path)
+
+	go imp.watch()
+	return imp
+}
+
+func loadImpairments(path string) (*impairmentCfg, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Dispatch     map[string]impairmentJson `json:"dispatch"`
+		WebTransport map[string]impairmentJson `json:"webtransport"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	cfg := &impairmentCfg{
+		dispatch:     make(map[string]*impairment),
+		webTransport: make(map[string]*impairment),
+	}
+	for section, entries := range map[string]map[string]impairmentJson{"dispatch": raw.Dispatch, "webtransport": raw.WebTransport} {
+		for svcName, entry := range entries {
+			imp, err := entry.parse()
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", section, svcName, err)
+			}
+			if section == "dispatch" {
+				cfg.dispatch[svcName] = imp
+			} else {
+				cfg.webTransport[svcName] = imp
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func (entry impairmentJson) parse() (*impairment, error) {
+	imp := &impairment{
+		loss:      entry.Loss,
+		bandwidth: entry.BandwidthKbps * 1000 / 8,
+		fail:      entry.Fail,
+	}
+	durations := []struct {
+		name  string
+		value string
+		out   *time.Duration
+	}{
+		{"delay", entry.Delay, &imp.delay},
+		{"jitter", entry.Jitter, &imp.jitter},
+		{"retransmit", entry.Retransmit, &imp.retransmit},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		var err error
+		if *d.out, err = time.ParseDuration(d.value); err != nil {
+			return nil, fmt.Errorf("%s: %w", d.name, err)
+		}
+	}
+	if entry.Retransmit == "" {
+		imp.retransmit = 2 * imp.delay
+	}
+	if imp.loss < 0 || imp.loss > 1 || imp.fail < 0 || imp.fail > 1 {
+		return nil, fmt.Errorf("loss and fail have to be between 0 and 1")
+	}
+	return imp, nil
+}
+
+func (imp *impairments) watch() {
+	var lastMod time.Time
+	if info, err := os.Stat(imp.path); err == nil {
+		lastMod = info.ModTime()
+	}
+	for range time.Tick(impairmentPoll) {
+		info, err := os.Stat(imp.path)
+		if err != nil || info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+
+		cfg, err := loadImpairments(imp.path)
+		if err != nil {
+			// Keep the old one rather than suddenly impairing nothing
+			log.Printf("(CAL) Not reloading IMPAIRMENT_FILE: %s\n", err)
+			continue
+		}
+		imp.cfg.Store(cfg)
+		log.Printf("(CAL) Reloaded %s\n", imp.path)
+	}
+}
+
+func lookupImpairment(rules map[string]*impairment, svcName string) *impairment {
+	if rule, ok := rules[svcName]; ok {
+		return rule
+	}
+	return rules["*"]
+}
+
+func (imp *impairments) link(name string) *impairedLink {
+	imp.lock.Lock()
+	defer imp.lock.Unlock()
+
+	state, ok := imp.links[name]
+	if !ok {
+		state = &impairedLink{}
+		imp.links[name] = state
+	}
+	return state
+}
+
+// When a message of size bytes sent now on link gets to the other side
+func (imp *impairments) arrival(state *impairedLink, rule *impairment, size int) time.Time {
+	now := time.Now()
+
+	latency := rule.delay
+	if rule.jitter > 0 {
+		latency += time.Duration(rand.Int64N(int64(2*rule.jitter)+1)) - rule.jitter
+	}
+	if rule.loss > 0 && rand.Float64() < rule.loss {
+		latency += rule.retransmit
+	}
+	latency = max(latency, 0)
+
+	imp.lock.Lock()
+	defer imp.lock.Unlock()
+
+	sent := now
+	if rule.bandwidth > 0 {
+		if state.busyUntil.After(sent) {
+			sent = state.busyUntil
+		}
+		sent = sent.Add(time.Duration(float64(size) / rule.bandwidth * float64(time.Second)))
+		state.busyUntil = sent
+	}
+
+	arrival := sent.Add(latency)
+	if arrival.Before(state.lastArrival) {
+		arrival = state.lastArrival
+	}
+	state.lastArrival = arrival
+	return arrival
+}
+
+func sleepUntil(ctx context.Context, until time.Time) error {
+	wait := time.Until(until)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func messageSize(msg any) int {
+	if pm, ok := msg.(proto.Message); ok {
+		return proto.Size(pm)
+	}
+	return 0
+}
+
+// Holds a Dispatch request to svcName up like the network would, or fails it
+func (imp *impairments) dispatchRequest(ctx context.Context, svcName string, req any) error {
+	if imp == nil {
+		return nil
+	}
+	rule := lookupImpairment(imp.cfg.Load().dispatch, svcName)
+	if rule == nil {
+		return nil
+	}
+	if rule.fail > 0 && rand.Float64() < rule.fail {
+		return status.Errorf(codes.Unavailable, "impaired: call to %s dropped", svcName)
+	}
+	return sleepUntil(ctx, imp.arrival(imp.link(svcName+" request"), rule, messageSize(req)))
+}
+
+// Holds the response from svcName up on its way back
+func (imp *impairments) dispatchResponse(ctx context.Context, svcName string, resp any) error {
+	if imp == nil {
+		return nil
+	}
+	rule := lookupImpairment(imp.cfg.Load().dispatch, svcName)
+	if rule == nil {
+		return nil
+	}
+	return sleepUntil(ctx, imp.arrival(imp.link(svcName+" response"), rule, messageSize(resp)))
+}
+
+// Writes to a WebTransport stream that get to the other side late. Writes
+// return right away and go out in order from their own goroutine, so the game
+// loop never waits on the impairment. Closing waits for whatever is still
+// queued to go out before it closes the stream.
+type impairedWriter struct {
+	svcName string
+	w       io.WriteCloser
+	// Guarded by impairer.lock
+	link impairedLink
+
+	lock    sync.Mutex
+	pending []impairedWrite
+	running bool
+	closed  bool
+	err     error
+}
+
+type impairedWrite struct {
+	data    []byte
+	arrival time.Time
+}
+
+// Wraps a WebTransport stream for svcName. Without IMPAIRMENT_FILE it's just w.
+func impairWriter(svcName string, w io.WriteCloser) io.WriteCloser {
+	if impairer == nil {
+		return w
+	}
+	return &impairedWriter{svcName: svcName, w: w}
+}
+
+func (iw *impairedWriter) Write(p []byte) (int, error) {
+	rule := lookupImpairment(impairer.cfg.Load().webTransport, iw.svcName)
+
+	iw.lock.Lock()
+	defer iw.lock.Unlock()
+
+	if iw.err != nil {
+		return 0, iw.err
+	}
+	if iw.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if rule == nil && !iw.running {
+		// Nothing queued to stay behind
+		return iw.w.Write(p)
+	}
+
+	arrival := time.Now()
+	if rule != nil {
+		arrival = impairer.arrival(&iw.link, rule, len(p))
+	}
+	// bufio reuses p
+	iw.pending = append(iw.pending, impairedWrite{data: append([]byte(nil), p...), arrival: arrival})
+	if !iw.running {
+		iw.running = true
+		go iw.drain()
+	}
+	return len(p), nil
+}
+
+// Close returns right away. The stream is closed once the queue is empty,
+// so a stream can be closed straight after its last frame.
+func (iw *impairedWriter) Close() error {
+	iw.lock.Lock()
+	defer iw.lock.Unlock()
+
+	if iw.closed {
+		return nil
+	}
+	iw.closed = true
+	if iw.running {
+		// drain closes it
+		return nil
+	}
+	return iw.w.Close()
+}
+
+func (iw *impairedWriter) drain() {
+	for {
+		iw.lock.Lock()
+		if len(iw.pending) == 0 || iw.err != nil {
+			iw.pending = nil
+			iw.running = false
+			closed := iw.closed
+			iw.lock.Unlock()
+			if closed {
+				iw.w.Close()
+			}
+			return
+		}
+		next := iw.pending[0]
+		iw.pending = iw.pending[1:]
+		iw.lock.Unlock()
+
+		sleepUntil(context.Background(), next.arrival)
+		if _, err := iw.w.Write(next.data); err != nil {
+			iw.lock.Lock()
+			iw.err = err
+			iw.lock.Unlock()
+		}
+	}
+}
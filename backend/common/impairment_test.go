@@ -0,0 +1,193 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestImpairmentParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   impairmentJson
+		want    impairment
+		wantErr bool
+	}{
+		{"retransmit defaults to two delays", impairmentJson{Delay: "40ms", Loss: 0.1},
+			impairment{delay: 40 * time.Millisecond, loss: 0.1, retransmit: 80 * time.Millisecond}, false},
+		{"retransmit set", impairmentJson{Delay: "40ms", Retransmit: "5ms"},
+			impairment{delay: 40 * time.Millisecond, retransmit: 5 * time.Millisecond}, false},
+		{"kbps to bytes", impairmentJson{BandwidthKbps: 8}, impairment{bandwidth: 1000}, false},
+		{"bad delay", impairmentJson{Delay: "soon"}, impairment{}, true},
+		{"loss over 1", impairmentJson{Loss: 1.5}, impairment{}, true},
+		{"negative fail", impairmentJson{Fail: -0.1}, impairment{}, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.entry.parse()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if err == nil && *got != tc.want {
+				t.Errorf("got %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestArrival(t *testing.T) {
+	imp := &impairments{links: make(map[string]*impairedLink)}
+
+	t.Run("delay", func(t *testing.T) {
+		rule := &impairment{delay: time.Second}
+		before := time.Now()
+		arrival := imp.arrival(&impairedLink{}, rule, 100)
+		if arrival.Before(before.Add(time.Second)) || arrival.After(time.Now().Add(time.Second)) {
+			t.Errorf("arrived %s after sending, want 1s", arrival.Sub(before))
+		}
+	})
+
+	t.Run("jitter stays in range", func(t *testing.T) {
+		rule := &impairment{delay: time.Second, jitter: 100 * time.Millisecond}
+		for range 100 {
+			before := time.Now()
+			// A fresh link each time, so ordering doesn't hold anything back
+			arrival := imp.arrival(&impairedLink{}, rule, 100)
+			if arrival.Before(before.Add(900*time.Millisecond)) || arrival.After(time.Now().Add(1100*time.Millisecond)) {
+				t.Fatalf("arrived %s after sending, want 1s±100ms", arrival.Sub(before))
+			}
+		}
+	})
+
+	t.Run("jitter never reorders", func(t *testing.T) {
+		rule := &impairment{delay: 10 * time.Millisecond, jitter: 10 * time.Millisecond}
+		link := &impairedLink{}
+		last := time.Time{}
+		for range 100 {
+			arrival := imp.arrival(link, rule, 100)
+			if arrival.Before(last) {
+				t.Fatalf("arrived at %s, before the last message at %s", arrival, last)
+			}
+			last = arrival
+		}
+	})
+
+	t.Run("loss waits a retransmit", func(t *testing.T) {
+		rule := &impairment{delay: time.Second, loss: 1, retransmit: 2 * time.Second}
+		before := time.Now()
+		if arrival := imp.arrival(&impairedLink{}, rule, 100); arrival.Before(before.Add(3 * time.Second)) {
+			t.Errorf("arrived %s after sending, want 3s", arrival.Sub(before))
+		}
+	})
+
+	t.Run("bandwidth queues", func(t *testing.T) {
+		// 1000 bytes a second, so each message takes a second to send
+		rule := &impairment{delay: 50 * time.Millisecond, bandwidth: 1000}
+		link := &impairedLink{}
+		before := time.Now()
+		first := imp.arrival(link, rule, 1000)
+		second := imp.arrival(link, rule, 1000)
+		if first.Before(before.Add(1050 * time.Millisecond)) {
+			t.Errorf("first arrived %s after sending, want 1.05s", first.Sub(before))
+		}
+		if gap := second.Sub(first); gap != time.Second {
+			t.Errorf("second arrived %s after the first, want 1s", gap)
+		}
+	})
+}
+
+// A WebTransport stream that remembers what went through it
+type testStream struct {
+	lock   sync.Mutex
+	writes []string
+	// What had been written by the time it was closed
+	atClose []string
+	closed  chan struct{}
+}
+
+func newTestStream() *testStream {
+	return &testStream{closed: make(chan struct{})}
+}
+
+func (stream *testStream) Write(p []byte) (int, error) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.writes = append(stream.writes, string(p))
+	return len(p), nil
+}
+
+func (stream *testStream) Close() error {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.atClose = slices.Clone(stream.writes)
+	close(stream.closed)
+	return nil
+}
+
+// Impairs WebTransport streams by service, like the webtransport section of IMPAIRMENT_FILE
+func withImpairment(t *testing.T, webTransport map[string]*impairment) {
+	old := impairer
+	imp := &impairments{links: make(map[string]*impairedLink)}
+	imp.cfg.Store(&impairmentCfg{dispatch: map[string]*impairment{}, webTransport: webTransport})
+	impairer = imp
+	t.Cleanup(func() { impairer = old })
+}
+
+func TestImpairedWriterCloseSendsPending(t *testing.T) {
+	withImpairment(t, map[string]*impairment{"GameEngine": {delay: 50 * time.Millisecond}})
+
+	stream := newTestStream()
+	w := impairWriter("GameEngine", stream)
+	for _, frame := range []string{"frame", "game over"} {
+		if _, err := w.Write([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Like the engine hanging up right after the last frame
+	start := time.Now()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 25*time.Millisecond {
+		t.Errorf("Close took %s, it shouldn't wait on the impairment", time.Since(start))
+	}
+	if _, err := w.Write([]byte("late")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("write after close got %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	select {
+	case <-stream.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream never closed")
+	}
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if want := []string{"frame", "game over"}; !slices.Equal(stream.atClose, want) {
+		t.Errorf("stream had %q when it closed, want %q", stream.atClose, want)
+	}
+}
+
+func TestImpairedWriterCloseWithNothingQueued(t *testing.T) {
+	// Impairment is on, but not for this service
+	withImpairment(t, map[string]*impairment{"GameEngine": {delay: 50 * time.Millisecond}})
+
+	stream := newTestStream()
+	w := impairWriter("MusicService", stream)
+	if _, err := w.Write([]byte("frame")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	select {
+	case <-stream.closed:
+	default:
+		t.Fatal("stream wasn't closed straight away")
+	}
+	if !slices.Equal(stream.atClose, []string{"frame"}) {
+		t.Errorf("stream had %q when it closed", stream.atClose)
+	}
+}
@@ -0,0 +1,46 @@
+package common
+
+// What the CAL reports on /metrics. Services register their own with
+// promauto, like the engine's frame timing.
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Seconds, from half a millisecond (a call within the monolith) to 10s (a
+// call that's about to time out)
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	dispatchLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "flappy_dispatch_duration_seconds",
+		Help:    "How long Dispatch calls took, by the verb that made the call and the verb called.",
+		Buckets: latencyBuckets,
+	}, []string{"src_verb", "dest_verb"})
+
+	webTransportSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "flappy_webtransport_sessions",
+		Help: "WebTransport sessions open right now.",
+	})
+
+	jwtChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "flappy_jwt_checks_total",
+		Help: "JWTs checked on incoming requests and sessions, by whether they were valid.",
+	}, []string{"result"})
+)
+
+func authResult(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "failure"
+}
+
+func (absCtx *AbstractionServer) mountMetrics() {
+	absCtx.CommonServer.mux.Handle("/metrics", promhttp.Handler())
+	log.Printf("(CALServer) Serving metrics at /metrics\n")
+}
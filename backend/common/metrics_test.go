@@ -0,0 +1,107 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/yuv418/cs553project/backend/commondata"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Scrapes /metrics and parses it the way Prometheus would
+func scrapeMetrics(t *testing.T, url string) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatalf("Prometheus can't parse /metrics: %s", err)
+	}
+	return families
+}
+
+func labelsOf(m *dto.Metric) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range m.GetLabel() {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labels
+}
+
+func TestMetrics(t *testing.T) {
+	AbsCtx.mountMetrics()
+	server := httptest.NewServer(AbsCtx.CommonServer.mux)
+	defer server.Close()
+
+	insertTestVerb(t, "MetricsVerb", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		return &emptypb.Empty{}, nil
+	})
+	if err := dispatchTest("MetricsVerb", "x"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := AbsCtx.CommonServer.Cfg.ServiceJwt("test", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExtractVerifyJwt(AbsCtx.CommonServer, token)
+	ExtractVerifyJwt(AbsCtx.CommonServer, "nope")
+
+	families := scrapeMetrics(t, server.URL)
+
+	t.Run("dispatch latency", func(t *testing.T) {
+		family := families["flappy_dispatch_duration_seconds"]
+		if family.GetType() != dto.MetricType_HISTOGRAM {
+			t.Fatalf("got %s", family.GetType())
+		}
+		var found *dto.Histogram
+		for _, m := range family.GetMetric() {
+			if labelsOf(m)["dest_verb"] == "MetricsVerb" {
+				found = m.GetHistogram()
+			}
+		}
+		if found == nil {
+			t.Fatal("no series for MetricsVerb")
+		}
+		if found.GetSampleCount() != 1 {
+			t.Errorf("got %d calls, want 1", found.GetSampleCount())
+		}
+		// The parser adds +Inf back
+		if len(found.GetBucket()) != len(latencyBuckets)+1 {
+			t.Errorf("got %d buckets, want %d", len(found.GetBucket()), len(latencyBuckets)+1)
+		}
+	})
+
+	t.Run("jwt checks", func(t *testing.T) {
+		family := families["flappy_jwt_checks_total"]
+		if family.GetType() != dto.MetricType_COUNTER {
+			t.Fatalf("got %s", family.GetType())
+		}
+		results := make(map[string]float64)
+		for _, m := range family.GetMetric() {
+			results[labelsOf(m)["result"]] = m.GetCounter().GetValue()
+		}
+		if results["success"] < 1 || results["failure"] < 1 {
+			t.Errorf("got %v, want a success and a failure", results)
+		}
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		family := families["flappy_webtransport_sessions"]
+		if family.GetType() != dto.MetricType_GAUGE {
+			t.Fatalf("got %s", family.GetType())
+		}
+		if got := family.GetMetric()[0].GetGauge().GetValue(); got != 0 {
+			t.Errorf("got %f open sessions, want 0", got)
+		}
+	})
+}
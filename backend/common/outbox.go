@@ -0,0 +1,498 @@
+// The outbox sends fire and forget calls in the background so the caller (the
+// engine's tick loop, mostly) never waits on them. Calls for the same game go
+// out in the order they were queued. Durable verbs are written to OUTBOX_DIR
+// first, so they survive a restart and get sent when we come back up. The
+// caller's JWT isn't kept, calls go out with a service token made when
+// they're sent (see ServiceJwt).
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuv418/cs553project/backend/commondata"
+	"google.golang.org/protobuf/proto"
+)
+
+type OutboxOptions struct {
+	// Write the call to disk until it's delivered
+	Durable bool
+	// Give up after this many tries. 0 keeps trying until it works or the
+	// other side rejects it.
+	MaxAttempts int
+}
+
+type outboxVerb struct {
+	opts    OutboxOptions
+	deliver func(ctx *commondata.ReqCtx, payload []byte) error
+}
+
+// What gets written to disk
+type outboxRecord struct {
+	Seq      uint64
+	Verb     string
+	GameId   string
+	Username string
+	SrcName  string
+	SrcVerb  string
+	Payload  []byte
+	QueuedAt time.Time
+	// So the call shows up in the trace of whatever queued it
+	TraceParent string `json:",omitempty"`
+
+	attempts int
+}
+
+// Calls for one game, oldest first
+type outboxGame struct {
+	records []*outboxRecord
+	// Set while a goroutine is sending this game's calls
+	sending bool
+	// Held by Enqueue from taking a seq until the call is queued. The engine
+	// queues from the tick loop and from HandleInput, and a durable call can
+	// take a while to write, so without this a game's calls could be queued
+	// out of seq order.
+	enqueueLock sync.Mutex
+	// Enqueue calls holding or waiting on enqueueLock. The game is kept
+	// around until they're done, even with nothing queued.
+	enqueuing int
+}
+
+type Outbox struct {
+	lock    sync.Mutex
+	dir     string
+	verbs   map[string]*outboxVerb
+	games   map[string]*outboxGame
+	nextSeq uint64
+	started bool
+
+	delivered uint64
+	retried   uint64
+	dropped   uint64
+}
+
+type OutboxMetrics struct {
+	Pending       int
+	PendingByVerb map[string]int
+	// Games with something still waiting
+	Games     int
+	OldestAge time.Duration
+	Delivered uint64
+	Retried   uint64
+	Dropped   uint64
+}
+
+// Longest wait between tries of the same call
+const outboxMaxBackoff = 30 * time.Second
+
+func newOutbox() *Outbox {
+	return &Outbox{
+		dir:   commondata.GetEnv("OUTBOX_DIR", "outbox"),
+		verbs: make(map[string]*outboxVerb),
+		games: make(map[string]*outboxGame),
+	}
+}
+
+// InsertOutboxVerb lets verb be queued with Enqueue. Do this before StartOutbox
+// so calls left over from last time can be sent.
+func InsertOutboxVerb[Req any, PtrReq interface {
+	proto.Message
+	*Req
+}, Resp any](absCtx *AbstractionServer, verb string, opts OutboxOptions) error {
+	action := absCtx.dispatchTable[verb]
+	if action == nil {
+		return fmt.Errorf("(CAL) %s isn't in the dispatch table", verb)
+	}
+
+	absCtx.outbox.lock.Lock()
+	defer absCtx.outbox.lock.Unlock()
+
+	absCtx.outbox.verbs[verb] = &outboxVerb{
+		opts: opts,
+		deliver: func(ctx *commondata.ReqCtx, payload []byte) error {
+			req := PtrReq(new(Req))
+			if err := proto.Unmarshal(payload, req); err != nil {
+				return err
+			}
+			_, err := dispatchOnce[Req, Resp](ctx, action, (*Req)(req))
+			return err
+		},
+	}
+	return nil
+}
+
+// StartOutbox picks up whatever was left on disk and starts sending it.
+func StartOutbox(absCtx *AbstractionServer) error {
+	outbox := absCtx.outbox
+
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+
+	if err := os.MkdirAll(outbox.dir, 0755); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(outbox.dir)
+	if err != nil {
+		return err
+	}
+
+	var records []*outboxRecord
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(outbox.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		record := &outboxRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			// Probably cut off by a crash while writing, it never got queued
+			log.Printf("(CAL Outbox) Removing unreadable %s: %s\n", path, err)
+			os.Remove(path)
+			continue
+		}
+		if outbox.verbs[record.Verb] == nil {
+			log.Printf("(CAL Outbox) Skipping %s, nothing here sends %s\n", path, record.Verb)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+	for _, record := range records {
+		outbox.nextSeq = max(outbox.nextSeq, record.Seq+1)
+		outbox.push(record)
+	}
+	if len(records) > 0 {
+		log.Printf("(CAL Outbox) Picked up %d calls from %s\n", len(records), outbox.dir)
+	}
+
+	outbox.started = true
+	for gameId := range outbox.games {
+		outbox.startSending(gameId)
+	}
+
+	go outbox.logBacklog()
+	OnShutdown("outbox", outbox.flush)
+
+	return nil
+}
+
+// Enqueue queues a call to verb and returns right away. The response is thrown out.
+func Enqueue(ctx *commondata.ReqCtx, verb string, req proto.Message) error {
+	outbox := AbsCtx.outbox
+
+	payload, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	outbox.lock.Lock()
+	if !outbox.started {
+		outbox.lock.Unlock()
+		return fmt.Errorf("(CAL Outbox) outbox isn't running")
+	}
+	outboxVerb := outbox.verbs[verb]
+	if outboxVerb == nil {
+		outbox.lock.Unlock()
+		return fmt.Errorf("(CAL Outbox) %s can't be queued", verb)
+	}
+	game := outbox.game(ctx.GameId)
+	game.enqueuing++
+	outbox.lock.Unlock()
+
+	// Other games don't wait on our fsync, only this game's next call does
+	game.enqueueLock.Lock()
+	defer game.enqueueLock.Unlock()
+
+	outbox.lock.Lock()
+	record := &outboxRecord{
+		Seq:      outbox.nextSeq,
+		Verb:     verb,
+		GameId:   ctx.GameId,
+		Username: ctx.Username,
+		SrcName:  ctx.TargetSvcName,
+		SrcVerb:  ctx.TargetSvcVerb,
+		Payload:  payload,
+		QueuedAt: time.Now(),
+
+		TraceParent: ctx.TraceParent,
+	}
+	outbox.nextSeq++
+	outbox.lock.Unlock()
+
+	if outboxVerb.opts.Durable {
+		err = outbox.write(record)
+	}
+
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+
+	game.enqueuing--
+	if err != nil {
+		outbox.forgetIfDone(record.GameId, game)
+		return err
+	}
+	game.records = append(game.records, record)
+	outbox.startSending(record.GameId)
+
+	return nil
+}
+
+func (outbox *Outbox) recordPath(record *outboxRecord) string {
+	return filepath.Join(outbox.dir, fmt.Sprintf("%020d.json", record.Seq))
+}
+
+// Written to a temp file first so a crash can't leave half a record behind
+func (outbox *Outbox) write(record *outboxRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	path := outbox.recordPath(record)
+	tmp, err := os.CreateTemp(outbox.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Must hold the outbox lock
+func (outbox *Outbox) game(gameId string) *outboxGame {
+	game := outbox.games[gameId]
+	if game == nil {
+		game = &outboxGame{}
+		outbox.games[gameId] = game
+	}
+	return game
+}
+
+// Must hold the outbox lock
+func (outbox *Outbox) push(record *outboxRecord) {
+	game := outbox.game(record.GameId)
+	game.records = append(game.records, record)
+}
+
+// Must hold the outbox lock
+func (outbox *Outbox) forgetIfDone(gameId string, game *outboxGame) {
+	if len(game.records) == 0 && !game.sending && game.enqueuing == 0 {
+		delete(outbox.games, gameId)
+	}
+}
+
+// Must hold the outbox lock
+func (outbox *Outbox) startSending(gameId string) {
+	game := outbox.games[gameId]
+	if game == nil || game.sending || len(game.records) == 0 {
+		return
+	}
+	game.sending = true
+	go outbox.send(gameId, game)
+}
+
+// Sends one game's calls in order until there aren't any left.
+func (outbox *Outbox) send(gameId string, game *outboxGame) {
+	backoff := DefaultRetry.Backoff
+
+	for {
+		outbox.lock.Lock()
+		if len(game.records) == 0 {
+			game.sending = false
+			outbox.forgetIfDone(gameId, game)
+			outbox.lock.Unlock()
+			return
+		}
+		record := game.records[0]
+		outboxVerb := outbox.verbs[record.Verb]
+		outbox.lock.Unlock()
+
+		action := AbsCtx.dispatchTable[record.Verb]
+		breaker := AbsCtx.serviceData[action.svcName].breaker
+
+		var err error
+		if breaker.allow() {
+			var jwt string
+			jwt, err = AbsCtx.CommonServer.Cfg.ServiceJwt(record.SrcName, record.Username)
+			if err == nil {
+				err = outboxVerb.deliver(&commondata.ReqCtx{
+					Username:      record.Username,
+					Jwt:           jwt,
+					GameId:        record.GameId,
+					TargetSvcName: record.SrcName,
+					TargetSvcVerb: record.SrcVerb,
+					TraceParent:   record.TraceParent,
+				}, record.Payload)
+			}
+			breaker.record(err)
+		} else {
+			err = breaker.openError()
+		}
+		record.attempts++
+
+		giveUp := outboxVerb.opts.MaxAttempts > 0 && record.attempts >= outboxVerb.opts.MaxAttempts
+		if isTransient(err) && !giveUp {
+			outbox.lock.Lock()
+			outbox.retried++
+			outbox.lock.Unlock()
+
+			log.Printf("(CAL Outbox) %s for game %s failed with %s, trying again in %s\n", record.Verb, gameId, err, backoff)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, outboxMaxBackoff)
+			continue
+		}
+		backoff = DefaultRetry.Backoff
+
+		outbox.lock.Lock()
+		if err != nil {
+			outbox.dropped++
+			log.Printf("(CAL Outbox) Dropping %s for game %s after %d tries: %s\n", record.Verb, gameId, record.attempts, err)
+		} else {
+			outbox.delivered++
+		}
+		game.records = game.records[1:]
+		outbox.lock.Unlock()
+
+		if outboxVerb.opts.Durable {
+			if err := os.Remove(outbox.recordPath(record)); err != nil {
+				log.Printf("(CAL Outbox) Couldn't remove %s: %s\n", outbox.recordPath(record), err)
+			}
+		}
+	}
+}
+
+// Waits for everything queued to go out. Durable calls that don't make it are
+// still on disk for next time, anything else is lost.
+func (outbox *Outbox) flush(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		metrics := OutboxBacklog(AbsCtx)
+		if metrics.Pending == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d calls didn't go out (%v)", metrics.Pending, metrics.PendingByVerb)
+		}
+	}
+}
+
+func OutboxBacklog(absCtx *AbstractionServer) OutboxMetrics {
+	outbox := absCtx.outbox
+
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+
+	metrics := OutboxMetrics{
+		PendingByVerb: make(map[string]int),
+		Delivered:     outbox.delivered,
+		Retried:       outbox.retried,
+		Dropped:       outbox.dropped,
+	}
+	for _, game := range outbox.games {
+		if len(game.records) == 0 {
+			continue
+		}
+		metrics.Games++
+		metrics.Pending += len(game.records)
+		for _, record := range game.records {
+			metrics.PendingByVerb[record.Verb]++
+		}
+		metrics.OldestAge = max(metrics.OldestAge, time.Since(game.records[0].QueuedAt))
+	}
+	return metrics
+}
+
+var (
+	outboxPendingDesc = prometheus.NewDesc("flappy_outbox_pending",
+		"Fire and forget calls waiting in the outbox, by verb.", []string{"verb"}, nil)
+	outboxOldestDesc = prometheus.NewDesc("flappy_outbox_oldest_seconds",
+		"How long the oldest call in the outbox has been waiting.", nil, nil)
+	outboxDoneDesc = prometheus.NewDesc("flappy_outbox_calls_total",
+		"Outbox calls that are done, by whether they were delivered or dropped.", []string{"result"}, nil)
+	outboxRetriesDesc = prometheus.NewDesc("flappy_outbox_retries_total",
+		"Outbox calls that failed and were tried again.", nil, nil)
+)
+
+// Puts OutboxBacklog on /metrics
+type outboxCollector struct {
+	absCtx *AbstractionServer
+}
+
+func (collector outboxCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- outboxPendingDesc
+	ch <- outboxOldestDesc
+	ch <- outboxDoneDesc
+	ch <- outboxRetriesDesc
+}
+
+func (collector outboxCollector) Collect(ch chan<- prometheus.Metric) {
+	outbox := collector.absCtx.outbox
+	metrics := OutboxBacklog(collector.absCtx)
+
+	// Verbs with nothing waiting show up as 0 rather than not at all
+	outbox.lock.Lock()
+	for verb := range outbox.verbs {
+		if _, ok := metrics.PendingByVerb[verb]; !ok {
+			metrics.PendingByVerb[verb] = 0
+		}
+	}
+	outbox.lock.Unlock()
+
+	for verb, pending := range metrics.PendingByVerb {
+		ch <- prometheus.MustNewConstMetric(outboxPendingDesc, prometheus.GaugeValue, float64(pending), verb)
+	}
+	ch <- prometheus.MustNewConstMetric(outboxOldestDesc, prometheus.GaugeValue, metrics.OldestAge.Seconds())
+	ch <- prometheus.MustNewConstMetric(outboxDoneDesc, prometheus.CounterValue, float64(metrics.Delivered), "delivered")
+	ch <- prometheus.MustNewConstMetric(outboxDoneDesc, prometheus.CounterValue, float64(metrics.Dropped), "dropped")
+	ch <- prometheus.MustNewConstMetric(outboxRetriesDesc, prometheus.CounterValue, float64(metrics.Retried))
+}
+
+func init() {
+	prometheus.MustRegister(outboxCollector{absCtx: AbsCtx})
+}
+
+// So a growing backlog shows up in the logs
+func (outbox *Outbox) logBacklog() {
+	for range time.Tick(30 * time.Second) {
+		metrics := OutboxBacklog(AbsCtx)
+		if metrics.Pending == 0 {
+			continue
+		}
+		log.Printf("(CAL Outbox) %d calls waiting for %d games (%v), oldest is %s old. %d delivered, %d retried, %d dropped\n",
+			metrics.Pending, metrics.Games, metrics.PendingByVerb, metrics.OldestAge.Round(time.Second),
+			metrics.Delivered, metrics.Retried, metrics.Dropped)
+	}
+}
@@ -0,0 +1,412 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuv418/cs553project/backend/commondata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testHandler = func(*commondata.ReqCtx, *wrapperspb.StringValue) (*emptypb.Empty, error)
+
+// Adds verb to the dispatch table with fn as its handler, in a service of
+// its own so breakers don't carry over between tests
+func insertTestVerb(t *testing.T, verb string, fn testHandler) *Action {
+	t.Helper()
+
+	svcName := "test" + verb
+	if err := InsertDispatchTable(AbsCtx, svcName, verb); err != nil {
+		t.Fatal(err)
+	}
+	action := AbsCtx.dispatchTable[verb]
+	action.fn = fn
+	AbsCtx.serviceData[svcName] = AbstractionService{breaker: newCircuitBreaker(svcName)}
+
+	t.Cleanup(func() {
+		delete(AbsCtx.dispatchTable, verb)
+		delete(AbsCtx.serviceData, svcName)
+	})
+	return action
+}
+
+// Swaps in an outbox that writes to a temp dir
+func newTestOutbox(t *testing.T) *Outbox {
+	t.Helper()
+
+	outbox := newOutbox()
+	outbox.dir = t.TempDir()
+	prev := AbsCtx.outbox
+	AbsCtx.outbox = outbox
+	t.Cleanup(func() { AbsCtx.outbox = prev })
+	return outbox
+}
+
+func waitForOutbox(t *testing.T) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := AbsCtx.outbox.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Collects the values a test handler was called with
+type calls struct {
+	lock   sync.Mutex
+	values []string
+	ctxs   []*commondata.ReqCtx
+}
+
+func (c *calls) add(ctx *commondata.ReqCtx, value string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values = append(c.values, value)
+	c.ctxs = append(c.ctxs, ctx)
+}
+
+func (c *calls) get() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return slices.Clone(c.values)
+}
+
+func unavailable() error {
+	return connect.NewError(connect.CodeUnavailable, errors.New("down"))
+}
+
+func TestOutboxKeepsOrderThroughRetries(t *testing.T) {
+	newTestOutbox(t)
+
+	var got calls
+	failures := 2
+	insertTestVerb(t, "OutboxOrder", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		// The first call fails a couple of times, the rest have to wait for it
+		if req.Value == "0" && failures > 0 {
+			failures--
+			return nil, unavailable()
+		}
+		got.add(ctx, req.Value)
+		return &emptypb.Empty{}, nil
+	})
+	if err := InsertOutboxVerb[wrapperspb.StringValue, *wrapperspb.StringValue, emptypb.Empty](AbsCtx, "OutboxOrder", OutboxOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartOutbox(AbsCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &commondata.ReqCtx{GameId: "game", Username: "alice", TargetSvcName: "gameEngine"}
+	for _, value := range []string{"0", "1", "2", "3"} {
+		if err := Enqueue(ctx, "OutboxOrder", wrapperspb.String(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForOutbox(t)
+
+	if want := []string{"0", "1", "2", "3"}; !slices.Equal(got.get(), want) {
+		t.Errorf("delivered %v, want %v", got.get(), want)
+	}
+	metrics := OutboxBacklog(AbsCtx)
+	if metrics.Delivered != 4 || metrics.Retried != 2 || metrics.Dropped != 0 {
+		t.Errorf("delivered %d, retried %d, dropped %d, want 4, 2, 0", metrics.Delivered, metrics.Retried, metrics.Dropped)
+	}
+}
+
+func TestOutboxDropsRejectedCalls(t *testing.T) {
+	newTestOutbox(t)
+
+	var got calls
+	insertTestVerb(t, "OutboxReject", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		switch req.Value {
+		case "rejected":
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("no"))
+		case "down":
+			return nil, unavailable()
+		}
+		got.add(ctx, req.Value)
+		return &emptypb.Empty{}, nil
+	})
+	if err := InsertOutboxVerb[wrapperspb.StringValue, *wrapperspb.StringValue, emptypb.Empty](AbsCtx, "OutboxReject", OutboxOptions{MaxAttempts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartOutbox(AbsCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &commondata.ReqCtx{GameId: "game", TargetSvcName: "gameEngine"}
+	for _, value := range []string{"rejected", "down", "ok"} {
+		if err := Enqueue(ctx, "OutboxReject", wrapperspb.String(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForOutbox(t)
+
+	if want := []string{"ok"}; !slices.Equal(got.get(), want) {
+		t.Errorf("delivered %v, want %v", got.get(), want)
+	}
+	if dropped := OutboxBacklog(AbsCtx).Dropped; dropped != 2 {
+		t.Errorf("dropped %d, want 2", dropped)
+	}
+}
+
+// A service that's down only holds up the games with calls to it
+func TestOutboxDownServiceDoesntBlockOthers(t *testing.T) {
+	newTestOutbox(t)
+	withBreaker(t, 1, time.Minute)
+
+	var downCalls atomic.Int32
+	insertTestVerb(t, "OutboxDown", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		downCalls.Add(1)
+		return nil, unavailable()
+	})
+	var got calls
+	var pendingThen int
+	insertTestVerb(t, "OutboxUp", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		pendingThen = OutboxBacklog(AbsCtx).PendingByVerb["OutboxDown"]
+		got.add(ctx, req.Value)
+		return &emptypb.Empty{}, nil
+	})
+	for _, verb := range []string{"OutboxDown", "OutboxUp"} {
+		if err := InsertOutboxVerb[wrapperspb.StringValue, *wrapperspb.StringValue, emptypb.Empty](AbsCtx, verb, OutboxOptions{MaxAttempts: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := StartOutbox(AbsCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Enqueue(&commondata.ReqCtx{GameId: "stuck", TargetSvcName: "gameEngine"}, "OutboxDown", wrapperspb.String("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Enqueue(&commondata.ReqCtx{GameId: "fine", TargetSvcName: "gameEngine"}, "OutboxUp", wrapperspb.String("y")); err != nil {
+		t.Fatal(err)
+	}
+	waitForOutbox(t)
+
+	if want := []string{"y"}; !slices.Equal(got.get(), want) {
+		t.Errorf("delivered %v, want %v", got.get(), want)
+	}
+	if pendingThen != 1 {
+		t.Errorf("%d OutboxDown calls waiting when OutboxUp went out, want 1", pendingThen)
+	}
+	// The breaker opened after the first try, so the rest didn't reach it
+	if n := downCalls.Load(); n != 1 {
+		t.Errorf("down service was called %d times, want 1", n)
+	}
+}
+
+func TestOutboxPicksUpWhereItLeftOff(t *testing.T) {
+	outbox := newTestOutbox(t)
+
+	// What the last run left behind, written out of order
+	for _, seq := range []uint64{7, 3, 5} {
+		payload, err := proto.Marshal(wrapperspb.String(strings.Repeat("x", int(seq))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = outbox.write(&outboxRecord{
+			Seq:      seq,
+			Verb:     "OutboxRestart",
+			GameId:   "game",
+			Username: "alice",
+			SrcName:  "gameEngine",
+			SrcVerb:  "GameSession",
+			Payload:  payload,
+			QueuedAt: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Cut off by a crash
+	if err := os.WriteFile(filepath.Join(outbox.dir, "00000000000000000009.json"), []byte(`{"Seq": 9, "Ve`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got calls
+	insertTestVerb(t, "OutboxRestart", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		got.add(ctx, req.Value)
+		return &emptypb.Empty{}, nil
+	})
+	if err := InsertOutboxVerb[wrapperspb.StringValue, *wrapperspb.StringValue, emptypb.Empty](AbsCtx, "OutboxRestart", OutboxOptions{Durable: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartOutbox(AbsCtx); err != nil {
+		t.Fatal(err)
+	}
+	waitForOutbox(t)
+
+	if want := []string{"xxx", "xxxxx", "xxxxxxx"}; !slices.Equal(got.get(), want) {
+		t.Errorf("delivered %v, want %v", got.get(), want)
+	}
+	for _, ctx := range got.ctxs {
+		claims := AbsCtx.CommonServer.Cfg.ValidateJwt(ctx.Jwt)
+		if claims["service"] != "gameEngine" || claims["username"] != "alice" {
+			t.Errorf("sent with claims %v, want a gameEngine token for alice", claims)
+		}
+	}
+
+	eventually(t, "the outbox dir to empty", func() bool {
+		entries, err := os.ReadDir(outbox.dir)
+		return err == nil && len(entries) == 0
+	})
+
+	outbox.lock.Lock()
+	nextSeq := outbox.nextSeq
+	outbox.lock.Unlock()
+	if nextSeq != 8 {
+		t.Errorf("next seq is %d, want 8 so new calls go after the old ones", nextSeq)
+	}
+}
+
+func TestOutboxDoesntWriteJwt(t *testing.T) {
+	outbox := newTestOutbox(t)
+
+	release := make(chan struct{})
+	insertTestVerb(t, "OutboxJwt", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		<-release
+		return &emptypb.Empty{}, nil
+	})
+	if err := InsertOutboxVerb[wrapperspb.StringValue, *wrapperspb.StringValue, emptypb.Empty](AbsCtx, "OutboxJwt", OutboxOptions{Durable: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartOutbox(AbsCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &commondata.ReqCtx{GameId: "game", Username: "alice", Jwt: "users-own-token", TargetSvcName: "gameEngine"}
+	if err := Enqueue(ctx, "OutboxJwt", wrapperspb.String("x")); err != nil {
+		close(release)
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(outbox.dir)
+	if err != nil || len(entries) != 1 {
+		close(release)
+		t.Fatalf("want one record on disk, got %v (%v)", entries, err)
+	}
+	data, err := os.ReadFile(filepath.Join(outbox.dir, entries[0].Name()))
+	close(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "users-own-token") {
+		t.Errorf("record has the caller's JWT in it: %s", data)
+	}
+	waitForOutbox(t)
+}
+
+func TestOutboxQueuesInSeqOrderFromManyGoroutines(t *testing.T) {
+	outbox := newTestOutbox(t)
+
+	release := make(chan struct{})
+	insertTestVerb(t, "OutboxRace", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		<-release
+		return &emptypb.Empty{}, nil
+	})
+	if err := InsertOutboxVerb[wrapperspb.StringValue, *wrapperspb.StringValue, emptypb.Empty](AbsCtx, "OutboxRace", OutboxOptions{Durable: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartOutbox(AbsCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Like the tick loop and HandleInput queueing for the same game at once
+	ctx := &commondata.ReqCtx{GameId: "game", TargetSvcName: "gameEngine"}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go (func() {
+			defer wg.Done()
+			for range 5 {
+				if err := Enqueue(ctx, "OutboxRace", wrapperspb.String("x")); err != nil {
+					t.Error(err)
+				}
+			}
+		})()
+	}
+	wg.Wait()
+
+	outbox.lock.Lock()
+	var seqs []uint64
+	for _, record := range outbox.games["game"].records {
+		seqs = append(seqs, record.Seq)
+	}
+	outbox.lock.Unlock()
+	close(release)
+
+	if len(seqs) != 40 || !slices.IsSorted(seqs) {
+		t.Errorf("queued %v, want 40 calls in seq order", seqs)
+	}
+	waitForOutbox(t)
+}
+
+func TestOutboxOnMetrics(t *testing.T) {
+	newTestOutbox(t)
+
+	release := make(chan struct{})
+	insertTestVerb(t, "OutboxMetrics", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		<-release
+		return &emptypb.Empty{}, nil
+	})
+	if err := InsertOutboxVerb[wrapperspb.StringValue, *wrapperspb.StringValue, emptypb.Empty](AbsCtx, "OutboxMetrics", OutboxOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartOutbox(AbsCtx); err != nil {
+		t.Fatal(err)
+	}
+	for _, gameId := range []string{"a", "a", "b"} {
+		if err := Enqueue(&commondata.ReqCtx{GameId: gameId}, "OutboxMetrics", wrapperspb.String("x")); err != nil {
+			close(release)
+			t.Fatal(err)
+		}
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	close(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "flappy_outbox_pending" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if labelsOf(m)["verb"] == "OutboxMetrics" {
+				if got := m.GetGauge().GetValue(); got != 3 {
+					t.Errorf("got %f pending, want 3", got)
+				}
+				waitForOutbox(t)
+				return
+			}
+		}
+	}
+	t.Error("flappy_outbox_pending has nothing for OutboxMetrics")
+	waitForOutbox(t)
+}
@@ -0,0 +1,241 @@
+// What Dispatch does when a call fails. Retries, the circuit breaker and
+// fallbacks only kick in for errors that look like the other service is down
+// or slow, not for errors a handler returned on purpose.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/yuv418/cs553project/backend/commondata"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// What Dispatch does when a service is down and retries didn't help. Calls
+// that have to get there eventually go through the outbox instead (outbox.go).
+type Fallback int8
+
+const (
+	// Hand the error to the caller
+	FallbackNone Fallback = iota
+	// Pretend it worked. For things that are useless late, like sounds.
+	FallbackDrop
+)
+
+type Policy struct {
+	// Total tries, so 1 (or 0) means no retries. Only retry verbs that are
+	// safe to run twice, since a timed out call may have gone through anyway.
+	Attempts int
+	// Wait before the first retry, doubling every time up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Fallback   Fallback
+}
+
+// A reasonable policy for idempotent verbs
+var DefaultRetry = Policy{
+	Attempts:   3,
+	Backoff:    100 * time.Millisecond,
+	MaxBackoff: time.Second,
+}
+
+func SetDispatchPolicy(absCtx *AbstractionServer, verb string, policy Policy) error {
+	action := absCtx.dispatchTable[verb]
+	if action == nil {
+		return fmt.Errorf("(CAL) %s isn't in the dispatch table", verb)
+	}
+	action.policy = &policy
+	return nil
+}
+
+// A monolith call timed out, but its handler is still running in the
+// background. Trying again would run it twice at once.
+var errAbandoned = errors.New("handler still running")
+
+// Whether the error is about the call rather than the answer
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	// The caller gave up, trying again won't help
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	// gRPC errors for microservices, connect errors for the breaker and handlers
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	switch connect.CodeOf(err) {
+	case connect.CodeUnavailable, connect.CodeDeadlineExceeded, connect.CodeResourceExhausted, connect.CodeAborted:
+		return true
+	}
+	return false
+}
+
+func dispatchWithPolicy[Req any, Resp any](ctx *commondata.ReqCtx, action *Action, req *Req) (*Resp, error) {
+	policy := action.policy
+	if policy == nil {
+		policy = &Policy{}
+	}
+	breaker := AbsCtx.serviceData[action.svcName].breaker
+
+	var resp *Resp
+	var err error
+	backoff := policy.Backoff
+
+retry:
+	for attempt := 1; ; attempt++ {
+		if !breaker.allow() {
+			err = breaker.openError()
+			break
+		}
+
+		resp, err = dispatchOnce[Req, Resp](ctx, action, req)
+		breaker.record(err)
+		if err == nil {
+			return resp, nil
+		}
+
+		if attempt >= policy.Attempts || !isTransient(err) || errors.Is(err, errAbandoned) || ctx.Context().Err() != nil {
+			break
+		}
+
+		log.Printf("(CAL Dispatch) %s failed with %s, retrying in %s\n", action.verb, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Context().Done():
+			break retry
+		}
+		backoff = min(backoff*2, max(policy.MaxBackoff, policy.Backoff))
+	}
+
+	// Fallbacks are for the service being gone. If it answered, the caller
+	// should hear about it.
+	if !isTransient(err) {
+		return nil, err
+	}
+
+	switch policy.Fallback {
+	case FallbackDrop:
+		log.Printf("(CAL Dispatch) %s failed with %s, dropping it\n", action.verb, err)
+		return new(Resp), nil
+	default:
+		return nil, err
+	}
+}
+
+type breakerState int8
+
+const (
+	// Calls go through
+	breakerClosed breakerState = iota
+	// Calls fail right away until the cooldown is up
+	breakerOpen
+	// One call goes through to see if the service is back
+	breakerHalfOpen
+)
+
+// Consecutive failures before a service's breaker opens, and how long it stays open
+var breakerFailures, breakerCooldown = breakerSetup()
+
+func breakerSetup() (int, time.Duration) {
+	failures, err := strconv.Atoi(commondata.GetEnv("BREAKER_FAILURES", "5"))
+	if err != nil {
+		log.Fatalf("BREAKER_FAILURES is invalid: %s\n", err)
+	}
+	cooldown, err := time.ParseDuration(commondata.GetEnv("BREAKER_COOLDOWN", "10s"))
+	if err != nil {
+		log.Fatalf("BREAKER_COOLDOWN is invalid: %s\n", err)
+	}
+	return failures, cooldown
+}
+
+// One per service. A nil breaker lets everything through.
+type circuitBreaker struct {
+	svcName  string
+	lock     sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// Set while the half open call is out
+	probing bool
+}
+
+func newCircuitBreaker(svcName string) *circuitBreaker {
+	return &circuitBreaker{svcName: svcName}
+}
+
+func (breaker *circuitBreaker) allow() bool {
+	if breaker == nil || breakerFailures <= 0 {
+		return true
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	switch breaker.state {
+	case breakerOpen:
+		if time.Since(breaker.openedAt) < breakerCooldown {
+			return false
+		}
+		log.Printf("(CAL) Trying %s again\n", breaker.svcName)
+		breaker.state = breakerHalfOpen
+		breaker.probing = true
+		return true
+	case breakerHalfOpen:
+		if breaker.probing {
+			return false
+		}
+		breaker.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (breaker *circuitBreaker) record(err error) {
+	if breaker == nil || breakerFailures <= 0 {
+		return
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.probing = false
+
+	// Any answer means the service is up, even if the answer is an error
+	if !isTransient(err) {
+		if breaker.state != breakerClosed {
+			log.Printf("(CAL) %s is back\n", breaker.svcName)
+		}
+		breaker.state = breakerClosed
+		breaker.failures = 0
+		return
+	}
+
+	breaker.failures++
+	if breaker.state == breakerHalfOpen || breaker.failures >= breakerFailures {
+		if breaker.state != breakerOpen {
+			log.Printf("(CAL) %s failed %d times, not calling it for %s\n", breaker.svcName, breaker.failures, breakerCooldown)
+		}
+		breaker.state = breakerOpen
+		breaker.openedAt = time.Now()
+	}
+}
+
+func (breaker *circuitBreaker) openError() error {
+	return connect.NewError(connect.CodeUnavailable, fmt.Errorf("%s is down, not calling it for now", breaker.svcName))
+}
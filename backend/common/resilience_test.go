@@ -0,0 +1,167 @@
+package common
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/yuv418/cs553project/backend/commondata"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func dispatchTest(verb string, value string) error {
+	_, err := Dispatch[wrapperspb.StringValue, emptypb.Empty](&commondata.ReqCtx{TargetSvcName: "test"}, verb, wrapperspb.String(value))
+	return err
+}
+
+func TestTimedOutHandlerIsntRunAgain(t *testing.T) {
+	var started atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+
+	insertTestVerb(t, "SlowVerb", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		started.Add(1)
+		// Doesn't look at ctx, like a handler stuck in a long loop
+		<-release
+		return &emptypb.Empty{}, nil
+	})
+	if err := SetDispatchTimeout(AbsCtx, "SlowVerb", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetDispatchPolicy(AbsCtx, "SlowVerb", DefaultRetry); err != nil {
+		t.Fatal(err)
+	}
+
+	err := dispatchTest("SlowVerb", "x")
+	if !errors.Is(err, errAbandoned) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if got := started.Load(); got != 1 {
+		t.Errorf("handler started %d times, want 1", got)
+	}
+}
+
+// Retries without waiting around
+var fastRetry = Policy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		// What each try returns, the last one repeats
+		results []error
+		wantErr bool
+		tries   int
+	}{
+		{"works first time", fastRetry, []error{nil}, false, 1},
+		{"down then up", fastRetry, []error{unavailable(), unavailable(), nil}, false, 3},
+		{"down for good", fastRetry, []error{unavailable()}, true, 3},
+		{"no retries by default", Policy{}, []error{unavailable(), nil}, true, 1},
+		{"rejected", fastRetry, []error{connect.NewError(connect.CodeInvalidArgument, errors.New("no")), nil}, true, 1},
+		{"caller gave up", fastRetry, []error{connect.NewError(connect.CodeCanceled, errors.New("gone")), nil}, true, 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tries := 0
+			insertTestVerb(t, "RetryVerb", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+				err := tc.results[min(tries, len(tc.results)-1)]
+				tries++
+				if err != nil {
+					return nil, err
+				}
+				return &emptypb.Empty{}, nil
+			})
+			if err := SetDispatchPolicy(AbsCtx, "RetryVerb", tc.policy); err != nil {
+				t.Fatal(err)
+			}
+
+			err := dispatchTest("RetryVerb", "x")
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got %v, want error %v", err, tc.wantErr)
+			}
+			if tries != tc.tries {
+				t.Errorf("tried %d times, want %d", tries, tc.tries)
+			}
+		})
+	}
+}
+
+func withBreaker(t *testing.T, failures int, cooldown time.Duration) {
+	prevFailures, prevCooldown := breakerFailures, breakerCooldown
+	breakerFailures, breakerCooldown = failures, cooldown
+	t.Cleanup(func() { breakerFailures, breakerCooldown = prevFailures, prevCooldown })
+}
+
+func TestBreaker(t *testing.T) {
+	withBreaker(t, 3, 50*time.Millisecond)
+
+	var down atomic.Bool
+	var tries atomic.Int32
+	down.Store(true)
+	insertTestVerb(t, "BreakerVerb", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		tries.Add(1)
+		if down.Load() {
+			return nil, unavailable()
+		}
+		if req.Value == "bad" {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("no"))
+		}
+		return &emptypb.Empty{}, nil
+	})
+
+	for range 3 {
+		dispatchTest("BreakerVerb", "x")
+	}
+	if tries.Load() != 3 {
+		t.Fatalf("tried %d times, want 3", tries.Load())
+	}
+
+	// Open, so it fails without calling
+	err := dispatchTest("BreakerVerb", "x")
+	if connect.CodeOf(err) != connect.CodeUnavailable || tries.Load() != 3 {
+		t.Fatalf("got %v after %d tries, want it to fail fast", err, tries.Load())
+	}
+
+	// Still down when the cooldown's up, so one probe and open again
+	time.Sleep(60 * time.Millisecond)
+	dispatchTest("BreakerVerb", "x")
+	dispatchTest("BreakerVerb", "x")
+	if tries.Load() != 4 {
+		t.Fatalf("tried %d times, want just the one probe", tries.Load())
+	}
+
+	// Back up. A rejection still means it's up.
+	down.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	if err := dispatchTest("BreakerVerb", "bad"); connect.CodeOf(err) != connect.CodeInvalidArgument {
+		t.Fatalf("got %v, want the handler's error", err)
+	}
+	if err := dispatchTest("BreakerVerb", "x"); err != nil {
+		t.Errorf("breaker didn't close: %v", err)
+	}
+}
+
+func TestFallbackDrop(t *testing.T) {
+	withBreaker(t, 0, 0)
+	insertTestVerb(t, "DroppedVerb", func(ctx *commondata.ReqCtx, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+		if req.Value == "bad" {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("no"))
+		}
+		return nil, unavailable()
+	})
+	if err := SetDispatchPolicy(AbsCtx, "DroppedVerb", Policy{Fallback: FallbackDrop}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dispatchTest("DroppedVerb", "x"); err != nil {
+		t.Errorf("got %v, want it dropped quietly", err)
+	}
+	// Only for the service being down
+	if err := dispatchTest("DroppedVerb", "bad"); connect.CodeOf(err) != connect.CodeInvalidArgument {
+		t.Errorf("got %v, want the handler's error", err)
+	}
+}
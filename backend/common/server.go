@@ -10,15 +10,19 @@ import (
 	"html"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"connectrpc.com/connect"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/webtransport-go"
 	"github.com/yuv418/cs553project/backend/commondata"
+	"github.com/yuv418/cs553project/backend/tracing"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 	"google.golang.org/protobuf/encoding/protodelim"
@@ -34,6 +38,8 @@ type SrvCfg struct {
 	CertFile      string
 	KeyFile       string
 	JWTSecret     string
+	// No TLS, for running behind something that terminates it
+	Plaintext bool
 }
 
 type CommonServer struct {
@@ -43,8 +49,21 @@ type CommonServer struct {
 	wtpServer *webtransport.Server
 	cert      tls.Certificate
 	Cfg       *SrvCfg
+	// Cleared once we're shutting down, so no new WebTransport sessions start
+	accepting atomic.Bool
+	// Set while the WebTransport listener is up
+	wtpListening atomic.Bool
+	// Every request's context comes from this, so cancelling it ends the
+	// streams that would otherwise hold up shutdown
+	requestCtx     context.Context
+	cancelRequests context.CancelFunc
 }
 
+// How long StopAccepting lets requests finish on their own before it cancels
+// whatever is left. Unary calls are done well before this, streams like
+// WatchScores only end when they're cancelled.
+const streamDrainTimeout = 2 * time.Second
+
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -52,7 +71,9 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func LoadSrvCfg() (*SrvCfg, error) {
+// Registers the command line flags. Until LoadCfg parses them, cfg has the
+// environment's values (or the defaults).
+func srvCfgFlags() *SrvCfg {
 	cfg := &SrvCfg{}
 
 	flag.StringVar(&cfg.ListenAddr, "addr", getEnv("AUTH_LISTEN_ADDR", ":50051"), "gRPC server listen address")
@@ -60,31 +81,56 @@ func LoadSrvCfg() (*SrvCfg, error) {
 	flag.StringVar(&cfg.CertFile, "cert", getEnv("AUTH_CERT_FILE", "../certs/cert.pem"), "TLS certificate file path") // Default relative path
 	flag.StringVar(&cfg.KeyFile, "key", getEnv("AUTH_KEY_FILE", "../certs/key.pem"), "TLS key file path")             // Default relative path
 	flag.StringVar(&cfg.JWTSecret, "jwt-secret", getEnv("AUTH_JWT_SECRET", "your-super-secret-key"), "Secret key for signing JWTs and encrypting passwords")
-	flag.Parse()
+	flag.BoolVar(&cfg.Plaintext, "plaintext", getEnv("AUTH_PLAINTEXT", "") == "1", "Serve h2c without TLS, and no WebTransport")
+	return cfg
+}
 
+func (cfg *SrvCfg) check() error {
 	if cfg.JWTSecret == "your-super-secret-key" {
 		log.Println("Warning: Using default JWT secret. Set AUTH_JWT_SECRET environment variable or --jwt-secret flag for production.")
 	}
+	if cfg.Plaintext {
+		log.Println("Warning: Serving without TLS, WebTransport routes won't be reachable.")
+		return nil
+	}
 	if _, err := os.Stat(cfg.CertFile); os.IsNotExist(err) {
-		return nil, fmt.Errorf("TLS cert file not found: %s. Set AUTH_CERT_FILE or --cert flag", cfg.CertFile)
+		return fmt.Errorf("TLS cert file not found: %s. Set AUTH_CERT_FILE or --cert flag", cfg.CertFile)
 	}
 	if _, err := os.Stat(cfg.KeyFile); os.IsNotExist(err) {
-		return nil, fmt.Errorf("TLS key file not found: %s. Set AUTH_KEY_FILE or --key flag", cfg.KeyFile)
+		return fmt.Errorf("TLS key file not found: %s. Set AUTH_KEY_FILE or --key flag", cfg.KeyFile)
 	}
-	return cfg, nil
+	return nil
 }
 
+// NewCommonServer sets up the routes. Nothing can be served until LoadCfg.
 func NewCommonServer() *CommonServer {
 	commonSrv := &CommonServer{}
-
-	cfg, err := LoadSrvCfg()
-	if err != nil {
-		log.Fatal(err)
-	}
-	commonSrv.Cfg = cfg
+	commonSrv.accepting.Store(true)
+	commonSrv.requestCtx, commonSrv.cancelRequests = context.WithCancel(context.Background())
+	commonSrv.Cfg = srvCfgFlags()
 
 	commonSrv.mux = http.NewServeMux()
 
+	commonSrv.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Hello, %q\n", html.EscapeString(r.URL.Path))
+	})
+
+	return commonSrv
+}
+
+// LoadCfg parses the command line and sets up the server from it. It has to
+// come before any WebTransport routes are added, since they need the cert.
+func (commonSrv *CommonServer) LoadCfg() error {
+	flag.Parse()
+	return commonSrv.configure()
+}
+
+func (commonSrv *CommonServer) configure() error {
+	cfg := commonSrv.Cfg
+	if err := cfg.check(); err != nil {
+		return err
+	}
+
 	corsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*") // Secure enough!
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
@@ -98,17 +144,19 @@ func NewCommonServer() *CommonServer {
 
 		commonSrv.mux.ServeHTTP(w, r)
 	})
+	baseContext := func(net.Listener) context.Context { return commonSrv.requestCtx }
 
-	if cfg.CertFile != "" && cfg.KeyFile != "" {
+	if !cfg.Plaintext {
 		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
 		if err != nil {
-			log.Fatalf("Failed to load TLS certificates: %v", err)
+			return fmt.Errorf("failed to load TLS certificates: %w", err)
 		}
 		commonSrv.cert = cert
 
 		commonSrv.server = &http.Server{
-			Addr:    cfg.ListenAddr,
-			Handler: corsHandler,
+			Addr:        cfg.ListenAddr,
+			Handler:     corsHandler,
+			BaseContext: baseContext,
 			TLSConfig: &tls.Config{
 				Certificates: []tls.Certificate{commonSrv.cert},
 				MinVersion:   tls.VersionTLS12,
@@ -118,16 +166,12 @@ func NewCommonServer() *CommonServer {
 		// Webtransport server will fail.
 
 		commonSrv.server = &http.Server{
-			Addr:    cfg.ListenAddr,
-			Handler: h2c.NewHandler(corsHandler, &http2.Server{}),
+			Addr:        cfg.ListenAddr,
+			Handler:     h2c.NewHandler(corsHandler, &http2.Server{}),
+			BaseContext: baseContext,
 		}
 	}
-
-	commonSrv.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Hello, %q\n", html.EscapeString(r.URL.Path))
-	})
-
-	return commonSrv
+	return nil
 }
 
 func SetupWebTransport(commonSrv *CommonServer) {
@@ -157,13 +201,38 @@ func WebTransportSendBuf[Res any, PtrRes interface {
 	ProtoReflect() protoreflect.Message
 	*Res
 }](byteWriter *bufio.Writer, resp PtrRes) error {
+	_, err := WebTransportSendBufTimed(byteWriter, resp)
+	return err
+}
+
+// How long each half of a send took
+type SendTiming struct {
+	// Marshalling into the buffer
+	Write time.Duration
+	// Sending the buffer
+	Flush time.Duration
+}
+
+// WebTransportSendBufTimed is WebTransportSendBuf, but says how long it took.
+func WebTransportSendBufTimed[Res any, PtrRes interface {
+	ProtoReflect() protoreflect.Message
+	*Res
+}](byteWriter *bufio.Writer, resp PtrRes) (SendTiming, error) {
 	ptrResp := PtrRes(resp)
+	timing := SendTiming{}
 
-	protodelim.MarshalTo(byteWriter, ptrResp)
+	start := time.Now()
+	_, err := protodelim.MarshalTo(byteWriter, ptrResp)
+	timing.Write = time.Since(start)
+	if err != nil {
+		return timing, err
+	}
 
 	// For latency reasons
-	byteWriter.Flush()
-	return nil
+	start = time.Now()
+	err = byteWriter.Flush()
+	timing.Flush = time.Since(start)
+	return timing, err
 }
 
 // TODO: add auth
@@ -190,6 +259,10 @@ func AddWebTransportRoute[Req any, PtrReq interface {
 	log.Printf("(CALServer) Adding WebTransport route %s\n", route)
 
 	commonSrv.wtpMux.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
+		if !commonSrv.accepting.Load() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
 		session, err := commonSrv.wtpServer.Upgrade(w, r)
 		if err != nil {
 			log.Printf("failed to upgrade: %v", err)
@@ -206,6 +279,8 @@ func AddWebTransportRoute[Req any, PtrReq interface {
 
 		log.Printf("Received a WebTransport Connection at %s\n", route)
 		go (func(session *webtransport.Session) {
+			webTransportSessions.Inc()
+			defer webTransportSessions.Dec()
 			defer session.CloseWithError(0, "session closed")
 
 			for {
@@ -222,6 +297,9 @@ func AddWebTransportRoute[Req any, PtrReq interface {
 						Username: claims["username"].(string),
 						Jwt:      r.URL.Query().Get("token"),
 						GameId:   r.URL.Query().Get("gameId"),
+						Query:    r.URL.Query(),
+						// No Ctx: the engine and music service use this for calls
+						// that have to go through after the player leaves, like UpdateScore.
 						// This won't really be used here, I think.
 						TargetSvcVerb: route,
 						TargetSvcName: svcName,
@@ -229,9 +307,20 @@ func AddWebTransportRoute[Req any, PtrReq interface {
 
 					// https://pkg.go.dev/io#ByteScanner
 					byteReader := bufio.NewReader(stream)
-					byteWriter := bufio.NewWriter(stream)
-
-					insertWebTransport(reqCtx, &commondata.WebTransportHandle{Writer: byteWriter, WtStream: &stream})
+					streamWriter := impairWriter(svcName, stream)
+					byteWriter := bufio.NewWriter(streamWriter)
+
+					err := insertWebTransport(reqCtx, &commondata.WebTransportHandle{
+						Writer:      byteWriter,
+						WtStream:    &stream,
+						Closer:      streamWriter,
+						CancelWrite: func() { stream.CancelWrite(0) },
+					})
+					if err != nil {
+						log.Printf("Couldn't set up WebTransport stream at %s: %s\n", route, err)
+						stream.Close()
+						return
+					}
 
 					for {
 						err := protodelim.UnmarshalFrom(byteReader, buf)
@@ -246,15 +335,21 @@ func AddWebTransportRoute[Req any, PtrReq interface {
 							}
 						}
 
+						// Each message is its own trace, unless the client started one
+						span := tracing.Start(r.URL.Query().Get("traceparent"), strings.TrimPrefix(route, "/"), tracing.Server)
+						span.SetAttr("game.id", reqCtx.GameId)
+						msgCtx := reqCtx.WithTraceParent(span.TraceParent(r.URL.Query().Get("traceparent")))
+
 						// TODO add the header for JWT
-						resp, err := handlerFn(reqCtx, buf)
+						resp, err := handlerFn(msgCtx, buf)
 						ptrResp := PtrRes(resp)
 
 						if err != nil {
 							log.Printf("Handler for WebTransport failed! %s\n", err)
 						} else if resp != nil {
-							WebTransportSendBuf(byteWriter, ptrResp)
+							err = WebTransportSendBuf(byteWriter, ptrResp)
 						}
+						span.End(err)
 
 					}
 
@@ -266,12 +361,42 @@ func AddWebTransportRoute[Req any, PtrReq interface {
 }
 
 func ExtractVerifyJwt(commonSrv *CommonServer, jwt string) jwt.MapClaims {
-	if claims := commonSrv.Cfg.ValidateJwt(jwt); claims != nil {
+	claims := commonSrv.Cfg.ValidateJwt(jwt)
+	jwtChecks.WithLabelValues(authResult(claims != nil)).Inc()
+	if claims != nil {
 		return claims
 	}
 	return nil
 }
 
+// Pulls the JWT out of the Authorization header and puts it (and its claims) on the context
+func authorize(commonSrv *CommonServer, ctx context.Context, header http.Header) (context.Context, error) {
+	// https://pkg.go.dev/net/http#Header
+	// https://www.reddit.com/r/golang/comments/cgbkel/why_are_headers_mapstringstring/
+	// https://pkg.go.dev/strings
+	// https://go.dev/doc/tutorial/handle-errors
+
+	// https://stackoverflow.com/questions/71114401/grpc-how-to-pass-value-from-interceptor-to-service-function
+	// https://chatgpt.com/share/6810f51b-79b8-8012-8ec9-4d526dd1c434
+
+	auth, ok := header["Authorization"]
+
+	if ok && strings.HasPrefix(auth[0], "Bearer") {
+		jwt := strings.Split(auth[0], " ")[1]
+		claims := ExtractVerifyJwt(commonSrv, jwt)
+		if claims != nil {
+			log.Printf("%v\n", claims)
+			reqCtx := context.WithValue(ctx, "claims", claims)
+			reqCtx = context.WithValue(reqCtx, "jwt", jwt)
+			return reqCtx, nil
+		}
+	}
+
+	// Return unauthorized
+	// https://connectrpc.com/docs/go/errors/
+	return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("Missing or invalid JWT token"))
+}
+
 func AddRoute[Req any, Res any](commonSrv *CommonServer, route string,
 	handlerFn func(context.Context, *connect.Request[Req]) (*connect.Response[Res], error),
 	shouldVerifyJwt bool) {
@@ -284,31 +409,11 @@ func AddRoute[Req any, Res any](commonSrv *CommonServer, route string,
 					log.Printf("Request: %s", req.Spec().Procedure)
 
 					if shouldVerifyJwt {
-						// https://pkg.go.dev/net/http#Header
-						// https://www.reddit.com/r/golang/comments/cgbkel/why_are_headers_mapstringstring/
-						// https://pkg.go.dev/strings
-						// https://go.dev/doc/tutorial/handle-errors
-
-						// https://stackoverflow.com/questions/71114401/grpc-how-to-pass-value-from-interceptor-to-service-function
-						// https://chatgpt.com/share/6810f51b-79b8-8012-8ec9-4d526dd1c434
-
-						auth, ok := req.Header()["Authorization"]
-
-						if ok && strings.HasPrefix(auth[0], "Bearer") {
-							jwt := strings.Split(auth[0], " ")[1]
-							claims := ExtractVerifyJwt(commonSrv, jwt)
-							if claims != nil {
-								log.Printf("%v\n", claims)
-								reqCtx := context.WithValue(ctx, "claims", claims)
-								reqCtx = context.WithValue(reqCtx, "jwt", jwt)
-								return next(reqCtx, req)
-
-							}
+						reqCtx, err := authorize(commonSrv, ctx, req.Header())
+						if err != nil {
+							return nil, err
 						}
-
-						// Return unauthorized
-						// https://connectrpc.com/docs/go/errors/
-						return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("Missing or invalid JWT token"))
+						return next(reqCtx, req)
 					} else {
 						return next(ctx, req)
 					}
@@ -320,17 +425,107 @@ func AddRoute[Req any, Res any](commonSrv *CommonServer, route string,
 
 }
 
-func (commonSrv *CommonServer) StartServer() {
-	if commonSrv.Cfg.CertFile != "" && commonSrv.Cfg.KeyFile != "" {
+// Same as the unary interceptor in AddRoute, but for streams
+type streamInterceptor struct {
+	commonSrv       *CommonServer
+	shouldVerifyJwt bool
+}
+
+func (interceptor *streamInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return next
+}
+
+func (interceptor *streamInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (interceptor *streamInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		log.Printf("Stream: %s", conn.Spec().Procedure)
+
+		if !interceptor.shouldVerifyJwt {
+			return next(ctx, conn)
+		}
+		reqCtx, err := authorize(interceptor.commonSrv, ctx, conn.RequestHeader())
+		if err != nil {
+			return err
+		}
+		return next(reqCtx, conn)
+	}
+}
+
+func AddServerStreamRoute[Req any, Res any](commonSrv *CommonServer, route string,
+	handlerFn func(context.Context, *connect.Request[Req], *connect.ServerStream[Res]) error,
+	shouldVerifyJwt bool) {
+	commonSrv.mux.Handle(route, connect.NewServerStreamHandler(
+		route,
+		handlerFn,
+		connect.WithInterceptors(&streamInterceptor{commonSrv: commonSrv, shouldVerifyJwt: shouldVerifyJwt}),
+	))
+}
+
+// Bidi streams need HTTP/2 all the way through, so browsers talking
+// connect over HTTP/1.1 can't use them
+func AddBidiStreamRoute[Req any, Res any](commonSrv *CommonServer, route string,
+	handlerFn func(context.Context, *connect.BidiStream[Req, Res]) error,
+	shouldVerifyJwt bool) {
+	commonSrv.mux.Handle(route, connect.NewBidiStreamHandler(
+		route,
+		handlerFn,
+		connect.WithInterceptors(&streamInterceptor{commonSrv: commonSrv, shouldVerifyJwt: shouldVerifyJwt}),
+	))
+}
+
+// StartServer starts serving in the background. The channel gets an error if
+// a server stops on its own.
+func (commonSrv *CommonServer) StartServer() <-chan error {
+	serverErr := make(chan error, 2)
+
+	if !commonSrv.Cfg.Plaintext {
 		if commonSrv.wtpServer != nil {
 			log.Printf("Starting WebTransport server at %s\n", commonSrv.Cfg.WtpListenAddr)
 			go (func() {
-				commonSrv.wtpServer.ListenAndServeTLS(commonSrv.Cfg.CertFile, commonSrv.Cfg.KeyFile)
+				commonSrv.wtpListening.Store(true)
+				err := commonSrv.wtpServer.ListenAndServeTLS(commonSrv.Cfg.CertFile, commonSrv.Cfg.KeyFile)
+				commonSrv.wtpListening.Store(false)
+				if commonSrv.accepting.Load() {
+					serverErr <- err
+				}
 			})()
 		}
 		log.Printf("Starting Connect server on %s", commonSrv.Cfg.ListenAddr)
-		log.Fatal(commonSrv.server.ListenAndServeTLS(commonSrv.Cfg.CertFile, commonSrv.Cfg.KeyFile))
+		go (func() {
+			err := commonSrv.server.ListenAndServeTLS(commonSrv.Cfg.CertFile, commonSrv.Cfg.KeyFile)
+			if err != http.ErrServerClosed {
+				serverErr <- err
+			}
+		})()
 	} else {
-		log.Fatal(commonSrv.server.ListenAndServe())
+		go (func() {
+			err := commonSrv.server.ListenAndServe()
+			if err != http.ErrServerClosed {
+				serverErr <- err
+			}
+		})()
+	}
+
+	return serverErr
+}
+
+// StopAccepting turns away new requests and WebTransport sessions, and waits
+// for requests in progress to finish. Anything still running after
+// streamDrainTimeout has its context cancelled. Sessions that are already
+// open keep going.
+func (commonSrv *CommonServer) StopAccepting(ctx context.Context) error {
+	commonSrv.accepting.Store(false)
+	cancelStreams := time.AfterFunc(streamDrainTimeout, commonSrv.cancelRequests)
+	defer cancelStreams.Stop()
+	return commonSrv.server.Shutdown(ctx)
+}
+
+// Close hangs up on every WebTransport session that's still open.
+func (commonSrv *CommonServer) Close() {
+	if commonSrv.wtpServer != nil {
+		commonSrv.wtpServer.Close()
 	}
 }
@@ -0,0 +1,172 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A CommonServer like NewCommonServer makes, without registering flags again
+func newTestCommonServer(t *testing.T, cfg *SrvCfg) *CommonServer {
+	commonSrv := &CommonServer{Cfg: cfg, mux: http.NewServeMux()}
+	commonSrv.accepting.Store(true)
+	commonSrv.requestCtx, commonSrv.cancelRequests = context.WithCancel(context.Background())
+	if err := commonSrv.configure(); err != nil {
+		t.Fatal(err)
+	}
+	return commonSrv
+}
+
+// Serves commonSrv on a free port until the test ends, returns its address
+func serveTest(t *testing.T, commonSrv *CommonServer) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (func() {
+		if commonSrv.Cfg.Plaintext {
+			commonSrv.server.Serve(listener)
+		} else {
+			// The cert is already in TLSConfig
+			commonSrv.server.ServeTLS(listener, "", "")
+		}
+	})()
+	t.Cleanup(func() { commonSrv.server.Close() })
+	return listener.Addr().String()
+}
+
+// Writes a self-signed cert for 127.0.0.1 to dir
+func writeTestCert(t *testing.T, dir string) (certFile string, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "flappygo test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServesTLS(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t, t.TempDir())
+	commonSrv := newTestCommonServer(t, &SrvCfg{CertFile: certFile, KeyFile: keyFile, JWTSecret: "test"})
+	commonSrv.mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	addr := serveTest(t, commonSrv)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + addr + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.TLS == nil || string(body) != "HTTP/2.0" {
+		t.Errorf("got %s over TLS %v, want HTTP/2.0 over TLS", body, resp.TLS != nil)
+	}
+	// Browsers need these to call us from the client's origin
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("got Access-Control-Allow-Origin %q", got)
+	}
+}
+
+func TestTLSNeedsCertFiles(t *testing.T) {
+	dir := t.TempDir()
+	commonSrv := &CommonServer{Cfg: &SrvCfg{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}}
+	if err := commonSrv.configure(); err == nil {
+		t.Error("configured TLS without a cert")
+	}
+}
+
+func TestServesPlaintext(t *testing.T) {
+	// The cert files don't matter
+	commonSrv := newTestCommonServer(t, &SrvCfg{CertFile: "nope.pem", KeyFile: "nope.pem", Plaintext: true})
+	commonSrv.mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	addr := serveTest(t, commonSrv)
+
+	resp, err := http.Get("http://" + addr + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %s", resp.Status)
+	}
+}
+
+func TestStopAcceptingCancelsStreams(t *testing.T) {
+	commonSrv := newTestCommonServer(t, &SrvCfg{Plaintext: true})
+	started := make(chan struct{})
+	// Stands in for WatchScores, which only returns once it's cancelled
+	commonSrv.mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	})
+	addr := serveTest(t, commonSrv)
+
+	resp, err := http.Get("http://" + addr + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*streamDrainTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := commonSrv.StopAccepting(ctx); err != nil {
+		t.Fatalf("stream held up shutdown: %s", err)
+	}
+	if took := time.Since(start); took > 2*streamDrainTimeout {
+		t.Errorf("shutdown took %s, should be about %s", took, streamDrainTimeout)
+	}
+}
@@ -0,0 +1,110 @@
+// Shutting down without losing anything. On SIGTERM or SIGINT we stop taking
+// new requests and sessions, give everyone who registered with OnShutdown
+// until SHUTDOWN_TIMEOUT to wrap up, then flush stats and hang up on the
+// other services.
+
+package common
+
+import (
+	"context"
+	"log"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+	"github.com/yuv418/cs553project/backend/tracing"
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+var (
+	shutdownHooks     []shutdownHook
+	shutdownHooksLock = sync.Mutex{}
+)
+
+// How long shutdown hooks get in total before we quit anyway
+var shutdownTimeout = shutdownTimeoutSetup()
+
+func shutdownTimeoutSetup() time.Duration {
+	timeout, err := time.ParseDuration(commondata.GetEnv("SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil {
+		log.Fatalf("SHUTDOWN_TIMEOUT is invalid: %s\n", err)
+	}
+	return timeout
+}
+
+// OnShutdown runs fn once the server has stopped taking requests. Hooks run
+// one at a time in the order they were added, and should give up when ctx is done.
+func OnShutdown(name string, fn func(ctx context.Context) error) {
+	shutdownHooksLock.Lock()
+	defer shutdownHooksLock.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// Run serves until we get a signal or the server dies, then shuts down.
+func (absCtx *AbstractionServer) Run() {
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	absCtx.mountHealth()
+	absCtx.mountMetrics()
+	absCtx.mountStats()
+	serverErr := absCtx.CommonServer.StartServer()
+
+	select {
+	case <-signalCtx.Done():
+		log.Printf("(CAL) Shutting down, giving it %s\n", shutdownTimeout)
+	case err := <-serverErr:
+		log.Printf("(CAL) Server stopped with %s, shutting down\n", err)
+	}
+	// A second signal kills us the usual way
+	stop()
+
+	absCtx.Shutdown(shutdownTimeout)
+}
+
+func (absCtx *AbstractionServer) Shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Requests already in progress get to finish
+	if err := absCtx.CommonServer.StopAccepting(ctx); err != nil {
+		log.Printf("(CAL) Requests were still running when we stopped waiting: %s\n", err)
+	}
+
+	shutdownHooksLock.Lock()
+	hooks := shutdownHooks
+	shutdownHooksLock.Unlock()
+
+	for _, hook := range hooks {
+		start := time.Now()
+		if err := hook.fn(ctx); err != nil {
+			log.Printf("(CAL) Shutting down %s failed: %s\n", hook.name, err)
+		} else {
+			log.Printf("(CAL) Shut down %s in %s\n", hook.name, time.Since(start).Round(time.Millisecond))
+		}
+	}
+
+	// Hooks can still be making calls, so these go last
+	absCtx.CommonServer.Close()
+	if absCtx.stats != nil {
+		absCtx.stats.Close()
+	}
+	for _, svcData := range absCtx.serviceData {
+		svcData.balancer.close()
+	}
+	// Everything that makes spans is done by now. The hooks may have used up
+	// ctx, so this gets its own few seconds.
+	traceCtx, traceCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer traceCancel()
+	if err := tracing.Close(traceCtx); err != nil {
+		log.Printf("(CAL) Couldn't export the last spans: %s\n", err)
+	}
+
+	log.Printf("(CAL) Shut down\n")
+}
@@ -0,0 +1,86 @@
+package common
+
+// Every service answers stats.StatsService/GetSummary with the latency
+// percentiles of the calls it made, like it answers /metrics. It isn't in the
+// dispatch table since there's one per process, not one per service. Callers
+// need a JWT, since it lists every game.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+
+	"connectrpc.com/connect"
+	statspb "github.com/yuv418/cs553project/backend/protos/stats"
+	"github.com/yuv418/cs553project/backend/stats"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func latencyToProto(latency stats.LatencySummary) *statspb.LatencySummary {
+	return &statspb.LatencySummary{
+		Count: latency.Count,
+		P50Ns: latency.P50.Nanoseconds(),
+		P90Ns: latency.P90.Nanoseconds(),
+		P99Ns: latency.P99.Nanoseconds(),
+		MaxNs: latency.Max.Nanoseconds(),
+	}
+}
+
+// The services we have handlers for, or monolith
+func (absCtx *AbstractionServer) serviceNames() string {
+	if !absCtx.Microservice {
+		return "monolith"
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, action := range absCtx.dispatchTable {
+		if action.fn != nil && !seen[action.svcName] {
+			seen[action.svcName] = true
+			names = append(names, action.svcName)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// StartStats starts writing Dispatch stats to STAT_DIR. Calls made before
+// this aren't recorded.
+func StartStats(absCtx *AbstractionServer) {
+	absCtx.stats = stats.StartStatThread()
+}
+
+func (absCtx *AbstractionServer) mountStats() {
+	AddRoute(absCtx.CommonServer, "/stats.StatsService/GetSummary",
+		func(ctx context.Context, req *connect.Request[statspb.GetSummaryReq]) (*connect.Response[statspb.GetSummaryResp], error) {
+			if absCtx.stats == nil {
+				return nil, connect.NewError(connect.CodeUnavailable, errors.New("stats aren't started"))
+			}
+			summary := absCtx.stats.Summary(req.Msg.GameId)
+
+			resp := &statspb.GetSummaryResp{
+				Service: absCtx.serviceNames(),
+				Since:   timestamppb.New(summary.Since),
+			}
+			for _, edge := range summary.Edges {
+				resp.Edges = append(resp.Edges, &statspb.EdgeSummary{
+					SrcSvcName:  edge.SrcSvcName,
+					SrcSvcVerb:  edge.SrcSvcVerb,
+					DestSvcName: edge.DestSvcName,
+					DestSvcVerb: edge.DestSvcVerb,
+					Latency:     latencyToProto(edge.Latency),
+				})
+			}
+			for _, game := range summary.Games {
+				resp.Games = append(resp.Games, &statspb.GameSummary{
+					GameId:  game.GameId,
+					Latency: latencyToProto(game.Latency),
+				})
+			}
+			return connect.NewResponse(resp), nil
+		}, true)
+
+	log.Printf("(CALServer) Serving stat summaries at /stats.StatsService/GetSummary\n")
+}
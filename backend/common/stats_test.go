@@ -0,0 +1,55 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetSummaryNeedsJwt(t *testing.T) {
+	t.Setenv("STAT_DIR", t.TempDir())
+	StartStats(AbsCtx)
+	t.Cleanup(func() {
+		AbsCtx.stats.Close()
+		AbsCtx.stats = nil
+	})
+
+	AbsCtx.mountStats()
+	server := httptest.NewServer(AbsCtx.CommonServer.mux)
+	defer server.Close()
+
+	token, err := AbsCtx.CommonServer.Cfg.ServiceJwt("test", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		auth   string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"bad token", "Bearer nope", http.StatusUnauthorized},
+		{"token", "Bearer " + token, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", server.URL+"/stats.StatsService/GetSummary", strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Errorf("got %d, want %d", resp.StatusCode, tc.status)
+			}
+		})
+	}
+}
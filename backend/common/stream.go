@@ -0,0 +1,309 @@
+// Streaming verbs. A handler gets a send (and for bidi, a recv) function and
+// doesn't care whether the caller is in the same process (channels) or
+// another service (a gRPC stream).
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/yuv418/cs553project/backend/commondata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// One request in, any number of responses out. Return to end the stream.
+type ServerStreamFn[Req any, Resp any] func(*commondata.ReqCtx, *Req, func(*Resp) error) error
+
+// recv gives io.EOF once the caller is done sending. Return to end the stream.
+type BidiStreamFn[Req any, Resp any] func(*commondata.ReqCtx, func() (*Req, error), func(*Resp) error) error
+
+// What the caller of a streaming verb gets back. Recv gives io.EOF once the
+// handler is done, or the handler's error as a connect error. Call Close when you stop reading so the handler can exit.
+type ClientStream[Req any, Resp any] struct {
+	send      func(*Req) error
+	recv      func() (*Resp, error)
+	closeSend func() error
+	cancel    context.CancelFunc
+}
+
+func (stream *ClientStream[Req, Resp]) Send(req *Req) error {
+	return stream.send(req)
+}
+
+func (stream *ClientStream[Req, Resp]) Recv() (*Resp, error) {
+	return stream.recv()
+}
+
+// Tells the handler no more requests are coming. Don't Send after this.
+func (stream *ClientStream[Req, Resp]) CloseSend() error {
+	return stream.closeSend()
+}
+
+func (stream *ClientStream[Req, Resp]) Close() {
+	stream.cancel()
+}
+
+// Stream errors come out of Recv as connect errors whether the handler is
+// local or not. gRPC and connect use the same codes.
+func streamError(err error) error {
+	var connectErr *connect.Error
+	switch {
+	case err == nil, err == io.EOF, errors.As(err, &connectErr):
+		return err
+	case errors.Is(err, context.Canceled):
+		return connect.NewError(connect.CodeCanceled, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return connect.NewError(connect.CodeDeadlineExceeded, err)
+	}
+	if st, ok := status.FromError(err); ok {
+		return connect.NewError(connect.Code(st.Code()), errors.New(st.Message()))
+	}
+	return connect.NewError(connect.CodeUnknown, err)
+}
+
+func InsertDispatchTableServerStreamHandler[ReqT any, RespT any](
+	absCtx *AbstractionServer,
+	svcName string,
+	verb string,
+	handlerFn ServerStreamFn[ReqT, RespT],
+	shouldVerifyJwt bool,
+) error {
+	svcData := absCtx.serviceData[svcName]
+	if err := setHandler(absCtx, verb, handlerFn); err != nil {
+		return err
+	}
+	route := svcData.prefix + "/" + verb
+	log.Println("(CAL) Adding server stream route ", route)
+
+	AddServerStreamRoute(absCtx.CommonServer, route,
+		func(ctx context.Context, req *connect.Request[ReqT], stream *connect.ServerStream[RespT]) error {
+			reqCtx := connectReqCtx(ctx, svcName, verb)
+			reqCtx.TraceParent = req.Header().Get("traceparent")
+			return handlerFn(reqCtx, req.Msg, stream.Send)
+		}, shouldVerifyJwt)
+
+	return nil
+}
+
+func InsertDispatchTableBidiStreamHandler[ReqT any, RespT any](
+	absCtx *AbstractionServer,
+	svcName string,
+	verb string,
+	handlerFn BidiStreamFn[ReqT, RespT],
+	shouldVerifyJwt bool,
+) error {
+	svcData := absCtx.serviceData[svcName]
+	if err := setHandler(absCtx, verb, handlerFn); err != nil {
+		return err
+	}
+	route := svcData.prefix + "/" + verb
+	log.Println("(CAL) Adding bidi stream route ", route)
+
+	AddBidiStreamRoute(absCtx.CommonServer, route,
+		func(ctx context.Context, stream *connect.BidiStream[ReqT, RespT]) error {
+			recv := func() (*ReqT, error) {
+				req, err := stream.Receive()
+				// connect wraps io.EOF, handlers just check for io.EOF
+				if errors.Is(err, io.EOF) {
+					return nil, io.EOF
+				}
+				return req, err
+			}
+			reqCtx := connectReqCtx(ctx, svcName, verb)
+			reqCtx.TraceParent = stream.RequestHeader().Get("traceparent")
+			return handlerFn(reqCtx, recv, stream.Send)
+		}, shouldVerifyJwt)
+
+	return nil
+}
+
+// DispatchServerStream sends one request to a server streaming verb and gives
+// back the stream of responses.
+func DispatchServerStream[Req any, Resp any](ctx *commondata.ReqCtx, verb string, req *Req) (*ClientStream[Req, Resp], error) {
+	dispatchTableData := AbsCtx.dispatchTable[verb]
+	if dispatchTableData == nil {
+		return nil, fmt.Errorf("unknown verb %s", verb)
+	}
+
+	if AbsCtx.Microservice {
+		stream, err := remoteStream[Req, Resp](ctx, dispatchTableData, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := stream.Send(req); err != nil {
+			stream.Close()
+			return nil, err
+		}
+		if err := stream.CloseSend(); err != nil {
+			stream.Close()
+			return nil, err
+		}
+		return stream, nil
+	}
+
+	handlerFn, ok := dispatchTableData.fn.(ServerStreamFn[Req, Resp])
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a server stream of %T to %T", verb, req, new(Resp))
+	}
+	stream := localStream(ctx, dispatchTableData, func(handlerCtx *commondata.ReqCtx, _ func() (*Req, error), send func(*Resp) error) error {
+		return handlerFn(handlerCtx, req, send)
+	})
+	stream.CloseSend()
+	return stream, nil
+}
+
+// DispatchBidiStream opens a stream to a bidi verb.
+func DispatchBidiStream[Req any, Resp any](ctx *commondata.ReqCtx, verb string) (*ClientStream[Req, Resp], error) {
+	dispatchTableData := AbsCtx.dispatchTable[verb]
+	if dispatchTableData == nil {
+		return nil, fmt.Errorf("unknown verb %s", verb)
+	}
+
+	if AbsCtx.Microservice {
+		return remoteStream[Req, Resp](ctx, dispatchTableData, true)
+	}
+
+	handlerFn, ok := dispatchTableData.fn.(BidiStreamFn[Req, Resp])
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a bidi stream of %T to %T", verb, new(Req), new(Resp))
+	}
+	return localStream(ctx, dispatchTableData, handlerFn), nil
+}
+
+// Runs the handler in a goroutine and connects it to the caller with channels.
+func localStream[Req any, Resp any](ctx *commondata.ReqCtx, action *Action, handlerFn BidiStreamFn[Req, Resp]) *ClientStream[Req, Resp] {
+	streamCtx, cancel := context.WithCancel(ctx.Context())
+	reqs := make(chan *Req)
+	resps := make(chan *Resp)
+	// Closed once the handler returns
+	done := make(chan struct{})
+	var handlerErr error
+	var closeSendOnce sync.Once
+
+	// The handler gets its own ReqCtx so it can tell when the caller leaves
+	handlerCtx := ctx.WithContext(streamCtx)
+
+	recv := func() (*Req, error) {
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				return nil, io.EOF
+			}
+			return req, nil
+		case <-streamCtx.Done():
+			return nil, streamCtx.Err()
+		}
+	}
+	send := func(resp *Resp) error {
+		select {
+		case resps <- resp:
+			return nil
+		case <-streamCtx.Done():
+			return streamCtx.Err()
+		}
+	}
+
+	start := time.Now()
+	go func() {
+		handlerErr = handlerFn(handlerCtx, recv, send)
+		close(done)
+		close(resps)
+		// How long the stream was open for
+		recordStat(ctx, action, time.Since(start))
+	}()
+
+	return &ClientStream[Req, Resp]{
+		send: func(req *Req) error {
+			select {
+			case reqs <- req:
+				return nil
+			case <-done:
+				// Same as gRPC, the real error comes out of Recv
+				return io.EOF
+			case <-streamCtx.Done():
+				return streamCtx.Err()
+			}
+		},
+		recv: func() (*Resp, error) {
+			resp, ok := <-resps
+			if !ok {
+				if handlerErr != nil {
+					return nil, streamError(handlerErr)
+				}
+				return nil, io.EOF
+			}
+			return resp, nil
+		},
+		closeSend: func() error {
+			closeSendOnce.Do(func() { close(reqs) })
+			return nil
+		},
+		cancel: cancel,
+	}
+}
+
+func remoteStream[Req any, Resp any](ctx *commondata.ReqCtx, action *Action, clientStreams bool) (*ClientStream[Req, Resp], error) {
+	svcData := AbsCtx.serviceData[action.svcName]
+	ep, err := svcData.balancer.pick(ctx.Instance)
+	if err != nil {
+		return nil, err
+	}
+	loc := svcData.prefix + "/" + action.verb
+	log.Printf("(CAL Dispatch) Opening microservice stream on %s at %s\n", ep.addr, loc)
+
+	// Create a context with the JWT as an authorization header
+	md := traceMetadata(ctx, map[string]string{
+		"authorization": "Bearer " + ctx.Jwt,
+	})
+	// Streams are long lived, so no timeout, but they do end with the caller
+	streamCtx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx.Context(), metadata.New(md)))
+
+	start := time.Now()
+	// https://pkg.go.dev/google.golang.org/grpc#ClientConn.NewStream
+	stream, err := ep.client.NewStream(streamCtx, &grpc.StreamDesc{
+		StreamName:    action.verb,
+		ServerStreams: true,
+		ClientStreams: clientStreams,
+	}, loc)
+	// We don't see the end of remote streams here, so this is just the time to open it
+	recordStat(ctx, action, time.Since(start))
+	if err != nil {
+		cancel()
+		svcData.balancer.done(ep, err)
+		log.Printf("Stream failed with %s\n", err)
+		return nil, err
+	}
+
+	// The stream counts against the instance until the caller closes it
+	var closeOnce sync.Once
+	closeStream := func() {
+		closeOnce.Do(func() {
+			cancel()
+			svcData.balancer.done(ep, nil)
+		})
+	}
+
+	return &ClientStream[Req, Resp]{
+		send: func(req *Req) error {
+			return stream.SendMsg(req)
+		},
+		recv: func() (*Resp, error) {
+			resp := new(Resp)
+			if err := stream.RecvMsg(resp); err != nil {
+				return nil, streamError(err)
+			}
+			return resp, nil
+		},
+		closeSend: stream.CloseSend,
+		cancel:    closeStream,
+	}, nil
+}
@@ -0,0 +1,224 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/yuv418/cs553project/backend/commondata"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Counts up to the request, or fails if it's negative
+func countHandler(ctx *commondata.ReqCtx, req *wrapperspb.Int32Value, send func(*wrapperspb.Int32Value) error) error {
+	if req.Value < 0 {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("can't count to a negative number"))
+	}
+	for i := range req.Value {
+		if err := send(wrapperspb.Int32(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Echoes everything back, then says bye once the caller is done
+func echoHandler(ctx *commondata.ReqCtx, recv func() (*wrapperspb.StringValue, error), send func(*wrapperspb.StringValue) error) error {
+	for {
+		req, err := recv()
+		if err == io.EOF {
+			return send(wrapperspb.String("bye"))
+		}
+		if err != nil {
+			return err
+		}
+		if req.Value == "fail" {
+			return connect.NewError(connect.CodeFailedPrecondition, errors.New("asked to fail"))
+		}
+		if err := send(req); err != nil {
+			return err
+		}
+	}
+}
+
+// Sends one message and waits for the caller to leave, like WatchScores
+func hangHandler(hungUp chan<- struct{}) ServerStreamFn[emptypb.Empty, emptypb.Empty] {
+	return func(ctx *commondata.ReqCtx, _ *emptypb.Empty, send func(*emptypb.Empty) error) error {
+		if err := send(&emptypb.Empty{}); err != nil {
+			return err
+		}
+		<-ctx.Context().Done()
+		close(hungUp)
+		return ctx.Context().Err()
+	}
+}
+
+// Registers the test streams, served over gRPC from another server for
+// microservices. hungUp is closed once the hang handler sees its caller leave.
+func withTestStreams(t *testing.T, microservice bool) (hungUp chan struct{}) {
+	t.Helper()
+
+	certFile, keyFile, _ := writeTestCert(t, t.TempDir())
+	commonSrv := newTestCommonServer(t, &SrvCfg{CertFile: certFile, KeyFile: keyFile, JWTSecret: "test"})
+	prevSrv, prevMicroservice := AbsCtx.CommonServer, AbsCtx.Microservice
+	AbsCtx.CommonServer = commonSrv
+	AbsCtx.Microservice = microservice
+
+	registry := NewLocalRegistry()
+	if microservice {
+		registry.Register("teststream", serveTest(t, commonSrv))
+	}
+	InsertServiceResolver(AbsCtx, "teststream", "local", registry.Resolver("teststream"), "/test.StreamService")
+
+	verbs := []string{"TestCount", "TestEcho", "TestHang"}
+	for _, verb := range verbs {
+		if err := InsertDispatchTable(AbsCtx, "teststream", verb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		AbsCtx.serviceData["teststream"].balancer.close()
+		delete(AbsCtx.serviceData, "teststream")
+		for _, verb := range verbs {
+			delete(AbsCtx.dispatchTable, verb)
+		}
+		AbsCtx.CommonServer = prevSrv
+		AbsCtx.Microservice = prevMicroservice
+	})
+
+	hungUp = make(chan struct{})
+	for _, err := range []error{
+		InsertDispatchTableServerStreamHandler(AbsCtx, "teststream", "TestCount", countHandler, false),
+		InsertDispatchTableBidiStreamHandler(AbsCtx, "teststream", "TestEcho", echoHandler, false),
+		InsertDispatchTableServerStreamHandler(AbsCtx, "teststream", "TestHang", hangHandler(hungUp), false),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return hungUp
+}
+
+func recvCode[Req any, Resp any](t *testing.T, stream *ClientStream[Req, Resp]) connect.Code {
+	t.Helper()
+
+	resp, err := stream.Recv()
+	if err == nil {
+		t.Fatalf("got %v, want an error", resp)
+	}
+	return connect.CodeOf(err)
+}
+
+func TestStreams(t *testing.T) {
+	for _, mode := range []struct {
+		name         string
+		microservice bool
+	}{
+		{"monolith", false},
+		{"microservice", true},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			hungUp := withTestStreams(t, mode.microservice)
+			ctx := &commondata.ReqCtx{TargetSvcName: "test"}
+
+			t.Run("server stream", func(t *testing.T) {
+				stream, err := DispatchServerStream[wrapperspb.Int32Value, wrapperspb.Int32Value](ctx, "TestCount", wrapperspb.Int32(3))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer stream.Close()
+				for i := range int32(3) {
+					resp, err := stream.Recv()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if resp.Value != i {
+						t.Errorf("got %d, want %d", resp.Value, i)
+					}
+				}
+				if _, err := stream.Recv(); err != io.EOF {
+					t.Errorf("got %v at the end, want EOF", err)
+				}
+			})
+
+			t.Run("bidi stream", func(t *testing.T) {
+				stream, err := DispatchBidiStream[wrapperspb.StringValue, wrapperspb.StringValue](ctx, "TestEcho")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer stream.Close()
+				for _, value := range []string{"a", "b", "c"} {
+					if err := stream.Send(wrapperspb.String(value)); err != nil {
+						t.Fatal(err)
+					}
+					resp, err := stream.Recv()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if resp.Value != value {
+						t.Errorf("got %q, want %q", resp.Value, value)
+					}
+				}
+				// The handler only says bye once it sees CloseSend
+				if err := stream.CloseSend(); err != nil {
+					t.Fatal(err)
+				}
+				resp, err := stream.Recv()
+				if err != nil || resp.Value != "bye" {
+					t.Errorf("got %v, %v after CloseSend, want bye", resp, err)
+				}
+				if _, err := stream.Recv(); err != io.EOF {
+					t.Errorf("got %v at the end, want EOF", err)
+				}
+			})
+
+			t.Run("server stream error", func(t *testing.T) {
+				stream, err := DispatchServerStream[wrapperspb.Int32Value, wrapperspb.Int32Value](ctx, "TestCount", wrapperspb.Int32(-1))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer stream.Close()
+				if code := recvCode(t, stream); code != connect.CodeInvalidArgument {
+					t.Errorf("got %s, want %s", code, connect.CodeInvalidArgument)
+				}
+			})
+
+			t.Run("bidi stream error", func(t *testing.T) {
+				stream, err := DispatchBidiStream[wrapperspb.StringValue, wrapperspb.StringValue](ctx, "TestEcho")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer stream.Close()
+				if err := stream.Send(wrapperspb.String("fail")); err != nil {
+					t.Fatal(err)
+				}
+				if code := recvCode(t, stream); code != connect.CodeFailedPrecondition {
+					t.Errorf("got %s, want %s", code, connect.CodeFailedPrecondition)
+				}
+			})
+
+			t.Run("caller cancels", func(t *testing.T) {
+				stream, err := DispatchServerStream[emptypb.Empty, emptypb.Empty](ctx, "TestHang", &emptypb.Empty{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := stream.Recv(); err != nil {
+					t.Fatal(err)
+				}
+				stream.Close()
+
+				select {
+				case <-hungUp:
+				case <-time.After(5 * time.Second):
+					t.Fatal("handler didn't see the caller leave")
+				}
+				if code := recvCode(t, stream); code != connect.CodeCanceled {
+					t.Errorf("got %s, want %s", code, connect.CodeCanceled)
+				}
+			})
+		})
+	}
+}
@@ -3,19 +3,78 @@ package commondata
 import (
 	"bufio"
 	"context"
+	"io"
+	"net/url"
 )
 
 type ReqCtx struct {
-	HttpCtx  *context.Context
+	// Carries the caller's deadline and is cancelled when the caller goes away.
+	// Use Context() instead of reading this, it's nil when there's no caller to wait on.
+	Ctx      context.Context
 	Username string
 	Jwt      string
 	GameId   string
+	// Query params a WebTransport session was opened with, nil for RPCs
+	Query url.Values
 
 	TargetSvcName string
 	TargetSvcVerb string
+
+	// Address of the instance dispatched calls have to go to, for services
+	// that keep state in memory. Empty lets the balancer pick.
+	Instance string
+
+	// W3C traceparent of the span this request is part of, empty if it
+	// isn't traced. Dispatch sends it along.
+	TraceParent string
+}
+
+func (ctx *ReqCtx) Context() context.Context {
+	if ctx.Ctx == nil {
+		return context.Background()
+	}
+	return ctx.Ctx
+}
+
+// WithContext copies the ReqCtx for a call that runs under newCtx
+func (ctx *ReqCtx) WithContext(newCtx context.Context) *ReqCtx {
+	reqCtx := *ctx
+	reqCtx.Ctx = newCtx
+	return &reqCtx
+}
+
+// WithInstance copies the ReqCtx for calls that have to reach the instance at addr
+func (ctx *ReqCtx) WithInstance(addr string) *ReqCtx {
+	reqCtx := *ctx
+	reqCtx.Instance = addr
+	return &reqCtx
+}
+
+// WithTraceParent copies the ReqCtx for calls made under the span traceParent
+func (ctx *ReqCtx) WithTraceParent(traceParent string) *ReqCtx {
+	reqCtx := *ctx
+	reqCtx.TraceParent = traceParent
+	return &reqCtx
 }
 
 type WebTransportHandle struct {
 	WtStream any
 	Writer   *bufio.Writer
+	// Closes WtStream once everything flushed to Writer has gone out
+	Closer io.Closer
+	// Aborts WtStream, even in the middle of a write. Can be nil.
+	CancelWrite func()
+}
+
+// Close hangs up the stream without losing what was just sent on it.
+func (handle *WebTransportHandle) Close() error {
+	return handle.Closer.Close()
+}
+
+// Cancel hangs up the stream right away, dropping anything not sent yet. A
+// write stuck on it returns an error. Don't Close the handle after this.
+func (handle *WebTransportHandle) Cancel() {
+	if handle.CancelWrite != nil {
+		handle.CancelWrite()
+	}
 }
@@ -11,9 +11,9 @@ import (
 	"sync"
 	"time"
 
-	"github.com/quic-go/webtransport-go"
-	"github.com/yuv418/cs553project/backend/common"
+	"connectrpc.com/connect"
 	"github.com/yuv418/cs553project/backend/commondata"
+	"github.com/yuv418/cs553project/backend/playability"
 	framegenpb "github.com/yuv418/cs553project/backend/protos/frame_gen"
 	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
 	musicpb "github.com/yuv418/cs553project/backend/protos/music"
@@ -35,13 +35,15 @@ const (
 	Over
 )
 
+// The physics live in playability, so the world validator checks worlds
+// against the same numbers
 const (
 	groundHeight = 112
-	pipeWidth    = 72
-	gravity      = 0.25
-	flapStrength = 4.6
-	maxPipeSpeed = 5
-	birdX        = 50
+	pipeWidth    = playability.PipeWidth
+	gravity      = playability.Gravity
+	flapStrength = playability.FlapStrength
+	maxPipeSpeed = playability.MaxPipeSpeed
+	birdX        = playability.BirdX
 )
 
 type IndividualGameState struct {
@@ -64,10 +66,37 @@ type IndividualGameState struct {
 	prevClosestPipe int
 	birdWidth       float64
 	birdHeight      float64
+	// Set if this bird is racing in a room
+	room *Room
+	// Read-only viewers that get a copy of every frame
+	spectators     []*spectator
+	viewportHeight float64
+	// Frame numbers the player flapped on, so the game can be replayed as a ghost
+	flapFrames []int32
+	// Set if the player is racing an earlier run
+	ghost *ghostState
+	// Sounds waiting for the next frame, when SOUND_DELIVERY=frame
+	pendingSounds []*framegenpb.SoundEvent
+	// Set once the game loop is running
+	hasSession bool
+	// traceparent of the last flap, until a frame with it goes out
+	inputTrace string
+	// When the first input since the last frame came in
+	inputAt time.Time
+	// Frames sent to the player so far. Goes in each frame as its seq.
+	frameSeq int64
+	// Clock sync pings waiting for the next tick
+	pendingPongs []*framegenpb.TimeSyncPong
+	// Set while a snapshot is on its way to another engine, which freezes the game
+	migrating bool
+	// Where the game went, for the game loop to pass on to the client
+	movedTo string
 }
 
 type GameState struct {
 	individualStateMap map[string]*IndividualGameState
+	// Games that moved to another engine, and its WebTransport address
+	movedGames map[string]string
 }
 
 type SessionState struct {
@@ -90,40 +119,178 @@ func MakeSessionState() *SessionState {
 func MakeGameState() *GameState {
 	state := &GameState{}
 	state.individualStateMap = make(map[string]*IndividualGameState)
+	state.movedGames = make(map[string]string)
 
 	return state
 }
 
-func StartGame(ctx *commondata.ReqCtx, req *enginepb.GameEngineStartReq) (*emptypb.Empty, error) {
-	GlobalStateLock.Lock()
-
-	// TODO: Validate that the game ID doesn't already exist.
-	game := &IndividualGameState{
-		birdY:        200,
+func newIndividualGameState(world *worldgenpb.WorldGenerated, viewportWidth int32, viewportHeight int32, birdWidth int32, birdHeight int32) *IndividualGameState {
+	return &IndividualGameState{
+		birdY:        playability.StartY,
 		birdVelocity: 0,
-		flapForce:    float64(req.ViewportHeight) / 10,
-		world:        req.World,
+		flapForce:    float64(viewportHeight) / 10,
+		world:        world,
 		frame:        0,
 		score:        0,
 		playState:    Ready,
 		// TODO maybe remove this
 		groundX:   0,
-		pipeSpeed: 2,
+		pipeSpeed: playability.StartPipeSpeed,
 		// Msut be less than 1
-		pipeWindowX:     float64(req.ViewportWidth) * -0.5,
-		pipeWindowWidth: float64(req.ViewportWidth),
+		pipeWindowX:     float64(viewportWidth) * -0.5,
+		pipeWindowWidth: float64(viewportWidth),
 		// Admittedly this could be better
-		pipesToRender:   int(float64(req.ViewportWidth)*float64(3)) / (pipeWidth + int(req.World.PipeSpacing)),
+		pipesToRender:   int(float64(viewportWidth)*float64(3)) / (pipeWidth + int(world.PipeSpacing)),
 		prevClosestPipe: 0,
-		birdWidth:       float64(req.BirdWidth),
-		birdHeight:      float64(req.BirdHeight),
+		birdWidth:       float64(birdWidth),
+		birdHeight:      float64(birdHeight),
+		viewportHeight:  float64(viewportHeight),
+	}
+}
+
+func newFrame(gameId string, pipesToRender int) *framegenpb.GenerateFrameReq {
+	return &framegenpb.GenerateFrameReq{
+		GameId:    gameId,
+		PipeWidth: pipeWidth,
+		BirdPosition: &framegenpb.Pos{
+			X: birdX,
+		},
+		PipePositions: make([]float64, pipesToRender, pipesToRender),
+		PipeStarts:    make([]float64, pipesToRender, pipesToRender),
+		PipeGaps:      make([]float64, pipesToRender, pipesToRender),
+		GameOver:      false,
+	}
+}
+
+// Where clients reach this engine's WebTransport server. Only needed when
+// there's more than one engine, since then the initiator has to tell clients
+// which one has their game.
+var PublicWtpAddr = commondata.GetEnv("ENGINE_PUBLIC_WTP_ADDR", "")
+
+// Must hold GlobalStateLock
+func startResp() *enginepb.GameEngineStartResp {
+	var activeGames int32
+	for _, game := range GlobalState.individualStateMap {
+		if game.playState != Over {
+			activeGames++
+		}
+	}
+	return &enginepb.GameEngineStartResp{
+		WebtransportAddr: PublicWtpAddr,
+		ActiveGames:      activeGames,
+	}
+}
+
+func StartGame(ctx *commondata.ReqCtx, req *enginepb.GameEngineStartReq) (*enginepb.GameEngineStartResp, error) {
+	if req.RoomId != nil {
+		return joinRoom(ctx, req)
+	}
+
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	if draining {
+		return nil, connect.NewError(connect.CodeUnavailable, fmt.Errorf("engine is draining"))
+	}
+
+	// TODO: Validate that the game ID doesn't already exist.
+	game := newIndividualGameState(req.World, req.ViewportWidth, req.ViewportHeight, req.BirdWidth, req.BirdHeight)
+	if req.Ghost != nil {
+		game.ghost = newGhost(req.World, req.ViewportWidth, req.ViewportHeight, req.Ghost)
 	}
 
 	GlobalState.individualStateMap[req.GameId] = game
 
-	GlobalStateLock.Unlock()
+	return startResp(), nil
+}
+
+// Moves the bird and the pipe window forward one tick and writes the result into frameUpdate.
+// Returns whether the bird made it past a pipe and whether it hit one.
+func (statePtr *IndividualGameState) step(frameUpdate *framegenpb.GenerateFrameReq) (scored bool, died bool) {
+	statePtr.frame++
+	statePtr.birdVelocity += gravity
+	statePtr.birdY += statePtr.birdVelocity
+
+	// TODO check collisions
+
+	// Advance the pipe window
+	statePtr.pipeWindowX += statePtr.pipeSpeed
+
+	advanceAmt := pipeWidth + statePtr.world.PipeSpacing
+
+	closestPipe := 0
+	// Render the pipes
+	for i := range statePtr.pipesToRender {
+		// Find the closest pipe to
+		// pipeWindowX + (i*advanceAmt)
+
+		if i == 0 {
+			adj := (statePtr.pipeWindowX - pipeWidth)
+			closestPipe = int(math.Max(0, math.Ceil(adj/advanceAmt)))
+			// log.Printf("adj %f pipeWindowX %f closest pipe is %d\n", adj, statePtr.pipeWindowX, closestPipe)
+			if statePtr.prevClosestPipe != closestPipe {
+				statePtr.score++
+				statePtr.prevClosestPipe = closestPipe
+				scored = true
+			}
+		} else {
+			closestPipe++
+		}
+
+		closestPipePos := (float64(closestPipe) * advanceAmt) //  + statePtr.pipeStartOffset
+
+		// TODO check out of bounds
+		frameUpdate.PipePositions[i] = closestPipePos - statePtr.pipeWindowX
+		frameUpdate.PipeGaps[i] = statePtr.world.PipeSpecs[closestPipe].GapHeight
+		frameUpdate.PipeStarts[i] = statePtr.world.PipeSpecs[closestPipe].GapStart
+
+		// Bounding box intersection check (supposedly)
+		if ((birdX > frameUpdate.PipePositions[i] &&
+			birdX < frameUpdate.PipePositions[i]+pipeWidth) ||
+			(birdX+statePtr.birdWidth > frameUpdate.PipePositions[i] &&
+				birdX < frameUpdate.PipePositions[i]+pipeWidth)) &&
+			(statePtr.birdY < statePtr.world.PipeSpecs[closestPipe].GapStart ||
+				statePtr.birdY+statePtr.birdHeight > statePtr.world.PipeSpecs[closestPipe].GapStart+statePtr.world.PipeSpecs[closestPipe].GapHeight) {
+
+			log.Printf(
+				"birdX %d, birdY %f, pipePos %f, pipePosEnd %f, GapStart %f, GapAfter %f Game over!",
+				birdX,
+				statePtr.birdY,
+				frameUpdate.PipePositions[i],
+				frameUpdate.PipePositions[i]+pipeWidth,
+				statePtr.world.PipeSpecs[closestPipe].GapStart,
+				statePtr.world.PipeSpecs[closestPipe].GapStart+statePtr.world.PipeSpecs[closestPipe].GapHeight,
+			)
+			died = true
+		}
+
+	}
+
+	// Increase difficulty slightly
+	if statePtr.score%5 == 0 && statePtr.pipeSpeed < maxPipeSpeed {
+		statePtr.pipeSpeed += playability.PipeSpeedStep
+	}
 
-	return &emptypb.Empty{}, nil
+	frameUpdate.Score = statePtr.score
+	frameUpdate.BirdPosition.Y = statePtr.birdY
+
+	return scored, died
+}
+
+// What the score service gets when a game ends. Has everything needed to replay it as a ghost.
+func (statePtr *IndividualGameState) scoreEntry(gameId string) *scorepb.ScoreEntry {
+	seed := statePtr.world.Seed
+	return &scorepb.ScoreEntry{
+		Score:          statePtr.score,
+		GameId:         gameId,
+		FinishTime:     timestamppb.New(time.Now()),
+		WorldSeed:      &seed,
+		ViewportWidth:  int32(statePtr.pipeWindowWidth),
+		ViewportHeight: int32(statePtr.viewportHeight),
+		BirdWidth:      int32(statePtr.birdWidth),
+		BirdHeight:     int32(statePtr.birdHeight),
+		FlapFrames:     statePtr.flapFrames,
+	}
 }
 
 func EstablishGameWebTransport(ctx *commondata.ReqCtx, handle *commondata.WebTransportHandle) error {
@@ -138,6 +305,25 @@ func EstablishGameWebTransport(ctx *commondata.ReqCtx, handle *commondata.WebTra
 
 	gameId := ctx.GameId
 
+	GlobalStateLock.Lock()
+	statePtr := GlobalState.individualStateMap[gameId]
+	movedTo, moved := GlobalState.movedGames[gameId]
+	if statePtr != nil && statePtr.room == nil && !moved {
+		statePtr.hasSession = true
+	}
+	GlobalStateLock.Unlock()
+
+	if moved {
+		sendMoved(gameId, movedTo, handle)
+		return nil
+	}
+	if statePtr == nil {
+		return fmt.Errorf("unknown game ID: %s", gameId)
+	}
+	if statePtr.room != nil {
+		return statePtr.room.addSession(ctx, handle)
+	}
+
 	go (func() {
 
 		timer := time.NewTicker((1000 / frameRate) * time.Millisecond)
@@ -146,132 +332,88 @@ func EstablishGameWebTransport(ctx *commondata.ReqCtx, handle *commondata.WebTra
 		pipesToRender := GlobalState.individualStateMap[gameId].pipesToRender
 		GlobalStateLock.Unlock()
 
-		frameUpdate := &framegenpb.GenerateFrameReq{
-			GameId:    gameId,
-			PipeWidth: pipeWidth,
-			BirdPosition: &framegenpb.Pos{
-				X: birdX,
-			},
-			PipePositions: make([]float64, pipesToRender, pipesToRender),
-			PipeStarts:    make([]float64, pipesToRender, pipesToRender),
-			PipeGaps:      make([]float64, pipesToRender, pipesToRender),
-			GameOver:      false,
-		}
+		frameUpdate := newFrame(gameId, pipesToRender)
+		clock := tickClock{}
 
 		for {
 			select {
-			case <-timer.C:
-				// Get the game ID corresponding to everything
+			case now := <-timer.C:
+				tick := clock.tick(now)
 
-				// TODO: Should we just lock to get the statePtr here and then
-				// lock again to write the statePtr, or what?
+				// Get the game ID corresponding to everything
 				GlobalStateLock.Lock()
 				statePtr := GlobalState.individualStateMap[gameId]
+				movedTo := statePtr.movedTo
 				GlobalStateLock.Unlock()
 
-				// This is, I think, redundant?
-				if statePtr.playState != Play {
-					continue
+				if movedTo != "" {
+					// Another engine has the game now
+					timer.Stop()
+					broadcastFrame(gameId, handle, &framegenpb.GenerateFrameReq{
+						GameId:  gameId,
+						MovedTo: movedTo,
+					}, nil)
+					handle.Close()
+					closeSpectators(gameId)
+
+					GlobalStateLock.Lock()
+					delete(GlobalState.individualStateMap, gameId)
+					GlobalStateLock.Unlock()
+					return
 				}
 
-				statePtr.birdVelocity += gravity
-				statePtr.birdY += statePtr.birdVelocity
-
-				// TODO check collisions
-
-				// Advance the pipe window
-				statePtr.pipeWindowX += statePtr.pipeSpeed
-
-				advanceAmt := pipeWidth + statePtr.world.PipeSpacing
-
-				closestPipe := 0
-				// Render the pipes
-				for i := range statePtr.pipesToRender {
-					// Find the closest pipe to
-					// pipeWindowX + (i*advanceAmt)
-
-					if i == 0 {
-						adj := (statePtr.pipeWindowX - pipeWidth)
-						closestPipe = int(math.Max(0, math.Ceil(adj/advanceAmt)))
-						// log.Printf("adj %f pipeWindowX %f closest pipe is %d\n", adj, statePtr.pipeWindowX, closestPipe)
-						if statePtr.prevClosestPipe != closestPipe {
-							statePtr.score++
-							statePtr.prevClosestPipe = closestPipe
-
-							go (func() {
-								common.Dispatch[musicpb.PlayMusicReq, emptypb.Empty](ctx, "PlayMusic", &musicpb.PlayMusicReq{
-									GameId: gameId,
-									Effect: musicpb.SoundEffect_SCORE_INCREASED,
-								})
-							})()
-						}
-					} else {
-						closestPipe++
-					}
+				// Clocks get synced before the game starts too
+				sendPongs(gameId, handle)
 
-					closestPipePos := (float64(closestPipe) * advanceAmt) //  + statePtr.pipeStartOffset
-
-					// TODO check out of bounds
-					frameUpdate.PipePositions[i] = closestPipePos - statePtr.pipeWindowX
-					frameUpdate.PipeGaps[i] = statePtr.world.PipeSpecs[closestPipe].GapHeight
-					frameUpdate.PipeStarts[i] = statePtr.world.PipeSpecs[closestPipe].GapStart
-
-					// Bounding box intersection check (supposedly)
-					if ((birdX > frameUpdate.PipePositions[i] &&
-						birdX < frameUpdate.PipePositions[i]+pipeWidth) ||
-						(birdX+statePtr.birdWidth > frameUpdate.PipePositions[i] &&
-							birdX < frameUpdate.PipePositions[i]+pipeWidth)) &&
-						(statePtr.birdY < statePtr.world.PipeSpecs[closestPipe].GapStart ||
-							statePtr.birdY+statePtr.birdHeight > statePtr.world.PipeSpecs[closestPipe].GapStart+statePtr.world.PipeSpecs[closestPipe].GapHeight) {
-
-						log.Printf(
-							"birdX %d, birdY %f, pipePos %f, pipePosEnd %f, GapStart %f, GapAfter %f Game over!",
-							birdX,
-							statePtr.birdY,
-							frameUpdate.PipePositions[i],
-							frameUpdate.PipePositions[i]+pipeWidth,
-							statePtr.world.PipeSpecs[closestPipe].GapStart,
-							statePtr.world.PipeSpecs[closestPipe].GapStart+statePtr.world.PipeSpecs[closestPipe].GapHeight,
-						)
-						statePtr.playState = Over
-						frameUpdate.GameOver = true
-
-						// This should be an asynchronous call to avoid blocking the
-						// game engine
-						go (func() {
-							common.Dispatch[musicpb.PlayMusicReq, emptypb.Empty](ctx, "PlayMusic", &musicpb.PlayMusicReq{
-								GameId: gameId,
-								Effect: musicpb.SoundEffect_DIE,
-							})
-							// This will quit
-							quit <- struct{}{}
-						})()
-
-						// TODO: Make this sync or async
-						common.Dispatch[scorepb.ScoreEntry, emptypb.Empty](ctx, "UpdateScore", &scorepb.ScoreEntry{
-							Score:      statePtr.score,
-							GameId:     gameId,
-							FinishTime: timestamppb.New(time.Now()),
-						})
+				// The whole tick happens under the lock, so a migration
+				// snapshot never catches the bird halfway through one
+				GlobalStateLock.Lock()
+				if statePtr.playState != Play || statePtr.migrating {
+					GlobalStateLock.Unlock()
+					continue
+				}
 
-					}
+				scored, died := statePtr.step(frameUpdate)
+				if statePtr.ghost != nil {
+					statePtr.ghost.step(frameUpdate)
+				}
 
+				if scored {
+					statePtr.playSound(ctx, gameId, musicpb.SoundEffect_SCORE_INCREASED)
 				}
 
-				// Increase difficulty slightly
-				if statePtr.score%5 == 0 && statePtr.pipeSpeed < maxPipeSpeed {
-					statePtr.pipeSpeed += 0.5
+				var finalScore *scorepb.ScoreEntry
+				if died {
+					statePtr.playState = Over
+					frameUpdate.GameOver = true
+					statePtr.playSound(ctx, gameId, musicpb.SoundEffect_DIE)
+					finalScore = statePtr.scoreEntry(gameId)
 				}
 
-				frameUpdate.Score = statePtr.score
-				frameUpdate.BirdPosition.Y = statePtr.birdY
+				frameUpdate.SoundEvents = statePtr.takeSounds()
+				GlobalStateLock.Unlock()
+
+				if finalScore != nil {
+					// The outbox keeps trying if the score service is down,
+					// so the loop doesn't wait on it
+					if err := scorepb.EnqueueUpdateScore(ctx, finalScore); err != nil {
+						log.Printf("(engine) Couldn't queue score for game %s: %s\n", gameId, err)
+					}
+
+					// The sound (if it's in the frame) goes out with this frame, then we're done
+					go (func() {
+						quit <- struct{}{}
+					})()
+				}
 
-				common.WebTransportSendBuf(handle.Writer, frameUpdate)
+				tick.compute = time.Since(tick.at)
+				broadcastFrame(gameId, handle, frameUpdate, tick)
 			case <-quit:
 				timer.Stop()
 
 				log.Printf("Closing game stream")
-				(*handle.WtStream.(*webtransport.Stream)).Close()
+				handle.Close()
+				closeSpectators(gameId)
 
 				return
 			}
@@ -285,6 +427,17 @@ func EstablishGameWebTransport(ctx *commondata.ReqCtx, handle *commondata.WebTra
 
 // This is a webtransport function, so returning nil will not send anything
 func HandleInput(ctx *commondata.ReqCtx, inp *enginepb.GameEngineInputReq) (*emptypb.Empty, error) {
+	recv := time.Now()
+
+	if inp.TimeSync != nil {
+		GlobalStateLock.Lock()
+		if statePtr := GlobalState.individualStateMap[ctx.GameId]; statePtr != nil {
+			statePtr.queuePong(inp.TimeSync, recv)
+		}
+		GlobalStateLock.Unlock()
+		return nil, nil
+	}
+
 	log.Printf("Username in HandleInput is %s game ID is %s\n", ctx.Username, ctx.GameId)
 
 	switch inp.Key {
@@ -292,20 +445,34 @@ func HandleInput(ctx *commondata.ReqCtx, inp *enginepb.GameEngineInputReq) (*emp
 		GlobalStateLock.Lock()
 		statePtr := GlobalState.individualStateMap[ctx.GameId]
 
-		if statePtr.playState == Ready {
+		if statePtr == nil || statePtr.migrating {
+			// Gone or on its way out, the flap would be lost anyway
+			GlobalStateLock.Unlock()
+			break
+		}
+
+		if statePtr.room != nil && statePtr.playState == Ready {
+			// The first flap from anyone starts the race for everyone
+			statePtr.room.start()
+		} else if statePtr.playState == Ready {
 			statePtr.playState = Play
+			if statePtr.ghost != nil {
+				statePtr.ghost.bird.playState = Play
+			}
 		} else if statePtr.playState == Play {
 			statePtr.birdVelocity = -flapStrength
+			statePtr.flapFrames = append(statePtr.flapFrames, statePtr.frame)
+		}
+		if ctx.TraceParent != "" {
+			statePtr.inputTrace = ctx.TraceParent
+		}
+		if statePtr.inputAt.IsZero() {
+			statePtr.inputAt = recv
 		}
 
-		GlobalStateLock.Unlock()
+		statePtr.playSound(ctx, ctx.GameId, musicpb.SoundEffect_JUMP)
 
-		go (func() {
-			common.Dispatch[musicpb.PlayMusicReq, emptypb.Empty](ctx, "PlayMusic", &musicpb.PlayMusicReq{
-				GameId: ctx.GameId,
-				Effect: musicpb.SoundEffect_JUMP,
-			})
-		})()
+		GlobalStateLock.Unlock()
 		break
 	default:
 		fmt.Fprintf(os.Stderr, "invalid key in Key enum %d\n", inp.Key)
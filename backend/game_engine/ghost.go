@@ -0,0 +1,53 @@
+package engine
+
+// Ghost runs: replay an earlier game's flaps against the same world, next to
+// the live bird. The physics are deterministic per tick, so the flap frames
+// are all we need.
+
+import (
+	framegenpb "github.com/yuv418/cs553project/backend/protos/frame_gen"
+	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
+	worldgenpb "github.com/yuv418/cs553project/backend/protos/world_gen"
+)
+
+type ghostState struct {
+	gameId     string
+	bird       *IndividualGameState
+	flapFrames []int32
+	nextFlap   int
+	// The ghost's own pipe positions, which nobody looks at
+	scratch *framegenpb.GenerateFrameReq
+}
+
+func newGhost(world *worldgenpb.WorldGenerated, viewportWidth int32, viewportHeight int32, run *enginepb.GhostRun) *ghostState {
+	bird := newIndividualGameState(world, viewportWidth, viewportHeight, run.BirdWidth, run.BirdHeight)
+	return &ghostState{
+		gameId:     run.GameId,
+		bird:       bird,
+		flapFrames: run.FlapFrames,
+		scratch:    newFrame(run.GameId, bird.pipesToRender),
+	}
+}
+
+// Replays any flaps due this tick, moves the ghost, and puts it in the live frame.
+func (ghost *ghostState) step(frameUpdate *framegenpb.GenerateFrameReq) {
+	bird := ghost.bird
+
+	if bird.playState == Play {
+		for ghost.nextFlap < len(ghost.flapFrames) && ghost.flapFrames[ghost.nextFlap] <= bird.frame {
+			bird.birdVelocity = -flapStrength
+			ghost.nextFlap++
+		}
+
+		_, died := bird.step(ghost.scratch)
+		if died {
+			bird.playState = Over
+		}
+	}
+
+	if frameUpdate.GhostPosition == nil {
+		frameUpdate.GhostPosition = &framegenpb.Pos{X: birdX}
+	}
+	frameUpdate.GhostPosition.Y = bird.birdY
+	frameUpdate.GhostOver = bird.playState == Over
+}
@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"testing"
+
+	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
+	worldgen "github.com/yuv418/cs553project/backend/world_gen"
+)
+
+// Longest a test game is played for
+const maxTestFrames = 10000
+
+func TestGhostReplaysTheSameGame(t *testing.T) {
+	world := worldgen.GenerateWorldWithSeed(42, testWidth, testHeight)
+
+	// Plays like someone aiming for the middle of the next gap, flapping
+	// the way HandleInput does
+	bird := newIndividualGameState(world, testWidth, testHeight, 34, 24)
+	bird.playState = Play
+	frame := newFrame("live", bird.pipesToRender)
+	for bird.playState == Play && bird.frame < maxTestFrames {
+		target := frame.PipeStarts[0] + frame.PipeGaps[0]/2
+		if bird.frame == 0 || (bird.birdY > target && bird.birdVelocity > 0) {
+			bird.birdVelocity = -flapStrength
+			bird.flapFrames = append(bird.flapFrames, bird.frame)
+		}
+		if _, died := bird.step(frame); died {
+			bird.playState = Over
+		}
+	}
+	if bird.playState != Over || bird.score == 0 {
+		t.Fatalf("test game scored %d and ended at frame %d, want a game that scores and ends", bird.score, bird.frame)
+	}
+
+	ghost := newGhost(world, testWidth, testHeight, &enginepb.GhostRun{
+		GameId:     "live",
+		FlapFrames: bird.flapFrames,
+		BirdWidth:  34,
+		BirdHeight: 24,
+	})
+	ghost.bird.playState = Play
+	liveFrame := newFrame("other", bird.pipesToRender)
+	for !liveFrame.GhostOver && ghost.bird.frame < maxTestFrames {
+		ghost.step(liveFrame)
+	}
+
+	if ghost.bird.score != bird.score || ghost.bird.frame != bird.frame {
+		t.Errorf("ghost scored %d and died at frame %d, the game scored %d and ended at frame %d",
+			ghost.bird.score, ghost.bird.frame, bird.score, bird.frame)
+	}
+	if ghost.nextFlap != len(bird.flapFrames) {
+		t.Errorf("ghost flapped %d times, the player flapped %d", ghost.nextFlap, len(bird.flapFrames))
+	}
+	if liveFrame.GhostPosition.Y != bird.birdY {
+		t.Errorf("ghost ended at y %f, the player at %f", liveFrame.GhostPosition.Y, bird.birdY)
+	}
+}
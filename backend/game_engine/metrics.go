@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/yuv418/cs553project/backend/common"
+	"github.com/yuv418/cs553project/backend/stats"
+)
+
+// A frame should take well under a tick (33ms) to go out
+var frameBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1}
+
+var (
+	frameSendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "flappy_frame_send_duration_seconds",
+		Help:    "How long writing a frame to the player and spectators took.",
+		Buckets: frameBuckets,
+	})
+
+	spectatorFramesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "flappy_spectator_frames_dropped_total",
+		Help: "Frames spectators missed because they were too far behind.",
+	})
+
+	tickJitter = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "flappy_tick_jitter_seconds",
+		Help:    "How far the time between two ticks of a game loop was from 1/30s.",
+		Buckets: frameBuckets,
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "flappy_active_games",
+		Help: "Games on this engine that aren't over.",
+	}, func() float64 {
+		GlobalStateLock.Lock()
+		defer GlobalStateLock.Unlock()
+		return float64(startResp().ActiveGames)
+	})
+)
+
+// Per-frame timing, written next to the Dispatch stats. See stats/frames.go.
+var frameStats *stats.FrameStatWriter
+
+func StartFrameStats() {
+	frameStats = stats.StartFrameStatThread()
+}
+
+// CloseFrameStats writes out the last frame stats, once the games are over.
+func CloseFrameStats(ctx context.Context) error {
+	if frameStats != nil {
+		frameStats.Close()
+	}
+	return nil
+}
+
+// When a tick was supposed to happen, when it did, and how long it took to
+// get its frames ready
+type tickTiming struct {
+	scheduled time.Time
+	at        time.Time
+	compute   time.Duration
+}
+
+// Tracks one game loop's ticks
+type tickClock struct {
+	first time.Time
+	last  time.Time
+}
+
+// now is when the ticker fired
+func (clock *tickClock) tick(now time.Time) *tickTiming {
+	interval := (1000 / frameRate) * time.Millisecond
+	if !clock.last.IsZero() {
+		tickJitter.Observe(math.Abs((now.Sub(clock.last) - interval).Seconds()))
+	}
+	clock.last = now
+	if clock.first.IsZero() {
+		clock.first = now
+	}
+
+	// The ticker skips ticks we're too slow for, so go by the nearest one
+	// we should have had rather than counting them
+	ticks := now.Sub(clock.first).Round(interval) / interval
+	return &tickTiming{
+		scheduled: clock.first.Add(ticks * interval),
+		at:        time.Now(),
+	}
+}
+
+// Records a frame sent on the player's session
+func recordFrame(gameId string, seq int64, tick *tickTiming, send common.SendTiming, inputAt time.Time, sent time.Time) {
+	if frameStats == nil || tick == nil {
+		return
+	}
+
+	frame := &stats.FrameStat{
+		GameId:      gameId,
+		Seq:         seq,
+		ScheduledAt: tick.scheduled,
+		TickedAt:    tick.at,
+		Compute:     tick.compute,
+		Write:       send.Write,
+		Flush:       send.Flush,
+	}
+	if !inputAt.IsZero() {
+		frame.InputToFrame = sent.Sub(inputAt)
+	}
+	frameStats.Record(frame)
+}
@@ -0,0 +1,305 @@
+package engine
+
+// Moving games to another engine so this one can be shut down without ending
+// them. The game is frozen while its snapshot goes over, then the client gets
+// one last frame telling it where to reconnect. Room games stay put, since
+// every bird in a room has to be on the same engine.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/yuv418/cs553project/backend/common"
+	"github.com/yuv418/cs553project/backend/commondata"
+	framegenpb "github.com/yuv418/cs553project/backend/protos/frame_gen"
+	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
+)
+
+// How the other services reach this engine, the same as in their
+// GAME_ENGINE_URL. Only needed to drain without naming a target.
+var SelfAddr = commondata.GetEnv("ENGINE_SELF_ADDR", "")
+
+// Set once we start draining, after which new games are turned away
+var draining = false
+
+// How long a game moved here waits for its client to reconnect before it's dropped
+const restoreConnectTimeout = 30 * time.Second
+
+func (statePtr *IndividualGameState) snapshot() *enginepb.BirdSnapshot {
+	return &enginepb.BirdSnapshot{
+		World:           statePtr.world,
+		BirdY:           statePtr.birdY,
+		BirdVelocity:    statePtr.birdVelocity,
+		FlapForce:       statePtr.flapForce,
+		Frame:           statePtr.frame,
+		Score:           statePtr.score,
+		PlayState:       enginepb.PlayState(statePtr.playState),
+		GroundX:         statePtr.groundX,
+		PipeSpeed:       statePtr.pipeSpeed,
+		PipeWindowX:     statePtr.pipeWindowX,
+		PipeWindowWidth: statePtr.pipeWindowWidth,
+		PipesToRender:   int32(statePtr.pipesToRender),
+		PipeStarts:      statePtr.pipeStarts,
+		PipePositions:   statePtr.pipePositions,
+		PipeGaps:        statePtr.pipeGaps,
+		PrevClosestPipe: int32(statePtr.prevClosestPipe),
+		BirdWidth:       statePtr.birdWidth,
+		BirdHeight:      statePtr.birdHeight,
+		ViewportHeight:  statePtr.viewportHeight,
+		FlapFrames:      statePtr.flapFrames,
+	}
+}
+
+func restoreBird(snapshot *enginepb.BirdSnapshot) *IndividualGameState {
+	return &IndividualGameState{
+		world:           snapshot.World,
+		birdY:           snapshot.BirdY,
+		birdVelocity:    snapshot.BirdVelocity,
+		flapForce:       snapshot.FlapForce,
+		frame:           snapshot.Frame,
+		score:           snapshot.Score,
+		playState:       PlayState(snapshot.PlayState),
+		groundX:         snapshot.GroundX,
+		pipeSpeed:       snapshot.PipeSpeed,
+		pipeWindowX:     snapshot.PipeWindowX,
+		pipeWindowWidth: snapshot.PipeWindowWidth,
+		pipesToRender:   int(snapshot.PipesToRender),
+		pipeStarts:      snapshot.PipeStarts,
+		pipePositions:   snapshot.PipePositions,
+		pipeGaps:        snapshot.PipeGaps,
+		prevClosestPipe: int(snapshot.PrevClosestPipe),
+		birdWidth:       snapshot.BirdWidth,
+		birdHeight:      snapshot.BirdHeight,
+		viewportHeight:  snapshot.ViewportHeight,
+		flapFrames:      snapshot.FlapFrames,
+	}
+}
+
+// Must hold GlobalStateLock
+func (statePtr *IndividualGameState) gameSnapshot(gameId string) *enginepb.GameSnapshot {
+	snapshot := &enginepb.GameSnapshot{
+		GameId:   gameId,
+		Bird:     statePtr.snapshot(),
+		FrameSeq: statePtr.frameSeq,
+	}
+	if ghost := statePtr.ghost; ghost != nil {
+		snapshot.Ghost = &enginepb.GhostSnapshot{
+			Run: &enginepb.GhostRun{
+				GameId:     ghost.gameId,
+				FlapFrames: ghost.flapFrames,
+				BirdWidth:  int32(ghost.bird.birdWidth),
+				BirdHeight: int32(ghost.bird.birdHeight),
+			},
+			Bird:     ghost.bird.snapshot(),
+			NextFlap: int32(ghost.nextFlap),
+		}
+	}
+	return snapshot
+}
+
+func RestoreGame(ctx *commondata.ReqCtx, snapshot *enginepb.GameSnapshot) (*enginepb.GameEngineStartResp, error) {
+	if err := common.RequireService(ctx); err != nil {
+		return nil, err
+	}
+
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	if draining {
+		return nil, connect.NewError(connect.CodeUnavailable, fmt.Errorf("engine is draining"))
+	}
+	if _, ok := GlobalState.individualStateMap[snapshot.GameId]; ok {
+		return nil, fmt.Errorf("game %s is already here", snapshot.GameId)
+	}
+
+	game := restoreBird(snapshot.Bird)
+	game.frameSeq = snapshot.FrameSeq
+	if snapshot.Ghost != nil {
+		bird := restoreBird(snapshot.Ghost.Bird)
+		game.ghost = &ghostState{
+			gameId:     snapshot.Ghost.Run.GameId,
+			bird:       bird,
+			flapFrames: snapshot.Ghost.Run.FlapFrames,
+			nextFlap:   int(snapshot.Ghost.NextFlap),
+			scratch:    newFrame(snapshot.Ghost.Run.GameId, bird.pipesToRender),
+		}
+	}
+	GlobalState.individualStateMap[snapshot.GameId] = game
+	delete(GlobalState.movedGames, snapshot.GameId)
+
+	log.Printf("(engine) Took over game %s at frame %d\n", snapshot.GameId, game.frame)
+	time.AfterFunc(restoreConnectTimeout, func() {
+		dropUnclaimed(snapshot.GameId, game)
+	})
+
+	return startResp(), nil
+}
+
+// Removes a game that was moved here if its client never showed up
+func dropUnclaimed(gameId string, game *IndividualGameState) {
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	if GlobalState.individualStateMap[gameId] != game || game.hasSession || game.migrating {
+		return
+	}
+	delete(GlobalState.individualStateMap, gameId)
+	log.Printf("(engine) Nobody reconnected to moved game %s, dropping it\n", gameId)
+}
+
+// Drain stops new games from starting here and moves every running game to
+// another engine. Only services (see common.ServiceJwt) can call it.
+func Drain(ctx *commondata.ReqCtx, req *enginepb.EngineDrainReq) (*enginepb.EngineDrainResp, error) {
+	if err := common.RequireService(ctx); err != nil {
+		return nil, err
+	}
+	return drain(ctx, req)
+}
+
+func drain(ctx *commondata.ReqCtx, req *enginepb.EngineDrainReq) (*enginepb.EngineDrainResp, error) {
+	target := req.TargetInstance
+	if target == "" {
+		if SelfAddr == "" {
+			return nil, fmt.Errorf("no target engine given and ENGINE_SELF_ADDR isn't set")
+		}
+		for _, instance := range common.ServiceInstances(common.AbsCtx, enginepb.GameEngineServiceName, true) {
+			if instance != SelfAddr {
+				target = instance
+				break
+			}
+		}
+		if target == "" {
+			return nil, fmt.Errorf("there's no other engine to move games to")
+		}
+	}
+
+	GlobalStateLock.Lock()
+	draining = true
+	var gameIds []string
+	for gameId, statePtr := range GlobalState.individualStateMap {
+		if statePtr.playState != Over && statePtr.movedTo == "" {
+			gameIds = append(gameIds, gameId)
+		}
+	}
+	GlobalStateLock.Unlock()
+
+	log.Printf("(engine) Draining %d games to %s\n", len(gameIds), target)
+
+	resp := &enginepb.EngineDrainResp{}
+	for _, gameId := range gameIds {
+		moved, err := migrateGame(ctx, gameId, target)
+		switch {
+		case err != nil:
+			log.Printf("(engine) Couldn't move game %s: %s\n", gameId, err)
+			resp.Failed++
+		case moved:
+			resp.Migrated++
+		default:
+			resp.Skipped++
+		}
+	}
+	return resp, nil
+}
+
+// Sends the game to target and points its client there. Returns false if the
+// game can't move.
+func migrateGame(ctx *commondata.ReqCtx, gameId string, target string) (bool, error) {
+	GlobalStateLock.Lock()
+	statePtr := GlobalState.individualStateMap[gameId]
+	if statePtr == nil || statePtr.room != nil || statePtr.playState == Over {
+		GlobalStateLock.Unlock()
+		return false, nil
+	}
+	// Frozen until it's either gone or we give up
+	statePtr.migrating = true
+	snapshot := statePtr.gameSnapshot(gameId)
+	GlobalStateLock.Unlock()
+
+	// RestoreGame only takes calls from other services
+	serviceCtx, err := common.AsService(ctx.WithInstance(target), enginepb.GameEngineServiceName)
+	var resp *enginepb.GameEngineStartResp
+	if err == nil {
+		resp, err = enginepb.DispatchEngineRestoreGame(serviceCtx, snapshot)
+	}
+	if err == nil && resp.WebtransportAddr == "" {
+		// The other engine has it now, but there'd be no telling the client where
+		err = fmt.Errorf("%s doesn't know its address, set ENGINE_PUBLIC_WTP_ADDR there", target)
+	}
+
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	if err != nil {
+		statePtr.migrating = false
+		return false, err
+	}
+
+	GlobalState.movedGames[gameId] = resp.WebtransportAddr
+	if statePtr.hasSession {
+		// The game loop sends the client on its way
+		statePtr.movedTo = resp.WebtransportAddr
+	} else {
+		delete(GlobalState.individualStateMap, gameId)
+	}
+
+	log.Printf("(engine) Moved game %s to %s\n", gameId, resp.WebtransportAddr)
+	return true, nil
+}
+
+// Tells a client that connected to a game we gave away where it went.
+func sendMoved(gameId string, movedTo string, handle *commondata.WebTransportHandle) {
+	common.WebTransportSendBuf(handle.Writer, &framegenpb.GenerateFrameReq{
+		GameId:  gameId,
+		MovedTo: movedTo,
+	})
+	handle.Close()
+}
+
+// Shutdown turns away new games and waits for the running ones to end. With
+// ENGINE_SELF_ADDR set, solo games move to another engine first instead.
+func Shutdown(ctx context.Context) error {
+	GlobalStateLock.Lock()
+	draining = true
+	GlobalStateLock.Unlock()
+
+	if SelfAddr != "" {
+		resp, err := drain(&commondata.ReqCtx{Ctx: ctx}, &enginepb.EngineDrainReq{})
+		if err != nil {
+			log.Printf("(engine) Couldn't move games before shutting down: %s\n", err)
+		} else {
+			log.Printf("(engine) Moved %d games, %d failed and %d have to finish here\n", resp.Migrated, resp.Failed, resp.Skipped)
+		}
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		running := runningGames()
+		if running == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d games were still running", running)
+		}
+	}
+}
+
+// Games someone is playing (or about to). Games nobody connected to don't count.
+func runningGames() int {
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	running := 0
+	for _, statePtr := range GlobalState.individualStateMap {
+		if statePtr.playState == Play || (statePtr.hasSession && statePtr.playState != Over) {
+			running++
+		}
+	}
+	return running
+}
@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/yuv418/cs553project/backend/common"
+	"github.com/yuv418/cs553project/backend/commondata"
+	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
+	worldgen "github.com/yuv418/cs553project/backend/world_gen"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testWidth  = 800
+	testHeight = 600
+)
+
+// A game partway through, with a ghost
+func playedGame(t *testing.T) *IndividualGameState {
+	t.Helper()
+
+	world := worldgen.GenerateWorldWithSeed(42, testWidth, testHeight)
+	game := newIndividualGameState(world, testWidth, testHeight, 34, 24)
+	game.ghost = newGhost(world, testWidth, testHeight, &enginepb.GhostRun{
+		GameId:     "earlier",
+		FlapFrames: []int32{3, 20, 40},
+		BirdWidth:  34,
+		BirdHeight: 24,
+	})
+	game.playState = Play
+	game.ghost.bird.playState = Play
+	game.frameSeq = 17
+
+	frame := newFrame("game", game.pipesToRender)
+	for i := range 30 {
+		if i%10 == 0 {
+			game.birdVelocity = -flapStrength
+			game.flapFrames = append(game.flapFrames, game.frame)
+		}
+		game.step(frame)
+		game.ghost.step(frame)
+	}
+	return game
+}
+
+// Sends the snapshot over the wire and back, like a migration does
+func roundTrip(t *testing.T, snapshot *enginepb.GameSnapshot) *enginepb.GameSnapshot {
+	t.Helper()
+
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &enginepb.GameSnapshot{}
+	if err := proto.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	game := playedGame(t)
+	snapshot := roundTrip(t, game.gameSnapshot("game"))
+
+	restored := restoreBird(snapshot.Bird)
+	if !proto.Equal(restored.snapshot(), game.snapshot()) {
+		t.Fatalf("restored bird differs:\n got %v\nwant %v", restored.snapshot(), game.snapshot())
+	}
+	if snapshot.FrameSeq != game.frameSeq {
+		t.Errorf("frame seq %d, want %d", snapshot.FrameSeq, game.frameSeq)
+	}
+	if snapshot.Ghost == nil || !proto.Equal(snapshot.Ghost.Bird, game.ghost.bird.snapshot()) ||
+		int(snapshot.Ghost.NextFlap) != game.ghost.nextFlap {
+		t.Fatalf("ghost didn't come through: %v", snapshot.Ghost)
+	}
+
+	// Both have to play out exactly the same from here
+	restoredGhost := restoreBird(snapshot.Ghost.Bird)
+	ghost := &ghostState{
+		bird:       restoredGhost,
+		flapFrames: snapshot.Ghost.Run.FlapFrames,
+		nextFlap:   int(snapshot.Ghost.NextFlap),
+		scratch:    newFrame("earlier", restoredGhost.pipesToRender),
+	}
+	want := newFrame("game", game.pipesToRender)
+	got := newFrame("game", restored.pipesToRender)
+	for range 60 {
+		game.step(want)
+		game.ghost.step(want)
+		restored.step(got)
+		ghost.step(got)
+		if !proto.Equal(got, want) {
+			t.Fatalf("frame %d differs after restoring:\n got %v\nwant %v", game.frame, got, want)
+		}
+	}
+}
+
+func serviceCtx(t *testing.T) *commondata.ReqCtx {
+	t.Helper()
+
+	token, err := common.AbsCtx.CommonServer.Cfg.ServiceJwt("gameEngine", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &commondata.ReqCtx{Jwt: token}
+}
+
+func TestRestoreGame(t *testing.T) {
+	snapshot := roundTrip(t, playedGame(t).gameSnapshot("restored"))
+	t.Cleanup(func() {
+		GlobalStateLock.Lock()
+		delete(GlobalState.individualStateMap, "restored")
+		GlobalStateLock.Unlock()
+	})
+
+	// Players can't push games onto an engine
+	userToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": "alice",
+		"exp":      time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte(common.AbsCtx.CommonServer.Cfg.JWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ctx := range []*commondata.ReqCtx{{}, {Jwt: "nope"}, {Jwt: userToken}} {
+		if _, err := RestoreGame(ctx, snapshot); connect.CodeOf(err) != connect.CodePermissionDenied {
+			t.Errorf("RestoreGame with %q gave %v, want permission denied", ctx.Jwt, err)
+		}
+	}
+
+	if _, err := RestoreGame(serviceCtx(t), snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreGame(serviceCtx(t), snapshot); err == nil {
+		t.Error("restoring the same game twice worked")
+	}
+
+	GlobalStateLock.Lock()
+	game := GlobalState.individualStateMap["restored"]
+	GlobalStateLock.Unlock()
+	if game == nil || game.frameSeq != snapshot.FrameSeq || game.ghost == nil {
+		t.Fatalf("restored game is %+v", game)
+	}
+
+	// Nobody connected in time
+	dropUnclaimed("restored", game)
+	GlobalStateLock.Lock()
+	_, ok := GlobalState.individualStateMap["restored"]
+	GlobalStateLock.Unlock()
+	if ok {
+		t.Error("unclaimed game is still around")
+	}
+}
+
+func TestDropUnclaimedKeepsConnectedGames(t *testing.T) {
+	game := playedGame(t)
+	game.hasSession = true
+
+	GlobalStateLock.Lock()
+	GlobalState.individualStateMap["connected"] = game
+	GlobalStateLock.Unlock()
+	t.Cleanup(func() {
+		GlobalStateLock.Lock()
+		delete(GlobalState.individualStateMap, "connected")
+		GlobalStateLock.Unlock()
+	})
+
+	dropUnclaimed("connected", game)
+
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+	if GlobalState.individualStateMap["connected"] != game {
+		t.Error("dropped a game its client reconnected to")
+	}
+}
+
+func TestDrainNeedsServiceToken(t *testing.T) {
+	_, err := Drain(&commondata.ReqCtx{}, &enginepb.EngineDrainReq{TargetInstance: "elsewhere"})
+	if connect.CodeOf(err) != connect.CodePermissionDenied {
+		t.Errorf("got %v, want permission denied", err)
+	}
+}
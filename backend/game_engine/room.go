@@ -0,0 +1,340 @@
+package engine
+
+// Race rooms: several players, one world, one tick loop.
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/yuv418/cs553project/backend/commondata"
+	framegenpb "github.com/yuv418/cs553project/backend/protos/frame_gen"
+	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
+	musicpb "github.com/yuv418/cs553project/backend/protos/music"
+	scorepb "github.com/yuv418/cs553project/backend/protos/score"
+	worldgenpb "github.com/yuv418/cs553project/backend/protos/world_gen"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const defaultMaxPlayers = 8
+
+// How long a room waits for its first flap before it's torn down
+const roomStartTimeout = 2 * time.Minute
+
+type roomSession struct {
+	ctx    *commondata.ReqCtx
+	handle *commondata.WebTransportHandle
+}
+
+// Everything in here is protected by GlobalStateLock, same as the games.
+type Room struct {
+	roomId         string
+	world          *worldgenpb.WorldGenerated
+	viewportWidth  int32
+	viewportHeight int32
+	maxPlayers     int
+	playState      PlayState
+	// Game IDs in the order the players joined
+	players []string
+	// The request each player joined with, so players who never connect
+	// still get their score recorded
+	joins map[string]*commondata.ReqCtx
+	// Players show up here once their WebTransport session is up
+	sessions map[string]*roomSession
+	frames   map[string]*framegenpb.GenerateFrameReq
+	// Game IDs grouped by the tick their bird died on, first death first
+	deaths  [][]string
+	running bool
+}
+
+var GlobalRoomState = make(map[string]*Room)
+
+func CreateRoom(ctx *commondata.ReqCtx, req *enginepb.GameEngineCreateRoomReq) (*emptypb.Empty, error) {
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	if draining {
+		return nil, connect.NewError(connect.CodeUnavailable, fmt.Errorf("engine is draining"))
+	}
+	if _, ok := GlobalRoomState[req.RoomId]; ok {
+		return nil, fmt.Errorf("room %s already exists", req.RoomId)
+	}
+
+	maxPlayers := int(req.MaxPlayers)
+	if maxPlayers <= 0 {
+		maxPlayers = defaultMaxPlayers
+	}
+
+	GlobalRoomState[req.RoomId] = &Room{
+		roomId:         req.RoomId,
+		world:          req.World,
+		viewportWidth:  req.ViewportWidth,
+		viewportHeight: req.ViewportHeight,
+		maxPlayers:     maxPlayers,
+		playState:      Ready,
+		joins:          make(map[string]*commondata.ReqCtx),
+		sessions:       make(map[string]*roomSession),
+		frames:         make(map[string]*framegenpb.GenerateFrameReq),
+	}
+	room := GlobalRoomState[req.RoomId]
+	time.AfterFunc(roomStartTimeout, func() {
+		room.expire()
+	})
+
+	log.Printf("(engine) Created room %s for %d players\n", req.RoomId, maxPlayers)
+
+	return &emptypb.Empty{}, nil
+}
+
+func joinRoom(ctx *commondata.ReqCtx, req *enginepb.GameEngineStartReq) (*enginepb.GameEngineStartResp, error) {
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	room := GlobalRoomState[*req.RoomId]
+	if room == nil {
+		return nil, fmt.Errorf("unknown room ID: %s", *req.RoomId)
+	}
+	if room.playState != Ready {
+		return nil, fmt.Errorf("room %s has already started", room.roomId)
+	}
+	if len(room.players) >= room.maxPlayers {
+		return nil, fmt.Errorf("room %s is full", room.roomId)
+	}
+
+	game := newIndividualGameState(room.world, room.viewportWidth, room.viewportHeight, req.BirdWidth, req.BirdHeight)
+	game.room = room
+
+	GlobalState.individualStateMap[req.GameId] = game
+	room.players = append(room.players, req.GameId)
+	room.joins[req.GameId] = ctx
+	room.frames[req.GameId] = newFrame(req.GameId, game.pipesToRender)
+
+	log.Printf("(engine) Game %s joined room %s (%d/%d)\n", req.GameId, room.roomId, len(room.players), room.maxPlayers)
+
+	return startResp(), nil
+}
+
+func (room *Room) addSession(ctx *commondata.ReqCtx, handle *commondata.WebTransportHandle) error {
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	room.sessions[ctx.GameId] = &roomSession{ctx: ctx, handle: handle}
+
+	if !room.running {
+		room.running = true
+		go room.run()
+	}
+
+	return nil
+}
+
+// Must hold GlobalStateLock
+func (room *Room) start() {
+	if room.playState != Ready {
+		return
+	}
+
+	log.Printf("(engine) Starting room %s with %d players\n", room.roomId, len(room.players))
+
+	room.playState = Play
+	for _, gameId := range room.players {
+		GlobalState.individualStateMap[gameId].playState = Play
+	}
+}
+
+// The last bird standing gets first place. Birds that die on the same tick tie.
+// Must hold GlobalStateLock
+func (room *Room) placements() map[string]int32 {
+	placements := make(map[string]int32, len(room.players))
+	place := int32(1)
+	for i := len(room.deaths) - 1; i >= 0; i-- {
+		for _, gameId := range room.deaths[i] {
+			placements[gameId] = place
+		}
+		place += int32(len(room.deaths[i]))
+	}
+	return placements
+}
+
+func (room *Room) run() {
+	timer := time.NewTicker((1000 / frameRate) * time.Millisecond)
+	defer timer.Stop()
+	clock := tickClock{}
+
+	for now := range timer.C {
+		tick := clock.tick(now)
+		room.sendPongs()
+		GlobalStateLock.Lock()
+
+		if room.playState == Over {
+			// Expired before anyone flapped
+			GlobalStateLock.Unlock()
+			return
+		}
+		if room.playState != Play {
+			GlobalStateLock.Unlock()
+			continue
+		}
+
+		players := make([]*framegenpb.PlayerPos, 0, len(room.players))
+		var died []string
+		alive := 0
+
+		for _, gameId := range room.players {
+			statePtr := GlobalState.individualStateMap[gameId]
+			session := room.sessions[gameId]
+
+			if statePtr.playState == Play {
+				scored, crashed := statePtr.step(room.frames[gameId])
+
+				if scored && session != nil {
+					statePtr.playSound(session.ctx, gameId, musicpb.SoundEffect_SCORE_INCREASED)
+				}
+
+				if crashed {
+					statePtr.playState = Over
+					room.frames[gameId].GameOver = true
+					died = append(died, gameId)
+
+					if session != nil {
+						statePtr.playSound(session.ctx, gameId, musicpb.SoundEffect_DIE)
+					}
+				} else {
+					alive++
+				}
+			}
+
+			username := ""
+			if session != nil {
+				username = session.ctx.Username
+			}
+
+			players = append(players, &framegenpb.PlayerPos{
+				GameId:   gameId,
+				Username: username,
+				Position: &framegenpb.Pos{X: birdX, Y: statePtr.birdY},
+				Score:    statePtr.score,
+				Dead:     statePtr.playState == Over,
+			})
+		}
+
+		if len(died) > 0 {
+			room.deaths = append(room.deaths, died)
+		}
+
+		roomOver := alive == 0
+		var placements map[string]int32
+		if roomOver {
+			room.playState = Over
+			placements = room.placements()
+		}
+
+		// Copy out what we need so the sends don't hold the lock
+		sessions := make(map[string]*roomSession, len(room.sessions))
+		frames := make(map[string]*framegenpb.GenerateFrameReq, len(room.sessions))
+		for gameId, session := range room.sessions {
+			sessions[gameId] = session
+			frame := room.frames[gameId]
+			frame.Players = players
+			frame.RoomOver = roomOver
+			frame.Placement = placements[gameId]
+			frame.SoundEvents = GlobalState.individualStateMap[gameId].takeSounds()
+			frames[gameId] = frame
+		}
+
+		GlobalStateLock.Unlock()
+
+		tick.compute = time.Since(tick.at)
+		for gameId, session := range sessions {
+			broadcastFrame(gameId, session.handle, frames[gameId], tick)
+		}
+
+		if roomOver {
+			room.finish(sessions, placements)
+			return
+		}
+	}
+}
+
+// Clocks get synced before the race starts too
+func (room *Room) sendPongs() {
+	GlobalStateLock.Lock()
+	handles := make(map[string]*commondata.WebTransportHandle, len(room.sessions))
+	for gameId, session := range room.sessions {
+		handles[gameId] = session.handle
+	}
+	GlobalStateLock.Unlock()
+
+	for gameId, handle := range handles {
+		sendPongs(gameId, handle)
+	}
+}
+
+func (room *Room) finish(sessions map[string]*roomSession, placements map[string]int32) {
+	log.Printf("(engine) Room %s is over\n", room.roomId)
+
+	for _, gameId := range room.players {
+		GlobalStateLock.Lock()
+		entry := GlobalState.individualStateMap[gameId].scoreEntry(gameId)
+		scoreCtx := room.joins[gameId]
+		GlobalStateLock.Unlock()
+
+		session := sessions[gameId]
+		if session != nil {
+			scoreCtx = session.ctx
+		}
+
+		placement := placements[gameId]
+		entry.RoomId = &room.roomId
+		entry.Placement = &placement
+		if err := scorepb.EnqueueUpdateScore(scoreCtx, entry); err != nil {
+			log.Printf("(engine) Couldn't queue score for game %s: %s\n", gameId, err)
+		}
+
+		if session != nil {
+			log.Printf("Closing game stream")
+			session.handle.Close()
+		}
+		closeSpectators(gameId)
+	}
+
+	room.remove()
+}
+
+// Tears the room down if nobody has flapped by now
+func (room *Room) expire() {
+	GlobalStateLock.Lock()
+	if GlobalRoomState[room.roomId] != room || room.playState != Ready {
+		GlobalStateLock.Unlock()
+		return
+	}
+	room.playState = Over
+	sessions := make([]*roomSession, 0, len(room.sessions))
+	for _, session := range room.sessions {
+		sessions = append(sessions, session)
+	}
+	GlobalStateLock.Unlock()
+
+	log.Printf("(engine) Room %s never started, dropping it\n", room.roomId)
+
+	for _, session := range sessions {
+		session.handle.Close()
+	}
+	for _, gameId := range room.players {
+		closeSpectators(gameId)
+	}
+
+	room.remove()
+}
+
+// Forgets the room and its players' games
+func (room *Room) remove() {
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	for _, gameId := range room.players {
+		delete(GlobalState.individualStateMap, gameId)
+	}
+	delete(GlobalRoomState, room.roomId)
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
+	worldgen "github.com/yuv418/cs553project/backend/world_gen"
+)
+
+// A room with two players who joined but never connected
+func joinedRoom(t *testing.T, roomId string) *Room {
+	t.Helper()
+
+	_, err := CreateRoom(&commondata.ReqCtx{}, &enginepb.GameEngineCreateRoomReq{
+		RoomId:         roomId,
+		World:          worldgen.GenerateWorldWithSeed(42, testWidth, testHeight),
+		ViewportWidth:  testWidth,
+		ViewportHeight: testHeight,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, gameId := range []string{roomId + "-a", roomId + "-b"} {
+		_, err := StartGame(&commondata.ReqCtx{GameId: gameId, Username: gameId}, &enginepb.GameEngineStartReq{
+			GameId:     gameId,
+			RoomId:     &roomId,
+			BirdWidth:  34,
+			BirdHeight: 24,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+	room := GlobalRoomState[roomId]
+	t.Cleanup(func() {
+		GlobalStateLock.Lock()
+		defer GlobalStateLock.Unlock()
+		for _, gameId := range room.players {
+			delete(GlobalState.individualStateMap, gameId)
+		}
+		delete(GlobalRoomState, roomId)
+	})
+	return room
+}
+
+func assertRoomGone(t *testing.T, room *Room) {
+	t.Helper()
+
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+	if _, ok := GlobalRoomState[room.roomId]; ok {
+		t.Errorf("room %s is still around", room.roomId)
+	}
+	for _, gameId := range room.players {
+		if _, ok := GlobalState.individualStateMap[gameId]; ok {
+			t.Errorf("game %s is still around", gameId)
+		}
+	}
+}
+
+func TestRoomExpiresBeforeStarting(t *testing.T) {
+	room := joinedRoom(t, "idle")
+
+	room.expire()
+	assertRoomGone(t, room)
+
+	roomId := "idle"
+	_, err := StartGame(&commondata.ReqCtx{}, &enginepb.GameEngineStartReq{GameId: "late", RoomId: &roomId})
+	if err == nil {
+		t.Error("joined a room that expired")
+	}
+}
+
+func TestStartedRoomDoesntExpire(t *testing.T) {
+	room := joinedRoom(t, "racing")
+
+	GlobalStateLock.Lock()
+	room.start()
+	GlobalStateLock.Unlock()
+
+	room.expire()
+
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+	if GlobalRoomState["racing"] != room || room.playState != Play {
+		t.Error("expired a room that's racing")
+	}
+}
+
+func TestFinishedRoomForgetsGames(t *testing.T) {
+	room := joinedRoom(t, "done")
+
+	GlobalStateLock.Lock()
+	room.start()
+	room.deaths = [][]string{{"done-a"}, {"done-b"}}
+	placements := room.placements()
+	GlobalStateLock.Unlock()
+
+	// Nobody connected, their scores still get queued with the join ctx
+	room.finish(map[string]*roomSession{}, placements)
+	assertRoomGone(t, room)
+}
@@ -0,0 +1,91 @@
+package engine
+
+// Sounds can either go through the music service (PlayMusic via the outbox,
+// then out on the music WebTransport session) or ride along in the game's own
+// frames. SOUND_DELIVERY=frame picks the latter so we can compare the two.
+//
+// Frame sounds are asset IDs, so the client needs the music service's
+// manifest, which it only sends with MUSIC_EFFECT_DELIVERY=id. The music
+// session also no longer hears DIE, so we end it ourselves when the game does.
+
+import (
+	"log"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+	framegenpb "github.com/yuv418/cs553project/backend/protos/frame_gen"
+	musicpb "github.com/yuv418/cs553project/backend/protos/music"
+)
+
+type SoundDelivery int8
+
+const (
+	SoundsViaMusic SoundDelivery = iota
+	SoundsInFrame
+)
+
+func SoundDeliverySetup() SoundDelivery {
+	switch delivery := commondata.GetEnv("SOUND_DELIVERY", "music"); delivery {
+	case "music":
+		return SoundsViaMusic
+	case "frame":
+		return SoundsInFrame
+	default:
+		log.Panicf("SOUND_DELIVERY must be music or frame, got %s", delivery)
+		return SoundsViaMusic
+	}
+}
+
+var SoundDeliveryMode = SoundDeliverySetup()
+
+func init() {
+	// Only catches it when both run with the same env (the monolith, or a
+	// shared .env), but that's how it's usually set up
+	if SoundDeliveryMode == SoundsInFrame && commondata.GetEnv("MUSIC_EFFECT_DELIVERY", "payload") != "id" {
+		log.Printf("(engine) SOUND_DELIVERY=frame needs the music service to run with MUSIC_EFFECT_DELIVERY=id, or clients won't know the sounds\n")
+	}
+}
+
+// These have to match the asset IDs in the music service's manifest
+var soundEventIds = map[musicpb.SoundEffect]string{
+	musicpb.SoundEffect_JUMP:            "wing",
+	musicpb.SoundEffect_SCORE_INCREASED: "point",
+	musicpb.SoundEffect_DIE:             "hit",
+}
+
+// Must hold GlobalStateLock
+func (statePtr *IndividualGameState) queueSound(effect musicpb.SoundEffect) {
+	statePtr.pendingSounds = append(statePtr.pendingSounds, &framegenpb.SoundEvent{
+		EffectId: soundEventIds[effect],
+		Frame:    statePtr.frame,
+	})
+}
+
+// Must hold GlobalStateLock
+func (statePtr *IndividualGameState) takeSounds() []*framegenpb.SoundEvent {
+	sounds := statePtr.pendingSounds
+	statePtr.pendingSounds = nil
+	return sounds
+}
+
+// Plays a sound whichever way we're configured to.
+// Must hold GlobalStateLock
+func (statePtr *IndividualGameState) playSound(ctx *commondata.ReqCtx, gameId string, effect musicpb.SoundEffect) {
+	if SoundDeliveryMode == SoundsInFrame {
+		statePtr.queueSound(effect)
+		if effect == musicpb.SoundEffect_DIE {
+			// Same outbox as PlayMusic would've gone through, so this
+			// lands after anything queued for the game before it
+			if err := musicpb.EnqueueEndMusicSession(ctx, &musicpb.EndMusicSessionReq{GameId: gameId}); err != nil {
+				log.Printf("(engine) Couldn't queue the end of game %s's music: %s\n", gameId, err)
+			}
+		}
+		return
+	}
+
+	if err := musicpb.EnqueuePlayMusic(ctx, &musicpb.PlayMusicReq{
+		GameId: gameId,
+		Effect: effect,
+	}); err != nil {
+		log.Printf("(engine) Couldn't queue sound for game %s: %s\n", gameId, err)
+	}
+}
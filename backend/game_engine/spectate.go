@@ -0,0 +1,174 @@
+package engine
+
+// Spectators attach to a running game and get the same frames as the player,
+// but anything they send is ignored. Each spectator has its own goroutine and
+// a short queue of frames, so a slow viewer never holds up the game loop or
+// the other viewers. When a queue is full the frame is dropped for that
+// viewer, and viewers that stay behind get disconnected.
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/yuv418/cs553project/backend/common"
+	"github.com/yuv418/cs553project/backend/commondata"
+	framegenpb "github.com/yuv418/cs553project/backend/protos/frame_gen"
+	"github.com/yuv418/cs553project/backend/tracing"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	// Frames a spectator can have waiting to go out
+	spectatorQueueLen = 8
+	// Spectators that miss this many frames in a row (2s) get disconnected
+	spectatorMaxDropped = 2 * frameRate
+)
+
+type spectator struct {
+	handle *commondata.WebTransportHandle
+	// Closed by whoever takes the spectator out of the game's list
+	frames chan *framegenpb.GenerateFrameReq
+	// Frames dropped in a row. Guarded by GlobalStateLock.
+	dropped int
+}
+
+func startSpectator(gameId string, handle *commondata.WebTransportHandle) *spectator {
+	viewer := &spectator{
+		handle: handle,
+		frames: make(chan *framegenpb.GenerateFrameReq, spectatorQueueLen),
+	}
+	go viewer.run(gameId)
+	return viewer
+}
+
+// Sends frames until the queue is closed, then hangs up once they're out
+func (viewer *spectator) run(gameId string) {
+	for frame := range viewer.frames {
+		if err := common.WebTransportSendBuf(viewer.handle.Writer, frame); err != nil {
+			log.Printf("Dropping spectator of game %s: %s\n", gameId, err)
+			removeSpectator(gameId, viewer)
+			return
+		}
+	}
+	viewer.handle.Close()
+}
+
+// Queues a frame without waiting. Says false once the spectator has been
+// behind for too long. Needs GlobalStateLock.
+func (viewer *spectator) offer(frame *framegenpb.GenerateFrameReq) bool {
+	select {
+	case viewer.frames <- frame:
+		viewer.dropped = 0
+		return true
+	default:
+		viewer.dropped++
+		spectatorFramesDropped.Inc()
+		return viewer.dropped < spectatorMaxDropped
+	}
+}
+
+// Takes viewer out of the game, if it's still there. Needs GlobalStateLock.
+func (statePtr *IndividualGameState) dropSpectator(viewer *spectator) bool {
+	for i, other := range statePtr.spectators {
+		if other == viewer {
+			statePtr.spectators = append(statePtr.spectators[:i], statePtr.spectators[i+1:]...)
+			close(viewer.frames)
+			return true
+		}
+	}
+	return false
+}
+
+func removeSpectator(gameId string, viewer *spectator) {
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	if statePtr := GlobalState.individualStateMap[gameId]; statePtr != nil {
+		statePtr.dropSpectator(viewer)
+	}
+}
+
+func EstablishSpectatorWebTransport(ctx *commondata.ReqCtx, handle *commondata.WebTransportHandle) error {
+	log.Printf("EstablishSpectatorWebTransport: user ID is %s game ID is %s\n", ctx.Username, ctx.GameId)
+
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	statePtr := GlobalState.individualStateMap[ctx.GameId]
+	if movedTo, ok := GlobalState.movedGames[ctx.GameId]; statePtr == nil && ok {
+		return fmt.Errorf("game %s moved to %s", ctx.GameId, movedTo)
+	}
+	if statePtr == nil {
+		return fmt.Errorf("unknown game ID: %s", ctx.GameId)
+	}
+	if statePtr.playState == Over {
+		return fmt.Errorf("game %s is already over", ctx.GameId)
+	}
+
+	statePtr.spectators = append(statePtr.spectators, startSpectator(ctx.GameId, handle))
+
+	return nil
+}
+
+func HandleSpectatorInput(ctx *commondata.ReqCtx, _ *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, fmt.Errorf("%s is spectating game %s and can't send input", ctx.Username, ctx.GameId)
+}
+
+// Sends a frame to the player and queues it for everyone watching. Frames
+// aren't touched once they're sent, so the spectators share them. tick is nil
+// for frames that aren't from a tick.
+func broadcastFrame(gameId string, handle *commondata.WebTransportHandle, frame *framegenpb.GenerateFrameReq, tick *tickTiming) {
+	start := time.Now()
+	defer func() {
+		frameSendDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	GlobalStateLock.Lock()
+	statePtr := GlobalState.individualStateMap[gameId]
+	// The first frame after a flap finishes off the flap's trace
+	inputTrace := statePtr.inputTrace
+	statePtr.inputTrace = ""
+	inputAt := statePtr.inputAt
+	statePtr.inputAt = time.Time{}
+	statePtr.frameSeq++
+	frame.Seq = statePtr.frameSeq
+	GlobalStateLock.Unlock()
+
+	var span *tracing.Span
+	if inputTrace != "" {
+		span = tracing.Start(inputTrace, "engine/frame", tracing.Internal)
+		span.SetAttr("game.id", gameId)
+	}
+	frame.LastInputTimeNs = 0
+	if !inputAt.IsZero() {
+		frame.LastInputTimeNs = inputAt.UnixNano()
+	}
+	frame.ServerTimeNs = time.Now().UnixNano()
+	send, err := common.WebTransportSendBufTimed(handle.Writer, frame)
+	span.End(err)
+	recordFrame(gameId, frame.Seq, tick, send, inputAt, time.Now())
+
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+	for _, viewer := range append([]*spectator(nil), statePtr.spectators...) {
+		if !viewer.offer(frame) {
+			log.Printf("Dropping spectator of game %s: %d frames behind\n", gameId, viewer.dropped)
+			statePtr.dropSpectator(viewer)
+			// Its goroutine is probably stuck on a write
+			viewer.handle.Cancel()
+		}
+	}
+}
+
+// Hangs up on everyone watching, once the frames they have queued are out
+func closeSpectators(gameId string) {
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+
+	statePtr := GlobalState.individualStateMap[gameId]
+	for _, viewer := range statePtr.spectators {
+		close(viewer.frames)
+	}
+	statePtr.spectators = nil
+}
@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+	framegenpb "github.com/yuv418/cs553project/backend/protos/frame_gen"
+	worldgen "github.com/yuv418/cs553project/backend/world_gen"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+var errCanceled = errors.New("canceled")
+
+// The far end of a spectator's stream. Writes block until it reads.
+type testViewer struct {
+	handle *commondata.WebTransportHandle
+	reader *bufio.Reader
+}
+
+func newTestViewer() *testViewer {
+	pr, pw := io.Pipe()
+	return &testViewer{
+		handle: &commondata.WebTransportHandle{
+			Writer:      bufio.NewWriter(pw),
+			Closer:      pw,
+			CancelWrite: func() { pw.CloseWithError(errCanceled) },
+		},
+		reader: bufio.NewReader(pr),
+	}
+}
+
+func (viewer *testViewer) next() (*framegenpb.GenerateFrameReq, error) {
+	frame := &framegenpb.GenerateFrameReq{}
+	err := protodelim.UnmarshalFrom(viewer.reader, frame)
+	return frame, err
+}
+
+// A game that's running, with nobody connected
+func watchedGame(t *testing.T, gameId string) *IndividualGameState {
+	t.Helper()
+
+	world := worldgen.GenerateWorldWithSeed(42, testWidth, testHeight)
+	game := newIndividualGameState(world, testWidth, testHeight, 34, 24)
+	game.playState = Play
+
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+	GlobalState.individualStateMap[gameId] = game
+	t.Cleanup(func() {
+		GlobalStateLock.Lock()
+		defer GlobalStateLock.Unlock()
+		delete(GlobalState.individualStateMap, gameId)
+		delete(GlobalState.movedGames, gameId)
+	})
+	return game
+}
+
+func spectate(t *testing.T, gameId string, viewer *testViewer) {
+	t.Helper()
+	if err := EstablishSpectatorWebTransport(&commondata.ReqCtx{Username: "viewer", GameId: gameId}, viewer.handle); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func spectatorCount(gameId string) int {
+	GlobalStateLock.Lock()
+	defer GlobalStateLock.Unlock()
+	return len(GlobalState.individualStateMap[gameId].spectators)
+}
+
+var playerHandle = &commondata.WebTransportHandle{Writer: bufio.NewWriter(io.Discard)}
+
+func TestSpectateRoute(t *testing.T) {
+	watchedGame(t, "running")
+	watchedGame(t, "over").playState = Over
+	GlobalStateLock.Lock()
+	GlobalState.movedGames["moved"] = "https://other:4433"
+	GlobalStateLock.Unlock()
+	t.Cleanup(func() {
+		GlobalStateLock.Lock()
+		defer GlobalStateLock.Unlock()
+		delete(GlobalState.movedGames, "moved")
+	})
+
+	for _, tc := range []struct {
+		gameId string
+		ok     bool
+	}{
+		{"running", true},
+		{"over", false},
+		{"moved", false},
+		{"nope", false},
+	} {
+		t.Run(tc.gameId, func(t *testing.T) {
+			err := EstablishSpectatorWebTransport(&commondata.ReqCtx{GameId: tc.gameId}, newTestViewer().handle)
+			if (err == nil) != tc.ok {
+				t.Errorf("got %v, want ok=%v", err, tc.ok)
+			}
+		})
+	}
+	if n := spectatorCount("running"); n != 1 {
+		t.Errorf("running game has %d spectators, want 1", n)
+	}
+	closeSpectators("running")
+
+	if _, err := HandleSpectatorInput(&commondata.ReqCtx{GameId: "running"}, nil); err == nil {
+		t.Error("spectator input was accepted")
+	}
+}
+
+func TestBroadcastFansOut(t *testing.T) {
+	watchedGame(t, "fanout")
+	viewers := []*testViewer{newTestViewer(), newTestViewer()}
+	for _, viewer := range viewers {
+		spectate(t, "fanout", viewer)
+	}
+
+	for i := range 3 {
+		broadcastFrame("fanout", playerHandle, &framegenpb.GenerateFrameReq{}, nil)
+		for _, viewer := range viewers {
+			frame, err := viewer.next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.Seq != int64(i+1) {
+				t.Errorf("got frame %d, want %d", frame.Seq, i+1)
+			}
+		}
+	}
+	closeSpectators("fanout")
+}
+
+func TestSlowSpectatorIsDropped(t *testing.T) {
+	watchedGame(t, "slow")
+	fast, stuck := newTestViewer(), newTestViewer()
+	spectate(t, "slow", fast)
+	spectate(t, "slow", stuck)
+
+	// stuck never reads, so it takes one frame, fills its queue and then
+	// misses the rest
+	for i := range 1 + spectatorQueueLen + spectatorMaxDropped {
+		broadcastFrame("slow", playerHandle, &framegenpb.GenerateFrameReq{}, nil)
+		frame, err := fast.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Seq != int64(i+1) {
+			t.Fatalf("fast spectator got frame %d, want %d", frame.Seq, i+1)
+		}
+	}
+
+	GlobalStateLock.Lock()
+	spectators := GlobalState.individualStateMap["slow"].spectators
+	if len(spectators) != 1 || spectators[0].handle != fast.handle {
+		t.Errorf("stuck spectator wasn't dropped")
+	}
+	GlobalStateLock.Unlock()
+
+	if _, err := stuck.next(); !errors.Is(err, errCanceled) {
+		t.Errorf("stuck spectator got %v, want its stream canceled", err)
+	}
+	closeSpectators("slow")
+}
+
+func TestCloseSpectatorsSendsQueuedFrames(t *testing.T) {
+	watchedGame(t, "closing")
+	viewer := newTestViewer()
+	spectate(t, "closing", viewer)
+
+	// Nothing has been read yet, so these are all still waiting
+	for range 3 {
+		broadcastFrame("closing", playerHandle, &framegenpb.GenerateFrameReq{}, nil)
+	}
+	closeSpectators("closing")
+	if n := spectatorCount("closing"); n != 0 {
+		t.Errorf("%d spectators left", n)
+	}
+
+	for i := range 3 {
+		frame, err := viewer.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Seq != int64(i+1) {
+			t.Errorf("got frame %d, want %d", frame.Seq, i+1)
+		}
+	}
+	if _, err := viewer.next(); err != io.EOF {
+		t.Errorf("got %v after the last frame, want EOF", err)
+	}
+}
@@ -0,0 +1,60 @@
+package engine
+
+// Clock sync. The client sends TimeSyncPings as input, and we answer each on
+// the game loop's next tick, so only the loop ever writes to the session. The
+// pong says when we got the ping and when we sent the answer, so the time it
+// waited for the tick doesn't count against the round trip.
+
+import (
+	"log"
+	"time"
+
+	"github.com/yuv418/cs553project/backend/common"
+	"github.com/yuv418/cs553project/backend/commondata"
+	framegenpb "github.com/yuv418/cs553project/backend/protos/frame_gen"
+	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
+)
+
+// Must hold GlobalStateLock
+func (statePtr *IndividualGameState) queuePong(ping *enginepb.TimeSyncPing, recv time.Time) {
+	statePtr.pendingPongs = append(statePtr.pendingPongs, &framegenpb.TimeSyncPong{
+		ClientSendTime:   ping.ClientSendTime,
+		ServerRecvTimeNs: recv.UnixNano(),
+	})
+}
+
+// Answers the pings that came in since the last tick. Only call from the
+// game loop, since it writes to the session.
+func sendPongs(gameId string, handle *commondata.WebTransportHandle) {
+	sendPongsAt(gameId, handle, time.Now())
+}
+
+// sendPongs, with the pongs saying they went out at sent
+func sendPongsAt(gameId string, handle *commondata.WebTransportHandle, sent time.Time) {
+	GlobalStateLock.Lock()
+	statePtr := GlobalState.individualStateMap[gameId]
+	if statePtr == nil {
+		GlobalStateLock.Unlock()
+		return
+	}
+	pongs := statePtr.pendingPongs
+	statePtr.pendingPongs = nil
+	GlobalStateLock.Unlock()
+
+	if len(pongs) == 0 {
+		return
+	}
+
+	now := sent.UnixNano()
+	for _, pong := range pongs {
+		pong.ServerSendTimeNs = now
+	}
+	err := common.WebTransportSendBuf(handle.Writer, &framegenpb.GenerateFrameReq{
+		GameId:       gameId,
+		TimeSync:     pongs,
+		ServerTimeNs: now,
+	})
+	if err != nil {
+		log.Printf("(engine) Couldn't send clock sync to game %s: %s\n", gameId, err)
+	}
+}
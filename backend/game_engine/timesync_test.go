@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+	framegenpb "github.com/yuv418/cs553project/backend/protos/frame_gen"
+	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// What the client does with a pong (handleTimeSync in
+// flap-client/src/network/timeSync.ts). Client times are in milliseconds.
+func clockSample(pong *framegenpb.TimeSyncPong, clientRecv float64) (offset float64, rtt float64) {
+	serverRecv := float64(pong.ServerRecvTimeNs/1000) / 1000
+	serverSend := float64(pong.ServerSendTimeNs/1000) / 1000
+	offset = ((serverRecv - pong.ClientSendTime) + (serverSend - clientRecv)) / 2
+	rtt = (clientRecv - pong.ClientSendTime) - (serverSend - serverRecv)
+	return offset, rtt
+}
+
+func TestClockSync(t *testing.T) {
+	// The server's clock is this far ahead of the client's
+	const trueOffset = 5000.0
+	// When the client sends its ping, on its own clock
+	const clientSend = 1000.0
+	serverEpoch := time.Unix(1_700_000_000, 0)
+
+	for _, tc := range []struct {
+		name string
+		// One way delays and the wait for the next tick, in ms
+		up, down, tickWait float64
+		// How far off the offset should be
+		offsetErr float64
+	}{
+		{"symmetric", 20, 20, 15, 0},
+		{"waits a whole tick", 20, 20, 33, 0},
+		// NTP can't tell which way was slower, so it's off by half the difference
+		{"slow downlink", 10, 40, 15, -15},
+		{"slow uplink", 40, 10, 15, 15},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gameId := "timesync"
+			game := watchedGame(t, gameId)
+
+			// The server's clock, in ms since serverEpoch
+			serverAt := func(ms float64) time.Time {
+				return serverEpoch.Add(time.Duration(ms * float64(time.Millisecond)))
+			}
+			serverRecv := clientSend + trueOffset + tc.up
+			serverSend := serverRecv + tc.tickWait
+			clientRecv := serverSend - trueOffset + tc.down
+			// Shift the client's clock onto the server's epoch
+			epochMs := float64(serverEpoch.UnixNano()) / 1e6
+
+			GlobalStateLock.Lock()
+			game.queuePong(&enginepb.TimeSyncPing{ClientSendTime: epochMs + clientSend}, serverAt(serverRecv))
+			GlobalStateLock.Unlock()
+
+			var out bytes.Buffer
+			sendPongsAt(gameId, &commondata.WebTransportHandle{Writer: bufio.NewWriter(&out)}, serverAt(serverSend))
+			frame := &framegenpb.GenerateFrameReq{}
+			if err := protodelim.UnmarshalFrom(&out, frame); err != nil {
+				t.Fatal(err)
+			}
+			if len(frame.TimeSync) != 1 {
+				t.Fatalf("got %d pongs, want 1", len(frame.TimeSync))
+			}
+			if frame.ServerTimeNs != serverAt(serverSend).UnixNano() {
+				t.Errorf("frame says it went out at %d, the pong at %d", frame.ServerTimeNs, serverAt(serverSend).UnixNano())
+			}
+
+			offset, rtt := clockSample(frame.TimeSync[0], epochMs+clientRecv)
+			if want := trueOffset + tc.offsetErr; math.Abs(offset-want) > 0.001 {
+				t.Errorf("offset %.3fms, want %.3fms", offset, want)
+			}
+			// The wait for the tick isn't part of the round trip
+			if want := tc.up + tc.down; math.Abs(rtt-want) > 0.001 {
+				t.Errorf("rtt %.3fms, want %.3fms", rtt, want)
+			}
+
+			GlobalStateLock.Lock()
+			defer GlobalStateLock.Unlock()
+			if len(game.pendingPongs) != 0 {
+				t.Errorf("%d pongs still waiting", len(game.pendingPongs))
+			}
+		})
+	}
+}
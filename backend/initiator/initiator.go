@@ -4,12 +4,11 @@ import (
 	"log"
 
 	"github.com/google/uuid"
-	"github.com/yuv418/cs553project/backend/common"
 	"github.com/yuv418/cs553project/backend/commondata"
 	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
 	initiatorpb "github.com/yuv418/cs553project/backend/protos/initiator"
+	scorepb "github.com/yuv418/cs553project/backend/protos/score"
 	worldgenpb "github.com/yuv418/cs553project/backend/protos/world_gen"
-	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 func StartGame(ctx *commondata.ReqCtx, req *initiatorpb.StartGameReq) (*initiatorpb.StartGameResp, error) {
@@ -22,30 +21,127 @@ func StartGame(ctx *commondata.ReqCtx, req *initiatorpb.StartGameReq) (*initiato
 
 	ctx.GameId = gameId
 
-	generatedWorld, err := common.Dispatch[worldgenpb.WorldGenReq, worldgenpb.WorldGenerated](ctx, "GenerateWorld", &worldgenpb.WorldGenReq{
+	if req.RoomId != nil {
+		return joinRoom(ctx, gameId, req)
+	}
+
+	worldReq := &worldgenpb.WorldGenReq{
 		GameId:         gameId,
 		ViewportWidth:  req.ViewportWidth,
 		ViewportHeight: req.ViewportHeight,
-	})
+	}
+
+	var ghost *enginepb.GhostRun
+	if req.GhostGameId != nil {
+		ghostEntry, err := scorepb.DispatchGetGhost(ctx, &scorepb.GetGhostReq{
+			GameId: *req.GhostGameId,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// The ghost only makes sense in the world it was recorded in
+		worldReq.Seed = ghostEntry.WorldSeed
+		worldReq.ViewportWidth = ghostEntry.ViewportWidth
+		worldReq.ViewportHeight = ghostEntry.ViewportHeight
+
+		ghost = &enginepb.GhostRun{
+			GameId:     ghostEntry.GameId,
+			FlapFrames: ghostEntry.FlapFrames,
+			BirdWidth:  ghostEntry.BirdWidth,
+			BirdHeight: ghostEntry.BirdHeight,
+		}
+		log.Printf("(initiator) Racing gameId %s against ghost %s\n", gameId, ghostEntry.GameId)
+	}
+
+	generatedWorld, err := worldgenpb.DispatchGenerateWorld(ctx, worldReq)
 	log.Printf("(initiator) Generated world for gameId %s...\n", gameId)
 
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = common.Dispatch[enginepb.GameEngineStartReq, emptypb.Empty](ctx, "EngineStartGame", &enginepb.GameEngineStartReq{
+	engine := placeGame(gameId)
+	engineResp, err := enginepb.DispatchEngineStartGame(ctx.WithInstance(engine), &enginepb.GameEngineStartReq{
 		GameId:         gameId,
-		ViewportWidth:  req.ViewportWidth,
-		ViewportHeight: req.ViewportHeight,
+		ViewportWidth:  worldReq.ViewportWidth,
+		ViewportHeight: worldReq.ViewportHeight,
 		BirdWidth:      req.BirdWidth,
 		BirdHeight:     req.BirdHeight,
 		World:          generatedWorld,
+		Ghost:          ghost,
 	})
 	if err != nil {
 		return nil, err
 	}
+	recordLoad(engine, engineResp)
 
 	return &initiatorpb.StartGameResp{
-		GameId: gameId,
+		GameId:           gameId,
+		WebtransportAddr: wtpAddr(engineResp),
+	}, nil
+}
+
+func joinRoom(ctx *commondata.ReqCtx, gameId string, req *initiatorpb.StartGameReq) (*initiatorpb.StartGameResp, error) {
+	// The engine already has the room's world
+	engine := placeRoom(*req.RoomId)
+	engineResp, err := enginepb.DispatchEngineStartGame(ctx.WithInstance(engine), &enginepb.GameEngineStartReq{
+		GameId:     gameId,
+		BirdWidth:  req.BirdWidth,
+		BirdHeight: req.BirdHeight,
+		RoomId:     req.RoomId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("(initiator) Game %s joined room %s\n", gameId, *req.RoomId)
+
+	recordLoad(engine, engineResp)
+
+	return &initiatorpb.StartGameResp{
+		GameId:           gameId,
+		RoomId:           req.RoomId,
+		WebtransportAddr: wtpAddr(engineResp),
+	}, nil
+}
+
+// Only set when the engine knows its address, otherwise the client uses the usual one
+func wtpAddr(engineResp *enginepb.GameEngineStartResp) *string {
+	if engineResp.WebtransportAddr == "" {
+		return nil
+	}
+	return &engineResp.WebtransportAddr
+}
+
+func CreateRoom(ctx *commondata.ReqCtx, req *initiatorpb.CreateRoomReq) (*initiatorpb.CreateRoomResp, error) {
+	log.Printf("Got request params %v\n", req)
+
+	roomId := uuid.New().String()
+
+	// Everyone in the room races in this one world
+	generatedWorld, err := worldgenpb.DispatchGenerateWorld(ctx, &worldgenpb.WorldGenReq{
+		GameId:         roomId,
+		ViewportWidth:  req.ViewportWidth,
+		ViewportHeight: req.ViewportHeight,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("(initiator) Generated world for roomId %s...\n", roomId)
+
+	_, err = enginepb.DispatchEngineCreateRoom(ctx.WithInstance(placeRoom(roomId)), &enginepb.GameEngineCreateRoomReq{
+		RoomId:         roomId,
+		ViewportWidth:  req.ViewportWidth,
+		ViewportHeight: req.ViewportHeight,
+		World:          generatedWorld,
+		MaxPlayers:     req.MaxPlayers,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &initiatorpb.CreateRoomResp{
+		RoomId: roomId,
 	}, nil
 }
@@ -0,0 +1,112 @@
+package initiator
+
+// Games only exist in the memory of the engine that started them, so with
+// more than one engine we have to pick one up front and send the game's
+// EngineStartGame and the client's WebTransport session to it.
+//
+// Rooms are always placed by hashing the room ID, so a join finds the room's
+// engine without us remembering anything (and works from any initiator).
+// Solo games hash on the game ID by default, or go to the engine with the
+// fewest running games with ENGINE_PLACEMENT=least_loaded.
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/yuv418/cs553project/backend/common"
+	"github.com/yuv418/cs553project/backend/commondata"
+	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
+)
+
+type Placement int8
+
+const (
+	PlaceByHash Placement = iota
+	PlaceLeastLoaded
+)
+
+func PlacementSetup() Placement {
+	switch placement := commondata.GetEnv("ENGINE_PLACEMENT", "hash"); placement {
+	case "hash":
+		return PlaceByHash
+	case "least_loaded":
+		return PlaceLeastLoaded
+	default:
+		log.Panicf("ENGINE_PLACEMENT must be hash or least_loaded, got %s", placement)
+		return PlaceByHash
+	}
+}
+
+var EnginePlacement = PlacementSetup()
+
+var (
+	// Running games per engine, as of the last game we started there. Only
+	// ever an estimate, since other initiators start games too.
+	engineLoad     = make(map[string]int32)
+	engineLoadLock = sync.Mutex{}
+)
+
+// Rendezvous hashing: every engine gets a score for the key and the highest
+// wins. Adding or removing an engine only moves the keys that it wins or won.
+func hashPick(instances []string, key string) string {
+	var best string
+	var bestScore uint64
+	for _, instance := range instances {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(instance))
+		if score := hash.Sum64(); best == "" || score > bestScore {
+			best, bestScore = instance, score
+		}
+	}
+	return best
+}
+
+// Picks the engine for a game. Empty means there's only one engine to go to
+// (or we're a monolith), so it doesn't matter.
+func placeGame(gameId string) string {
+	// A new game can go anywhere, so skip engines that are acting up
+	instances := common.ServiceInstances(common.AbsCtx, enginepb.GameEngineServiceName, true)
+	if len(instances) <= 1 {
+		return ""
+	}
+	if EnginePlacement == PlaceByHash {
+		return hashPick(instances, gameId)
+	}
+
+	engineLoadLock.Lock()
+	defer engineLoadLock.Unlock()
+
+	// Engines we haven't heard from count as empty. Ties go by hash so they
+	// don't all land on the first engine.
+	best := hashPick(instances, gameId)
+	for _, instance := range instances {
+		if engineLoad[instance] < engineLoad[best] {
+			best = instance
+		}
+	}
+	// Count it now so games started before the engine answers spread out too
+	engineLoad[best]++
+	return best
+}
+
+func placeRoom(roomId string) string {
+	// Every join has to land where the room was created, even if that engine
+	// had a bad moment in between
+	instances := common.ServiceInstances(common.AbsCtx, enginepb.GameEngineServiceName, false)
+	if len(instances) <= 1 {
+		return ""
+	}
+	return hashPick(instances, roomId)
+}
+
+func recordLoad(instance string, resp *enginepb.GameEngineStartResp) {
+	if instance == "" {
+		return
+	}
+	engineLoadLock.Lock()
+	defer engineLoadLock.Unlock()
+	engineLoad[instance] = resp.ActiveGames
+}
@@ -0,0 +1,158 @@
+package initiator
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/yuv418/cs553project/backend/common"
+	enginepb "github.com/yuv418/cs553project/backend/protos/game_engine"
+)
+
+// Points the engine service at addrs, as a microservice
+func withEngines(t *testing.T, addrs ...string) {
+	t.Helper()
+
+	registry := common.NewLocalRegistry()
+	for _, addr := range addrs {
+		registry.Register(enginepb.GameEngineServiceName, addr)
+	}
+	common.InsertServiceResolver(common.AbsCtx, enginepb.GameEngineServiceName, "local",
+		registry.Resolver(enginepb.GameEngineServiceName), "/game_engine.GameEngineService")
+
+	prev := common.AbsCtx.Microservice
+	common.AbsCtx.Microservice = true
+	t.Cleanup(func() { common.AbsCtx.Microservice = prev })
+}
+
+func withPlacement(t *testing.T, placement Placement) {
+	prev := EnginePlacement
+	EnginePlacement = placement
+	t.Cleanup(func() {
+		EnginePlacement = prev
+		engineLoadLock.Lock()
+		defer engineLoadLock.Unlock()
+		clear(engineLoad)
+	})
+}
+
+func gameIds(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("game-%d", i)
+	}
+	return ids
+}
+
+func TestHashPickSpreadsGames(t *testing.T) {
+	engines := []string{"e1:4433", "e2:4433", "e3:4433", "e4:4433"}
+
+	counts := make(map[string]int)
+	for _, id := range gameIds(1000) {
+		counts[hashPick(engines, id)]++
+	}
+	for _, engine := range engines {
+		// 250 each if it were perfect
+		if counts[engine] < 150 {
+			t.Errorf("got %v, want them spread out", counts)
+			break
+		}
+	}
+}
+
+func TestHashPickOnlyMovesWhatItHasTo(t *testing.T) {
+	engines := []string{"e1:4433", "e2:4433", "e3:4433", "e4:4433"}
+	before := make(map[string]string)
+	for _, id := range gameIds(1000) {
+		before[id] = hashPick(engines, id)
+	}
+
+	t.Run("removed", func(t *testing.T) {
+		fewer := slices.DeleteFunc(slices.Clone(engines), func(e string) bool { return e == "e3:4433" })
+		for id, engine := range before {
+			after := hashPick(fewer, id)
+			if engine != "e3:4433" && after != engine {
+				t.Errorf("%s moved from %s to %s, but %s is still there", id, engine, after, engine)
+			}
+		}
+	})
+
+	t.Run("added", func(t *testing.T) {
+		more := append(slices.Clone(engines), "e5:4433")
+		moved := 0
+		for id, engine := range before {
+			after := hashPick(more, id)
+			if after != engine {
+				moved++
+				if after != "e5:4433" {
+					t.Errorf("%s moved from %s to %s, only the new engine should take games", id, engine, after)
+				}
+			}
+		}
+		// About a fifth of the games
+		if moved == 0 || moved > 300 {
+			t.Errorf("%d of 1000 games moved to the new engine", moved)
+		}
+	})
+
+	// The order engines come back from discovery in doesn't matter
+	reversed := slices.Clone(engines)
+	slices.Reverse(reversed)
+	for id, engine := range before {
+		if after := hashPick(reversed, id); after != engine {
+			t.Errorf("%s went to %s, then %s with the engines in another order", id, engine, after)
+		}
+	}
+}
+
+func TestOneEngineDoesntNeedPlacing(t *testing.T) {
+	withEngines(t, "e1:4433")
+	if engine := placeGame("game"); engine != "" {
+		t.Errorf("placed a game on %s with one engine", engine)
+	}
+	if engine := placeRoom("room"); engine != "" {
+		t.Errorf("placed a room on %s with one engine", engine)
+	}
+}
+
+func TestLeastLoaded(t *testing.T) {
+	withEngines(t, "e1:4433", "e2:4433", "e3:4433")
+	withPlacement(t, PlaceLeastLoaded)
+
+	recordLoad("e1:4433", &enginepb.GameEngineStartResp{ActiveGames: 5})
+	recordLoad("e2:4433", &enginepb.GameEngineStartResp{ActiveGames: 3})
+	recordLoad("e3:4433", &enginepb.GameEngineStartResp{ActiveGames: 7})
+	// Monolith games don't count against anything
+	recordLoad("", &enginepb.GameEngineStartResp{ActiveGames: 100})
+
+	if engine := placeGame("a"); engine != "e2:4433" {
+		t.Errorf("placed on %s, want e2, which has the fewest games", engine)
+	}
+	// Counted right away, before the engine says how many it has
+	if engine := placeGame("b"); engine != "e2:4433" {
+		t.Errorf("placed on %s, want e2 with 4 games", engine)
+	}
+	recordLoad("e2:4433", &enginepb.GameEngineStartResp{ActiveGames: 9})
+	if engine := placeGame("c"); engine != "e1:4433" {
+		t.Errorf("placed on %s, want e1 once e2 filled up", engine)
+	}
+}
+
+func TestRoomStaysOnOneEngine(t *testing.T) {
+	withEngines(t, "e1:4433", "e2:4433", "e3:4433")
+	withPlacement(t, PlaceLeastLoaded)
+
+	engine := placeRoom("room")
+	if engine == "" {
+		t.Fatal("room wasn't placed")
+	}
+	// Every player's join goes to the room's engine, however loaded it gets
+	// and wherever solo games are going in between
+	for i := range 10 {
+		placeGame(fmt.Sprintf("solo-%d", i))
+		recordLoad(engine, &enginepb.GameEngineStartResp{ActiveGames: int32(100 + i)})
+		if joined := placeRoom("room"); joined != engine {
+			t.Fatalf("join %d went to %s, the room is on %s", i, joined, engine)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package music
+
+// Picking (and if we have to, converting) the version of an asset a client can play.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/jfreymuth/oggvorbis"
+	musicpb "github.com/yuv418/cs553project/backend/protos/music"
+)
+
+// Every codec the server knows about, by the name clients use in the codecs
+// query param and by file extension
+var codecNames = map[string]musicpb.AudioCodec{
+	"ogg":  musicpb.AudioCodec_OGG,
+	"opus": musicpb.AudioCodec_OGG,
+	"wav":  musicpb.AudioCodec_WAV_PCM,
+	"mp3":  musicpb.AudioCodec_MP3,
+}
+
+// Used when the client doesn't say, since that's what the old client plays
+var defaultCodecs = []musicpb.AudioCodec{musicpb.AudioCodec_OGG}
+
+// Asset sources are the same sound in whatever codecs we have files for
+type audioSources map[musicpb.AudioCodec][]byte
+
+// Turns a source in one codec into another (or cleans it up if from == to).
+// There's no pure Go Vorbis or MP3 encoder around, so those can only be
+// decoded. Clients that only list ogg or mp3 need a file in that codec.
+type transcoder func(bin []byte) ([]byte, error)
+
+type codecPair struct {
+	from musicpb.AudioCodec
+	to   musicpb.AudioCodec
+}
+
+var transcoders = map[codecPair]transcoder{
+	// Browsers are picky about WAVs that aren't 16-bit PCM, so anything from
+	// MUSIC_DIR gets converted
+	{musicpb.AudioCodec_WAV_PCM, musicpb.AudioCodec_WAV_PCM}: normalizeWav,
+	// For clients that can't play Vorbis (Safari, mostly). Opus files are
+	// also .ogg, those fail to decode and we fall back to the next source.
+	{musicpb.AudioCodec_OGG, musicpb.AudioCodec_WAV_PCM}: vorbisToWav,
+}
+
+type assetKey struct {
+	name  string
+	codec musicpb.AudioCodec
+}
+
+// Parses something like "wav,ogg" from the client. Unknown codecs are skipped
+// so newer clients can ask for things we don't have yet.
+func parseCodecs(param string) []musicpb.AudioCodec {
+	var codecs []musicpb.AudioCodec
+	for _, name := range strings.Split(param, ",") {
+		codec, ok := codecNames[strings.ToLower(strings.TrimSpace(name))]
+		if ok {
+			codecs = append(codecs, codec)
+		}
+	}
+	if len(codecs) == 0 {
+		return defaultCodecs
+	}
+	return codecs
+}
+
+func codecForFile(fileName string) (musicpb.AudioCodec, bool) {
+	codec, ok := codecNames[strings.TrimPrefix(strings.ToLower(filepath.Ext(fileName)), ".")]
+	return codec, ok
+}
+
+// Must hold MusicServerLock
+func (server *musicServer) transcode(name string, sources audioSources, codec musicpb.AudioCodec) []byte {
+	key := assetKey{name: name, codec: codec}
+	if bin, ok := server.transcoded[key]; ok {
+		return bin
+	}
+
+	var bin []byte
+	// Prefer converting from a file that's already in the right codec
+	from := append([]musicpb.AudioCodec{codec}, allCodecs()...)
+	for _, source := range from {
+		sourceBin := sources[source]
+		if sourceBin == nil {
+			continue
+		}
+
+		convert := transcoders[codecPair{from: source, to: codec}]
+		if convert == nil {
+			if source == codec {
+				bin = sourceBin
+				break
+			}
+			continue
+		}
+
+		converted, err := convert(sourceBin)
+		if err != nil {
+			log.Printf("(music) Couldn't convert %s from %s to %s: %s\n", name, source, codec, err)
+			continue
+		}
+		bin = converted
+		break
+	}
+
+	// Remember misses too so we don't try again every time
+	server.transcoded[key] = bin
+	return bin
+}
+
+// Returns the asset in the first codec on the list we can produce, falling back
+// to whatever we have.
+// Must hold MusicServerLock
+func (server *musicServer) pickAsset(name string, sources audioSources, codecs []musicpb.AudioCodec) ([]byte, musicpb.AudioCodec) {
+	for _, codec := range codecs {
+		if bin := server.transcode(name, sources, codec); bin != nil {
+			return bin, codec
+		}
+	}
+	for _, codec := range allCodecs() {
+		if bin := server.transcode(name, sources, codec); bin != nil {
+			return bin, codec
+		}
+	}
+	return nil, musicpb.AudioCodec_OGG
+}
+
+func allCodecs() []musicpb.AudioCodec {
+	return []musicpb.AudioCodec{musicpb.AudioCodec_OGG, musicpb.AudioCodec_WAV_PCM, musicpb.AudioCodec_MP3}
+}
+
+const (
+	wavFormatPcm        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// normalizeWav rewrites an 8/16/24/32-bit PCM or 32-bit float WAV as a plain
+// 16-bit PCM WAV with nothing but the fmt and data chunks.
+func normalizeWav(bin []byte) ([]byte, error) {
+	if len(bin) < 12 || string(bin[0:4]) != "RIFF" || string(bin[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("not a WAV file")
+	}
+
+	var format, channels, bitsPerSample uint16
+	var sampleRate uint32
+	var data []byte
+	haveFmt := false
+
+	for offset := 12; offset+8 <= len(bin); {
+		chunkId := string(bin[offset : offset+4])
+		chunkSize := int(binary.LittleEndian.Uint32(bin[offset+4 : offset+8]))
+		body := bin[offset+8 : min(offset+8+chunkSize, len(bin))]
+
+		switch chunkId {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, fmt.Errorf("fmt chunk is too short")
+			}
+			format = binary.LittleEndian.Uint16(body[0:2])
+			channels = binary.LittleEndian.Uint16(body[2:4])
+			sampleRate = binary.LittleEndian.Uint32(body[4:8])
+			bitsPerSample = binary.LittleEndian.Uint16(body[14:16])
+			if format == wavFormatExtensible && len(body) >= 26 {
+				// The real format is the first two bytes of the sub format GUID
+				format = binary.LittleEndian.Uint16(body[24:26])
+			}
+			haveFmt = true
+		case "data":
+			data = body
+		}
+
+		// Chunks are padded to an even size
+		offset += 8 + chunkSize + chunkSize%2
+	}
+
+	if !haveFmt || data == nil {
+		return nil, fmt.Errorf("missing fmt or data chunk")
+	}
+	if channels == 0 {
+		return nil, fmt.Errorf("no channels")
+	}
+
+	// Already what we want, just drop the extra chunks
+	if format == wavFormatPcm && bitsPerSample == 16 {
+		return writeWav(channels, sampleRate, data), nil
+	}
+
+	var decode func(sample []byte) int16
+	switch {
+	case format == wavFormatPcm && bitsPerSample == 8:
+		// 8-bit WAVs are unsigned
+		decode = func(sample []byte) int16 { return int16(int(sample[0])-128) << 8 }
+	case format == wavFormatPcm && bitsPerSample == 24:
+		decode = func(sample []byte) int16 { return int16(uint16(sample[1]) | uint16(sample[2])<<8) }
+	case format == wavFormatPcm && bitsPerSample == 32:
+		decode = func(sample []byte) int16 { return int16(binary.LittleEndian.Uint16(sample[2:4])) }
+	case format == wavFormatFloat && bitsPerSample == 32:
+		decode = func(sample []byte) int16 {
+			value := math.Float32frombits(binary.LittleEndian.Uint32(sample))
+			value = max(-1, min(1, value))
+			return int16(value * math.MaxInt16)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported WAV format %d with %d bits per sample", format, bitsPerSample)
+	}
+
+	sampleBytes := int(bitsPerSample / 8)
+	samples := len(data) / sampleBytes
+	out := make([]byte, samples*2)
+	for i := range samples {
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(decode(data[i*sampleBytes:(i+1)*sampleBytes])))
+	}
+
+	return writeWav(channels, sampleRate, out), nil
+}
+
+func writeWav(channels uint16, sampleRate uint32, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(44 + len(data))
+
+	le := binary.LittleEndian
+	buf.WriteString("RIFF")
+	binary.Write(&buf, le, uint32(36+len(data)))
+	buf.WriteString("WAVE")
+
+	buf.WriteString("fmt ")
+	binary.Write(&buf, le, uint32(16))
+	binary.Write(&buf, le, uint16(wavFormatPcm))
+	binary.Write(&buf, le, channels)
+	binary.Write(&buf, le, sampleRate)
+	binary.Write(&buf, le, sampleRate*uint32(channels)*2) // Byte rate
+	binary.Write(&buf, le, channels*2)                    // Block align
+	binary.Write(&buf, le, uint16(16))
+
+	buf.WriteString("data")
+	binary.Write(&buf, le, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+
+	return buf.Bytes()
+}
+
+// vorbisToWav decodes an Ogg Vorbis file into a 16-bit PCM WAV
+func vorbisToWav(bin []byte) ([]byte, error) {
+	samples, format, err := oggvorbis.ReadAll(bytes.NewReader(bin))
+	if err != nil {
+		return nil, err
+	}
+	if format.Channels == 0 {
+		return nil, fmt.Errorf("no channels")
+	}
+
+	// Already interleaved, like WAV wants
+	out := make([]byte, len(samples)*2)
+	for i, value := range samples {
+		value = max(-1, min(1, value))
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(int16(value*math.MaxInt16)))
+	}
+
+	return writeWav(uint16(format.Channels), uint32(format.SampleRate), out), nil
+}
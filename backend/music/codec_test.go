@@ -0,0 +1,209 @@
+package music
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+
+	musicpb "github.com/yuv418/cs553project/backend/protos/music"
+)
+
+// A WAV with one fmt chunk, an extra chunk we don't care about and data
+func rawWav(format uint16, channels uint16, bitsPerSample uint16, data []byte) []byte {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+
+	fmtChunk := new(bytes.Buffer)
+	binary.Write(fmtChunk, le, format)
+	binary.Write(fmtChunk, le, channels)
+	binary.Write(fmtChunk, le, uint32(8000))
+	binary.Write(fmtChunk, le, uint32(8000)*uint32(channels*bitsPerSample/8))
+	binary.Write(fmtChunk, le, channels*bitsPerSample/8)
+	binary.Write(fmtChunk, le, bitsPerSample)
+
+	// Odd sized, so it's padded
+	extra := []byte("odd")
+
+	buf.WriteString("RIFF")
+	binary.Write(&buf, le, uint32(4+8+fmtChunk.Len()+8+len(extra)+1+8+len(data)))
+	buf.WriteString("WAVE")
+	buf.WriteString("fmt ")
+	binary.Write(&buf, le, uint32(fmtChunk.Len()))
+	buf.Write(fmtChunk.Bytes())
+	buf.WriteString("LIST")
+	binary.Write(&buf, le, uint32(len(extra)))
+	buf.Write(extra)
+	buf.WriteByte(0)
+	buf.WriteString("data")
+	binary.Write(&buf, le, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func float32Bytes(values ...float32) []byte {
+	out := make([]byte, len(values)*4)
+	for i, value := range values {
+		binary.LittleEndian.PutUint32(out[i*4:], math.Float32bits(value))
+	}
+	return out
+}
+
+// Pulls the samples back out of a WAV we wrote
+func pcm16(t *testing.T, wav []byte) (channels uint16, samples []int16) {
+	t.Helper()
+
+	if len(wav) < 44 || string(wav[0:4]) != "RIFF" || string(wav[36:40]) != "data" {
+		t.Fatalf("not a plain WAV: %q", wav[:min(len(wav), 44)])
+	}
+	le := binary.LittleEndian
+	if format, bits := le.Uint16(wav[20:22]), le.Uint16(wav[34:36]); format != wavFormatPcm || bits != 16 {
+		t.Fatalf("format %d with %d bits, want 16-bit PCM", format, bits)
+	}
+	if riffSize := le.Uint32(wav[4:8]); int(riffSize) != len(wav)-8 {
+		t.Errorf("RIFF size is %d, file is %d", riffSize, len(wav))
+	}
+
+	data := wav[44 : 44+le.Uint32(wav[40:44])]
+	for i := 0; i+1 < len(data); i += 2 {
+		samples = append(samples, int16(le.Uint16(data[i:])))
+	}
+	return le.Uint16(wav[22:24]), samples
+}
+
+func TestNormalizeWav(t *testing.T) {
+	tests := []struct {
+		name     string
+		wav      []byte
+		channels uint16
+		want     []int16
+	}{
+		{
+			name:     "16-bit keeps its samples",
+			wav:      rawWav(wavFormatPcm, 2, 16, []byte{0x01, 0x00, 0xFF, 0xFF, 0x00, 0x80, 0xFF, 0x7F}),
+			channels: 2,
+			want:     []int16{1, -1, math.MinInt16, math.MaxInt16},
+		},
+		{
+			name:     "8-bit is unsigned",
+			wav:      rawWav(wavFormatPcm, 1, 8, []byte{0, 128, 255}),
+			channels: 1,
+			want:     []int16{math.MinInt16, 0, 127 << 8},
+		},
+		{
+			name:     "24-bit keeps the top bytes",
+			wav:      rawWav(wavFormatPcm, 1, 24, []byte{0xAA, 0x34, 0x12, 0xAA, 0x00, 0x80}),
+			channels: 1,
+			want:     []int16{0x1234, math.MinInt16},
+		},
+		{
+			name:     "32-bit keeps the top bytes",
+			wav:      rawWav(wavFormatPcm, 1, 32, []byte{0xAA, 0xAA, 0x34, 0x12}),
+			channels: 1,
+			want:     []int16{0x1234},
+		},
+		{
+			name:     "float is scaled and clipped",
+			wav:      rawWav(wavFormatFloat, 1, 32, float32Bytes(0, 0.5, -1, 2)),
+			channels: 1,
+			want:     []int16{0, math.MaxInt16 / 2, -math.MaxInt16, math.MaxInt16},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := normalizeWav(tc.wav)
+			if err != nil {
+				t.Fatal(err)
+			}
+			channels, samples := pcm16(t, out)
+			if channels != tc.channels || !slices.Equal(samples, tc.want) {
+				t.Errorf("got %d channels %v, want %d channels %v", channels, samples, tc.channels, tc.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeWavRejects(t *testing.T) {
+	tests := map[string][]byte{
+		"not a WAV":     []byte("OggS and then some"),
+		"no data chunk": rawWav(wavFormatPcm, 1, 16, nil)[:36],
+		"no channels":   rawWav(wavFormatPcm, 0, 16, []byte{0, 0}),
+		"12-bit":        rawWav(wavFormatPcm, 1, 12, []byte{0, 0}),
+		"64-bit float":  rawWav(wavFormatFloat, 1, 64, make([]byte, 8)),
+		"short fmt":     append([]byte("RIFF\x10\x00\x00\x00WAVEfmt \x04\x00\x00\x00"), 1, 0, 1, 0),
+	}
+	for name, wav := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := normalizeWav(wav); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestVorbisToWav(t *testing.T) {
+	ogg, err := musicFiles.ReadFile("audio/point.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wav, err := vorbisToWav(ogg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channels, samples := pcm16(t, wav)
+	if channels == 0 || len(samples) == 0 {
+		t.Fatalf("got %d channels and %d samples", channels, len(samples))
+	}
+	if !slices.ContainsFunc(samples, func(sample int16) bool { return sample != 0 }) {
+		t.Error("decoded nothing but silence")
+	}
+
+	if _, err := vorbisToWav([]byte("RIFF nope")); err == nil {
+		t.Error("decoded something that isn't Vorbis")
+	}
+}
+
+func TestParseCodecs(t *testing.T) {
+	tests := map[string][]musicpb.AudioCodec{
+		"":                  defaultCodecs,
+		"flac":              defaultCodecs,
+		"wav":               {musicpb.AudioCodec_WAV_PCM},
+		" WAV , flac, mp3 ": {musicpb.AudioCodec_WAV_PCM, musicpb.AudioCodec_MP3},
+		"opus,wav":          {musicpb.AudioCodec_OGG, musicpb.AudioCodec_WAV_PCM},
+	}
+	for param, want := range tests {
+		if got := parseCodecs(param); !slices.Equal(got, want) {
+			t.Errorf("parseCodecs(%q) is %v, want %v", param, got, want)
+		}
+	}
+}
+
+func TestPickAsset(t *testing.T) {
+	ogg, err := musicFiles.ReadFile("audio/hit.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &musicServer{transcoded: make(map[assetKey][]byte)}
+	sources := audioSources{musicpb.AudioCodec_OGG: ogg}
+
+	// Vorbis is fine, send it as is
+	bin, codec := server.pickAsset("hit", sources, []musicpb.AudioCodec{musicpb.AudioCodec_OGG, musicpb.AudioCodec_WAV_PCM})
+	if codec != musicpb.AudioCodec_OGG || !bytes.Equal(bin, ogg) {
+		t.Errorf("got %s, want the ogg file", codec)
+	}
+
+	// Only WAV, so it gets decoded
+	bin, codec = server.pickAsset("hit", sources, []musicpb.AudioCodec{musicpb.AudioCodec_MP3, musicpb.AudioCodec_WAV_PCM})
+	if codec != musicpb.AudioCodec_WAV_PCM || string(bin[0:4]) != "RIFF" {
+		t.Errorf("got %s, want a converted WAV", codec)
+	}
+
+	// Nothing we can make, so whatever we have
+	_, codec = server.pickAsset("hit", sources, []musicpb.AudioCodec{musicpb.AudioCodec_MP3})
+	if codec != musicpb.AudioCodec_OGG {
+		t.Errorf("got %s, want the ogg file as a fallback", codec)
+	}
+}
@@ -1,61 +1,261 @@
 package music
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"embed"
 
+	"connectrpc.com/connect"
 	"github.com/golang/protobuf/ptypes/empty"
-	"github.com/quic-go/webtransport-go"
 	"github.com/yuv418/cs553project/backend/common"
 	"github.com/yuv418/cs553project/backend/commondata"
 	musicpb "github.com/yuv418/cs553project/backend/protos/music"
+	"github.com/yuv418/cs553project/backend/tracing"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var (
 	//go:embed audio/wing.ogg
 	//go:embed audio/point.ogg
 	//go:embed audio/hit.ogg
+	//go:embed audio/wing.wav
+	//go:embed audio/point.wav
+	//go:embed audio/hit.wav
 	musicFiles      embed.FS
 	MusicServer     = newMusicServer()
 	MusicServerLock = sync.Mutex{}
 )
 
+// The enum effects are just names for files. Drop a file with the same name
+// into MUSIC_DIR/effects to replace one.
+var effectNames = map[musicpb.SoundEffect]string{
+	musicpb.SoundEffect_JUMP:            "wing",  // Flap sound
+	musicpb.SoundEffect_SCORE_INCREASED: "point", // Score increment sound
+	musicpb.SoundEffect_DIE:             "hit",   // Collision sound
+}
+
+// How long settings sent before the music session wait for it
+const pendingSettingsTimeout = time.Minute
+
+// Per game, set through UpdateAudioSettings
+type audioSettings struct {
+	// The player whose game this is. Only they can change its settings.
+	owner       string
+	mute        bool
+	volume      float32
+	effectsOnly bool
+	track       string
+	// What the client said it can play, best first
+	codecs []musicpb.AudioCodec
+}
+
+// One client's music stream. Effects and chunks are written from different
+// goroutines, so every write goes through send.
+type musicSession struct {
+	handle *commondata.WebTransportHandle
+	lock   sync.Mutex
+}
+
+func (session *musicSession) send(resp *musicpb.PlayMusicResp) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return common.WebTransportSendBuf(session.handle.Writer, resp)
+}
+
+func (session *musicSession) close() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.handle.Close()
+}
+
 type musicServer struct {
-	soundFiles   map[musicpb.SoundEffect][]byte // Maps SoundEffect to WAV file paths
-	transportMap map[string]*commondata.WebTransportHandle
+	soundFiles   map[string]audioSources // Maps effect names to audio files
+	tracks       map[string]audioSources // Background music, streamed in chunks
+	defaultTrack string
+	transportMap map[string]*musicSession
+	settings     map[string]*audioSettings
+
+	// Send effect IDs instead of the whole file every time.
+	// Set MUSIC_EFFECT_DELIVERY=id to turn this on.
+	sendEffectIds bool
+	// Sent when the session starts if effects go out by ID, one per codec list
+	manifests map[string]*musicpb.AssetManifest
+	// Assets we converted (or couldn't) for a codec
+	transcoded map[assetKey][]byte
+
+	chunkSize     int
+	chunkInterval time.Duration
 }
 
-// newMusicServer initializes the server with audio context and sound file mappings
+// newMusicServer loads the embedded effects and anything in MUSIC_DIR
 func newMusicServer() *musicServer {
+	soundFiles := make(map[string]audioSources)
 
 	// TODO: efficientize
-	wingBin, err := musicFiles.ReadFile("audio/wing.ogg")
+	for _, name := range effectNames {
+		soundFiles[name] = make(audioSources)
+		for _, ext := range []string{".ogg", ".wav"} {
+			bin, err := musicFiles.ReadFile("audio/" + name + ext)
+			if err != nil {
+				log.Panicf("couldn't read audio/%s%s", name, ext)
+			}
+			codec, _ := codecForFile(ext)
+			soundFiles[name][codec] = bin
+		}
+	}
+
+	server := &musicServer{
+		soundFiles:   soundFiles,
+		tracks:       make(map[string]audioSources),
+		transportMap: make(map[string]*musicSession),
+		settings:     make(map[string]*audioSettings),
+		manifests:    make(map[string]*musicpb.AssetManifest),
+		transcoded:   make(map[assetKey][]byte),
+	}
+
+	// MUSIC_DIR/effects/* are extra (or replacement) sound effects and
+	// MUSIC_DIR/tracks/* are background music. Both are named after the file,
+	// and the extension says what codec it is (.ogg, .wav or .mp3).
+	if musicDir := commondata.GetEnv("MUSIC_DIR", ""); musicDir != "" {
+		loadAudioDir(filepath.Join(musicDir, "effects"), server.soundFiles)
+		loadAudioDir(filepath.Join(musicDir, "tracks"), server.tracks)
+	}
+
+	server.defaultTrack = commondata.GetEnv("MUSIC_TRACK", "")
+	if server.defaultTrack == "" && len(server.tracks) > 0 {
+		// Something stable so every game sounds the same
+		names := make([]string, 0, len(server.tracks))
+		for name := range server.tracks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		server.defaultTrack = names[0]
+	}
+
+	switch delivery := commondata.GetEnv("MUSIC_EFFECT_DELIVERY", "payload"); delivery {
+	case "payload":
+		server.sendEffectIds = false
+	case "id":
+		server.sendEffectIds = true
+	default:
+		log.Panicf("MUSIC_EFFECT_DELIVERY must be payload or id, got %s", delivery)
+	}
+
+	chunkSize, err := strconv.Atoi(commondata.GetEnv("MUSIC_CHUNK_BYTES", "16384"))
 	if err != nil {
-		log.Panic("couldn't read wing.ogg")
+		log.Panicf("MUSIC_CHUNK_BYTES is invalid: %v", err)
 	}
-	pointBin, err := musicFiles.ReadFile("audio/point.ogg")
+	chunkInterval, err := time.ParseDuration(commondata.GetEnv("MUSIC_CHUNK_INTERVAL", "250ms"))
 	if err != nil {
-		log.Panic("couldn't read audio/point.ogg")
+		log.Panicf("MUSIC_CHUNK_INTERVAL is invalid: %v", err)
 	}
-	hitBin, err := musicFiles.ReadFile("audio/hit.ogg")
+	server.chunkSize = chunkSize
+	server.chunkInterval = chunkInterval
+
+	return server
+}
+
+func loadAudioDir(dir string, into map[string]audioSources) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		log.Panic("couldn't read audio/hitBin.ogg")
+		if !os.IsNotExist(err) {
+			log.Printf("(music) Couldn't read %s: %s\n", dir, err)
+		}
+		return
 	}
 
-	// Define mapping of SoundEffect enums to WAV file paths
-	soundFiles := map[musicpb.SoundEffect][]byte{
-		musicpb.SoundEffect_JUMP:            wingBin,  // Flap sound
-		musicpb.SoundEffect_SCORE_INCREASED: pointBin, // Score increment sound
-		musicpb.SoundEffect_DIE:             hitBin,   // Collision sound
+	loaded := make(map[string]audioSources)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		codec, ok := codecForFile(entry.Name())
+		if !ok {
+			log.Printf("(music) Skipping %s, not a codec we know\n", path)
+			continue
+		}
+
+		bin, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("(music) Couldn't read %s: %s\n", path, err)
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		// Replacing an effect replaces every version of it
+		if into[name] == nil || loaded[name] == nil {
+			into[name] = make(audioSources)
+			loaded[name] = into[name]
+		}
+		into[name][codec] = bin
+		log.Printf("(music) Loaded %s as %s (%s)\n", path, name, codec)
 	}
+}
 
-	return &musicServer{
-		soundFiles:   soundFiles,
-		transportMap: make(map[string]*commondata.WebTransportHandle),
+// Must hold MusicServerLock
+func (server *musicServer) manifestFor(codecs []musicpb.AudioCodec) *musicpb.AssetManifest {
+	key := fmt.Sprint(codecs)
+	if manifest, ok := server.manifests[key]; ok {
+		return manifest
+	}
+
+	manifest := &musicpb.AssetManifest{}
+	for name, sources := range server.soundFiles {
+		bin, codec := server.pickAsset("effects/"+name, sources, codecs)
+		if bin == nil {
+			continue
+		}
+		hash := sha256.Sum256(bin)
+		manifest.Assets = append(manifest.Assets, &musicpb.AudioAsset{
+			Id:     name,
+			Sha256: hex.EncodeToString(hash[:]),
+			Size:   int32(len(bin)),
+			Data:   bin,
+			Codec:  codec,
+		})
+	}
+	sort.Slice(manifest.Assets, func(i, j int) bool {
+		return manifest.Assets[i].Id < manifest.Assets[j].Id
+	})
+
+	server.manifests[key] = manifest
+	return manifest
+}
+
+func (server *musicServer) defaultSettings(owner string) *audioSettings {
+	return &audioSettings{owner: owner, volume: 1, track: server.defaultTrack, codecs: defaultCodecs}
+}
+
+// Games nobody set anything for get the defaults, which aren't stored.
+// Must hold MusicServerLock
+func (server *musicServer) settingsFor(gameId string) *audioSettings {
+	if settings := server.settings[gameId]; settings != nil {
+		return settings
+	}
+	return server.defaultSettings("")
+}
+
+// Drops settings for a game whose music session never showed up
+func (server *musicServer) dropPending(gameId string, settings *audioSettings) {
+	MusicServerLock.Lock()
+	defer MusicServerLock.Unlock()
+
+	if server.settings[gameId] == settings && server.transportMap[gameId] == nil {
+		log.Printf("(music) Game %s never connected, dropping its settings\n", gameId)
+		delete(server.settings, gameId)
 	}
 }
 
@@ -72,42 +272,229 @@ func EstablishMusicWebTransport(ctx *commondata.ReqCtx, handle *commondata.WebTr
 
 	MusicServerLock.Lock()
 
-	MusicServer.transportMap[ctx.GameId] = handle
+	session := &musicSession{handle: handle}
+	MusicServer.transportMap[ctx.GameId] = session
+	hasTracks := len(MusicServer.tracks) > 0
+
+	settings := MusicServer.settings[ctx.GameId]
+	if settings == nil || settings.owner != ctx.Username {
+		// Whatever someone else set for this game doesn't count
+		settings = MusicServer.defaultSettings(ctx.Username)
+		MusicServer.settings[ctx.GameId] = settings
+	}
+	settings.codecs = parseCodecs(ctx.Query.Get("codecs"))
+	log.Printf("(music) Game %s plays %v\n", ctx.GameId, settings.codecs)
+
+	// Everything the client needs up front, after this it's just IDs
+	var manifest *musicpb.AssetManifest
+	if MusicServer.sendEffectIds {
+		manifest = MusicServer.manifestFor(settings.codecs)
+	}
 
 	MusicServerLock.Unlock()
 
+	if manifest != nil {
+		if err := session.send(&musicpb.PlayMusicResp{Manifest: manifest}); err != nil {
+			return err
+		}
+	}
+
+	if hasTracks {
+		go streamMusic(ctx.GameId, session)
+	}
+
 	return nil
 }
 
+// Sends the game's background track a chunk at a time until its session goes away.
+func streamMusic(gameId string, session *musicSession) {
+	timer := time.NewTicker(MusicServer.chunkInterval)
+	defer timer.Stop()
+
+	track := ""
+	index := int32(0)
+	offset := 0
+
+	for range timer.C {
+		MusicServerLock.Lock()
+
+		// Game's over (or someone else took over the session)
+		if MusicServer.transportMap[gameId] != session {
+			MusicServerLock.Unlock()
+			return
+		}
+
+		settings := MusicServer.settingsFor(gameId)
+		trackBin, codec := MusicServer.pickAsset("tracks/"+settings.track, MusicServer.tracks[settings.track], settings.codecs)
+		if settings.mute || settings.effectsOnly || len(trackBin) == 0 {
+			MusicServerLock.Unlock()
+			continue
+		}
+
+		// Start over if the player switched tracks
+		if settings.track != track {
+			track = settings.track
+			index = 0
+			offset = 0
+		}
+
+		// The track bytes never change once loaded, so the chunk can be
+		// written after we let go of the lock
+		end := min(offset+MusicServer.chunkSize, len(trackBin))
+		resp := &musicpb.PlayMusicResp{
+			MusicChunk: &musicpb.MusicChunk{
+				Track: track,
+				Index: index,
+				Data:  trackBin[offset:end],
+				Last:  end == len(trackBin),
+				Codec: codec,
+			},
+			Volume: settings.volume,
+		}
+
+		MusicServerLock.Unlock()
+
+		if err := session.send(resp); err != nil {
+			log.Printf("(music) Stopping background music for %s: %s\n", gameId, err)
+			return
+		}
+
+		if end == len(trackBin) {
+			// Loop
+			index = 0
+			offset = 0
+		} else {
+			index++
+			offset = end
+		}
+	}
+}
+
 // PlayMusic implements the PlayMusic RPC to play a sound effect
 func PlayMusic(ctx *commondata.ReqCtx, req *musicpb.PlayMusicReq) (*empty.Empty, error) {
 	// Log incoming request for debugging
 
 	MusicServerLock.Lock()
-	defer MusicServerLock.Unlock()
 
 	log.Printf("Received PlayMusic request: game_id=%s, effect=%v", req.GameId, req.Effect)
 
-	gameTransport := MusicServer.transportMap[req.GameId]
-	if gameTransport == nil {
+	session := MusicServer.transportMap[req.GameId]
+	if session == nil {
+		MusicServerLock.Unlock()
 		return nil, fmt.Errorf("unknown game ID: %v", ctx.GameId)
 	}
 
-	// Look up the WAV file path for the requested sound effect
-	effectBin := MusicServer.soundFiles[req.Effect]
-	if effectBin == nil {
-		return nil, fmt.Errorf("unknown sound effect: %v", req.Effect)
+	// Look up the audio for the requested sound effect
+	effectName := effectNames[req.Effect]
+	if req.EffectName != nil {
+		effectName = *req.EffectName
+	}
+	effectSources := MusicServer.soundFiles[effectName]
+	if effectSources == nil {
+		MusicServerLock.Unlock()
+		return nil, fmt.Errorf("unknown sound effect: %v", effectName)
 	}
 
-	respPb := &musicpb.PlayMusicResp{AudioPayload: effectBin}
-	common.WebTransportSendBuf(gameTransport.Writer, respPb)
+	settings := MusicServer.settingsFor(req.GameId)
+	var respPb *musicpb.PlayMusicResp
+	if !settings.mute {
+		respPb = &musicpb.PlayMusicResp{Volume: settings.volume, ServerTime: timestamppb.Now()}
+		if MusicServer.sendEffectIds {
+			respPb.EffectId = effectName
+		} else {
+			respPb.AudioPayload, respPb.Codec = MusicServer.pickAsset("effects/"+effectName, effectSources, settings.codecs)
+		}
+	}
+
+	gameOver := req.Effect == musicpb.SoundEffect_DIE
+	if gameOver {
+		MusicServer.forget(req.GameId)
+	}
+
+	MusicServerLock.Unlock()
+
+	if respPb != nil {
+		span := tracing.Start(ctx.TraceParent, "music/write", tracing.Internal)
+		span.SetAttr("game.id", req.GameId)
+		span.End(session.send(respPb))
+	}
 
 	// Close stream if this is a DIE message
-	if req.Effect == musicpb.SoundEffect_DIE {
+	if gameOver {
 		log.Printf("Closing audio stream")
-		(*gameTransport.WtStream.(*webtransport.Stream)).Close()
+		session.close()
 	}
 
 	// Return empty response (opus_payload is a placeholder for future streaming)
 	return &emptypb.Empty{}, nil
 }
+
+// Must hold MusicServerLock
+func (server *musicServer) forget(gameId string) {
+	// This also stops the background music
+	delete(server.transportMap, gameId)
+	delete(server.settings, gameId)
+}
+
+// EndMusicSession closes a game's music session when its sounds didn't come
+// through here, so there was no DIE to close it
+func EndMusicSession(ctx *commondata.ReqCtx, req *musicpb.EndMusicSessionReq) (*empty.Empty, error) {
+	MusicServerLock.Lock()
+	session := MusicServer.transportMap[req.GameId]
+	MusicServer.forget(req.GameId)
+	MusicServerLock.Unlock()
+
+	log.Printf("Received EndMusicSession request: game_id=%s", req.GameId)
+
+	if session != nil {
+		log.Printf("Closing audio stream")
+		session.close()
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// UpdateAudioSettings changes how a game sounds. It can be called before the
+// music session is up, but settings for a session that doesn't show up within
+// pendingSettingsTimeout are dropped.
+func UpdateAudioSettings(ctx *commondata.ReqCtx, req *musicpb.AudioSettingsReq) (*empty.Empty, error) {
+	MusicServerLock.Lock()
+	defer MusicServerLock.Unlock()
+
+	log.Printf("Received UpdateAudioSettings request: game_id=%s, user=%s", req.GameId, ctx.Username)
+
+	if req.Volume != nil && (*req.Volume < 0 || *req.Volume > 1) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("volume must be between 0 and 1, got %f", *req.Volume))
+	}
+	if req.Track != nil && len(MusicServer.tracks[*req.Track]) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unknown track: %s", *req.Track))
+	}
+
+	settings := MusicServer.settings[req.GameId]
+	if settings == nil {
+		settings = MusicServer.defaultSettings(ctx.Username)
+		MusicServer.settings[req.GameId] = settings
+		if MusicServer.transportMap[req.GameId] == nil {
+			time.AfterFunc(pendingSettingsTimeout, func() {
+				MusicServer.dropPending(req.GameId, settings)
+			})
+		}
+	} else if settings.owner != ctx.Username {
+		return nil, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("game %s isn't yours", req.GameId))
+	}
+
+	if req.Mute != nil {
+		settings.mute = *req.Mute
+	}
+	if req.Volume != nil {
+		settings.volume = *req.Volume
+	}
+	if req.EffectsOnly != nil {
+		settings.effectsOnly = *req.EffectsOnly
+	}
+	if req.Track != nil {
+		settings.track = *req.Track
+	}
+
+	return &emptypb.Empty{}, nil
+}
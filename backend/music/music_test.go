@@ -0,0 +1,122 @@
+package music
+
+import (
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/yuv418/cs553project/backend/commondata"
+	musicpb "github.com/yuv418/cs553project/backend/protos/music"
+	"google.golang.org/protobuf/proto"
+)
+
+func forgetGame(t *testing.T, gameId string) {
+	t.Cleanup(func() {
+		MusicServerLock.Lock()
+		defer MusicServerLock.Unlock()
+		delete(MusicServer.settings, gameId)
+		delete(MusicServer.transportMap, gameId)
+	})
+}
+
+func TestUpdateAudioSettingsOnlyChangesWhatsSet(t *testing.T) {
+	forgetGame(t, "partial")
+	alice := &commondata.ReqCtx{Username: "alice"}
+
+	_, err := UpdateAudioSettings(alice, &musicpb.AudioSettingsReq{GameId: "partial", Volume: proto.Float32(0.5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = UpdateAudioSettings(alice, &musicpb.AudioSettingsReq{GameId: "partial", Mute: proto.Bool(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	MusicServerLock.Lock()
+	settings := *MusicServer.settingsFor("partial")
+	MusicServerLock.Unlock()
+	if !settings.mute || settings.volume != 0.5 || settings.effectsOnly || settings.track != MusicServer.defaultTrack {
+		t.Errorf("got %+v, want muted at half volume and the rest untouched", settings)
+	}
+}
+
+func TestUpdateAudioSettingsRejects(t *testing.T) {
+	forgetGame(t, "owned")
+	_, err := UpdateAudioSettings(&commondata.ReqCtx{Username: "alice"}, &musicpb.AudioSettingsReq{GameId: "owned", Mute: proto.Bool(false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user string
+		req  *musicpb.AudioSettingsReq
+		code connect.Code
+	}{
+		{"someone else's game", "bob", &musicpb.AudioSettingsReq{GameId: "owned", Mute: proto.Bool(true)}, connect.CodePermissionDenied},
+		{"too loud", "alice", &musicpb.AudioSettingsReq{GameId: "owned", Volume: proto.Float32(2)}, connect.CodeInvalidArgument},
+		{"negative volume", "alice", &musicpb.AudioSettingsReq{GameId: "owned", Volume: proto.Float32(-0.1)}, connect.CodeInvalidArgument},
+		{"unknown track", "alice", &musicpb.AudioSettingsReq{GameId: "owned", Track: proto.String("nope")}, connect.CodeInvalidArgument},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := UpdateAudioSettings(&commondata.ReqCtx{Username: tc.user}, tc.req)
+			if connect.CodeOf(err) != tc.code {
+				t.Errorf("got %v, want %s", err, tc.code)
+			}
+		})
+	}
+
+	MusicServerLock.Lock()
+	defer MusicServerLock.Unlock()
+	if settings := MusicServer.settingsFor("owned"); settings.mute || settings.volume != 1 {
+		t.Errorf("rejected requests changed the settings to %+v", settings)
+	}
+}
+
+func TestSettingsForUnknownGamesArentKept(t *testing.T) {
+	MusicServerLock.Lock()
+	MusicServer.settingsFor("unknown")
+	_, kept := MusicServer.settings["unknown"]
+	MusicServerLock.Unlock()
+	if kept {
+		t.Error("looking up settings stored them")
+	}
+
+	forgetGame(t, "pending")
+	_, err := UpdateAudioSettings(&commondata.ReqCtx{Username: "alice"}, &musicpb.AudioSettingsReq{GameId: "pending", Mute: proto.Bool(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	MusicServerLock.Lock()
+	settings := MusicServer.settings["pending"]
+	MusicServerLock.Unlock()
+
+	// The session never showed up
+	MusicServer.dropPending("pending", settings)
+	MusicServerLock.Lock()
+	defer MusicServerLock.Unlock()
+	if _, ok := MusicServer.settings["pending"]; ok {
+		t.Error("settings for a game that never connected are still around")
+	}
+}
+
+func TestEndMusicSessionForgetsGame(t *testing.T) {
+	forgetGame(t, "ended")
+	_, err := UpdateAudioSettings(&commondata.ReqCtx{Username: "alice"}, &musicpb.AudioSettingsReq{GameId: "ended", Mute: proto.Bool(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Twice, the outbox can deliver it again
+	for range 2 {
+		if _, err := EndMusicSession(&commondata.ReqCtx{}, &musicpb.EndMusicSessionReq{GameId: "ended"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	MusicServerLock.Lock()
+	defer MusicServerLock.Unlock()
+	if _, ok := MusicServer.settings["ended"]; ok {
+		t.Error("settings outlived the session")
+	}
+}
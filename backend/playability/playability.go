@@ -0,0 +1,272 @@
+package playability
+
+// Checks whether a generated world can actually be cleared with the engine's
+// physics. We search the whole simulation: every tick the bird either flaps or
+// it doesn't. Birds that last flapped on the same tick all have the same velocity
+// and move together, so instead of tracking every bird we track the set of
+// heights they can be at for each velocity.
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+
+	worldgenpb "github.com/yuv418/cs553project/backend/protos/world_gen"
+)
+
+// The engine's physics. game_engine uses these instead of its own numbers, so
+// the validator always checks against what the engine actually does.
+const (
+	Gravity      = 0.25
+	FlapStrength = 4.6
+	PipeWidth    = 72
+	BirdX        = 50
+	// Where the bird spawns, and how fast the pipes start out
+	StartY         = 200
+	StartPipeSpeed = 2
+	// The pipes speed up by this much every 5 points, up to MaxPipeSpeed
+	PipeSpeedStep = 0.5
+	MaxPipeSpeed  = 5
+)
+
+type Physics struct {
+	Gravity      float64
+	FlapStrength float64
+	PipeWidth    float64
+	BirdX        float64
+	BirdWidth    float64
+	BirdHeight   float64
+	// The pipe speed ramps up the same way the engine does it
+	PipeSpeed     float64
+	PipeSpeedStep float64
+	MaxPipeSpeed  float64
+	// The engine doesn't stop the bird at the edges of the screen, but a
+	// player can't see it there, so we treat the viewport as the bounds.
+	ViewportWidth  float64
+	ViewportHeight float64
+	StartY         float64
+}
+
+func DefaultPhysics(viewportWidth int32, viewportHeight int32) *Physics {
+	return &Physics{
+		Gravity:        Gravity,
+		FlapStrength:   FlapStrength,
+		PipeWidth:      PipeWidth,
+		BirdX:          BirdX,
+		BirdWidth:      34,
+		BirdHeight:     24,
+		PipeSpeed:      StartPipeSpeed,
+		PipeSpeedStep:  PipeSpeedStep,
+		MaxPipeSpeed:   MaxPipeSpeed,
+		ViewportWidth:  float64(viewportWidth),
+		ViewportHeight: float64(viewportHeight),
+		StartY:         StartY,
+	}
+}
+
+// A transition is the move from pipe Index-1 into pipe Index.
+type Transition struct {
+	Index int
+	// Vertical movement of the gap center from the previous pipe
+	GapDelta float64
+	// Height (in pixels) of the band of bird positions that survive
+	// while inside this pipe. Smaller is harder.
+	Slack float64
+}
+
+type Report struct {
+	Playable bool
+	// Index of the first pipe nobody can get through, -1 if playable
+	FailedPipe int
+	Hardest    Transition
+	// Number of pipes that were cleared on the best path
+	PipesCleared int
+	Ticks        int
+}
+
+func (r *Report) String() string {
+	if r.Playable {
+		return fmt.Sprintf("playable in %d ticks, hardest pipe %d (gap delta %.1f, slack %.1f)",
+			r.Ticks, r.Hardest.Index, r.Hardest.GapDelta, r.Hardest.Slack)
+	}
+	return fmt.Sprintf("unplayable at pipe %d after %d ticks (gap delta %.1f)",
+		r.FailedPipe, r.Ticks, r.Hardest.GapDelta)
+}
+
+// Starting from a single spawn point, the heights a bird can reach are really a
+// (very dense) set of points. Points closer than this are treated as one span,
+// otherwise the search blows up.
+const mergeTolerance = 1.0
+
+// A closed range of heights the bird can be at
+type span struct {
+	low  float64
+	high float64
+}
+
+// Every bird that has been falling for the same number of ticks
+type birdGroup struct {
+	velocity float64
+	spans    []span
+}
+
+// Clips every span to [low, high], dropping the ones that end up empty.
+func clip(spans []span, low float64, high float64) []span {
+	out := spans[:0]
+	for _, s := range spans {
+		s.low = math.Max(s.low, low)
+		s.high = math.Min(s.high, high)
+		if s.low <= s.high {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Merges overlapping (or nearly overlapping) spans into a sorted, disjoint list.
+func union(spans []span) []span {
+	slices.SortFunc(spans, func(a, b span) int {
+		return cmp.Compare(a.low, b.low)
+	})
+	out := make([]span, 0, len(spans))
+	for _, s := range spans {
+		if len(out) > 0 && s.low <= out[len(out)-1].high+mergeTolerance {
+			out[len(out)-1].high = math.Max(out[len(out)-1].high, s.high)
+		} else {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func gapCenter(spec *worldgenpb.PipeSpec) float64 {
+	return spec.GapStart + spec.GapHeight/2
+}
+
+func gapDelta(world *worldgenpb.WorldGenerated, i int) float64 {
+	if i <= 0 {
+		return 0
+	}
+	return gapCenter(world.PipeSpecs[i]) - gapCenter(world.PipeSpecs[i-1])
+}
+
+// Validate searches over every flap/no-flap sequence and reports whether the
+// bird can make it past the last pipe in the world.
+func Validate(world *worldgenpb.WorldGenerated, phys *Physics) *Report {
+	report := &Report{
+		Playable:   false,
+		FailedPipe: -1,
+		Hardest:    Transition{Index: -1, Slack: math.Inf(1)},
+	}
+
+	pipeCount := len(world.PipeSpecs)
+	if pipeCount == 0 {
+		report.Playable = true
+		return report
+	}
+
+	advanceAmt := phys.PipeWidth + world.PipeSpacing
+	pipeWindowX := phys.ViewportWidth * -0.5
+	pipeSpeed := phys.PipeSpeed
+	prevClosestPipe := 0
+	score := 0
+
+	// The engine sits in Ready until the first input, which starts the game
+	// without flapping.
+	groups := []*birdGroup{{velocity: 0, spans: []span{{low: phys.StartY, high: phys.StartY}}}}
+
+	// Per pipe, the lowest and highest surviving bird position while inside it
+	bandLow := make([]float64, pipeCount)
+	bandHigh := make([]float64, pipeCount)
+	for i := range pipeCount {
+		bandLow[i] = math.Inf(1)
+		bandHigh[i] = math.Inf(-1)
+	}
+
+	for tick := 0; ; tick++ {
+		report.Ticks = tick
+
+		// Every pipe the bird could be touching this tick
+		pipeWindowX += pipeSpeed
+		firstPipe := int(math.Max(0, math.Ceil((pipeWindowX+phys.BirdX-phys.PipeWidth)/advanceAmt)))
+		lastPipe := int(math.Floor((pipeWindowX + phys.BirdX + phys.BirdWidth) / advanceAmt))
+
+		if firstPipe >= pipeCount {
+			// Every pipe is behind us
+			report.Playable = true
+			report.PipesCleared = pipeCount
+			break
+		}
+
+		// Any bird alive right now can flap on this tick
+		var flapped []span
+		for _, group := range groups {
+			flapped = append(flapped, group.spans...)
+		}
+		groups = append(groups, &birdGroup{velocity: -phys.FlapStrength, spans: union(flapped)})
+
+		// Highest and lowest y (top of the bird) that don't hit anything
+		low := 0.0
+		high := phys.ViewportHeight - phys.BirdHeight
+		for pipe := firstPipe; pipe <= lastPipe && pipe < pipeCount; pipe++ {
+			spec := world.PipeSpecs[pipe]
+			low = math.Max(low, spec.GapStart)
+			high = math.Min(high, spec.GapStart+spec.GapHeight-phys.BirdHeight)
+		}
+
+		alive := groups[:0]
+		for _, group := range groups {
+			group.velocity += phys.Gravity
+			for i := range group.spans {
+				group.spans[i].low += group.velocity
+				group.spans[i].high += group.velocity
+			}
+			group.spans = clip(group.spans, low, high)
+			if len(group.spans) == 0 {
+				continue
+			}
+			alive = append(alive, group)
+
+			for pipe := firstPipe; pipe <= lastPipe && pipe < pipeCount; pipe++ {
+				bandLow[pipe] = math.Min(bandLow[pipe], group.spans[0].low)
+				bandHigh[pipe] = math.Max(bandHigh[pipe], group.spans[len(group.spans)-1].high)
+			}
+		}
+		groups = alive
+
+		if len(groups) == 0 {
+			report.FailedPipe = min(lastPipe, pipeCount-1)
+			report.PipesCleared = firstPipe
+			report.Hardest = Transition{
+				Index:    report.FailedPipe,
+				GapDelta: gapDelta(world, report.FailedPipe),
+				Slack:    0,
+			}
+			return report
+		}
+
+		// Same scoring and speed ramp as the engine
+		closestPipe := int(math.Max(0, math.Ceil((pipeWindowX-phys.PipeWidth)/advanceAmt)))
+		if closestPipe != prevClosestPipe {
+			score++
+			prevClosestPipe = closestPipe
+		}
+		if score%5 == 0 && pipeSpeed < phys.MaxPipeSpeed {
+			pipeSpeed += phys.PipeSpeedStep
+		}
+	}
+
+	for i := range pipeCount {
+		slack := bandHigh[i] - bandLow[i]
+		if slack < report.Hardest.Slack {
+			report.Hardest = Transition{
+				Index:    i,
+				GapDelta: gapDelta(world, i),
+				Slack:    slack,
+			}
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,88 @@
+package playability
+
+import (
+	"testing"
+
+	worldgenpb "github.com/yuv418/cs553project/backend/protos/world_gen"
+)
+
+func worldWithGaps(gaps ...[2]float64) *worldgenpb.WorldGenerated {
+	world := &worldgenpb.WorldGenerated{PipeSpacing: 250}
+	for _, gap := range gaps {
+		world.PipeSpecs = append(world.PipeSpecs, &worldgenpb.PipeSpec{GapStart: gap[0], GapHeight: gap[1]})
+	}
+	return world
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		world    *worldgenpb.WorldGenerated
+		playable bool
+		// Only checked when it isn't playable
+		failedPipe int
+	}{
+		{
+			name:     "no pipes",
+			world:    worldWithGaps(),
+			playable: true,
+		},
+		{
+			name:     "gaps in line with the spawn",
+			world:    worldWithGaps([2]float64{120, 200}, [2]float64{120, 200}, [2]float64{120, 200}),
+			playable: true,
+		},
+		{
+			name:     "gentle climb",
+			world:    worldWithGaps([2]float64{250, 150}, [2]float64{200, 150}, [2]float64{150, 150}, [2]float64{100, 150}),
+			playable: true,
+		},
+		{
+			name:       "gap smaller than the bird",
+			world:      worldWithGaps([2]float64{120, 200}, [2]float64{200, 20}, [2]float64{120, 200}),
+			failedPipe: 1,
+		},
+		{
+			name:       "top to bottom in one pipe",
+			world:      worldWithGaps([2]float64{120, 200}, [2]float64{0, 50}, [2]float64{550, 50}),
+			failedPipe: 2,
+		},
+		{
+			name:       "first gap off screen",
+			world:      worldWithGaps([2]float64{600, 100}),
+			failedPipe: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			report := Validate(tc.world, DefaultPhysics(800, 600))
+			if report.Playable != tc.playable {
+				t.Fatalf("got %s, want playable %v", report, tc.playable)
+			}
+			if tc.playable {
+				if report.FailedPipe != -1 || report.PipesCleared != len(tc.world.PipeSpecs) {
+					t.Errorf("playable world has failed pipe %d and cleared %d", report.FailedPipe, report.PipesCleared)
+				}
+				return
+			}
+			if report.FailedPipe != tc.failedPipe {
+				t.Errorf("failed at pipe %d, want %d", report.FailedPipe, tc.failedPipe)
+			}
+			if report.PipesCleared > report.FailedPipe {
+				t.Errorf("cleared %d pipes but failed at %d", report.PipesCleared, report.FailedPipe)
+			}
+		})
+	}
+}
+
+// Same world, same answer
+func TestValidateIsDeterministic(t *testing.T) {
+	world := worldWithGaps([2]float64{100, 120}, [2]float64{300, 120}, [2]float64{150, 120}, [2]float64{350, 120})
+	first := Validate(world, DefaultPhysics(800, 600))
+	for range 5 {
+		if again := Validate(world, DefaultPhysics(800, 600)); *again != *first {
+			t.Fatalf("got %s, then %s", first, again)
+		}
+	}
+}
@@ -5,30 +5,44 @@ package score
 // https://pkg.go.dev/encoding/json
 
 import (
+	"context"
 	"encoding/json"
-	"io"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
+
+	"connectrpc.com/connect"
 
 	"github.com/emirpasic/gods/trees/binaryheap"
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/yuv418/cs553project/backend/commondata"
 	scorepb "github.com/yuv418/cs553project/backend/protos/score"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 type ScoreCtx struct {
-	jsonFile *os.File
+	fileName string
 	// game id -> entry
 	data       map[string][]*scorepb.ScoreEntry
 	globalHeap *binaryheap.Heap
+	// Guards data, globalHeap and the file
+	dataLock sync.Mutex
+	// Why the last write failed, nil if it didn't
+	writeErr error
+
+	// WatchScores streams, poked every time a score comes in
+	watchers  map[chan struct{}]struct{}
+	watchLock sync.Mutex
 }
 
 func LoadScoreCtx() (*ScoreCtx, error) {
 	scoreFileName := commondata.GetEnv("SCORE_FILE", "score.json")
-	scoreFile, err := os.OpenFile(scoreFileName, os.O_RDWR, 0)
+	data, err := os.ReadFile(scoreFileName)
 
-	ctx := &ScoreCtx{}
+	ctx := &ScoreCtx{fileName: scoreFileName, watchers: make(map[chan struct{}]struct{})}
 	ctx.globalHeap = binaryheap.NewWith(func(a, b interface{}) int {
 		// Max heap
 		return int(b.(*scorepb.ScoreEntry).Score - a.(*scorepb.ScoreEntry).Score)
@@ -36,12 +50,6 @@ func LoadScoreCtx() (*ScoreCtx, error) {
 
 	if err != nil && os.IsNotExist(err) {
 		// Doesn't exist, try to make it
-		scoreFile, err = os.Create(scoreFileName)
-		if err != nil {
-			return nil, err
-		}
-
-		ctx.jsonFile = scoreFile
 		ctx.data = make(map[string][]*scorepb.ScoreEntry)
 
 		// Initial write
@@ -54,12 +62,6 @@ func LoadScoreCtx() (*ScoreCtx, error) {
 
 	} else if err == nil {
 		// Exists it, read
-		ctx.jsonFile = scoreFile
-
-		data, err := io.ReadAll(ctx.jsonFile)
-		if err != nil {
-			return nil, err
-		}
 		err = json.Unmarshal(data, &ctx.data)
 		if err != nil {
 			return nil, err
@@ -83,34 +85,91 @@ func LoadScoreCtx() (*ScoreCtx, error) {
 
 }
 
+// Writes a new file and renames it over the old one, so getting killed
+// halfway through leaves the old scores instead of half of the new ones.
+// Must hold dataLock
 func (ctx *ScoreCtx) WriteScores() error {
+	ctx.writeErr = ctx.writeScores()
+	return ctx.writeErr
+}
+
+func (ctx *ScoreCtx) writeScores() error {
 	// Write to file
 	out, err := json.Marshal(ctx.data)
 	if err != nil {
 		return err
 	}
 
-	ctx.jsonFile.Truncate(0)
-	ctx.jsonFile.Seek(0, 0)
-
-	// TODO check bytes write
-	_, err = ctx.jsonFile.Write(out)
+	tmp, err := os.CreateTemp(filepath.Dir(ctx.fileName), filepath.Base(ctx.fileName)+".tmp-*")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), ctx.fileName)
+}
+
+// Close waits for a write in progress. Every update is on disk as soon as
+// it's in, so there's nothing else to do.
+func (ctx *ScoreCtx) Close(_ context.Context) error {
+	ctx.dataLock.Lock()
+	defer ctx.dataLock.Unlock()
+
+	return ctx.WriteScores()
+}
+
+// Healthy fails if the last write to the score file did, since new scores
+// would be lost on restart.
+func (ctx *ScoreCtx) Healthy(_ context.Context) error {
+	ctx.dataLock.Lock()
+	defer ctx.dataLock.Unlock()
 
+	if ctx.writeErr != nil {
+		return fmt.Errorf("can't write %s: %w", ctx.fileName, ctx.writeErr)
+	}
 	return nil
 }
 
 func (ctx *ScoreCtx) UpdateScore(reqCtx *commondata.ReqCtx, req *scorepb.ScoreEntry) (*empty.Empty, error) {
 	log.Printf("(UpdateScore) Received request for %v\n", req)
 
+	ctx.dataLock.Lock()
+	defer ctx.dataLock.Unlock()
+
+	// Retries and replays can send the same game more than once
+	for _, entry := range ctx.data[reqCtx.Username] {
+		if entry.GameId == req.GameId {
+			log.Printf("(UpdateScore) Already have game %s for %s\n", req.GameId, reqCtx.Username)
+			return &emptypb.Empty{}, nil
+		}
+	}
+
 	// Set
-	ctx.data[reqCtx.Username] = append(ctx.data[reqCtx.Username], req)
+	entries := ctx.data[reqCtx.Username]
+	ctx.data[reqCtx.Username] = append(entries, req)
 
 	// Write
 	err := ctx.WriteScores()
 	if err != nil {
+		// Take it back out, or the caller's retry would look like a duplicate
+		// and the score would never make it to disk
+		if len(entries) == 0 {
+			delete(ctx.data, reqCtx.Username)
+		} else {
+			ctx.data[reqCtx.Username] = entries
+		}
 		return nil, err
 	}
 
@@ -119,12 +178,31 @@ func (ctx *ScoreCtx) UpdateScore(reqCtx *commondata.ReqCtx, req *scorepb.ScoreEn
 	// Note there may be a bug here?
 	ctx.globalHeap.Push(req)
 
+	ctx.watchLock.Lock()
+	for updated := range ctx.watchers {
+		// Watchers only need to know something changed, not how many times
+		select {
+		case updated <- struct{}{}:
+		default:
+		}
+	}
+	ctx.watchLock.Unlock()
+
 	return &emptypb.Empty{}, nil
 }
 
 func (ctx *ScoreCtx) GetScores(reqCtx *commondata.ReqCtx, _ *emptypb.Empty) (*scorepb.GetScoresResp, error) {
 	log.Printf("(GetScores) Received request for %s\n", reqCtx.Username)
 
+	ctx.dataLock.Lock()
+	defer ctx.dataLock.Unlock()
+
+	return ctx.scoresFor(reqCtx.Username), nil
+}
+
+// Copies everything, since the response gets marshalled after dataLock is let go.
+// Must hold dataLock
+func (ctx *ScoreCtx) scoresFor(username string) *scorepb.GetScoresResp {
 	i := 0
 	it := ctx.globalHeap.Iterator()
 	// I don't like the efficiency of this
@@ -132,12 +210,82 @@ func (ctx *ScoreCtx) GetScores(reqCtx *commondata.ReqCtx, _ *emptypb.Empty) (*sc
 
 	// https://stackoverflow.com/questions/21950244/is-there-a-way-to-iterate-over-a-range-of-integers
 	for it.Next() && i < 5 {
-		globalEntries = append(globalEntries, it.Value().(*scorepb.ScoreEntry))
+		globalEntries = append(globalEntries, proto.Clone(it.Value().(*scorepb.ScoreEntry)).(*scorepb.ScoreEntry))
 		i++
 	}
 
+	entries := make([]*scorepb.ScoreEntry, 0, len(ctx.data[username]))
+	for _, entry := range ctx.data[username] {
+		entries = append(entries, proto.Clone(entry).(*scorepb.ScoreEntry))
+	}
+
 	return &scorepb.GetScoresResp{
-		Entries:       ctx.data[reqCtx.Username],
+		Entries:       entries,
 		GlobalEntries: globalEntries,
-	}, nil
+	}
+}
+
+// WatchScores sends the same thing as GetScores right away and then again
+// whenever a new score comes in, until the caller goes away.
+func (ctx *ScoreCtx) WatchScores(reqCtx *commondata.ReqCtx, _ *emptypb.Empty, send func(*scorepb.GetScoresResp) error) error {
+	log.Printf("(WatchScores) Received request for %s\n", reqCtx.Username)
+
+	updated := make(chan struct{}, 1)
+	ctx.watchLock.Lock()
+	ctx.watchers[updated] = struct{}{}
+	ctx.watchLock.Unlock()
+
+	defer func() {
+		ctx.watchLock.Lock()
+		delete(ctx.watchers, updated)
+		ctx.watchLock.Unlock()
+	}()
+
+	for {
+		ctx.dataLock.Lock()
+		scores := ctx.scoresFor(reqCtx.Username)
+		ctx.dataLock.Unlock()
+
+		if err := send(scores); err != nil {
+			return err
+		}
+
+		select {
+		case <-updated:
+		case <-reqCtx.Context().Done():
+			return nil
+		}
+	}
+}
+
+// GetGhost finds one of the player's earlier games that can be replayed as a ghost.
+// No game ID means their personal best.
+func (ctx *ScoreCtx) GetGhost(reqCtx *commondata.ReqCtx, req *scorepb.GetGhostReq) (*scorepb.ScoreEntry, error) {
+	log.Printf("(GetGhost) Received request for %s game %s\n", reqCtx.Username, req.GameId)
+
+	ctx.dataLock.Lock()
+	defer ctx.dataLock.Unlock()
+
+	var ghost *scorepb.ScoreEntry
+	for _, entry := range ctx.data[reqCtx.Username] {
+		// Entries from before ghost runs existed can't be replayed
+		if entry.WorldSeed == nil {
+			continue
+		}
+
+		if req.GameId == "" {
+			if ghost == nil || entry.Score > ghost.Score {
+				ghost = entry
+			}
+		} else if entry.GameId == req.GameId {
+			ghost = entry
+			break
+		}
+	}
+
+	if ghost == nil {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("no replayable game %q for %s", req.GameId, reqCtx.Username))
+	}
+
+	return ghost, nil
 }
@@ -0,0 +1,159 @@
+package score
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+	scorepb "github.com/yuv418/cs553project/backend/protos/score"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func newTestScoreCtx(t *testing.T) *ScoreCtx {
+	t.Helper()
+
+	t.Setenv("SCORE_FILE", filepath.Join(t.TempDir(), "score.json"))
+	ctx, err := LoadScoreCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+// Run with -race, the watcher marshals what it got while scores keep coming in
+func TestWatchScoresWhileUpdating(t *testing.T) {
+	ctx := newTestScoreCtx(t)
+	const games = 50
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lock sync.Mutex
+	seen := 0
+	watched := make(chan error, 1)
+	go func() {
+		watched <- ctx.WatchScores(&commondata.ReqCtx{Ctx: watchCtx, Username: "alice"}, &emptypb.Empty{}, func(resp *scorepb.GetScoresResp) error {
+			// Like the stream would
+			if _, err := proto.Marshal(resp); err != nil {
+				return err
+			}
+			lock.Lock()
+			seen = len(resp.Entries)
+			lock.Unlock()
+			return nil
+		})
+	}()
+
+	var wg sync.WaitGroup
+	for _, username := range []string{"alice", "bob"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reqCtx := &commondata.ReqCtx{Username: username}
+			for i := range games {
+				entry := &scorepb.ScoreEntry{GameId: fmt.Sprintf("%s-%d", username, i), Score: int32(i)}
+				if _, err := ctx.UpdateScore(reqCtx, entry); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := ctx.GetScores(reqCtx, &emptypb.Empty{}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		got := seen
+		lock.Unlock()
+		if got == games {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("watcher saw %d of alice's games, want %d", got, games)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-watched; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScoresForIsACopy(t *testing.T) {
+	ctx := newTestScoreCtx(t)
+	if _, err := ctx.UpdateScore(&commondata.ReqCtx{Username: "alice"}, &scorepb.ScoreEntry{GameId: "game", Score: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := ctx.GetScores(&commondata.ReqCtx{Username: "alice"}, &emptypb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Entries[0].Score = 100
+	resp.GlobalEntries[0].Score = 100
+
+	ctx.dataLock.Lock()
+	defer ctx.dataLock.Unlock()
+	if ctx.data["alice"][0].Score != 3 || ctx.globalHeap.Size() != 1 {
+		t.Errorf("changing the response changed the stored score to %d", ctx.data["alice"][0].Score)
+	}
+	if top, _ := ctx.globalHeap.Peek(); top.(*scorepb.ScoreEntry).Score != 3 {
+		t.Errorf("changing the response changed the leaderboard to %d", top.(*scorepb.ScoreEntry).Score)
+	}
+}
+
+func TestUpdateScoreRetriesAfterFailedWrite(t *testing.T) {
+	ctx := newTestScoreCtx(t)
+	fileName := ctx.fileName
+	reqCtx := &commondata.ReqCtx{Username: "alice"}
+
+	if _, err := ctx.UpdateScore(reqCtx, &scorepb.ScoreEntry{GameId: "first", Score: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Somewhere we can't write
+	ctx.fileName = filepath.Join(t.TempDir(), "missing", "score.json")
+	for _, username := range []string{"alice", "bob"} {
+		_, err := ctx.UpdateScore(&commondata.ReqCtx{Username: username}, &scorepb.ScoreEntry{GameId: "second", Score: 2})
+		if err == nil {
+			t.Fatal("write to a missing directory worked")
+		}
+	}
+	if err := ctx.Healthy(context.Background()); err == nil {
+		t.Error("healthy after a failed write")
+	}
+
+	ctx.dataLock.Lock()
+	if len(ctx.data["alice"]) != 1 || ctx.globalHeap.Size() != 1 {
+		t.Errorf("failed write left %d entries for alice and %d on the leaderboard", len(ctx.data["alice"]), ctx.globalHeap.Size())
+	}
+	if _, ok := ctx.data["bob"]; ok {
+		t.Error("failed write left an empty list for bob")
+	}
+	ctx.dataLock.Unlock()
+
+	// The retry has to go through, not get skipped as a duplicate
+	ctx.fileName = fileName
+	if _, err := ctx.UpdateScore(reqCtx, &scorepb.ScoreEntry{GameId: "second", Score: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadScoreCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(reloaded.data["alice"]); got != 2 {
+		t.Errorf("%d of alice's games made it to disk, want 2", got)
+	}
+}
@@ -1,13 +1,26 @@
 package stats
 
+// Stats are queued by Record and written out in batches by a background
+// goroutine, so callers (like the game loop) never wait on disk. Frame stats
+// (frames.go) go through a pipeline of their own the same way. What happens
+// when the queue fills up is STAT_BACKPRESSURE:
+//   drop   - new stats are thrown away until there's room (the default)
+//   sample - once the queue is half full only every STAT_SAMPLE_RATE'th stat
+//            is kept, and the rest are dropped once it's full
+//   block  - Record waits for room, like the old unbuffered channel
+// Where batches go is STAT_SINKS, see sinks.go. Percentiles are kept as stats
+// come in, see summary.go.
+
 import (
-	"encoding/csv"
 	"log"
-	"os"
-	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/yuv418/cs553project/backend/commondata"
 )
 
@@ -22,39 +35,256 @@ type Stat struct {
 	ReqTime time.Duration
 }
 
-// https://gobyexample.com/channels
-func StartStatThread() chan *Stat {
-	messageChan := make(chan *Stat)
+type Backpressure int8
 
-	statDir := commondata.GetEnv("STAT_DIR", "statout")
-	os.MkdirAll(statDir, 0755)
+const (
+	DropWhenFull Backpressure = iota
+	SampleWhenBusy
+	BlockWhenFull
+)
+
+type pipelineCfg struct {
+	backpressure  Backpressure
+	sampleRate    uint64
+	bufferSize    int
+	batchSize     int
+	flushInterval time.Duration
+}
+
+func pipelineSetup() pipelineCfg {
+	cfg := pipelineCfg{}
+
+	switch backpressure := commondata.GetEnv("STAT_BACKPRESSURE", "drop"); backpressure {
+	case "drop":
+		cfg.backpressure = DropWhenFull
+	case "sample":
+		cfg.backpressure = SampleWhenBusy
+	case "block":
+		cfg.backpressure = BlockWhenFull
+	default:
+		log.Fatalf("STAT_BACKPRESSURE must be drop, sample or block, got %s\n", backpressure)
+	}
 
-	statFile := filepath.Join(statDir, "stats.csv")
-	file, err := os.Create(statFile)
+	var err error
+	cfg.sampleRate, err = strconv.ParseUint(commondata.GetEnv("STAT_SAMPLE_RATE", "10"), 10, 64)
+	if err != nil || cfg.sampleRate == 0 {
+		log.Fatalf("STAT_SAMPLE_RATE must be a positive number\n")
+	}
+	cfg.bufferSize, err = strconv.Atoi(commondata.GetEnv("STAT_BUFFER", "8192"))
+	if err != nil || cfg.bufferSize <= 0 {
+		log.Fatalf("STAT_BUFFER must be a positive number\n")
+	}
+	cfg.batchSize, err = strconv.Atoi(commondata.GetEnv("STAT_BATCH", "512"))
+	if err != nil || cfg.batchSize <= 0 {
+		log.Fatalf("STAT_BATCH must be a positive number\n")
+	}
+	cfg.flushInterval, err = time.ParseDuration(commondata.GetEnv("STAT_FLUSH_INTERVAL", "1s"))
 	if err != nil {
-		log.Fatalf("Failed at creating %s\n", statFile)
+		log.Fatalf("STAT_FLUSH_INTERVAL is invalid: %s\n", err)
 	}
-	writer := csv.NewWriter(file)
-	dataArray := []string{"SrcSvcName", "SrcSvcVerb", "DestSvcName", "DestSvcVerb", "GameId", "ReqTime"}
+	return cfg
+}
 
-	writer.Write(dataArray)
-	writer.Flush()
+var statsLost = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "flappy_stats_lost_total",
+	Help: "Stats that never got written because the queue was busy, by what kind and why.",
+}, []string{"kind", "reason"})
 
-	go (func() {
-		defer file.Close()
+// Anything the pipeline can write out
+type record interface {
+	// One value per column
+	row() []string
+}
+
+type column struct {
+	name string
+	// What jsonl calls it
+	jsonName string
+	// Written as a number rather than a string
+	integer bool
+}
 
-		for statEnt := range messageChan {
-			dataArray[0] = statEnt.SrcSvcName
-			dataArray[1] = statEnt.SrcSvcVerb
-			dataArray[2] = statEnt.DestSvcName
-			dataArray[3] = statEnt.DestSvcVerb
-			dataArray[4] = statEnt.GameId
-			dataArray[5] = strconv.FormatInt(statEnt.ReqTime.Nanoseconds(), 10)
+// Writes records to the sinks in STAT_SINKS in the background
+type pipeline struct {
+	name     string
+	cfg      pipelineCfg
+	statDir  string
+	sinks    []Sink
+	messages chan record
+	// Sees every record, from the pipeline goroutine
+	observe func(record)
+	// Runs once everything is written
+	finish func()
+	// Records seen while sampling, so we know which ones to keep
+	seen atomic.Uint64
+	// Held for reading while sending, so Close doesn't close messages under a sender
+	lock   sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
 
-			writer.Write(dataArray)
-			writer.Flush()
+// https://gobyexample.com/channels
+// Sinks write to files called name, like stats.csv. Records are *T.
+func startPipeline[T any](name string, columns []column) *pipeline {
+	statDir := commondata.GetEnv("STAT_DIR", "statout")
+	p := &pipeline{
+		name:    name,
+		cfg:     pipelineSetup(),
+		statDir: statDir,
+		sinks:   sinksSetup[T](statDir, name, columns, commondata.GetEnv("STAT_SINKS", "csv")),
+		observe: func(record) {},
+		finish:  func() {},
+		done:    make(chan struct{}),
+	}
+	p.messages = make(chan record, p.cfg.bufferSize)
+
+	return p
+}
+
+func (p *pipeline) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.cfg.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]record, 0, p.cfg.batchSize)
+	for {
+		select {
+		case rec, ok := <-p.messages:
+			if !ok {
+				p.write(batch)
+				for _, sink := range p.sinks {
+					if err := sink.Close(); err != nil {
+						log.Printf("Couldn't close %s: %s\n", sink, err)
+					}
+				}
+				p.finish()
+				return
+			}
+			p.observe(rec)
+			batch = append(batch, rec)
+			if len(batch) < p.cfg.batchSize {
+				continue
+			}
+		case <-ticker.C:
 		}
-	})()
 
-	return messageChan
+		p.write(batch)
+		batch = batch[:0]
+	}
+}
+
+func (p *pipeline) write(batch []record) {
+	if len(batch) == 0 {
+		return
+	}
+	for _, sink := range p.sinks {
+		if err := sink.Write(batch); err != nil {
+			log.Printf("Couldn't write %d %s to %s: %s\n", len(batch), p.name, sink, err)
+		}
+	}
+}
+
+// Queues rec to be written. Records after Close are dropped.
+func (p *pipeline) record(rec record) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.closed {
+		return
+	}
+
+	switch p.cfg.backpressure {
+	case BlockWhenFull:
+		p.messages <- rec
+		return
+	case SampleWhenBusy:
+		if len(p.messages) > cap(p.messages)/2 &&
+			p.seen.Add(1)%p.cfg.sampleRate != 0 {
+			statsLost.WithLabelValues(p.name, "sampled").Inc()
+			return
+		}
+	}
+
+	select {
+	case p.messages <- rec:
+	default:
+		statsLost.WithLabelValues(p.name, "full").Inc()
+	}
+}
+
+// Close writes out whatever is queued and closes the sinks.
+func (p *pipeline) Close() {
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.messages)
+	}
+	p.lock.Unlock()
+
+	<-p.done
+}
+
+// Writes Dispatch stats, and keeps a summary of them
+type StatWriter struct {
+	*pipeline
+	summary *summarizer
+}
+
+func StartStatThread() *StatWriter {
+	statWriter := &StatWriter{
+		pipeline: startPipeline[Stat]("stats", statColumns),
+		summary:  summarizerSetup(),
+	}
+	statWriter.observe = func(rec record) {
+		statWriter.summary.add(rec.(*Stat))
+	}
+	statWriter.finish = func() {
+		statWriter.summary.dump(statWriter.statDir)
+	}
+	go statWriter.run()
+
+	return statWriter
+}
+
+// Record queues a stat to be written. Stats after Close are dropped.
+func (statWriter *StatWriter) Record(stat *Stat) {
+	statWriter.record(stat)
+}
+
+// Summary has latency percentiles for every service edge, and for gameId or
+// every game when it's empty.
+func (statWriter *StatWriter) Summary(gameId string) Summary {
+	return statWriter.summary.summary(gameId)
+}
+
+var statColumns = []column{
+	{name: "SrcSvcName", jsonName: "src_svc_name"},
+	{name: "SrcSvcVerb", jsonName: "src_svc_verb"},
+	{name: "DestSvcName", jsonName: "dest_svc_name"},
+	{name: "DestSvcVerb", jsonName: "dest_svc_verb"},
+	{name: "GameId", jsonName: "game_id"},
+	{name: "ReqTime", jsonName: "req_time_ns", integer: true},
+}
+
+// ReqTime is in nanoseconds
+func (stat *Stat) row() []string {
+	return []string{
+		stat.SrcSvcName,
+		stat.SrcSvcVerb,
+		stat.DestSvcName,
+		stat.DestSvcVerb,
+		stat.GameId,
+		strconv.FormatInt(stat.ReqTime.Nanoseconds(), 10),
+	}
+}
+
+func splitList(list string) []string {
+	var out []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
 }
@@ -0,0 +1,67 @@
+package stats
+
+// Per-frame timing from the engine's game loops, written to frames.* next to
+// stats.*. Seq matches the seq in the frame the client got, so these join with
+// the client's latency_data.csv.
+
+import (
+	"strconv"
+	"time"
+)
+
+type FrameStat struct {
+	GameId string
+	Seq    int64
+	// When the tick should have happened, and when the loop got to it
+	ScheduledAt time.Time `parquet:",timestamp(nanosecond)"`
+	TickedAt    time.Time `parquet:",timestamp(nanosecond)"`
+	// Moving the game forward and building the frame
+	Compute time.Duration
+	// Marshalling the frame into the session's buffer, then sending it
+	Write time.Duration
+	Flush time.Duration
+	// From the first input since the last frame to this frame being sent.
+	// 0 if there wasn't any.
+	InputToFrame time.Duration
+}
+
+type FrameStatWriter struct {
+	*pipeline
+}
+
+func StartFrameStatThread() *FrameStatWriter {
+	frameWriter := &FrameStatWriter{pipeline: startPipeline[FrameStat]("frames", frameColumns)}
+	go frameWriter.run()
+
+	return frameWriter
+}
+
+// Record queues a frame stat to be written. Stats after Close are dropped.
+func (frameWriter *FrameStatWriter) Record(frame *FrameStat) {
+	frameWriter.record(frame)
+}
+
+var frameColumns = []column{
+	{name: "GameId", jsonName: "game_id"},
+	{name: "Seq", jsonName: "seq", integer: true},
+	{name: "ScheduledAt", jsonName: "scheduled_at_unix_ns", integer: true},
+	{name: "TickedAt", jsonName: "ticked_at_unix_ns", integer: true},
+	{name: "Compute", jsonName: "compute_ns", integer: true},
+	{name: "Write", jsonName: "write_ns", integer: true},
+	{name: "Flush", jsonName: "flush_ns", integer: true},
+	{name: "InputToFrame", jsonName: "input_to_frame_ns", integer: true},
+}
+
+// Times are Unix nanoseconds, durations are nanoseconds
+func (frame *FrameStat) row() []string {
+	return []string{
+		frame.GameId,
+		strconv.FormatInt(frame.Seq, 10),
+		strconv.FormatInt(frame.ScheduledAt.UnixNano(), 10),
+		strconv.FormatInt(frame.TickedAt.UnixNano(), 10),
+		strconv.FormatInt(frame.Compute.Nanoseconds(), 10),
+		strconv.FormatInt(frame.Write.Nanoseconds(), 10),
+		strconv.FormatInt(frame.Flush.Nanoseconds(), 10),
+		strconv.FormatInt(frame.InputToFrame.Nanoseconds(), 10),
+	}
+}
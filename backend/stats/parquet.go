@@ -0,0 +1,52 @@
+package stats
+
+// Parquet files are written with parquet-go, one column per field of the
+// stat type and one row group per batch.
+// https://parquet.apache.org/docs/file-format/
+
+import (
+	"os"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Writes records of type *T
+type parquetSink[T any] struct {
+	file   *os.File
+	writer *parquet.GenericWriter[T]
+}
+
+func newParquetSink[T any](statDir string, name string) (*parquetSink[T], error) {
+	file, err := createRotated(statDir, name+".parquet")
+	if err != nil {
+		return nil, err
+	}
+	return &parquetSink[T]{file: file, writer: parquet.NewGenericWriter[T](file)}, nil
+}
+
+func (sink *parquetSink[T]) Write(batch []record) error {
+	rows := make([]T, len(batch))
+	for i, rec := range batch {
+		rows[i] = *any(rec).(*T)
+	}
+	if _, err := sink.writer.Write(rows); err != nil {
+		return err
+	}
+	// Ends the row group
+	return sink.writer.Flush()
+}
+
+func (sink *parquetSink[T]) Close() error {
+	// Writes the footer
+	if err := sink.writer.Close(); err != nil {
+		return err
+	}
+	if err := sink.file.Sync(); err != nil {
+		return err
+	}
+	return sink.file.Close()
+}
+
+func (sink *parquetSink[T]) String() string {
+	return sink.file.Name()
+}
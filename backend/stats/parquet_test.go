@@ -0,0 +1,110 @@
+package stats
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Writes batches with a parquet sink, then reads the file back
+func parquetRoundTrip[T any](t *testing.T, name string, columns []column, batches [][]*T) []T {
+	t.Helper()
+
+	sink, err := newParquetSink[T](t.TempDir(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range batches {
+		records := make([]record, len(batch))
+		for i, rec := range batch {
+			records[i] = any(rec).(record)
+		}
+		if err := sink.Write(records); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileName := sink.String()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pqFile, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		t.Fatalf("can't open %s: %s", fileName, err)
+	}
+	// One row group per batch
+	if got := len(pqFile.RowGroups()); got != len(batches) {
+		t.Errorf("got %d row groups, want %d", got, len(batches))
+	}
+	// Same columns as the CSV
+	for _, col := range columns {
+		if _, ok := pqFile.Schema().Lookup(col.name); !ok {
+			t.Errorf("schema is missing %s", col.name)
+		}
+	}
+
+	rows, err := parquet.Read[T](file, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestParquetStats(t *testing.T) {
+	batches := [][]*Stat{
+		{
+			{"engine", "Tick", "score", "UpdateScore", "game-1", 1500 * time.Microsecond},
+			{"engine", "Tick", "music", "PlayMusic", "game-1", 0},
+		},
+		{
+			{"auth", "Login", "", "", "", 42 * time.Second},
+		},
+	}
+	got := parquetRoundTrip(t, "stats", statColumns, batches)
+
+	var want []Stat
+	for _, batch := range batches {
+		for _, stat := range batch {
+			want = append(want, *stat)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("read back %+v, want %+v", got, want)
+	}
+}
+
+func TestParquetFrames(t *testing.T) {
+	at := time.Unix(1760000000, 123456789)
+	batches := [][]*FrameStat{{
+		{GameId: "game-1", Seq: 1, ScheduledAt: at, TickedAt: at.Add(time.Millisecond), Compute: time.Millisecond, Write: 3, Flush: 4, InputToFrame: 5},
+		{GameId: "game-1", Seq: 2, ScheduledAt: at.Add(33 * time.Millisecond), TickedAt: at.Add(34 * time.Millisecond)},
+	}}
+	got := parquetRoundTrip(t, "frames", frameColumns, batches)
+
+	if len(got) != 2 {
+		t.Fatalf("read back %d frames, want 2", len(got))
+	}
+	for i, frame := range got {
+		want := batches[0][i]
+		// Down to the nanosecond
+		if !frame.ScheduledAt.Equal(want.ScheduledAt) || !frame.TickedAt.Equal(want.TickedAt) {
+			t.Errorf("frame %d: got times %s %s, want %s %s", i, frame.ScheduledAt, frame.TickedAt, want.ScheduledAt, want.TickedAt)
+		}
+		frame.ScheduledAt, frame.TickedAt = want.ScheduledAt, want.TickedAt
+		if frame != *want {
+			t.Errorf("frame %d: got %+v, want %+v", i, frame, *want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package stats
+
+// STAT_SINKS is a comma separated list of where stats go, all under STAT_DIR.
+// Dispatch stats go in stats.*, frame stats in frames.*.
+//   csv     - stats.csv, what we've always written
+//   jsonl   - stats.jsonl, one JSON object per stat
+//   parquet - stats.parquet, one row group per batch. The footer is only
+//             written on Close, so the file can't be read if we crash.
+// STAT_SINKS=none writes no stats, for when /metrics is enough. The summary
+// is still written at shutdown.
+// Each run starts fresh files. The last run's are renamed to stats-<time>.<ext>
+// first so they don't get overwritten.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type Sink interface {
+	// Write is only ever called from the stat goroutine
+	Write(batch []record) error
+	Close() error
+	String() string
+}
+
+// Parquet sinks write records of type *T
+func sinksSetup[T any](statDir string, name string, columns []column, sinkList string) []Sink {
+	var sinks []Sink
+	for _, kind := range splitList(sinkList) {
+		if kind == "none" {
+			continue
+		}
+
+		var sink Sink
+		var err error
+		switch kind {
+		case "csv":
+			sink, err = newCSVSink(statDir, name, columns)
+		case "jsonl":
+			sink, err = newJSONSink(statDir, name, columns)
+		case "parquet":
+			sink, err = newParquetSink[T](statDir, name)
+		default:
+			log.Fatalf("STAT_SINKS can only have csv, jsonl, parquet or none, got %s\n", kind)
+		}
+		if err != nil {
+			log.Fatalf("Failed at creating the %s stat sink: %s\n", kind, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks
+}
+
+// Moves the last run's file out of the way and creates a new one
+func createRotated(statDir string, name string) (*os.File, error) {
+	if err := os.MkdirAll(statDir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(statDir, name)
+	if info, err := os.Stat(path); err == nil {
+		ext := filepath.Ext(name)
+		old := fmt.Sprintf("%s-%s%s", name[:len(name)-len(ext)], info.ModTime().Format("20060102-150405"), ext)
+		if err := os.Rename(path, filepath.Join(statDir, old)); err != nil {
+			return nil, err
+		}
+	}
+
+	return os.Create(path)
+}
+
+type csvSink struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+func newCSVSink(statDir string, name string, columns []column) (*csvSink, error) {
+	file, err := createRotated(statDir, name+".csv")
+	if err != nil {
+		return nil, err
+	}
+	sink := &csvSink{file: file, writer: csv.NewWriter(file)}
+
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = col.name
+	}
+	sink.writer.Write(header)
+	return sink, nil
+}
+
+func (sink *csvSink) Write(batch []record) error {
+	for _, rec := range batch {
+		sink.writer.Write(rec.row())
+	}
+	sink.writer.Flush()
+	return sink.writer.Error()
+}
+
+func (sink *csvSink) Close() error {
+	sink.writer.Flush()
+	if err := sink.file.Sync(); err != nil {
+		return err
+	}
+	return sink.file.Close()
+}
+
+func (sink *csvSink) String() string {
+	return sink.file.Name()
+}
+
+type jsonSink struct {
+	file    *os.File
+	buf     *bufio.Writer
+	columns []column
+}
+
+func newJSONSink(statDir string, name string, columns []column) (*jsonSink, error) {
+	file, err := createRotated(statDir, name+".jsonl")
+	if err != nil {
+		return nil, err
+	}
+	return &jsonSink{file: file, buf: bufio.NewWriter(file), columns: columns}, nil
+}
+
+func (sink *jsonSink) Write(batch []record) error {
+	var line []byte
+	for _, rec := range batch {
+		line = append(line[:0], '{')
+		for i, value := range rec.row() {
+			col := sink.columns[i]
+			if i > 0 {
+				line = append(line, ',')
+			}
+			line = strconv.AppendQuote(line, col.jsonName)
+			line = append(line, ':')
+			if col.integer {
+				line = append(line, value...)
+			} else {
+				quoted, err := json.Marshal(value)
+				if err != nil {
+					return err
+				}
+				line = append(line, quoted...)
+			}
+		}
+		line = append(line, '}', '\n')
+
+		if _, err := sink.buf.Write(line); err != nil {
+			return err
+		}
+	}
+	return sink.buf.Flush()
+}
+
+func (sink *jsonSink) Close() error {
+	if err := sink.buf.Flush(); err != nil {
+		return err
+	}
+	if err := sink.file.Sync(); err != nil {
+		return err
+	}
+	return sink.file.Close()
+}
+
+func (sink *jsonSink) String() string {
+	return sink.file.Name()
+}
@@ -0,0 +1,274 @@
+package stats
+
+// Latency percentiles kept as stats come in, per service edge (who called what)
+// and per game, so we don't have to copy the CSVs somewhere to get numbers.
+// With STAT_SUMMARY_WINDOW set, summaries only cover roughly the last window
+// (between one and two of them), otherwise they cover the whole run.
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+)
+
+// Like an HDR histogram: exact below 64ns, and within about 3% above that.
+// Bucket i holds values whose top 6 bits are the same.
+const histogramSubBits = 6
+
+type histogram struct {
+	// Sparse, since most games only see a few distinct latencies
+	buckets map[int]uint64
+	count   uint64
+	max     int64
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make(map[int]uint64)}
+}
+
+func bucketOf(v int64) int {
+	if v < 0 {
+		v = 0
+	}
+	shift := max(bits.Len64(uint64(v))-histogramSubBits, 0)
+	return shift<<(histogramSubBits-1) + int(v>>shift)
+}
+
+// The largest value that lands in bucket i
+func bucketTop(i int) int64 {
+	half := 1 << (histogramSubBits - 1)
+	if i < 2*half {
+		return int64(i)
+	}
+	shift := i/half - 1
+	return int64(i-shift*half+1)<<shift - 1
+}
+
+func (h *histogram) add(v int64) {
+	h.buckets[bucketOf(v)]++
+	h.count++
+	h.max = max(h.max, v)
+}
+
+func (h *histogram) merge(other *histogram) {
+	for i, n := range other.buckets {
+		h.buckets[i] += n
+	}
+	h.count += other.count
+	h.max = max(h.max, other.max)
+}
+
+func (h *histogram) percentiles(qs ...float64) []int64 {
+	keys := make([]int, 0, len(h.buckets))
+	for i := range h.buckets {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+
+	out := make([]int64, len(qs))
+	for j, q := range qs {
+		target := uint64(math.Ceil(q * float64(h.count)))
+		var seen uint64
+		for _, i := range keys {
+			seen += h.buckets[i]
+			if seen >= target {
+				out[j] = min(bucketTop(i), h.max)
+				break
+			}
+		}
+	}
+	return out
+}
+
+type LatencySummary struct {
+	Count uint64        `json:"count"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+func (h *histogram) summary() LatencySummary {
+	p := h.percentiles(0.5, 0.9, 0.99)
+	return LatencySummary{
+		Count: h.count,
+		P50:   time.Duration(p[0]),
+		P90:   time.Duration(p[1]),
+		P99:   time.Duration(p[2]),
+		Max:   time.Duration(h.max),
+	}
+}
+
+type Edge struct {
+	SrcSvcName  string `json:"src_svc_name"`
+	SrcSvcVerb  string `json:"src_svc_verb"`
+	DestSvcName string `json:"dest_svc_name"`
+	DestSvcVerb string `json:"dest_svc_verb"`
+}
+
+type EdgeSummary struct {
+	Edge
+	Latency LatencySummary `json:"latency"`
+}
+
+type GameSummary struct {
+	GameId  string         `json:"game_id"`
+	Latency LatencySummary `json:"latency"`
+}
+
+type Summary struct {
+	// When the oldest stat in here could be from
+	Since time.Time     `json:"since"`
+	Edges []EdgeSummary `json:"edges"`
+	Games []GameSummary `json:"games"`
+}
+
+type summaryWindow struct {
+	start time.Time
+	edges map[Edge]*histogram
+	games map[string]*histogram
+}
+
+func newSummaryWindow(start time.Time) *summaryWindow {
+	return &summaryWindow{
+		start: start,
+		edges: make(map[Edge]*histogram),
+		games: make(map[string]*histogram),
+	}
+}
+
+type summarizer struct {
+	lock sync.Mutex
+	// 0 keeps everything
+	window   time.Duration
+	current  *summaryWindow
+	previous *summaryWindow
+}
+
+func summarizerSetup() *summarizer {
+	window, err := time.ParseDuration(commondata.GetEnv("STAT_SUMMARY_WINDOW", "0"))
+	if err != nil {
+		log.Fatalf("STAT_SUMMARY_WINDOW is invalid: %s\n", err)
+	}
+	return &summarizer{window: window, current: newSummaryWindow(time.Now())}
+}
+
+// Starts a new window if the current one is over. Needs lock.
+func (s *summarizer) roll(now time.Time) {
+	if s.window <= 0 || now.Sub(s.current.start) < s.window {
+		return
+	}
+	if now.Sub(s.current.start) < 2*s.window {
+		s.previous = s.current
+	} else {
+		// Nothing came in for a whole window, so the current one is too old too
+		s.previous = nil
+	}
+	s.current = newSummaryWindow(now)
+}
+
+func (s *summarizer) add(stat *Stat) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.roll(time.Now())
+
+	edge := Edge{
+		SrcSvcName:  stat.SrcSvcName,
+		SrcSvcVerb:  stat.SrcSvcVerb,
+		DestSvcName: stat.DestSvcName,
+		DestSvcVerb: stat.DestSvcVerb,
+	}
+	if _, ok := s.current.edges[edge]; !ok {
+		s.current.edges[edge] = newHistogram()
+	}
+	s.current.edges[edge].add(stat.ReqTime.Nanoseconds())
+
+	if stat.GameId != "" {
+		if _, ok := s.current.games[stat.GameId]; !ok {
+			s.current.games[stat.GameId] = newHistogram()
+		}
+		s.current.games[stat.GameId].add(stat.ReqTime.Nanoseconds())
+	}
+}
+
+// Summary of every edge, and of gameId or every game if it's empty
+func (s *summarizer) summary(gameId string) Summary {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.roll(time.Now())
+
+	windows := []*summaryWindow{s.current}
+	if s.previous != nil {
+		windows = append(windows, s.previous)
+	}
+
+	edges := make(map[Edge]*histogram)
+	games := make(map[string]*histogram)
+	for _, window := range windows {
+		for edge, h := range window.edges {
+			if _, ok := edges[edge]; !ok {
+				edges[edge] = newHistogram()
+			}
+			edges[edge].merge(h)
+		}
+		for id, h := range window.games {
+			if gameId != "" && id != gameId {
+				continue
+			}
+			if _, ok := games[id]; !ok {
+				games[id] = newHistogram()
+			}
+			games[id].merge(h)
+		}
+	}
+
+	summary := Summary{Since: windows[len(windows)-1].start}
+	for edge, h := range edges {
+		summary.Edges = append(summary.Edges, EdgeSummary{Edge: edge, Latency: h.summary()})
+	}
+	for id, h := range games {
+		summary.Games = append(summary.Games, GameSummary{GameId: id, Latency: h.summary()})
+	}
+
+	sort.Slice(summary.Edges, func(i, j int) bool {
+		a, b := summary.Edges[i].Edge, summary.Edges[j].Edge
+		if a.SrcSvcVerb != b.SrcSvcVerb {
+			return a.SrcSvcVerb < b.SrcSvcVerb
+		}
+		return a.DestSvcVerb < b.DestSvcVerb
+	})
+	sort.Slice(summary.Games, func(i, j int) bool {
+		return summary.Games[i].GameId < summary.Games[j].GameId
+	})
+	return summary
+}
+
+// Writes the summary to STAT_DIR/summary.json, at shutdown
+func (s *summarizer) dump(statDir string) {
+	out, err := json.MarshalIndent(s.summary(""), "", "  ")
+	if err != nil {
+		log.Printf("Couldn't encode the stat summary: %s\n", err)
+		return
+	}
+
+	file, err := createRotated(statDir, "summary.json")
+	if err != nil {
+		log.Printf("Couldn't write the stat summary: %s\n", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(out); err != nil {
+		log.Printf("Couldn't write the stat summary to %s: %s\n", file.Name(), err)
+		return
+	}
+	log.Printf("Wrote the stat summary to %s\n", file.Name())
+}
@@ -0,0 +1,62 @@
+package stats
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBucketOf(t *testing.T) {
+	for _, tc := range []struct {
+		v      int64
+		bucket int
+		top    int64
+	}{
+		{-5, 0, 0},
+		{0, 0, 0},
+		{1, 1, 1},
+		{63, 63, 63},
+		// Past 64 buckets are two wide, then four...
+		{64, 64, 65},
+		{65, 64, 65},
+		{66, 65, 67},
+		{127, 95, 127},
+		{128, 96, 131},
+		{131, 96, 131},
+		{132, 97, 135},
+		{math.MaxInt64, 1887, math.MaxInt64},
+	} {
+		if got := bucketOf(tc.v); got != tc.bucket {
+			t.Errorf("bucketOf(%d) = %d, want %d", tc.v, got, tc.bucket)
+		}
+		if got := bucketTop(tc.bucket); got != tc.top {
+			t.Errorf("bucketTop(%d) = %d, want %d", tc.bucket, got, tc.top)
+		}
+	}
+}
+
+func TestBucketsCoverEveryValue(t *testing.T) {
+	values := []int64{math.MaxInt64}
+	for shift := range 63 {
+		p := int64(1) << shift
+		values = append(values, p-1, p, p+1, p+p/3)
+	}
+
+	for _, v := range values {
+		i := bucketOf(v)
+		top := bucketTop(i)
+		// v is in bucket i, and not in the one before
+		if top < v {
+			t.Errorf("%d went in bucket %d, which stops at %d", v, i, top)
+		}
+		if i > 0 && bucketTop(i-1) >= v {
+			t.Errorf("%d went in bucket %d, but bucket %d goes up to %d", v, i, i-1, bucketTop(i-1))
+		}
+		// Exact below 64, within about 3% above
+		if v < 1<<histogramSubBits && top != v {
+			t.Errorf("%d should be exact, bucket %d stops at %d", v, i, top)
+		}
+		if v > 0 && float64(top-v)/float64(v) > 1.0/(1<<(histogramSubBits-1)) {
+			t.Errorf("%d is reported as %d, more than 3%% off", v, top)
+		}
+	}
+}
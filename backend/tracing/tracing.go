@@ -0,0 +1,168 @@
+package tracing
+
+// Distributed tracing with OpenTelemetry. Trace context goes between services
+// as a W3C traceparent, which callers carry in ReqCtx.TraceParent, so this
+// only deals in traceparent strings. Spans are exported over OTLP/HTTP to a
+// collector at OTEL_EXPORTER_OTLP_ENDPOINT, and/or written as JSON to
+// TRACE_FILE by the stdout exporter for looking at offline. With neither
+// set, spans are never made and traceparents just pass through.
+// https://www.w3.org/TR/trace-context/
+// https://opentelemetry.io/docs/languages/go/
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+)
+
+type SpanKind = trace.SpanKind
+
+const (
+	Internal = trace.SpanKindInternal
+	Server   = trace.SpanKindServer
+	Client   = trace.SpanKindClient
+)
+
+type Span struct {
+	span trace.Span
+	ctx  context.Context
+}
+
+type tracing struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+	// TRACE_FILE, closed after the last spans are written to it
+	file *os.File
+}
+
+// nil when spans don't go anywhere
+var tracer = tracingSetup()
+
+var propagator = propagation.TraceContext{}
+
+func tracingSetup() *tracing {
+	endpoint := commondata.GetEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	fileName := commondata.GetEnv("TRACE_FILE", "")
+	if endpoint == "" && fileName == "" {
+		return nil
+	}
+
+	var exporters []sdktrace.SpanExporter
+	var file *os.File
+	if endpoint != "" {
+		// Reads OTEL_EXPORTER_OTLP_ENDPOINT (and _TIMEOUT, _HEADERS) itself
+		exporter, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			log.Fatalf("Couldn't set up the OTLP exporter for %s: %s\n", endpoint, err)
+		}
+		exporters = append(exporters, exporter)
+	}
+	if fileName != "" {
+		var err error
+		file, err = os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Couldn't open TRACE_FILE %s: %s\n", fileName, err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			log.Fatalf("Couldn't set up the TRACE_FILE exporter: %s\n", err)
+		}
+		exporters = append(exporters, exporter)
+	}
+
+	serviceName := commondata.GetEnv("OTEL_SERVICE_NAME", "flappygo")
+	log.Printf("(tracing) Exporting spans as %s to %s %s\n", serviceName, endpoint, fileName)
+	return newTracing(serviceName, file, exporters...)
+}
+
+func newTracing(serviceName string, file *os.File, exporters ...sdktrace.SpanExporter) *tracing {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+		// Go with whatever the caller decided, and sample traces we start
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	}
+	for _, exporter := range exporters {
+		// Batched in the background, so ending a span never waits on the exporter
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	provider := sdktrace.NewTracerProvider(opts...)
+	return &tracing{
+		provider: provider,
+		tracer:   provider.Tracer("github.com/yuv418/cs553project/backend/tracing"),
+		file:     file,
+	}
+}
+
+// Enabled says whether spans go anywhere.
+func Enabled() bool {
+	return tracer != nil
+}
+
+// Start begins a span under traceParent, or a new trace if traceParent is
+// empty or broken. Returns nil when tracing is off, which every Span method
+// is fine with.
+func Start(traceParent string, name string, kind SpanKind) *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier{"traceparent": traceParent})
+	ctx, span := tracer.tracer.Start(ctx, name, trace.WithSpanKind(kind))
+	return &Span{span: span, ctx: ctx}
+}
+
+// TraceParent is what to send along so the other side's spans end up under
+// this one, with the caller's trace flags. If there's no span, it's whatever
+// we were passed, so the trace still gets through services that don't export.
+func (span *Span) TraceParent(parent string) string {
+	if span == nil {
+		return parent
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(span.ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+func (span *Span) SetAttr(key string, value string) {
+	if span == nil {
+		return
+	}
+	span.span.SetAttributes(attribute.String(key, value))
+}
+
+// End finishes the span and queues it for export. err marks it failed.
+func (span *Span) End(err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.span.RecordError(err)
+		span.span.SetStatus(codes.Error, err.Error())
+	}
+	span.span.End()
+}
+
+// Close exports every span that's been ended. Spans ended after this are dropped.
+func Close(ctx context.Context) error {
+	if tracer == nil {
+		return nil
+	}
+	err := tracer.provider.Shutdown(ctx)
+	if tracer.file != nil {
+		err = errors.Join(err, tracer.file.Close())
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Sends spans to memory for the rest of the test
+func withTestTracing(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	old := tracer
+	tracer = newTracing("test", nil, exporter)
+	t.Cleanup(func() { tracer = old })
+	return exporter
+}
+
+// Makes sure everything ended so far has been exported
+func flush(t *testing.T) {
+	if err := tracer.provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const parentTraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+func TestTraceParent(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		traceParent string
+		// Whether the span carries on the caller's trace
+		sameTrace bool
+		flags     string
+		exported  bool
+	}{
+		{"sampled", "00-" + parentTraceId + "-00f067aa0ba902b7-01", true, "01", true},
+		{"not sampled", "00-" + parentTraceId + "-00f067aa0ba902b7-00", true, "00", false},
+		{"empty", "", false, "01", true},
+		{"broken", "00-" + parentTraceId + "-zz-01", false, "01", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exporter := withTestTracing(t)
+
+			span := Start(tc.traceParent, "test", Server)
+			out := span.TraceParent(tc.traceParent)
+			span.End(nil)
+			flush(t)
+
+			parts := strings.Split(out, "-")
+			if len(parts) != 4 {
+				t.Fatalf("got traceparent %q", out)
+			}
+			if (parts[1] == parentTraceId) != tc.sameTrace {
+				t.Errorf("got trace %s, want the caller's: %v", parts[1], tc.sameTrace)
+			}
+			if strings.Contains(tc.traceParent, parts[2]) {
+				t.Errorf("span %s has the caller's span ID", parts[2])
+			}
+			if parts[3] != tc.flags {
+				t.Errorf("got flags %s, want %s", parts[3], tc.flags)
+			}
+			if got := len(exporter.GetSpans()); (got == 1) != tc.exported {
+				t.Errorf("exported %d spans, want exported: %v", got, tc.exported)
+			}
+		})
+	}
+}
+
+func TestSpanParentAndError(t *testing.T) {
+	exporter := withTestTracing(t)
+
+	parent := Start("", "parent", Server)
+	child := Start(parent.TraceParent(""), "child", Client)
+	child.SetAttr("game.id", "game")
+	child.End(errors.New("down"))
+	parent.End(nil)
+	flush(t)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	childSpan, parentSpan := spans[0], spans[1]
+	if childSpan.Parent.SpanID() != parentSpan.SpanContext.SpanID() {
+		t.Errorf("child's parent is %s, want %s", childSpan.Parent.SpanID(), parentSpan.SpanContext.SpanID())
+	}
+	if childSpan.Status.Code != codes.Error || childSpan.Status.Description != "down" {
+		t.Errorf("child status is %+v, want an error", childSpan.Status)
+	}
+	if len(childSpan.Attributes) != 1 || childSpan.Attributes[0].Value.AsString() != "game" {
+		t.Errorf("child attributes are %v", childSpan.Attributes)
+	}
+}
+
+func TestOffPassesTraceParentThrough(t *testing.T) {
+	old := tracer
+	tracer = nil
+	t.Cleanup(func() { tracer = old })
+
+	traceParent := "00-" + parentTraceId + "-00f067aa0ba902b7-00"
+	span := Start(traceParent, "test", Internal)
+	if span != nil {
+		t.Fatal("made a span with tracing off")
+	}
+	if got := span.TraceParent(traceParent); got != traceParent {
+		t.Errorf("got %s, want %s", got, traceParent)
+	}
+	span.SetAttr("a", "b")
+	span.End(nil)
+}
@@ -0,0 +1,107 @@
+package worldgen
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/yuv418/cs553project/backend/commondata"
+	"github.com/yuv418/cs553project/backend/playability"
+	worldgenpb "github.com/yuv418/cs553project/backend/protos/world_gen"
+)
+
+type WorldValidation int8
+
+const (
+	// Hand out whatever we generated
+	ValidationOff WorldValidation = iota
+	// Fail the request if the world can't be cleared
+	ValidationReject
+	// Nudge impossible pipes until the world can be cleared
+	ValidationRepair
+)
+
+// How many pipes we are willing to fix up before giving up on a world
+const maxRepairs = 50
+
+func ValidationSetup() WorldValidation {
+	switch mode := commondata.GetEnv("WORLD_VALIDATION", "off"); mode {
+	case "off", "":
+		return ValidationOff
+	case "reject":
+		return ValidationReject
+	case "repair":
+		return ValidationRepair
+	default:
+		log.Panicf("WORLD_VALIDATION must be off, reject or repair, got %s", mode)
+		return ValidationOff
+	}
+}
+
+var ValidationMode = ValidationSetup()
+
+func checkWorld(ctx context.Context, world *worldgenpb.WorldGenerated, phys *playability.Physics) (*worldgenpb.WorldGenerated, error) {
+	report := playability.Validate(world, phys)
+	if report.Playable {
+		log.Printf("(worldgen) World is %s\n", report)
+		return world, nil
+	}
+
+	if ValidationMode == ValidationReject {
+		return nil, fmt.Errorf("generated world is %s", report)
+	}
+
+	report, err := RepairWorld(ctx, world, phys)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("(worldgen) Repaired world is %s\n", report)
+
+	return world, nil
+}
+
+// RepairWorld moves the first impossible pipe's gap towards the previous one
+// (and opens it up a bit) until the whole world can be cleared.
+// The world is modified in place. Each try runs the whole validator, so it
+// gives up between tries once ctx is done.
+func RepairWorld(ctx context.Context, world *worldgenpb.WorldGenerated, phys *playability.Physics) (*playability.Report, error) {
+	report := playability.Validate(world, phys)
+
+	for range maxRepairs {
+		if report.Playable {
+			return report, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return report, fmt.Errorf("stopped repairing world: %w", err)
+		}
+		// The bird died before reaching a pipe, moving gaps won't help
+		if report.FailedPipe < 0 {
+			return report, fmt.Errorf("bird can't survive in a %fx%f viewport", phys.ViewportWidth, phys.ViewportHeight)
+		}
+
+		failed := world.PipeSpecs[report.FailedPipe]
+		// The first pipe has to be reachable from where the bird spawns
+		prevCenter := phys.StartY + phys.BirdHeight/2
+		if report.FailedPipe > 0 {
+			prev := world.PipeSpecs[report.FailedPipe-1]
+			prevCenter = prev.GapStart + prev.GapHeight/2
+		}
+
+		gapHeight := math.Min(failed.GapHeight*1.1, phys.ViewportHeight/2)
+		center := failed.GapStart + failed.GapHeight/2
+		center = center + (prevCenter-center)/2
+
+		failed.GapHeight = gapHeight
+		failed.GapStart = math.Max(0, math.Min(center-gapHeight/2, phys.ViewportHeight-gapHeight))
+
+		log.Printf("(worldgen) Repairing pipe %d, new gap start %f height %f\n", report.FailedPipe, failed.GapStart, failed.GapHeight)
+
+		report = playability.Validate(world, phys)
+	}
+
+	if report.Playable {
+		return report, nil
+	}
+	return report, fmt.Errorf("couldn't repair world after %d attempts, still %s", maxRepairs, report)
+}
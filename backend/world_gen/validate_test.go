@@ -0,0 +1,129 @@
+package worldgen
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/yuv418/cs553project/backend/playability"
+	worldgenpb "github.com/yuv418/cs553project/backend/protos/world_gen"
+	"google.golang.org/protobuf/proto"
+)
+
+// Run with go test -fuzz FuzzWorldGen ./world_gen to look for worlds the
+// generator makes that repair can't fix. A failing seed is also a bad
+// STABLE_WORLD_SEED.
+func FuzzWorldGen(f *testing.F) {
+	f.Add(int64(0), int32(800), int32(600))
+	f.Add(int64(42), int32(400), int32(700))
+	f.Add(int64(1234), int32(1920), int32(1080))
+
+	f.Fuzz(func(t *testing.T, seed int64, viewportWidth int32, viewportHeight int32) {
+		// Roughly the screens the client runs on
+		if viewportWidth < 300 || viewportWidth > 2000 || viewportHeight < 300 || viewportHeight > 1500 {
+			t.Skip()
+		}
+
+		world := GenerateWorldWithSeed(seed, viewportWidth, viewportHeight)
+		if len(world.PipeSpecs) != PipesToGenerate {
+			t.Fatalf("generated %d pipes, want %d", len(world.PipeSpecs), PipesToGenerate)
+		}
+
+		phys := playability.DefaultPhysics(viewportWidth, viewportHeight)
+		report, err := RepairWorld(context.Background(), world, phys)
+		if err != nil {
+			t.Fatalf("seed %d at %dx%d: %s", seed, viewportWidth, viewportHeight, err)
+		}
+		if !report.Playable {
+			t.Fatalf("RepairWorld returned without an error, but the world is %s", report)
+		}
+		for i, spec := range world.PipeSpecs {
+			if spec.GapStart < 0 || spec.GapStart+spec.GapHeight > float64(viewportHeight) {
+				t.Fatalf("pipe %d's gap (%f, %f) is off screen", i, spec.GapStart, spec.GapHeight)
+			}
+		}
+	})
+}
+
+// Pipes the same distance apart as a generated world, with these gaps
+func worldWithGaps(gaps ...[2]float64) *worldgenpb.WorldGenerated {
+	world := &worldgenpb.WorldGenerated{PipeSpacing: 250}
+	for _, gap := range gaps {
+		world.PipeSpecs = append(world.PipeSpecs, &worldgenpb.PipeSpec{GapStart: gap[0], GapHeight: gap[1]})
+	}
+	return world
+}
+
+func TestRepairWorld(t *testing.T) {
+	tests := []struct {
+		name  string
+		world *worldgenpb.WorldGenerated
+		// Viewport height
+		height  int32
+		wantErr bool
+		// Whether RepairWorld should have to touch the world
+		changed bool
+	}{
+		{
+			name:   "already playable",
+			world:  worldWithGaps([2]float64{150, 200}, [2]float64{160, 200}, [2]float64{140, 200}),
+			height: 600,
+		},
+		{
+			name:    "gap too small for the bird",
+			world:   worldWithGaps([2]float64{150, 200}, [2]float64{200, 10}, [2]float64{150, 200}),
+			height:  600,
+			changed: true,
+		},
+		{
+			name:    "gap jumps from the top to the bottom",
+			world:   worldWithGaps([2]float64{0, 60}, [2]float64{540, 60}, [2]float64{0, 60}),
+			height:  600,
+			changed: true,
+		},
+		{
+			name:    "viewport shorter than the bird",
+			world:   worldWithGaps([2]float64{0, 10}),
+			height:  20,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			phys := playability.DefaultPhysics(800, tc.height)
+			before := proto.Clone(tc.world)
+
+			report, err := RepairWorld(context.Background(), tc.world, phys)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if changed := !proto.Equal(before, tc.world); changed != tc.changed {
+				t.Errorf("world changed is %v, want %v", changed, tc.changed)
+			}
+			if err != nil {
+				return
+			}
+
+			if !report.Playable || !playability.Validate(tc.world, phys).Playable {
+				t.Errorf("repaired world is %s", report)
+			}
+			for i, spec := range tc.world.PipeSpecs {
+				if spec.GapStart < 0 || spec.GapStart+spec.GapHeight > float64(tc.height) {
+					t.Errorf("pipe %d's gap (%f, %f) is off screen", i, spec.GapStart, spec.GapHeight)
+				}
+			}
+		})
+	}
+}
+
+func TestRepairWorldStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	world := worldWithGaps([2]float64{0, 60}, [2]float64{540, 60}, [2]float64{0, 60})
+	_, err := RepairWorld(ctx, world, playability.DefaultPhysics(800, 600))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want it to stop", err)
+	}
+}
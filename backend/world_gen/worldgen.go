@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	"github.com/yuv418/cs553project/backend/commondata"
+	"github.com/yuv418/cs553project/backend/playability"
 	worldgenpb "github.com/yuv418/cs553project/backend/protos/world_gen"
 )
 
@@ -34,35 +35,61 @@ var (
 )
 
 func GenerateWorld(ctx *commondata.ReqCtx, req *worldgenpb.WorldGenReq) (*worldgenpb.WorldGenerated, error) {
-	var pipeArray []*worldgenpb.PipeSpec
-	var height int32
-	var start int32
-
 	log.Printf("Got request params %v\n", req)
 
 	// The game ID doesn't even matter. Maybe we can use it as a seed?
 	log.Printf("req.ViewportWidth %d\n", req.ViewportWidth)
 
 	randLock.Lock()
-	defer randLock.Unlock()
 
 	// https://pkg.go.dev/math/rand
 	// do some seed setup if necessary
 	// the point of this is to generate the same world over and over again
-	if StableWorld {
-		randomizer = rand.New(rand.NewSource(StableSeed))
+	var seed int64
+	if req.Seed != nil {
+		// Someone wants an old world back (ghost runs)
+		seed = *req.Seed
+		log.Printf("regenerating world with seed %d\n", seed)
+	} else if StableWorld {
+		seed = StableSeed
 	} else {
 		// this is mainly because we want to figure out what the seed of a "good" game is
 		// which is helpful for stabilizing
-		randSeed := rand.Int63()
-		randomizer = rand.New(rand.NewSource(randSeed))
+		seed = rand.Int63()
 
-		log.Printf("generating world with randSeed %d\n", randSeed)
+		log.Printf("generating world with randSeed %d\n", seed)
 	}
+	randomizer = rand.New(rand.NewSource(seed))
+
+	world := generatePipes(randomizer, req.ViewportWidth, req.ViewportHeight)
+	world.Seed = seed
+
+	// Validation can be slow, and doesn't need the randomizer
+	randLock.Unlock()
+
+	if ValidationMode == ValidationOff {
+		return world, nil
+	}
+
+	return checkWorld(ctx.Context(), world, playability.DefaultPhysics(req.ViewportWidth, req.ViewportHeight))
+}
 
-	gap := (req.ViewportWidth / 4) + randomizer.Int31n(req.ViewportWidth/4)
-	thresh := (2 * req.ViewportHeight) / 3
-	maxHeight := (1 * req.ViewportHeight) / 3
+// GenerateWorldWithSeed builds the same world GenerateWorld would for a given seed,
+// without touching the shared randomizer or running validation.
+func GenerateWorldWithSeed(seed int64, viewportWidth int32, viewportHeight int32) *worldgenpb.WorldGenerated {
+	world := generatePipes(rand.New(rand.NewSource(seed)), viewportWidth, viewportHeight)
+	world.Seed = seed
+	return world
+}
+
+func generatePipes(randomizer *rand.Rand, viewportWidth int32, viewportHeight int32) *worldgenpb.WorldGenerated {
+	var pipeArray []*worldgenpb.PipeSpec
+	var height int32
+	var start int32
+
+	gap := (viewportWidth / 4) + randomizer.Int31n(viewportWidth/4)
+	thresh := (2 * viewportHeight) / 3
+	maxHeight := (1 * viewportHeight) / 3
 
 	// Laziness
 	prevClear := "up"
@@ -74,24 +101,24 @@ func GenerateWorld(ctx *commondata.ReqCtx, req *worldgenpb.WorldGenReq) (*worldg
 		// If previously generated pipe is center, then can either generate anywhere
 		if prevClear == "center" {
 			// btw 1/9 and 7/9
-			start = (req.ViewportHeight / 9) + randomizer.Int31n(thresh)
+			start = (viewportHeight / 9) + randomizer.Int31n(thresh)
 		} else if prevClear == "bottom" {
 			// btw 4/9 and 7/9
-			start = (4 * req.ViewportHeight / 9) + randomizer.Int31n(3*req.ViewportHeight/9)
+			start = (4 * viewportHeight / 9) + randomizer.Int31n(3*viewportHeight/9)
 		} else if prevClear == "up" {
 			// btw 1/9 and 1/2
-			start = (req.ViewportHeight / 9) + randomizer.Int31n(7*req.ViewportHeight/18)
+			start = (viewportHeight / 9) + randomizer.Int31n(7*viewportHeight/18)
 		}
 
-		if start < req.ViewportHeight/3 {
+		if start < viewportHeight/3 {
 			prevClear = "up"
-		} else if start > 2*req.ViewportHeight/3 {
+		} else if start > 2*viewportHeight/3 {
 			prevClear = "bottom"
 		} else {
 			prevClear = "center"
 		}
 
-		remaining := req.ViewportHeight - start
+		remaining := viewportHeight - start
 		// If the remaining amount is less than the gap
 		if remaining < thresh {
 			height = ((2 * remaining) / 3) + randomizer.Int31n(remaining/6)
@@ -111,6 +138,5 @@ func GenerateWorld(ctx *commondata.ReqCtx, req *worldgenpb.WorldGenReq) (*worldg
 	return &worldgenpb.WorldGenerated{
 		PipeSpacing: float64(gap),
 		PipeSpecs:   pipeArray,
-	}, nil
-
+	}
 }
@@ -11,5 +11,7 @@ declare global {
         gameOverScreenShown: boolean;
         firstFrameReceived: boolean;
         gameId: string;
+        // The engine running the game, spectators connect here too
+        engineAddr: string;
     }
 }
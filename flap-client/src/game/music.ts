@@ -1,10 +1,27 @@
-import type { PlayMusicResp } from '../protos/music/music_pb';
+import type { AssetManifest, PlayMusicResp } from '../protos/music/music_pb';
 import { logReceiveTime } from '../latencyLogger';
 
 // Initiatlize stuff
 
 const context = new AudioContext();
 
+// Effects from the manifest, by ID. Decoded ones are also kept by hash so
+// the next game's manifest doesn't decode them again.
+const effects = new Map<string, Promise<AudioBuffer>>();
+const decodedByHash = new Map<string, Promise<AudioBuffer>>();
+
+
+// What we tell the music service we can play, best first. It sends each
+// sound in the first of these it has (or can convert to).
+export function playableCodecs(): string {
+    const probe = new Audio();
+    const types: [string, string][] = [
+        ['ogg', 'audio/ogg; codecs="vorbis"'],
+        ['mp3', 'audio/mpeg'],
+        ['wav', 'audio/wav; codecs="1"'],
+    ];
+    return types.filter((type) => probe.canPlayType(type[1]) !== '').map((type) => type[0]).join(',');
+}
 
 // Copied from https://stackoverflow.com/questions/37228285/uint8array-to-arraybuffer
 // There's really no point in rewriting this myself.
@@ -12,17 +29,61 @@ function typedArrayToBuffer(array: Uint8Array): ArrayBuffer {
     return array.buffer.slice(array.byteOffset, array.byteLength + array.byteOffset)
 }
 
+function loadManifest(manifest: AssetManifest) {
+    effects.clear();
+    for (const asset of manifest.assets) {
+        let decoded = decodedByHash.get(asset.sha256);
+        if (!decoded) {
+            decoded = context.decodeAudioData(typedArrayToBuffer(asset.data));
+            decodedByHash.set(asset.sha256, decoded);
+        }
+        effects.set(asset.id, decoded);
+    }
+
+    if (import.meta.env.VITE_DEBUG) {
+        console.log('Loaded sound effects:', [...effects.keys()]);
+    }
+}
+
+function playBuffer(buf: AudioBuffer, volume: number) {
+    const src = context.createBufferSource();
+    const gain = context.createGain();
+
+    src.buffer = buf;
+    gain.gain.value = volume;
+    src.connect(gain);
+    gain.connect(context.destination);
+    src.start(0);
+}
+
+// Plays an effect from the manifest. Game frames carry these too.
+export function playEffect(effectId: string, volume: number = 1) {
+    const effect = effects.get(effectId);
+    if (!effect) {
+        console.error('Sound effect not in the manifest:', effectId);
+        return;
+    }
+    effect.then((buf) => playBuffer(buf, volume));
+}
+
 // decodeAudioData
 // https://stackoverflow.com/questions/24151121/how-to-play-wav-audio-byte-array-via-javascript-html5
 export function playSound(_: string, resp: PlayMusicResp) {
+    if (resp.manifest) {
+        // Sent once when the session starts, effects come by ID after this
+        loadManifest(resp.manifest);
+        return;
+    }
+
     if (import.meta.env.VITE_LOG_LATENCY) {
         logReceiveTime('audio');
     }
-    context.decodeAudioData(typedArrayToBuffer(resp.audioPayload), (retBuf) => {
-        let src = context.createBufferSource()
 
-        src.buffer = retBuf
-        src.connect(context.destination)
-        src.start(0)
-    })
+    if (resp.effectId) {
+        playEffect(resp.effectId, resp.volume);
+    } else if (resp.audioPayload.length > 0) {
+        context.decodeAudioData(typedArrayToBuffer(resp.audioPayload), (retBuf) => {
+            playBuffer(retBuf, resp.volume);
+        })
+    }
 }
@@ -2,13 +2,38 @@ import type { GenerateFrameReq } from '../protos/frame_gen/frame_gen_pb';
 import { updateBirdPosition } from './bird';
 import { updatePipes } from './pipes';
 import { showGameOverScreen, updateScore } from './ui';
-import { logReceiveTime } from '../latencyLogger';
+import { logReceiveTime, logServerTime } from '../latencyLogger';
+import { handleTimeSync, serverToClientTime } from '../network/timeSync';
+import { playEffect } from './music';
 
 export function updateGameState(jwt: string, frame: GenerateFrameReq) {
+    if (frame.timeSync.length > 0) {
+        handleTimeSync(frame.timeSync);
+        // Clock sync only, not a real frame
+        if (!frame.birdPosition) {
+            return;
+        }
+    }
+
     window.firstFrameReceived = true
 
+    // Only set when the engine sends sounds in frames (SOUND_DELIVERY=frame)
+    for (const sound of frame.soundEvents) {
+        playEffect(sound.effectId);
+    }
+
     if (import.meta.env.VITE_LOG_LATENCY) {
-        logReceiveTime('frame');
+        logReceiveTime('frame', frame.seq);
+
+        // When the server sent this, and got the input before it, on our clock
+        const sent = serverToClientTime(frame.serverTimeNs);
+        if (sent !== null) {
+            logServerTime('frame', sent, frame.seq);
+        }
+        const inputRecv = frame.lastInputTimeNs ? serverToClientTime(frame.lastInputTimeNs) : null;
+        if (inputRecv !== null) {
+            logServerTime('input', inputRecv, frame.seq);
+        }
     }
     // Update game state
     if (frame.gameOver) {
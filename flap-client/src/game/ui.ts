@@ -180,11 +180,12 @@ export async function startGame(response: AuthResponse) {
         if (startGameResponse.gameId) {
             // for extraction
             window.gameId = startGameResponse.gameId
+            window.engineAddr = startGameResponse.webtransportAddr ?? ''
             hideJumpInstruction();
             hideLoginContainer();
 
             // This blocks!
-            setTimeout(async () => { await startGameTransport(response.jwtToken, startGameResponse.gameId) });
+            setTimeout(async () => { await startGameTransport(response.jwtToken, startGameResponse.gameId, startGameResponse.webtransportAddr) });
             await startMusicTransport(response.jwtToken, startGameResponse.gameId);
         }
     } catch (error) {
@@ -3,40 +3,58 @@ type LatencyType = 'input' | 'audio' | 'frame';
 interface LatencyLog {
   sendTimestamps: number[];
   receiveTimestamps: number[];
+  // The server's seq for each received frame, to join with its frames.csv
+  receiveSeqs: (bigint | undefined)[];
+  // When the server got or sent it, converted to our clock with the clock sync
+  serverTimestamps: number[];
+  serverSeqs: bigint[];
 }
 
 const latencyLogs: Record<LatencyType, LatencyLog> = {
-  input: { sendTimestamps: [], receiveTimestamps: [] },
-  audio: { sendTimestamps: [], receiveTimestamps: [] },
-  frame: { sendTimestamps: [], receiveTimestamps: [] },
+  input: { sendTimestamps: [], receiveTimestamps: [], receiveSeqs: [], serverTimestamps: [], serverSeqs: [] },
+  audio: { sendTimestamps: [], receiveTimestamps: [], receiveSeqs: [], serverTimestamps: [], serverSeqs: [] },
+  frame: { sendTimestamps: [], receiveTimestamps: [], receiveSeqs: [], serverTimestamps: [], serverSeqs: [] },
 };
 
 export function logSendTime(type: LatencyType) {
   latencyLogs[type].sendTimestamps.push(performance.now());
 }
 
-export function logReceiveTime(type: LatencyType) {
+export function logReceiveTime(type: LatencyType, seq?: bigint) {
   latencyLogs[type].receiveTimestamps.push(performance.now());
+  latencyLogs[type].receiveSeqs.push(seq);
+}
+
+// Uplink is input server - input send, downlink is frame recv - frame server
+export function logServerTime(type: LatencyType, time: number, seq: bigint) {
+  latencyLogs[type].serverTimestamps.push(time);
+  latencyLogs[type].serverSeqs.push(seq);
 }
 
 export function downloadLatencyCSV() {
   if (!import.meta.env.VITE_LOG_LATENCY) { return; }
 
-  let csv = "type,direction,time\n";
+  let csv = "type,direction,time,seq\n";
   for (const type of Object.keys(latencyLogs) as LatencyType[]) {
     const log = latencyLogs[type];
     for (let i = 0; i < log.sendTimestamps.length; i++) {
       const send = log.sendTimestamps[i];
-      csv += `${type},send,${send.toFixed(3)}\n`;
+      csv += `${type},send,${send.toFixed(3)},\n`;
     }
     for (let i = 0; i < log.receiveTimestamps.length; i++) {
       const recv = log.receiveTimestamps[i];
-      csv += `${type},recv,${recv.toFixed(3)}\n`;
+      csv += `${type},recv,${recv.toFixed(3)},${log.receiveSeqs[i] ?? ''}\n`;
+    }
+    for (let i = 0; i < log.serverTimestamps.length; i++) {
+      csv += `${type},server,${log.serverTimestamps[i].toFixed(3)},${log.serverSeqs[i]}\n`;
     }
 
     // Clear it out
     latencyLogs[type].sendTimestamps = []
     latencyLogs[type].receiveTimestamps = []
+    latencyLogs[type].receiveSeqs = []
+    latencyLogs[type].serverTimestamps = []
+    latencyLogs[type].serverSeqs = []
   }
 
   const blob = new Blob([csv], { type: 'text/csv' });
@@ -0,0 +1,110 @@
+import { create } from "@bufbuild/protobuf";
+import { sizeDelimitedEncode } from "@bufbuild/protobuf/wire";
+import * as engine from '../protos/game_engine/game_engine_pb';
+import type { TimeSyncPong } from '../protos/frame_gen/frame_gen_pb';
+
+// NTP-style clock sync with the game engine, so latencies can be split into
+// uplink and downlink. Times here are performance.now() milliseconds, the
+// same clock latencyLogger uses.
+
+interface SyncSample {
+  // When the ping went out, on our clock
+  clientTime: number;
+  // Server clock minus ours
+  offset: number;
+  rtt: number;
+}
+
+// A burst at the start to get going, then a ping every so often to follow drift
+const BURST_PINGS = 8;
+const BURST_SPACING_MS = 50;
+const SYNC_INTERVAL_MS = 5000;
+const MAX_SAMPLES = 64;
+
+let samples: SyncSample[] = [];
+// offset(t) = offset + drift * (t - since)
+let estimate: { offset: number, drift: number, since: number } | null = null;
+let timers: number[] = [];
+
+function serverNsToMs(ns: bigint): number {
+  // Down to microseconds first, since Unix nanoseconds don't fit in a double
+  return Number(ns / 1000n) / 1000;
+}
+
+async function sendPing(writer: WritableStreamDefaultWriter<any>, gameId: string) {
+  const pingReq = create(engine.GameEngineInputReqSchema, {
+    gameId: gameId,
+    timeSync: { clientSendTime: performance.now() },
+  });
+  await writer.write(sizeDelimitedEncode(engine.GameEngineInputReqSchema, pingReq));
+}
+
+export function startTimeSync(writer: WritableStreamDefaultWriter<any>, gameId: string) {
+  stopTimeSync();
+  samples = [];
+  estimate = null;
+
+  for (let i = 0; i < BURST_PINGS; i++) {
+    timers.push(window.setTimeout(() => sendPing(writer, gameId).catch(() => { }), i * BURST_SPACING_MS));
+  }
+  timers.push(window.setInterval(() => sendPing(writer, gameId).catch(() => { }), SYNC_INTERVAL_MS));
+}
+
+export function stopTimeSync() {
+  for (const timer of timers) {
+    clearTimeout(timer);
+    clearInterval(timer);
+  }
+  timers = [];
+}
+
+export function handleTimeSync(pongs: TimeSyncPong[]) {
+  const clientRecv = performance.now();
+  for (const pong of pongs) {
+    const serverRecv = serverNsToMs(pong.serverRecvTimeNs);
+    const serverSend = serverNsToMs(pong.serverSendTimeNs);
+    samples.push({
+      clientTime: pong.clientSendTime,
+      offset: ((serverRecv - pong.clientSendTime) + (serverSend - clientRecv)) / 2,
+      rtt: (clientRecv - pong.clientSendTime) - (serverSend - serverRecv),
+    });
+  }
+  if (samples.length > MAX_SAMPLES) {
+    samples = samples.slice(samples.length - MAX_SAMPLES);
+  }
+  updateEstimate();
+}
+
+// Slow round trips were probably queued somewhere on one leg, so only the
+// fastest half of the samples count. Drift is a least squares line through them.
+function updateEstimate() {
+  const best = [...samples].sort((a, b) => a.rtt - b.rtt).slice(0, Math.max(1, Math.ceil(samples.length / 2)));
+
+  const since = best.reduce((sum, s) => sum + s.clientTime, 0) / best.length;
+  const meanOffset = best.reduce((sum, s) => sum + s.offset, 0) / best.length;
+
+  let covariance = 0;
+  let variance = 0;
+  for (const s of best) {
+    covariance += (s.clientTime - since) * (s.offset - meanOffset);
+    variance += (s.clientTime - since) ** 2;
+  }
+  // Samples from one burst are too close together to say anything about drift
+  const drift = variance > (SYNC_INTERVAL_MS ** 2) ? covariance / variance : 0;
+
+  estimate = { offset: meanOffset, drift: drift, since: since };
+
+  if (import.meta.env.VITE_DEBUG) {
+    console.log(`Clock offset ${meanOffset.toFixed(3)}ms, drift ${(drift * 1e6).toFixed(1)}ppm, best rtt ${best[0].rtt.toFixed(3)}ms`);
+  }
+}
+
+// A server timestamp on our clock, or null before the first pong
+export function serverToClientTime(serverNs: bigint): number | null {
+  if (!estimate) { return null; }
+
+  const serverMs = serverNsToMs(serverNs);
+  // Drift is tiny, so the offset at the roughly right time is close enough
+  const approx = serverMs - estimate.offset;
+  return serverMs - (estimate.offset + estimate.drift * (approx - estimate.since));
+}
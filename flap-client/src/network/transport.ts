@@ -6,16 +6,33 @@ import * as musicPb from '../protos/music/music_pb';
 import { updateGameState } from '../game/state';
 import { resetBird } from '../game/bird';
 import { hideJumpInstruction } from '../game/ui';
-import { playSound } from "../game/music";
+import { playSound, playableCodecs } from "../game/music";
 import { logSendTime } from '../latencyLogger';
+import { startTimeSync, stopTimeSync } from './timeSync';
 
 
 let gameWriter: WritableStreamDefaultWriter<any> | null = null;
 
+// Games run on whichever engine the initiator picked, which tells us its
+// host:port. Without one we use VITE_WEBTRANSPORT_GAME_URL as is.
+export function engineUrl(engineAddr: string | undefined, path: string): string {
+    const url = new URL(import.meta.env.VITE_WEBTRANSPORT_GAME_URL);
+    if (engineAddr) {
+        url.host = engineAddr;
+    }
+    url.pathname = path;
+    return url.toString();
+}
+
+// Where to watch a game from, which has to be the engine running it
+export function spectateUrl(engineAddr: string | undefined = window.engineAddr): string {
+    return engineUrl(engineAddr, '/gameEngine/Spectate');
+}
+
 // TODO typing
-export async function startTransport(jwt: string, gameId: string, baseUrl: string, setupFn: any, cleanupFn: any, schema: any, handler: any) {
+export async function startTransport(jwt: string, gameId: string, baseUrl: string, setupFn: any, cleanupFn: any, schema: any, handler: any, query: string = "", initialInput: boolean = true) {
     try {
-        const url = baseUrl + "?token=" + jwt + "&gameId=" + gameId;
+        const url = baseUrl + "?token=" + jwt + "&gameId=" + gameId + query;
         const transport = new WebTransport(url);
 
         await transport.ready;
@@ -25,10 +42,12 @@ export async function startTransport(jwt: string, gameId: string, baseUrl: strin
         gameWriter = stream.writable.getWriter();
 
         // Send initial input
-        await sendGameInput(gameId);
+        if (initialInput) {
+            await sendGameInput(gameId);
 
-        if (import.meta.env.VITE_DEBUG) {
-            console.log('Initial input sent');
+            if (import.meta.env.VITE_DEBUG) {
+                console.log('Initial input sent');
+            }
         }
 
         // Set up space bar event listener
@@ -54,10 +73,14 @@ export async function startMusicTransport(jwt: string, gameId: string) {
         (_: string) => { },
         () => { },
         musicPb.PlayMusicRespSchema,
-        playSound)
+        playSound,
+        "&codecs=" + encodeURIComponent(playableCodecs()))
 }
 
-export async function startGameTransport(jwt: string, gameId: string) {
+// resumed is set when the game moved here from another engine and is already going
+export async function startGameTransport(jwt: string, gameId: string, engineAddr?: string, resumed: boolean = false) {
+    // Set by the last frame of a game that moved to another engine
+    let movedTo = '';
 
     let eventListenerEvent = async (event: KeyboardEvent) => {
         if (event.code === 'Space' && gameWriter) {
@@ -69,20 +92,41 @@ export async function startGameTransport(jwt: string, gameId: string) {
 
     let setupInputHandling = (_: string) => {
         document.addEventListener('keydown', eventListenerEvent);
+        if (gameWriter) {
+            startTimeSync(gameWriter, gameId);
+        }
     };
 
     let cleanup = () => {
+        stopTimeSync();
         // https://developer.mozilla.org/en-US/docs/Web/API/EventTarget/removeEventListener#matching_event_listeners_for_removal
         document.removeEventListener('keydown', eventListenerEvent)
     }
 
+    let handleFrame = (jwt: string, frame: frameGen.GenerateFrameReq) => {
+        if (frame.movedTo) {
+            movedTo = frame.movedTo;
+            return;
+        }
+        updateGameState(jwt, frame);
+    }
+
     await startTransport(jwt,
         gameId,
-        import.meta.env.VITE_WEBTRANSPORT_GAME_URL,
+        engineUrl(engineAddr, '/gameEngine/GameSession'),
         setupInputHandling,
         cleanup,
         frameGen.GenerateFrameReqSchema,
-        updateGameState)
+        handleFrame,
+        "",
+        !resumed)
+
+    // Only once the old session is cleaned up, so it doesn't take the new one with it
+    if (movedTo) {
+        console.log('Game moved to', movedTo);
+        window.engineAddr = movedTo;
+        await startGameTransport(jwt, gameId, movedTo, true);
+    }
 }
 
 async function sendGameInput(gameId: string) {
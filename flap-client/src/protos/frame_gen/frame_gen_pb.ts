@@ -10,7 +10,7 @@ import type { Message } from "@bufbuild/protobuf";
  * Describes the file protos/frame_gen/frame_gen.proto.
  */
 export const file_protos_frame_gen_frame_gen: GenFile = /*@__PURE__*/
-  fileDesc("CiBwcm90b3MvZnJhbWVfZ2VuL2ZyYW1lX2dlbi5wcm90bxIJZnJhbWVfZ2VuIhsKA1BvcxIJCgF4GAEgASgBEgkKAXkYAiABKAEiwAEKEEdlbmVyYXRlRnJhbWVSZXESDwoHZ2FtZV9pZBgBIAEoCRIlCg1iaXJkX3Bvc2l0aW9uGAIgASgLMg4uZnJhbWVfZ2VuLlBvcxIWCg5waXBlX3Bvc2l0aW9ucxgDIAMoARITCgtwaXBlX3N0YXJ0cxgEIAMoARIRCglwaXBlX2dhcHMYBSADKAESDQoFc2NvcmUYBiABKAUSEgoKcGlwZV93aWR0aBgHIAEoBRIRCglnYW1lX292ZXIYCCABKAgiJwoRR2VuZXJhdGVGcmFtZVJlc3ASEgoKZnJhbWVfZGlmZhgHIAEoDDJfCg9GcmFtZUdlblNlcnZpY2USTAoNR2VuZXJhdGVGcmFtZRIbLmZyYW1lX2dlbi5HZW5lcmF0ZUZyYW1lUmVxGhwuZnJhbWVfZ2VuLkdlbmVyYXRlRnJhbWVSZXNwIgBCD1oNLi87ZnJhbWVnZW5wYmIGcHJvdG8z");
+  fileDesc("CiBwcm90b3MvZnJhbWVfZ2VuL2ZyYW1lX2dlbi5wcm90bxIJZnJhbWVfZ2VuIhsKA1BvcxIJCgF4GAEgASgBEgkKAXkYAiABKAEibQoJUGxheWVyUG9zEg8KB2dhbWVfaWQYASABKAkSEAoIdXNlcm5hbWUYAiABKAkSIAoIcG9zaXRpb24YAyABKAsyDi5mcmFtZV9nZW4uUG9zEg0KBXNjb3JlGAQgASgFEgwKBGRlYWQYBSABKAgiLgoKU291bmRFdmVudBIRCgllZmZlY3RfaWQYASABKAkSDQoFZnJhbWUYAiABKAUiYgoMVGltZVN5bmNQb25nEhgKEGNsaWVudF9zZW5kX3RpbWUYASABKAESGwoTc2VydmVyX3JlY3ZfdGltZV9ucxgCIAEoAxIbChNzZXJ2ZXJfc2VuZF90aW1lX25zGAMgASgDIvUDChBHZW5lcmF0ZUZyYW1lUmVxEg8KB2dhbWVfaWQYASABKAkSJQoNYmlyZF9wb3NpdGlvbhgCIAEoCzIOLmZyYW1lX2dlbi5Qb3MSFgoOcGlwZV9wb3NpdGlvbnMYAyADKAESEwoLcGlwZV9zdGFydHMYBCADKAESEQoJcGlwZV9nYXBzGAUgAygBEg0KBXNjb3JlGAYgASgFEhIKCnBpcGVfd2lkdGgYByABKAUSEQoJZ2FtZV9vdmVyGAggASgIEiUKB3BsYXllcnMYCSADKAsyFC5mcmFtZV9nZW4uUGxheWVyUG9zEhEKCXJvb21fb3ZlchgKIAEoCBIRCglwbGFjZW1lbnQYCyABKAUSJgoOZ2hvc3RfcG9zaXRpb24YDCABKAsyDi5mcmFtZV9nZW4uUG9zEhIKCmdob3N0X292ZXIYDSABKAgSKwoMc291bmRfZXZlbnRzGA4gAygLMhUuZnJhbWVfZ2VuLlNvdW5kRXZlbnQSEAoIbW92ZWRfdG8YDyABKAkSCwoDc2VxGBAgASgDEioKCXRpbWVfc3luYxgRIAMoCzIXLmZyYW1lX2dlbi5UaW1lU3luY1BvbmcSFgoOc2VydmVyX3RpbWVfbnMYEiABKAMSGgoSbGFzdF9pbnB1dF90aW1lX25zGBMgASgDIicKEUdlbmVyYXRlRnJhbWVSZXNwEhIKCmZyYW1lX2RpZmYYByABKAwyXwoPRnJhbWVHZW5TZXJ2aWNlEkwKDUdlbmVyYXRlRnJhbWUSGy5mcmFtZV9nZW4uR2VuZXJhdGVGcmFtZVJlcRocLmZyYW1lX2dlbi5HZW5lcmF0ZUZyYW1lUmVzcCIAQg9aDS4vO2ZyYW1lZ2VucGJiBnByb3RvMw");
 
 /**
  * @generated from message frame_gen.Pos
@@ -34,6 +34,102 @@ export type Pos = Message<"frame_gen.Pos"> & {
 export const PosSchema: GenMessage<Pos> = /*@__PURE__*/
   messageDesc(file_protos_frame_gen_frame_gen, 0);
 
+/**
+ * Another bird in the same race room
+ *
+ * @generated from message frame_gen.PlayerPos
+ */
+export type PlayerPos = Message<"frame_gen.PlayerPos"> & {
+  /**
+   * @generated from field: string game_id = 1;
+   */
+  gameId: string;
+
+  /**
+   * @generated from field: string username = 2;
+   */
+  username: string;
+
+  /**
+   * @generated from field: frame_gen.Pos position = 3;
+   */
+  position?: Pos;
+
+  /**
+   * @generated from field: int32 score = 4;
+   */
+  score: number;
+
+  /**
+   * @generated from field: bool dead = 5;
+   */
+  dead: boolean;
+};
+
+/**
+ * Describes the message frame_gen.PlayerPos.
+ * Use `create(PlayerPosSchema)` to create a new message.
+ */
+export const PlayerPosSchema: GenMessage<PlayerPos> = /*@__PURE__*/
+  messageDesc(file_protos_frame_gen_frame_gen, 1);
+
+/**
+ * A sound to play on the tick this frame was generated on.
+ * effect_id is an asset ID from the music service's manifest.
+ *
+ * @generated from message frame_gen.SoundEvent
+ */
+export type SoundEvent = Message<"frame_gen.SoundEvent"> & {
+  /**
+   * @generated from field: string effect_id = 1;
+   */
+  effectId: string;
+
+  /**
+   * @generated from field: int32 frame = 2;
+   */
+  frame: number;
+};
+
+/**
+ * Describes the message frame_gen.SoundEvent.
+ * Use `create(SoundEventSchema)` to create a new message.
+ */
+export const SoundEventSchema: GenMessage<SoundEvent> = /*@__PURE__*/
+  messageDesc(file_protos_frame_gen_frame_gen, 2);
+
+/**
+ * Answer to a TimeSyncPing, NTP style. With the time the client got it back,
+ * the client can work out the offset between its clock and ours.
+ *
+ * @generated from message frame_gen.TimeSyncPong
+ */
+export type TimeSyncPong = Message<"frame_gen.TimeSyncPong"> & {
+  /**
+   * @generated from field: double client_send_time = 1;
+   */
+  clientSendTime: number;
+
+  /**
+   * Unix nanoseconds on the server
+   *
+   * @generated from field: int64 server_recv_time_ns = 2;
+   */
+  serverRecvTimeNs: bigint;
+
+  /**
+   * @generated from field: int64 server_send_time_ns = 3;
+   */
+  serverSendTimeNs: bigint;
+};
+
+/**
+ * Describes the message frame_gen.TimeSyncPong.
+ * Use `create(TimeSyncPongSchema)` to create a new message.
+ */
+export const TimeSyncPongSchema: GenMessage<TimeSyncPong> = /*@__PURE__*/
+  messageDesc(file_protos_frame_gen_frame_gen, 3);
+
 /**
  * @generated from message frame_gen.GenerateFrameReq
  */
@@ -83,6 +179,85 @@ export type GenerateFrameReq = Message<"frame_gen.GenerateFrameReq"> & {
    * @generated from field: bool game_over = 8;
    */
   gameOver: boolean;
+
+  /**
+   * Only set for race rooms. Includes this player's bird.
+   *
+   * @generated from field: repeated frame_gen.PlayerPos players = 9;
+   */
+  players: PlayerPos[];
+
+  /**
+   * The last bird in the room died
+   *
+   * @generated from field: bool room_over = 10;
+   */
+  roomOver: boolean;
+
+  /**
+   * 1 is first place, only set once room_over is true
+   *
+   * @generated from field: int32 placement = 11;
+   */
+  placement: number;
+
+  /**
+   * Only set when racing a ghost
+   *
+   * @generated from field: frame_gen.Pos ghost_position = 12;
+   */
+  ghostPosition?: Pos;
+
+  /**
+   * @generated from field: bool ghost_over = 13;
+   */
+  ghostOver: boolean;
+
+  /**
+   * Only used when the engine sends sounds itself (SOUND_DELIVERY=frame)
+   *
+   * @generated from field: repeated frame_gen.SoundEvent sound_events = 14;
+   */
+  soundEvents: SoundEvent[];
+
+  /**
+   * The game moved to another engine. This is the last frame, reopen the
+   * session at this address to carry on.
+   *
+   * @generated from field: string moved_to = 15;
+   */
+  movedTo: string;
+
+  /**
+   * Counts frames sent on this game's session from 1, and carries on
+   * after the game moves. The engine's frames.csv has the same seq.
+   *
+   * @generated from field: int64 seq = 16;
+   */
+  seq: bigint;
+
+  /**
+   * Pongs go out on the next tick, even before the game starts. A frame
+   * with only these (and server_time_ns) isn't a real frame.
+   *
+   * @generated from field: repeated frame_gen.TimeSyncPong time_sync = 17;
+   */
+  timeSync: TimeSyncPong[];
+
+  /**
+   * Unix nanoseconds when this frame was sent
+   *
+   * @generated from field: int64 server_time_ns = 18;
+   */
+  serverTimeNs: bigint;
+
+  /**
+   * Unix nanoseconds when the first input since the last frame got here,
+   * or 0 if there wasn't one
+   *
+   * @generated from field: int64 last_input_time_ns = 19;
+   */
+  lastInputTimeNs: bigint;
 };
 
 /**
@@ -90,7 +265,7 @@ export type GenerateFrameReq = Message<"frame_gen.GenerateFrameReq"> & {
  * Use `create(GenerateFrameReqSchema)` to create a new message.
  */
 export const GenerateFrameReqSchema: GenMessage<GenerateFrameReq> = /*@__PURE__*/
-  messageDesc(file_protos_frame_gen_frame_gen, 1);
+  messageDesc(file_protos_frame_gen_frame_gen, 4);
 
 /**
  * @generated from message frame_gen.GenerateFrameResp
@@ -107,7 +282,7 @@ export type GenerateFrameResp = Message<"frame_gen.GenerateFrameResp"> & {
  * Use `create(GenerateFrameRespSchema)` to create a new message.
  */
 export const GenerateFrameRespSchema: GenMessage<GenerateFrameResp> = /*@__PURE__*/
-  messageDesc(file_protos_frame_gen_frame_gen, 2);
+  messageDesc(file_protos_frame_gen_frame_gen, 5);
 
 /**
  * @generated from service frame_gen.FrameGenService
@@ -14,7 +14,28 @@ import type { Message } from "@bufbuild/protobuf";
  * Describes the file protos/game_engine/game_engine.proto.
  */
 export const file_protos_game_engine_game_engine: GenFile = /*@__PURE__*/
-  fileDesc("CiRwcm90b3MvZ2FtZV9lbmdpbmUvZ2FtZV9lbmdpbmUucHJvdG8SC2dhbWVfZW5naW5lIkQKEkdhbWVFbmdpbmVJbnB1dFJlcRIPCgdnYW1lX2lkGAIgASgJEh0KA2tleRgDIAEoDjIQLmdhbWVfZW5naW5lLktleSKpAQoSR2FtZUVuZ2luZVN0YXJ0UmVxEg8KB2dhbWVfaWQYAiABKAkSFgoOdmlld3BvcnRfd2lkdGgYAyABKAUSFwoPdmlld3BvcnRfaGVpZ2h0GAQgASgFEigKBXdvcmxkGAUgASgLMhkud29ybGRfZ2VuLldvcmxkR2VuZXJhdGVkEhIKCmJpcmRfd2lkdGgYBiABKAUSEwoLYmlyZF9oZWlnaHQYByABKAUqEAoDS2V5EgkKBVNQQUNFEAAypQEKEUdhbWVFbmdpbmVTZXJ2aWNlEkgKC0hhbmRsZUlucHV0Eh8uZ2FtZV9lbmdpbmUuR2FtZUVuZ2luZUlucHV0UmVxGhYuZ29vZ2xlLnByb3RvYnVmLkVtcHR5IgASRgoJU3RhcnRHYW1lEh8uZ2FtZV9lbmdpbmUuR2FtZUVuZ2luZVN0YXJ0UmVxGhYuZ29vZ2xlLnByb3RvYnVmLkVtcHR5IgBCO1o5Z2l0aHViLmNvbS95dXY0MTgvY3M1NTNwcm9qZWN0L2JhY2tlbmQvcHJvdG9zL2dhbWVfZW5naW5lYgZwcm90bzM", [file_protos_world_gen_world_gen, file_google_protobuf_empty]);
+  fileDesc("CiRwcm90b3MvZ2FtZV9lbmdpbmUvZ2FtZV9lbmdpbmUucHJvdG8SC2dhbWVfZW5naW5lIigKDFRpbWVTeW5jUGluZxIYChBjbGllbnRfc2VuZF90aW1lGAEgASgBIoUBChJHYW1lRW5naW5lSW5wdXRSZXESDwoHZ2FtZV9pZBgCIAEoCRIdCgNrZXkYAyABKA4yEC5nYW1lX2VuZ2luZS5LZXkSMQoJdGltZV9zeW5jGAQgASgLMhkuZ2FtZV9lbmdpbmUuVGltZVN5bmNQaW5nSACIAQFCDAoKX3RpbWVfc3luYyKAAgoSR2FtZUVuZ2luZVN0YXJ0UmVxEg8KB2dhbWVfaWQYAiABKAkSFgoOdmlld3BvcnRfd2lkdGgYAyABKAUSFwoPdmlld3BvcnRfaGVpZ2h0GAQgASgFEigKBXdvcmxkGAUgASgLMhkud29ybGRfZ2VuLldvcmxkR2VuZXJhdGVkEhIKCmJpcmRfd2lkdGgYBiABKAUSEwoLYmlyZF9oZWlnaHQYByABKAUSFAoHcm9vbV9pZBgIIAEoCUgAiAEBEikKBWdob3N0GAkgASgLMhUuZ2FtZV9lbmdpbmUuR2hvc3RSdW5IAYgBAUIKCghfcm9vbV9pZEIICgZfZ2hvc3QiRgoTR2FtZUVuZ2luZVN0YXJ0UmVzcBIZChF3ZWJ0cmFuc3BvcnRfYWRkchgBIAEoCRIUCgxhY3RpdmVfZ2FtZXMYAiABKAUiWQoIR2hvc3RSdW4SDwoHZ2FtZV9pZBgBIAEoCRITCgtmbGFwX2ZyYW1lcxgCIAMoBRISCgpiaXJkX3dpZHRoGAMgASgFEhMKC2JpcmRfaGVpZ2h0GAQgASgFIpoBChdHYW1lRW5naW5lQ3JlYXRlUm9vbVJlcRIPCgdyb29tX2lkGAEgASgJEhYKDnZpZXdwb3J0X3dpZHRoGAIgASgFEhcKD3ZpZXdwb3J0X2hlaWdodBgDIAEoBRIoCgV3b3JsZBgEIAEoCzIZLndvcmxkX2dlbi5Xb3JsZEdlbmVyYXRlZBITCgttYXhfcGxheWVycxgFIAEoBSLgAwoMQmlyZFNuYXBzaG90EigKBXdvcmxkGAEgASgLMhkud29ybGRfZ2VuLldvcmxkR2VuZXJhdGVkEg4KBmJpcmRfeRgCIAEoARIVCg1iaXJkX3ZlbG9jaXR5GAMgASgBEhIKCmZsYXBfZm9yY2UYBCABKAESDQoFZnJhbWUYBSABKAUSDQoFc2NvcmUYBiABKAUSKgoKcGxheV9zdGF0ZRgHIAEoDjIWLmdhbWVfZW5naW5lLlBsYXlTdGF0ZRIQCghncm91bmRfeBgIIAEoARISCgpwaXBlX3NwZWVkGAkgASgBEhUKDXBpcGVfd2luZG93X3gYCiABKAESGQoRcGlwZV93aW5kb3dfd2lkdGgYCyABKAESFwoPcGlwZXNfdG9fcmVuZGVyGAwgASgFEhMKC3BpcGVfc3RhcnRzGA0gAygBEhYKDnBpcGVfcG9zaXRpb25zGA4gAygBEhEKCXBpcGVfZ2FwcxgPIAMoARIZChFwcmV2X2Nsb3Nlc3RfcGlwZRgQIAEoBRISCgpiaXJkX3dpZHRoGBEgASgBEhMKC2JpcmRfaGVpZ2h0GBIgASgBEhcKD3ZpZXdwb3J0X2hlaWdodBgTIAEoARITCgtmbGFwX2ZyYW1lcxgUIAMoBSJvCg1HaG9zdFNuYXBzaG90EiIKA3J1bhgBIAEoCzIVLmdhbWVfZW5naW5lLkdob3N0UnVuEicKBGJpcmQYAiABKAsyGS5nYW1lX2VuZ2luZS5CaXJkU25hcHNob3QSEQoJbmV4dF9mbGFwGAMgASgFIpUBCgxHYW1lU25hcHNob3QSDwoHZ2FtZV9pZBgBIAEoCRInCgRiaXJkGAIgASgLMhkuZ2FtZV9lbmdpbmUuQmlyZFNuYXBzaG90Ei4KBWdob3N0GAMgASgLMhouZ2FtZV9lbmdpbmUuR2hvc3RTbmFwc2hvdEgAiAEBEhEKCWZyYW1lX3NlcRgEIAEoA0IICgZfZ2hvc3QiKQoORW5naW5lRHJhaW5SZXESFwoPdGFyZ2V0X2luc3RhbmNlGAEgASgJIkQKD0VuZ2luZURyYWluUmVzcBIQCghtaWdyYXRlZBgBIAEoBRIOCgZmYWlsZWQYAiABKAUSDwoHc2tpcHBlZBgDIAEoBSoQCgNLZXkSCQoFU1BBQ0UQACoqCglQbGF5U3RhdGUSCQoFUkVBRFkQABIICgRQTEFZEAESCAoET1ZFUhACMt8CChFHYW1lRW5naW5lU2VydmljZRJWCg9FbmdpbmVTdGFydEdhbWUSHy5nYW1lX2VuZ2luZS5HYW1lRW5naW5lU3RhcnRSZXEaIC5nYW1lX2VuZ2luZS5HYW1lRW5naW5lU3RhcnRSZXNwIgASUgoQRW5naW5lQ3JlYXRlUm9vbRIkLmdhbWVfZW5naW5lLkdhbWVFbmdpbmVDcmVhdGVSb29tUmVxGhYuZ29vZ2xlLnByb3RvYnVmLkVtcHR5IgASUgoRRW5naW5lUmVzdG9yZUdhbWUSGS5nYW1lX2VuZ2luZS5HYW1lU25hcHNob3QaIC5nYW1lX2VuZ2luZS5HYW1lRW5naW5lU3RhcnRSZXNwIgASSgoLRW5naW5lRHJhaW4SGy5nYW1lX2VuZ2luZS5FbmdpbmVEcmFpblJlcRocLmdhbWVfZW5naW5lLkVuZ2luZURyYWluUmVzcCIAMl4KEkdhbWVTZXNzaW9uU2VydmljZRJICgtIYW5kbGVJbnB1dBIfLmdhbWVfZW5naW5lLkdhbWVFbmdpbmVJbnB1dFJlcRoWLmdvb2dsZS5wcm90b2J1Zi5FbXB0eSIAQjtaOWdpdGh1Yi5jb20veXV2NDE4L2NzNTUzcHJvamVjdC9iYWNrZW5kL3Byb3Rvcy9nYW1lX2VuZ2luZWIGcHJvdG8z", [file_protos_world_gen_world_gen, file_google_protobuf_empty]);
+
+/**
+ * A clock sync ping, answered with a TimeSyncPong in the frame stream
+ *
+ * @generated from message game_engine.TimeSyncPing
+ */
+export type TimeSyncPing = Message<"game_engine.TimeSyncPing"> & {
+  /**
+   * The client's clock (performance.now(), in ms) when it sent this
+   *
+   * @generated from field: double client_send_time = 1;
+   */
+  clientSendTime: number;
+};
+
+/**
+ * Describes the message game_engine.TimeSyncPing.
+ * Use `create(TimeSyncPingSchema)` to create a new message.
+ */
+export const TimeSyncPingSchema: GenMessage<TimeSyncPing> = /*@__PURE__*/
+  messageDesc(file_protos_game_engine_game_engine, 0);
 
 /**
  * @generated from message game_engine.GameEngineInputReq
@@ -29,6 +50,13 @@ export type GameEngineInputReq = Message<"game_engine.GameEngineInputReq"> & {
    * @generated from field: game_engine.Key key = 3;
    */
   key: Key;
+
+  /**
+   * When set this is only a ping, and key is ignored
+   *
+   * @generated from field: optional game_engine.TimeSyncPing time_sync = 4;
+   */
+  timeSync?: TimeSyncPing;
 };
 
 /**
@@ -36,7 +64,7 @@ export type GameEngineInputReq = Message<"game_engine.GameEngineInputReq"> & {
  * Use `create(GameEngineInputReqSchema)` to create a new message.
  */
 export const GameEngineInputReqSchema: GenMessage<GameEngineInputReq> = /*@__PURE__*/
-  messageDesc(file_protos_game_engine_game_engine, 0);
+  messageDesc(file_protos_game_engine_game_engine, 1);
 
 /**
  * @generated from message game_engine.GameEngineStartReq
@@ -71,6 +99,18 @@ export type GameEngineStartReq = Message<"game_engine.GameEngineStartReq"> & {
    * @generated from field: int32 bird_height = 7;
    */
   birdHeight: number;
+
+  /**
+   * If set, the world and viewport come from the room
+   *
+   * @generated from field: optional string room_id = 8;
+   */
+  roomId?: string;
+
+  /**
+   * @generated from field: optional game_engine.GhostRun ghost = 9;
+   */
+  ghost?: GhostRun;
 };
 
 /**
@@ -78,7 +118,333 @@ export type GameEngineStartReq = Message<"game_engine.GameEngineStartReq"> & {
  * Use `create(GameEngineStartReqSchema)` to create a new message.
  */
 export const GameEngineStartReqSchema: GenMessage<GameEngineStartReq> = /*@__PURE__*/
-  messageDesc(file_protos_game_engine_game_engine, 1);
+  messageDesc(file_protos_game_engine_game_engine, 2);
+
+/**
+ * @generated from message game_engine.GameEngineStartResp
+ */
+export type GameEngineStartResp = Message<"game_engine.GameEngineStartResp"> & {
+  /**
+   * Where the client should open the game session, since the game only
+   * exists on this engine. Empty if the engine doesn't know its public address.
+   *
+   * @generated from field: string webtransport_addr = 1;
+   */
+  webtransportAddr: string;
+
+  /**
+   * Games on this engine that aren't over yet, counting this one
+   *
+   * @generated from field: int32 active_games = 2;
+   */
+  activeGames: number;
+};
+
+/**
+ * Describes the message game_engine.GameEngineStartResp.
+ * Use `create(GameEngineStartRespSchema)` to create a new message.
+ */
+export const GameEngineStartRespSchema: GenMessage<GameEngineStartResp> = /*@__PURE__*/
+  messageDesc(file_protos_game_engine_game_engine, 3);
+
+/**
+ * An earlier run replayed next to the live bird
+ *
+ * @generated from message game_engine.GhostRun
+ */
+export type GhostRun = Message<"game_engine.GhostRun"> & {
+  /**
+   * @generated from field: string game_id = 1;
+   */
+  gameId: string;
+
+  /**
+   * Ticks (counted from the start of play) the player flapped on
+   *
+   * @generated from field: repeated int32 flap_frames = 2;
+   */
+  flapFrames: number[];
+
+  /**
+   * @generated from field: int32 bird_width = 3;
+   */
+  birdWidth: number;
+
+  /**
+   * @generated from field: int32 bird_height = 4;
+   */
+  birdHeight: number;
+};
+
+/**
+ * Describes the message game_engine.GhostRun.
+ * Use `create(GhostRunSchema)` to create a new message.
+ */
+export const GhostRunSchema: GenMessage<GhostRun> = /*@__PURE__*/
+  messageDesc(file_protos_game_engine_game_engine, 4);
+
+/**
+ * @generated from message game_engine.GameEngineCreateRoomReq
+ */
+export type GameEngineCreateRoomReq = Message<"game_engine.GameEngineCreateRoomReq"> & {
+  /**
+   * @generated from field: string room_id = 1;
+   */
+  roomId: string;
+
+  /**
+   * @generated from field: int32 viewport_width = 2;
+   */
+  viewportWidth: number;
+
+  /**
+   * @generated from field: int32 viewport_height = 3;
+   */
+  viewportHeight: number;
+
+  /**
+   * @generated from field: world_gen.WorldGenerated world = 4;
+   */
+  world?: WorldGenerated;
+
+  /**
+   * @generated from field: int32 max_players = 5;
+   */
+  maxPlayers: number;
+};
+
+/**
+ * Describes the message game_engine.GameEngineCreateRoomReq.
+ * Use `create(GameEngineCreateRoomReqSchema)` to create a new message.
+ */
+export const GameEngineCreateRoomReqSchema: GenMessage<GameEngineCreateRoomReq> = /*@__PURE__*/
+  messageDesc(file_protos_game_engine_game_engine, 5);
+
+/**
+ * One bird's physics and where it is in the world
+ *
+ * @generated from message game_engine.BirdSnapshot
+ */
+export type BirdSnapshot = Message<"game_engine.BirdSnapshot"> & {
+  /**
+   * @generated from field: world_gen.WorldGenerated world = 1;
+   */
+  world?: WorldGenerated;
+
+  /**
+   * @generated from field: double bird_y = 2;
+   */
+  birdY: number;
+
+  /**
+   * @generated from field: double bird_velocity = 3;
+   */
+  birdVelocity: number;
+
+  /**
+   * @generated from field: double flap_force = 4;
+   */
+  flapForce: number;
+
+  /**
+   * @generated from field: int32 frame = 5;
+   */
+  frame: number;
+
+  /**
+   * @generated from field: int32 score = 6;
+   */
+  score: number;
+
+  /**
+   * @generated from field: game_engine.PlayState play_state = 7;
+   */
+  playState: PlayState;
+
+  /**
+   * @generated from field: double ground_x = 8;
+   */
+  groundX: number;
+
+  /**
+   * @generated from field: double pipe_speed = 9;
+   */
+  pipeSpeed: number;
+
+  /**
+   * @generated from field: double pipe_window_x = 10;
+   */
+  pipeWindowX: number;
+
+  /**
+   * @generated from field: double pipe_window_width = 11;
+   */
+  pipeWindowWidth: number;
+
+  /**
+   * @generated from field: int32 pipes_to_render = 12;
+   */
+  pipesToRender: number;
+
+  /**
+   * @generated from field: repeated double pipe_starts = 13;
+   */
+  pipeStarts: number[];
+
+  /**
+   * @generated from field: repeated double pipe_positions = 14;
+   */
+  pipePositions: number[];
+
+  /**
+   * @generated from field: repeated double pipe_gaps = 15;
+   */
+  pipeGaps: number[];
+
+  /**
+   * @generated from field: int32 prev_closest_pipe = 16;
+   */
+  prevClosestPipe: number;
+
+  /**
+   * @generated from field: double bird_width = 17;
+   */
+  birdWidth: number;
+
+  /**
+   * @generated from field: double bird_height = 18;
+   */
+  birdHeight: number;
+
+  /**
+   * @generated from field: double viewport_height = 19;
+   */
+  viewportHeight: number;
+
+  /**
+   * @generated from field: repeated int32 flap_frames = 20;
+   */
+  flapFrames: number[];
+};
+
+/**
+ * Describes the message game_engine.BirdSnapshot.
+ * Use `create(BirdSnapshotSchema)` to create a new message.
+ */
+export const BirdSnapshotSchema: GenMessage<BirdSnapshot> = /*@__PURE__*/
+  messageDesc(file_protos_game_engine_game_engine, 6);
+
+/**
+ * @generated from message game_engine.GhostSnapshot
+ */
+export type GhostSnapshot = Message<"game_engine.GhostSnapshot"> & {
+  /**
+   * @generated from field: game_engine.GhostRun run = 1;
+   */
+  run?: GhostRun;
+
+  /**
+   * @generated from field: game_engine.BirdSnapshot bird = 2;
+   */
+  bird?: BirdSnapshot;
+
+  /**
+   * @generated from field: int32 next_flap = 3;
+   */
+  nextFlap: number;
+};
+
+/**
+ * Describes the message game_engine.GhostSnapshot.
+ * Use `create(GhostSnapshotSchema)` to create a new message.
+ */
+export const GhostSnapshotSchema: GenMessage<GhostSnapshot> = /*@__PURE__*/
+  messageDesc(file_protos_game_engine_game_engine, 7);
+
+/**
+ * Everything another engine needs to carry on with a game
+ *
+ * @generated from message game_engine.GameSnapshot
+ */
+export type GameSnapshot = Message<"game_engine.GameSnapshot"> & {
+  /**
+   * @generated from field: string game_id = 1;
+   */
+  gameId: string;
+
+  /**
+   * @generated from field: game_engine.BirdSnapshot bird = 2;
+   */
+  bird?: BirdSnapshot;
+
+  /**
+   * @generated from field: optional game_engine.GhostSnapshot ghost = 3;
+   */
+  ghost?: GhostSnapshot;
+
+  /**
+   * Last seq sent to the client, so the next engine carries on from it
+   *
+   * @generated from field: int64 frame_seq = 4;
+   */
+  frameSeq: bigint;
+};
+
+/**
+ * Describes the message game_engine.GameSnapshot.
+ * Use `create(GameSnapshotSchema)` to create a new message.
+ */
+export const GameSnapshotSchema: GenMessage<GameSnapshot> = /*@__PURE__*/
+  messageDesc(file_protos_game_engine_game_engine, 8);
+
+/**
+ * @generated from message game_engine.EngineDrainReq
+ */
+export type EngineDrainReq = Message<"game_engine.EngineDrainReq"> & {
+  /**
+   * Engine to move the games to, as the other services reach it. Empty
+   * picks one from GAME_ENGINE_URL, which needs ENGINE_SELF_ADDR set.
+   *
+   * @generated from field: string target_instance = 1;
+   */
+  targetInstance: string;
+};
+
+/**
+ * Describes the message game_engine.EngineDrainReq.
+ * Use `create(EngineDrainReqSchema)` to create a new message.
+ */
+export const EngineDrainReqSchema: GenMessage<EngineDrainReq> = /*@__PURE__*/
+  messageDesc(file_protos_game_engine_game_engine, 9);
+
+/**
+ * @generated from message game_engine.EngineDrainResp
+ */
+export type EngineDrainResp = Message<"game_engine.EngineDrainResp"> & {
+  /**
+   * @generated from field: int32 migrated = 1;
+   */
+  migrated: number;
+
+  /**
+   * @generated from field: int32 failed = 2;
+   */
+  failed: number;
+
+  /**
+   * Room games can't move, so they finish here
+   *
+   * @generated from field: int32 skipped = 3;
+   */
+  skipped: number;
+};
+
+/**
+ * Describes the message game_engine.EngineDrainResp.
+ * Use `create(EngineDrainRespSchema)` to create a new message.
+ */
+export const EngineDrainRespSchema: GenMessage<EngineDrainResp> = /*@__PURE__*/
+  messageDesc(file_protos_game_engine_game_engine, 10);
 
 /**
  * @generated from enum game_engine.Key
@@ -96,28 +462,92 @@ export enum Key {
 export const KeySchema: GenEnum<Key> = /*@__PURE__*/
   enumDesc(file_protos_game_engine_game_engine, 0);
 
+/**
+ * @generated from enum game_engine.PlayState
+ */
+export enum PlayState {
+  /**
+   * @generated from enum value: READY = 0;
+   */
+  READY = 0,
+
+  /**
+   * @generated from enum value: PLAY = 1;
+   */
+  PLAY = 1,
+
+  /**
+   * @generated from enum value: OVER = 2;
+   */
+  OVER = 2,
+}
+
+/**
+ * Describes the enum game_engine.PlayState.
+ */
+export const PlayStateSchema: GenEnum<PlayState> = /*@__PURE__*/
+  enumDesc(file_protos_game_engine_game_engine, 1);
+
 /**
  * Won't do anything on failure other than reject the requests.
+ * These are prefixed because dispatch verbs share one namespace with the initiator's.
  *
  * @generated from service game_engine.GameEngineService
  */
 export const GameEngineService: GenService<{
   /**
-   * @generated from rpc game_engine.GameEngineService.HandleInput
+   * @generated from rpc game_engine.GameEngineService.EngineStartGame
    */
-  handleInput: {
+  engineStartGame: {
     methodKind: "unary";
-    input: typeof GameEngineInputReqSchema;
-    output: typeof EmptySchema;
+    input: typeof GameEngineStartReqSchema;
+    output: typeof GameEngineStartRespSchema;
   },
   /**
-   * @generated from rpc game_engine.GameEngineService.StartGame
+   * @generated from rpc game_engine.GameEngineService.EngineCreateRoom
    */
-  startGame: {
+  engineCreateRoom: {
     methodKind: "unary";
-    input: typeof GameEngineStartReqSchema;
+    input: typeof GameEngineCreateRoomReqSchema;
     output: typeof EmptySchema;
   },
+  /**
+   * Takes over a game another engine was running
+   *
+   * @generated from rpc game_engine.GameEngineService.EngineRestoreGame
+   */
+  engineRestoreGame: {
+    methodKind: "unary";
+    input: typeof GameSnapshotSchema;
+    output: typeof GameEngineStartRespSchema;
+  },
+  /**
+   * Stops taking new games and moves the running ones to another engine
+   *
+   * @generated from rpc game_engine.GameEngineService.EngineDrain
+   */
+  engineDrain: {
+    methodKind: "unary";
+    input: typeof EngineDrainReqSchema;
+    output: typeof EngineDrainRespSchema;
+  },
 }> = /*@__PURE__*/
   serviceDesc(file_protos_game_engine_game_engine, 0);
 
+/**
+ * Runs over WebTransport at /gameEngine/GameSession, not through dispatch.
+ *
+ * @generated from service game_engine.GameSessionService
+ */
+export const GameSessionService: GenService<{
+  /**
+   * @generated from rpc game_engine.GameSessionService.HandleInput
+   */
+  handleInput: {
+    methodKind: "unary";
+    input: typeof GameEngineInputReqSchema;
+    output: typeof EmptySchema;
+  },
+}> = /*@__PURE__*/
+  serviceDesc(file_protos_game_engine_game_engine, 1);
+
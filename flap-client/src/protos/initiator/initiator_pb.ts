@@ -10,7 +10,7 @@ import type { Message } from "@bufbuild/protobuf";
  * Describes the file protos/initiator/initiator.proto.
  */
 export const file_protos_initiator_initiator: GenFile = /*@__PURE__*/
-  fileDesc("CiBwcm90b3MvaW5pdGlhdG9yL2luaXRpYXRvci5wcm90bxIJaW5pdGlhdG9yInUKDFN0YXJ0R2FtZVJlcRILCgNqd3QYASABKAkSFgoOdmlld3BvcnRfd2lkdGgYAiABKAUSFwoPdmlld3BvcnRfaGVpZ2h0GAMgASgFEhIKCmJpcmRfd2lkdGgYBCABKAUSEwoLYmlyZF9oZWlnaHQYBSABKAUiIAoNU3RhcnRHYW1lUmVzcBIPCgdnYW1lX2lkGAEgASgJMlQKEEluaXRpYXRvclNlcnZpY2USQAoJU3RhcnRHYW1lEhcuaW5pdGlhdG9yLlN0YXJ0R2FtZVJlcRoYLmluaXRpYXRvci5TdGFydEdhbWVSZXNwIgBCEFoOLi87aW5pdGlhdG9ycGJiBnByb3RvMw");
+  fileDesc("CiBwcm90b3MvaW5pdGlhdG9yL2luaXRpYXRvci5wcm90bxIJaW5pdGlhdG9yIsUBCgxTdGFydEdhbWVSZXESCwoDand0GAEgASgJEhYKDnZpZXdwb3J0X3dpZHRoGAIgASgFEhcKD3ZpZXdwb3J0X2hlaWdodBgDIAEoBRISCgpiaXJkX3dpZHRoGAQgASgFEhMKC2JpcmRfaGVpZ2h0GAUgASgFEhQKB3Jvb21faWQYBiABKAlIAIgBARIaCg1naG9zdF9nYW1lX2lkGAcgASgJSAGIAQFCCgoIX3Jvb21faWRCEAoOX2dob3N0X2dhbWVfaWQieAoNU3RhcnRHYW1lUmVzcBIPCgdnYW1lX2lkGAEgASgJEhQKB3Jvb21faWQYAiABKAlIAIgBARIeChF3ZWJ0cmFuc3BvcnRfYWRkchgDIAEoCUgBiAEBQgoKCF9yb29tX2lkQhQKEl93ZWJ0cmFuc3BvcnRfYWRkciJVCg1DcmVhdGVSb29tUmVxEhYKDnZpZXdwb3J0X3dpZHRoGAEgASgFEhcKD3ZpZXdwb3J0X2hlaWdodBgCIAEoBRITCgttYXhfcGxheWVycxgDIAEoBSIhCg5DcmVhdGVSb29tUmVzcBIPCgdyb29tX2lkGAEgASgJMpkBChBJbml0aWF0b3JTZXJ2aWNlEkAKCVN0YXJ0R2FtZRIXLmluaXRpYXRvci5TdGFydEdhbWVSZXEaGC5pbml0aWF0b3IuU3RhcnRHYW1lUmVzcCIAEkMKCkNyZWF0ZVJvb20SGC5pbml0aWF0b3IuQ3JlYXRlUm9vbVJlcRoZLmluaXRpYXRvci5DcmVhdGVSb29tUmVzcCIAQhBaDi4vO2luaXRpYXRvcnBiYgZwcm90bzM");
 
 /**
  * @generated from message initiator.StartGameReq
@@ -40,6 +40,22 @@ export type StartGameReq = Message<"initiator.StartGameReq"> & {
    * @generated from field: int32 bird_height = 5;
    */
   birdHeight: number;
+
+  /**
+   * Join this race room instead of starting a solo game.
+   * The room's viewport wins over the one above.
+   *
+   * @generated from field: optional string room_id = 6;
+   */
+  roomId?: string;
+
+  /**
+   * Race against a replay of one of your earlier games.
+   * Leave it empty to race your personal best.
+   *
+   * @generated from field: optional string ghost_game_id = 7;
+   */
+  ghostGameId?: string;
 };
 
 /**
@@ -57,6 +73,19 @@ export type StartGameResp = Message<"initiator.StartGameResp"> & {
    * @generated from field: string game_id = 1;
    */
   gameId: string;
+
+  /**
+   * @generated from field: optional string room_id = 2;
+   */
+  roomId?: string;
+
+  /**
+   * The engine running this game. Open the game session here instead of the
+   * usual address when it's set.
+   *
+   * @generated from field: optional string webtransport_addr = 3;
+   */
+  webtransportAddr?: string;
 };
 
 /**
@@ -66,6 +95,50 @@ export type StartGameResp = Message<"initiator.StartGameResp"> & {
 export const StartGameRespSchema: GenMessage<StartGameResp> = /*@__PURE__*/
   messageDesc(file_protos_initiator_initiator, 1);
 
+/**
+ * @generated from message initiator.CreateRoomReq
+ */
+export type CreateRoomReq = Message<"initiator.CreateRoomReq"> & {
+  /**
+   * @generated from field: int32 viewport_width = 1;
+   */
+  viewportWidth: number;
+
+  /**
+   * @generated from field: int32 viewport_height = 2;
+   */
+  viewportHeight: number;
+
+  /**
+   * @generated from field: int32 max_players = 3;
+   */
+  maxPlayers: number;
+};
+
+/**
+ * Describes the message initiator.CreateRoomReq.
+ * Use `create(CreateRoomReqSchema)` to create a new message.
+ */
+export const CreateRoomReqSchema: GenMessage<CreateRoomReq> = /*@__PURE__*/
+  messageDesc(file_protos_initiator_initiator, 2);
+
+/**
+ * @generated from message initiator.CreateRoomResp
+ */
+export type CreateRoomResp = Message<"initiator.CreateRoomResp"> & {
+  /**
+   * @generated from field: string room_id = 1;
+   */
+  roomId: string;
+};
+
+/**
+ * Describes the message initiator.CreateRoomResp.
+ * Use `create(CreateRoomRespSchema)` to create a new message.
+ */
+export const CreateRoomRespSchema: GenMessage<CreateRoomResp> = /*@__PURE__*/
+  messageDesc(file_protos_initiator_initiator, 3);
+
 /**
  * @generated from service initiator.InitiatorService
  */
@@ -78,6 +151,16 @@ export const InitiatorService: GenService<{
     input: typeof StartGameReqSchema;
     output: typeof StartGameRespSchema;
   },
+  /**
+   * Everyone who joins a room races in the same world
+   *
+   * @generated from rpc initiator.InitiatorService.CreateRoom
+   */
+  createRoom: {
+    methodKind: "unary";
+    input: typeof CreateRoomReqSchema;
+    output: typeof CreateRoomRespSchema;
+  },
 }> = /*@__PURE__*/
   serviceDesc(file_protos_initiator_initiator, 0);
 
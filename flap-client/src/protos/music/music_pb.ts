@@ -4,15 +4,15 @@
 
 import type { GenEnum, GenFile, GenMessage, GenService } from "@bufbuild/protobuf/codegenv1";
 import { enumDesc, fileDesc, messageDesc, serviceDesc } from "@bufbuild/protobuf/codegenv1";
-import type { EmptySchema } from "@bufbuild/protobuf/wkt";
-import { file_google_protobuf_empty } from "@bufbuild/protobuf/wkt";
+import type { EmptySchema, Timestamp } from "@bufbuild/protobuf/wkt";
+import { file_google_protobuf_empty, file_google_protobuf_timestamp } from "@bufbuild/protobuf/wkt";
 import type { Message } from "@bufbuild/protobuf";
 
 /**
  * Describes the file protos/music/music.proto.
  */
 export const file_protos_music_music: GenFile = /*@__PURE__*/
-  fileDesc("Chhwcm90b3MvbXVzaWMvbXVzaWMucHJvdG8SBW11c2ljIkMKDFBsYXlNdXNpY1JlcRIPCgdnYW1lX2lkGAEgASgJEiIKBmVmZmVjdBgCIAEoDjISLm11c2ljLlNvdW5kRWZmZWN0IiYKDVBsYXlNdXNpY1Jlc3ASFQoNYXVkaW9fcGF5bG9hZBgBIAEoDCo1CgtTb3VuZEVmZmVjdBIICgRKVU1QEAASEwoPU0NPUkVfSU5DUkVBU0VEEAESBwoDRElFEAIySgoMTXVzaWNTZXJ2aWNlEjoKCVBsYXlNdXNpYxITLm11c2ljLlBsYXlNdXNpY1JlcRoWLmdvb2dsZS5wcm90b2J1Zi5FbXB0eSIAQgxaCi4vO211c2ljcGJiBnByb3RvMw", [file_google_protobuf_empty]);
+  fileDesc("Chhwcm90b3MvbXVzaWMvbXVzaWMucHJvdG8SBW11c2ljIm0KDFBsYXlNdXNpY1JlcRIPCgdnYW1lX2lkGAEgASgJEiIKBmVmZmVjdBgCIAEoDjISLm11c2ljLlNvdW5kRWZmZWN0EhgKC2VmZmVjdF9uYW1lGAMgASgJSACIAQFCDgoMX2VmZmVjdF9uYW1lImgKCk11c2ljQ2h1bmsSDQoFdHJhY2sYASABKAkSDQoFaW5kZXgYAiABKAUSDAoEZGF0YRgDIAEoDBIMCgRsYXN0GAQgASgIEiAKBWNvZGVjGAUgASgOMhEubXVzaWMuQXVkaW9Db2RlYyJmCgpBdWRpb0Fzc2V0EgoKAmlkGAEgASgJEg4KBnNoYTI1NhgCIAEoCRIMCgRzaXplGAMgASgFEgwKBGRhdGEYBCABKAwSIAoFY29kZWMYBSABKA4yES5tdXNpYy5BdWRpb0NvZGVjIjIKDUFzc2V0TWFuaWZlc3QSIQoGYXNzZXRzGAEgAygLMhEubXVzaWMuQXVkaW9Bc3NldCLsAQoNUGxheU11c2ljUmVzcBIVCg1hdWRpb19wYXlsb2FkGAEgASgMEiYKC211c2ljX2NodW5rGAIgASgLMhEubXVzaWMuTXVzaWNDaHVuaxIOCgZ2b2x1bWUYAyABKAISJgoIbWFuaWZlc3QYBCABKAsyFC5tdXNpYy5Bc3NldE1hbmlmZXN0EhEKCWVmZmVjdF9pZBgFIAEoCRIvCgtzZXJ2ZXJfdGltZRgGIAEoCzIaLmdvb2dsZS5wcm90b2J1Zi5UaW1lc3RhbXASIAoFY29kZWMYByABKA4yES5tdXNpYy5BdWRpb0NvZGVjIqkBChBBdWRpb1NldHRpbmdzUmVxEg8KB2dhbWVfaWQYASABKAkSEQoEbXV0ZRgCIAEoCEgAiAEBEhMKBnZvbHVtZRgDIAEoAkgBiAEBEhkKDGVmZmVjdHNfb25seRgEIAEoCEgCiAEBEhIKBXRyYWNrGAUgASgJSAOIAQFCBwoFX211dGVCCQoHX3ZvbHVtZUIPCg1fZWZmZWN0c19vbmx5QggKBl90cmFjayIlChJFbmRNdXNpY1Nlc3Npb25SZXESDwoHZ2FtZV9pZBgBIAEoCSo1CgtTb3VuZEVmZmVjdBIICgRKVU1QEAASEwoPU0NPUkVfSU5DUkVBU0VEEAESBwoDRElFEAIqKwoKQXVkaW9Db2RlYxIHCgNPR0cQABILCgdXQVZfUENNEAESBwoDTVAzEAIy3AEKDE11c2ljU2VydmljZRI6CglQbGF5TXVzaWMSEy5tdXNpYy5QbGF5TXVzaWNSZXEaFi5nb29nbGUucHJvdG9idWYuRW1wdHkiABJGCg9FbmRNdXNpY1Nlc3Npb24SGS5tdXNpYy5FbmRNdXNpY1Nlc3Npb25SZXEaFi5nb29nbGUucHJvdG9idWYuRW1wdHkiABJIChNVcGRhdGVBdWRpb1NldHRpbmdzEhcubXVzaWMuQXVkaW9TZXR0aW5nc1JlcRoWLmdvb2dsZS5wcm90b2J1Zi5FbXB0eSIAQgxaCi4vO211c2ljcGJiBnByb3RvMw", [file_google_protobuf_empty, file_google_protobuf_timestamp]);
 
 /**
  * @generated from message music.PlayMusicReq
@@ -27,6 +27,13 @@ export type PlayMusicReq = Message<"music.PlayMusicReq"> & {
    * @generated from field: music.SoundEffect effect = 2;
    */
   effect: SoundEffect;
+
+  /**
+   * Play an effect loaded from MUSIC_DIR instead of the enum one
+   *
+   * @generated from field: optional string effect_name = 3;
+   */
+  effectName?: string;
 };
 
 /**
@@ -36,14 +43,154 @@ export type PlayMusicReq = Message<"music.PlayMusicReq"> & {
 export const PlayMusicReqSchema: GenMessage<PlayMusicReq> = /*@__PURE__*/
   messageDesc(file_protos_music_music, 0);
 
+/**
+ * A piece of the background track. Chunks of a track arrive in order and
+ * the track starts over from index 0 once the last one is sent.
+ *
+ * @generated from message music.MusicChunk
+ */
+export type MusicChunk = Message<"music.MusicChunk"> & {
+  /**
+   * @generated from field: string track = 1;
+   */
+  track: string;
+
+  /**
+   * @generated from field: int32 index = 2;
+   */
+  index: number;
+
+  /**
+   * @generated from field: bytes data = 3;
+   */
+  data: Uint8Array;
+
+  /**
+   * @generated from field: bool last = 4;
+   */
+  last: boolean;
+
+  /**
+   * @generated from field: music.AudioCodec codec = 5;
+   */
+  codec: AudioCodec;
+};
+
+/**
+ * Describes the message music.MusicChunk.
+ * Use `create(MusicChunkSchema)` to create a new message.
+ */
+export const MusicChunkSchema: GenMessage<MusicChunk> = /*@__PURE__*/
+  messageDesc(file_protos_music_music, 1);
+
+/**
+ * A sound effect the client should keep around and play by ID
+ *
+ * @generated from message music.AudioAsset
+ */
+export type AudioAsset = Message<"music.AudioAsset"> & {
+  /**
+   * @generated from field: string id = 1;
+   */
+  id: string;
+
+  /**
+   * Hex SHA-256 of data, so clients can cache across sessions
+   *
+   * @generated from field: string sha256 = 2;
+   */
+  sha256: string;
+
+  /**
+   * @generated from field: int32 size = 3;
+   */
+  size: number;
+
+  /**
+   * @generated from field: bytes data = 4;
+   */
+  data: Uint8Array;
+
+  /**
+   * @generated from field: music.AudioCodec codec = 5;
+   */
+  codec: AudioCodec;
+};
+
+/**
+ * Describes the message music.AudioAsset.
+ * Use `create(AudioAssetSchema)` to create a new message.
+ */
+export const AudioAssetSchema: GenMessage<AudioAsset> = /*@__PURE__*/
+  messageDesc(file_protos_music_music, 2);
+
+/**
+ * @generated from message music.AssetManifest
+ */
+export type AssetManifest = Message<"music.AssetManifest"> & {
+  /**
+   * @generated from field: repeated music.AudioAsset assets = 1;
+   */
+  assets: AudioAsset[];
+};
+
+/**
+ * Describes the message music.AssetManifest.
+ * Use `create(AssetManifestSchema)` to create a new message.
+ */
+export const AssetManifestSchema: GenMessage<AssetManifest> = /*@__PURE__*/
+  messageDesc(file_protos_music_music, 3);
+
 /**
  * @generated from message music.PlayMusicResp
  */
 export type PlayMusicResp = Message<"music.PlayMusicResp"> & {
   /**
+   * A whole sound effect
+   *
    * @generated from field: bytes audio_payload = 1;
    */
   audioPayload: Uint8Array;
+
+  /**
+   * @generated from field: music.MusicChunk music_chunk = 2;
+   */
+  musicChunk?: MusicChunk;
+
+  /**
+   * 0 to 1, the client should apply this to whatever it plays
+   *
+   * @generated from field: float volume = 3;
+   */
+  volume: number;
+
+  /**
+   * Sent once when the music session starts, if effects are sent by ID
+   *
+   * @generated from field: music.AssetManifest manifest = 4;
+   */
+  manifest?: AssetManifest;
+
+  /**
+   * Play this asset from the manifest instead of audio_payload
+   *
+   * @generated from field: string effect_id = 5;
+   */
+  effectId: string;
+
+  /**
+   * When the server sent the effect, for scheduling
+   *
+   * @generated from field: google.protobuf.Timestamp server_time = 6;
+   */
+  serverTime?: Timestamp;
+
+  /**
+   * Codec of audio_payload
+   *
+   * @generated from field: music.AudioCodec codec = 7;
+   */
+  codec: AudioCodec;
 };
 
 /**
@@ -51,7 +198,71 @@ export type PlayMusicResp = Message<"music.PlayMusicResp"> & {
  * Use `create(PlayMusicRespSchema)` to create a new message.
  */
 export const PlayMusicRespSchema: GenMessage<PlayMusicResp> = /*@__PURE__*/
-  messageDesc(file_protos_music_music, 1);
+  messageDesc(file_protos_music_music, 4);
+
+/**
+ * Only the fields that are set change, the rest keep their current values
+ *
+ * @generated from message music.AudioSettingsReq
+ */
+export type AudioSettingsReq = Message<"music.AudioSettingsReq"> & {
+  /**
+   * @generated from field: string game_id = 1;
+   */
+  gameId: string;
+
+  /**
+   * @generated from field: optional bool mute = 2;
+   */
+  mute?: boolean;
+
+  /**
+   * @generated from field: optional float volume = 3;
+   */
+  volume?: number;
+
+  /**
+   * No background music, just sound effects
+   *
+   * @generated from field: optional bool effects_only = 4;
+   */
+  effectsOnly?: boolean;
+
+  /**
+   * Switch background tracks
+   *
+   * @generated from field: optional string track = 5;
+   */
+  track?: string;
+};
+
+/**
+ * Describes the message music.AudioSettingsReq.
+ * Use `create(AudioSettingsReqSchema)` to create a new message.
+ */
+export const AudioSettingsReqSchema: GenMessage<AudioSettingsReq> = /*@__PURE__*/
+  messageDesc(file_protos_music_music, 5);
+
+/**
+ * The game is over. Closes the music session and stops the background music.
+ * Playing DIE does this too, this is for engines that send their sounds in
+ * frames (SOUND_DELIVERY=frame) and never play DIE here.
+ *
+ * @generated from message music.EndMusicSessionReq
+ */
+export type EndMusicSessionReq = Message<"music.EndMusicSessionReq"> & {
+  /**
+   * @generated from field: string game_id = 1;
+   */
+  gameId: string;
+};
+
+/**
+ * Describes the message music.EndMusicSessionReq.
+ * Use `create(EndMusicSessionReqSchema)` to create a new message.
+ */
+export const EndMusicSessionReqSchema: GenMessage<EndMusicSessionReq> = /*@__PURE__*/
+  messageDesc(file_protos_music_music, 6);
 
 /**
  * @generated from enum music.SoundEffect
@@ -79,6 +290,37 @@ export enum SoundEffect {
 export const SoundEffectSchema: GenEnum<SoundEffect> = /*@__PURE__*/
   enumDesc(file_protos_music_music, 0);
 
+/**
+ * What an asset is encoded as. The client lists the ones it can play when it
+ * connects (the codecs query param) and gets the first one we can produce.
+ *
+ * @generated from enum music.AudioCodec
+ */
+export enum AudioCodec {
+  /**
+   * @generated from enum value: OGG = 0;
+   */
+  OGG = 0,
+
+  /**
+   * 16-bit PCM in a WAV container
+   *
+   * @generated from enum value: WAV_PCM = 1;
+   */
+  WAV_PCM = 1,
+
+  /**
+   * @generated from enum value: MP3 = 2;
+   */
+  MP3 = 2,
+}
+
+/**
+ * Describes the enum music.AudioCodec.
+ */
+export const AudioCodecSchema: GenEnum<AudioCodec> = /*@__PURE__*/
+  enumDesc(file_protos_music_music, 1);
+
 /**
  * @generated from service music.MusicService
  */
@@ -91,6 +333,22 @@ export const MusicService: GenService<{
     input: typeof PlayMusicReqSchema;
     output: typeof EmptySchema;
   },
+  /**
+   * @generated from rpc music.MusicService.EndMusicSession
+   */
+  endMusicSession: {
+    methodKind: "unary";
+    input: typeof EndMusicSessionReqSchema;
+    output: typeof EmptySchema;
+  },
+  /**
+   * @generated from rpc music.MusicService.UpdateAudioSettings
+   */
+  updateAudioSettings: {
+    methodKind: "unary";
+    input: typeof AudioSettingsReqSchema;
+    output: typeof EmptySchema;
+  },
 }> = /*@__PURE__*/
   serviceDesc(file_protos_music_music, 0);
 
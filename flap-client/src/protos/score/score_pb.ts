@@ -12,7 +12,7 @@ import type { Message } from "@bufbuild/protobuf";
  * Describes the file protos/score/score.proto.
  */
 export const file_protos_score_score: GenFile = /*@__PURE__*/
-  fileDesc("Chhwcm90b3Mvc2NvcmUvc2NvcmUucHJvdG8SBXNjb3JlIoEBCgpTY29yZUVudHJ5Eg8KB2dhbWVfaWQYASABKAkSDQoFc2NvcmUYAiABKAUSLwoLZmluaXNoX3RpbWUYAyABKAsyGi5nb29nbGUucHJvdG9idWYuVGltZXN0YW1wEhUKCHVzZXJuYW1lGAQgASgJSACIAQFCCwoJX3VzZXJuYW1lIl4KDUdldFNjb3Jlc1Jlc3ASIgoHZW50cmllcxgBIAMoCzIRLnNjb3JlLlNjb3JlRW50cnkSKQoOZ2xvYmFsX2VudHJpZXMYAiADKAsyES5zY29yZS5TY29yZUVudHJ5MocBCgxTY29yZVNlcnZpY2USOgoLVXBkYXRlU2NvcmUSES5zY29yZS5TY29yZUVudHJ5GhYuZ29vZ2xlLnByb3RvYnVmLkVtcHR5IgASOwoJR2V0U2NvcmVzEhYuZ29vZ2xlLnByb3RvYnVmLkVtcHR5GhQuc2NvcmUuR2V0U2NvcmVzUmVzcCIAQgxaCi4vO3Njb3JlcGJiBnByb3RvMw", [file_google_protobuf_empty, file_google_protobuf_timestamp]);
+  fileDesc("Chhwcm90b3Mvc2NvcmUvc2NvcmUucHJvdG8SBXNjb3JlIuACCgpTY29yZUVudHJ5Eg8KB2dhbWVfaWQYASABKAkSDQoFc2NvcmUYAiABKAUSLwoLZmluaXNoX3RpbWUYAyABKAsyGi5nb29nbGUucHJvdG9idWYuVGltZXN0YW1wEhUKCHVzZXJuYW1lGAQgASgJSACIAQESFAoHcm9vbV9pZBgFIAEoCUgBiAEBEhYKCXBsYWNlbWVudBgGIAEoBUgCiAEBEhcKCndvcmxkX3NlZWQYByABKANIA4gBARIWCg52aWV3cG9ydF93aWR0aBgIIAEoBRIXCg92aWV3cG9ydF9oZWlnaHQYCSABKAUSEgoKYmlyZF93aWR0aBgKIAEoBRITCgtiaXJkX2hlaWdodBgLIAEoBRITCgtmbGFwX2ZyYW1lcxgMIAMoBUILCglfdXNlcm5hbWVCCgoIX3Jvb21faWRCDAoKX3BsYWNlbWVudEINCgtfd29ybGRfc2VlZCIeCgtHZXRHaG9zdFJlcRIPCgdnYW1lX2lkGAEgASgJIl4KDUdldFNjb3Jlc1Jlc3ASIgoHZW50cmllcxgBIAMoCzIRLnNjb3JlLlNjb3JlRW50cnkSKQoOZ2xvYmFsX2VudHJpZXMYAiADKAsyES5zY29yZS5TY29yZUVudHJ5Mv0BCgxTY29yZVNlcnZpY2USOgoLVXBkYXRlU2NvcmUSES5zY29yZS5TY29yZUVudHJ5GhYuZ29vZ2xlLnByb3RvYnVmLkVtcHR5IgASOwoJR2V0U2NvcmVzEhYuZ29vZ2xlLnByb3RvYnVmLkVtcHR5GhQuc2NvcmUuR2V0U2NvcmVzUmVzcCIAEjMKCEdldEdob3N0EhIuc2NvcmUuR2V0R2hvc3RSZXEaES5zY29yZS5TY29yZUVudHJ5IgASPwoLV2F0Y2hTY29yZXMSFi5nb29nbGUucHJvdG9idWYuRW1wdHkaFC5zY29yZS5HZXRTY29yZXNSZXNwIgAwAUIMWgouLztzY29yZXBiYgZwcm90bzM", [file_google_protobuf_empty, file_google_protobuf_timestamp]);
 
 /**
  * https://stackoverflow.com/questions/3574716/date-and-time-type-for-use-with-protobuf
@@ -39,6 +39,51 @@ export type ScoreEntry = Message<"score.ScoreEntry"> & {
    * @generated from field: optional string username = 4;
    */
   username?: string;
+
+  /**
+   * Set when the game was part of a race room
+   *
+   * @generated from field: optional string room_id = 5;
+   */
+  roomId?: string;
+
+  /**
+   * @generated from field: optional int32 placement = 6;
+   */
+  placement?: number;
+
+  /**
+   * Everything needed to replay this game as a ghost.
+   * Old entries don't have a seed and can't be replayed.
+   *
+   * @generated from field: optional int64 world_seed = 7;
+   */
+  worldSeed?: bigint;
+
+  /**
+   * @generated from field: int32 viewport_width = 8;
+   */
+  viewportWidth: number;
+
+  /**
+   * @generated from field: int32 viewport_height = 9;
+   */
+  viewportHeight: number;
+
+  /**
+   * @generated from field: int32 bird_width = 10;
+   */
+  birdWidth: number;
+
+  /**
+   * @generated from field: int32 bird_height = 11;
+   */
+  birdHeight: number;
+
+  /**
+   * @generated from field: repeated int32 flap_frames = 12;
+   */
+  flapFrames: number[];
 };
 
 /**
@@ -48,6 +93,25 @@ export type ScoreEntry = Message<"score.ScoreEntry"> & {
 export const ScoreEntrySchema: GenMessage<ScoreEntry> = /*@__PURE__*/
   messageDesc(file_protos_score_score, 0);
 
+/**
+ * @generated from message score.GetGhostReq
+ */
+export type GetGhostReq = Message<"score.GetGhostReq"> & {
+  /**
+   * Empty means the player's personal best
+   *
+   * @generated from field: string game_id = 1;
+   */
+  gameId: string;
+};
+
+/**
+ * Describes the message score.GetGhostReq.
+ * Use `create(GetGhostReqSchema)` to create a new message.
+ */
+export const GetGhostReqSchema: GenMessage<GetGhostReq> = /*@__PURE__*/
+  messageDesc(file_protos_score_score, 1);
+
 /**
  * @generated from message score.GetScoresResp
  */
@@ -68,7 +132,7 @@ export type GetScoresResp = Message<"score.GetScoresResp"> & {
  * Use `create(GetScoresRespSchema)` to create a new message.
  */
 export const GetScoresRespSchema: GenMessage<GetScoresResp> = /*@__PURE__*/
-  messageDesc(file_protos_score_score, 1);
+  messageDesc(file_protos_score_score, 2);
 
 /**
  * @generated from service score.ScoreService
@@ -90,6 +154,24 @@ export const ScoreService: GenService<{
     input: typeof EmptySchema;
     output: typeof GetScoresRespSchema;
   },
+  /**
+   * @generated from rpc score.ScoreService.GetGhost
+   */
+  getGhost: {
+    methodKind: "unary";
+    input: typeof GetGhostReqSchema;
+    output: typeof ScoreEntrySchema;
+  },
+  /**
+   * The leaderboard, again every time it changes
+   *
+   * @generated from rpc score.ScoreService.WatchScores
+   */
+  watchScores: {
+    methodKind: "server_streaming";
+    input: typeof EmptySchema;
+    output: typeof GetScoresRespSchema;
+  },
 }> = /*@__PURE__*/
   serviceDesc(file_protos_score_score, 0);
 
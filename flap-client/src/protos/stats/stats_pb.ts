@@ -0,0 +1,188 @@
+// @generated by protoc-gen-es v2.2.5 with parameter "target=ts"
+// @generated from file protos/stats/stats.proto (package stats, syntax proto3)
+/* eslint-disable */
+
+import type { GenFile, GenMessage, GenService } from "@bufbuild/protobuf/codegenv1";
+import { fileDesc, messageDesc, serviceDesc } from "@bufbuild/protobuf/codegenv1";
+import type { Timestamp } from "@bufbuild/protobuf/wkt";
+import { file_google_protobuf_timestamp } from "@bufbuild/protobuf/wkt";
+import type { Message } from "@bufbuild/protobuf";
+
+/**
+ * Describes the file protos/stats/stats.proto.
+ */
+export const file_protos_stats_stats: GenFile = /*@__PURE__*/
+  fileDesc("Chhwcm90b3Mvc3RhdHMvc3RhdHMucHJvdG8SBXN0YXRzIiAKDUdldFN1bW1hcnlSZXESDwoHZ2FtZV9pZBgBIAEoCSJfCg5MYXRlbmN5U3VtbWFyeRINCgVjb3VudBgBIAEoBBIOCgZwNTBfbnMYAiABKAMSDgoGcDkwX25zGAMgASgDEg4KBnA5OV9ucxgEIAEoAxIOCgZtYXhfbnMYBSABKAMijwEKC0VkZ2VTdW1tYXJ5EhQKDHNyY19zdmNfbmFtZRgBIAEoCRIUCgxzcmNfc3ZjX3ZlcmIYAiABKAkSFQoNZGVzdF9zdmNfbmFtZRgDIAEoCRIVCg1kZXN0X3N2Y192ZXJiGAQgASgJEiYKB2xhdGVuY3kYBSABKAsyFS5zdGF0cy5MYXRlbmN5U3VtbWFyeSJGCgtHYW1lU3VtbWFyeRIPCgdnYW1lX2lkGAEgASgJEiYKB2xhdGVuY3kYAiABKAsyFS5zdGF0cy5MYXRlbmN5U3VtbWFyeSKSAQoOR2V0U3VtbWFyeVJlc3ASDwoHc2VydmljZRgBIAEoCRIpCgVzaW5jZRgCIAEoCzIaLmdvb2dsZS5wcm90b2J1Zi5UaW1lc3RhbXASIQoFZWRnZXMYAyADKAsyEi5zdGF0cy5FZGdlU3VtbWFyeRIhCgVnYW1lcxgEIAMoCzISLnN0YXRzLkdhbWVTdW1tYXJ5MksKDFN0YXRzU2VydmljZRI7CgpHZXRTdW1tYXJ5EhQuc3RhdHMuR2V0U3VtbWFyeVJlcRoVLnN0YXRzLkdldFN1bW1hcnlSZXNwIgBCDFoKLi87c3RhdHNwYmIGcHJvdG8z", [file_google_protobuf_timestamp]);
+
+/**
+ * @generated from message stats.GetSummaryReq
+ */
+export type GetSummaryReq = Message<"stats.GetSummaryReq"> & {
+  /**
+   * Empty means every game
+   *
+   * @generated from field: string game_id = 1;
+   */
+  gameId: string;
+};
+
+/**
+ * Describes the message stats.GetSummaryReq.
+ * Use `create(GetSummaryReqSchema)` to create a new message.
+ */
+export const GetSummaryReqSchema: GenMessage<GetSummaryReq> = /*@__PURE__*/
+  messageDesc(file_protos_stats_stats, 0);
+
+/**
+ * Latencies are in nanoseconds
+ *
+ * @generated from message stats.LatencySummary
+ */
+export type LatencySummary = Message<"stats.LatencySummary"> & {
+  /**
+   * @generated from field: uint64 count = 1;
+   */
+  count: bigint;
+
+  /**
+   * @generated from field: int64 p50_ns = 2;
+   */
+  p50Ns: bigint;
+
+  /**
+   * @generated from field: int64 p90_ns = 3;
+   */
+  p90Ns: bigint;
+
+  /**
+   * @generated from field: int64 p99_ns = 4;
+   */
+  p99Ns: bigint;
+
+  /**
+   * @generated from field: int64 max_ns = 5;
+   */
+  maxNs: bigint;
+};
+
+/**
+ * Describes the message stats.LatencySummary.
+ * Use `create(LatencySummarySchema)` to create a new message.
+ */
+export const LatencySummarySchema: GenMessage<LatencySummary> = /*@__PURE__*/
+  messageDesc(file_protos_stats_stats, 1);
+
+/**
+ * Calls from one verb to another
+ *
+ * @generated from message stats.EdgeSummary
+ */
+export type EdgeSummary = Message<"stats.EdgeSummary"> & {
+  /**
+   * @generated from field: string src_svc_name = 1;
+   */
+  srcSvcName: string;
+
+  /**
+   * @generated from field: string src_svc_verb = 2;
+   */
+  srcSvcVerb: string;
+
+  /**
+   * @generated from field: string dest_svc_name = 3;
+   */
+  destSvcName: string;
+
+  /**
+   * @generated from field: string dest_svc_verb = 4;
+   */
+  destSvcVerb: string;
+
+  /**
+   * @generated from field: stats.LatencySummary latency = 5;
+   */
+  latency?: LatencySummary;
+};
+
+/**
+ * Describes the message stats.EdgeSummary.
+ * Use `create(EdgeSummarySchema)` to create a new message.
+ */
+export const EdgeSummarySchema: GenMessage<EdgeSummary> = /*@__PURE__*/
+  messageDesc(file_protos_stats_stats, 2);
+
+/**
+ * Every call made for one game
+ *
+ * @generated from message stats.GameSummary
+ */
+export type GameSummary = Message<"stats.GameSummary"> & {
+  /**
+   * @generated from field: string game_id = 1;
+   */
+  gameId: string;
+
+  /**
+   * @generated from field: stats.LatencySummary latency = 2;
+   */
+  latency?: LatencySummary;
+};
+
+/**
+ * Describes the message stats.GameSummary.
+ * Use `create(GameSummarySchema)` to create a new message.
+ */
+export const GameSummarySchema: GenMessage<GameSummary> = /*@__PURE__*/
+  messageDesc(file_protos_stats_stats, 3);
+
+/**
+ * @generated from message stats.GetSummaryResp
+ */
+export type GetSummaryResp = Message<"stats.GetSummaryResp"> & {
+  /**
+   * Which service answered
+   *
+   * @generated from field: string service = 1;
+   */
+  service: string;
+
+  /**
+   * When the oldest call in here could be from
+   *
+   * @generated from field: google.protobuf.Timestamp since = 2;
+   */
+  since?: Timestamp;
+
+  /**
+   * @generated from field: repeated stats.EdgeSummary edges = 3;
+   */
+  edges: EdgeSummary[];
+
+  /**
+   * @generated from field: repeated stats.GameSummary games = 4;
+   */
+  games: GameSummary[];
+};
+
+/**
+ * Describes the message stats.GetSummaryResp.
+ * Use `create(GetSummaryRespSchema)` to create a new message.
+ */
+export const GetSummaryRespSchema: GenMessage<GetSummaryResp> = /*@__PURE__*/
+  messageDesc(file_protos_stats_stats, 4);
+
+/**
+ * @generated from service stats.StatsService
+ */
+export const StatsService: GenService<{
+  /**
+   * @generated from rpc stats.StatsService.GetSummary
+   */
+  getSummary: {
+    methodKind: "unary";
+    input: typeof GetSummaryReqSchema;
+    output: typeof GetSummaryRespSchema;
+  },
+}> = /*@__PURE__*/
+  serviceDesc(file_protos_stats_stats, 0);
+
@@ -10,7 +10,7 @@ import type { Message } from "@bufbuild/protobuf";
  * Describes the file protos/world_gen/world_gen.proto.
  */
 export const file_protos_world_gen_world_gen: GenFile = /*@__PURE__*/
-  fileDesc("CiBwcm90b3Mvd29ybGRfZ2VuL3dvcmxkX2dlbi5wcm90bxIJd29ybGRfZ2VuIk8KC1dvcmxkR2VuUmVxEg8KB2dhbWVfaWQYASABKAkSFgoOdmlld3BvcnRfd2lkdGgYAiABKAUSFwoPdmlld3BvcnRfaGVpZ2h0GAMgASgFIjEKCFBpcGVTcGVjEhEKCWdhcF9zdGFydBgBIAEoARISCgpnYXBfaGVpZ2h0GAIgASgBIk8KDldvcmxkR2VuZXJhdGVkEhQKDHBpcGVfc3BhY2luZxgBIAEoARInCgpwaXBlX3NwZWNzGAIgAygLMhMud29ybGRfZ2VuLlBpcGVTcGVjMlcKD1dvcmxkR2VuU2VydmljZRJECg1HZW5lcmF0ZVdvcmxkEhYud29ybGRfZ2VuLldvcmxkR2VuUmVxGhkud29ybGRfZ2VuLldvcmxkR2VuZXJhdGVkIgBCOVo3Z2l0aHViLmNvbS95dXY0MTgvY3M1NTNwcm9qZWN0L2JhY2tlbmQvcHJvdG9zL3dvcmxkX2dlbmIGcHJvdG8z");
+  fileDesc("CiBwcm90b3Mvd29ybGRfZ2VuL3dvcmxkX2dlbi5wcm90bxIJd29ybGRfZ2VuImsKC1dvcmxkR2VuUmVxEg8KB2dhbWVfaWQYASABKAkSFgoOdmlld3BvcnRfd2lkdGgYAiABKAUSFwoPdmlld3BvcnRfaGVpZ2h0GAMgASgFEhEKBHNlZWQYBCABKANIAIgBAUIHCgVfc2VlZCIxCghQaXBlU3BlYxIRCglnYXBfc3RhcnQYASABKAESEgoKZ2FwX2hlaWdodBgCIAEoASJdCg5Xb3JsZEdlbmVyYXRlZBIUCgxwaXBlX3NwYWNpbmcYASABKAESJwoKcGlwZV9zcGVjcxgCIAMoCzITLndvcmxkX2dlbi5QaXBlU3BlYxIMCgRzZWVkGAMgASgDMlcKD1dvcmxkR2VuU2VydmljZRJECg1HZW5lcmF0ZVdvcmxkEhYud29ybGRfZ2VuLldvcmxkR2VuUmVxGhkud29ybGRfZ2VuLldvcmxkR2VuZXJhdGVkIgBCOVo3Z2l0aHViLmNvbS95dXY0MTgvY3M1NTNwcm9qZWN0L2JhY2tlbmQvcHJvdG9zL3dvcmxkX2dlbmIGcHJvdG8z");
 
 /**
  * @generated from message world_gen.WorldGenReq
@@ -30,6 +30,13 @@ export type WorldGenReq = Message<"world_gen.WorldGenReq"> & {
    * @generated from field: int32 viewport_height = 3;
    */
   viewportHeight: number;
+
+  /**
+   * Rebuild a world we've handed out before
+   *
+   * @generated from field: optional int64 seed = 4;
+   */
+  seed?: bigint;
 };
 
 /**
@@ -92,6 +99,13 @@ export type WorldGenerated = Message<"world_gen.WorldGenerated"> & {
    * @generated from field: repeated world_gen.PipeSpec pipe_specs = 2;
    */
   pipeSpecs: PipeSpec[];
+
+  /**
+   * Same seed and viewport gives the same world
+   *
+   * @generated from field: int64 seed = 3;
+   */
+  seed: bigint;
 };
 
 /**